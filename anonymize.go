@@ -0,0 +1,405 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Pseudonymizes IPv4, IPv6, and MAC addresses in packet capture streams, using
+// the prefix-preserving Crypto-PAn scheme: addresses sharing a common prefix
+// before anonymization share a common prefix of the same length after
+// anonymization. Using the same key thus keeps anonymized captures of the same
+// incident correlatable, without revealing the original addresses.
+//
+// See also: J. Xu, J. Fan, M. Ammar, S. Moon, "Prefix-Preserving IP Address
+// Anonymization: Measurement-based Security Evaluation and a New
+// Cryptography-based Scheme", ICNP 2002.
+
+package main
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	pcapng "github.com/siemens/csharg/pcapng"
+)
+
+// AnonymizationKeyLen is the length of Crypto-PAn keys in octets: the first
+// half is the AES key, the second half is the secret pad.
+const AnonymizationKeyLen = 32
+
+// pcapng option codes of Interface Description Blocks carrying addresses.
+const (
+	OptIfIPv4Addr = uint16(4) // IPv4 address and netmask.
+	OptIfIPv6Addr = uint16(5) // IPv6 address and prefix length.
+	OptIfMACAddr  = uint16(6) // MAC address.
+)
+
+// AnonymizationCacheSize is the maximum number of anonymized addresses cached
+// per anonymizer; the least recently used addresses get evicted first.
+const AnonymizationCacheSize = 4096
+
+// AnonymizedComment marks the section header of an anonymized capture.
+const AnonymizedComment = "packet capture addresses anonymized (prefix-preserving Crypto-PAn)"
+
+// CryptoPAn anonymizes addresses of arbitrary bit length in a prefix-preserving
+// manner, caching anonymized addresses as to not repeatedly run expensive
+// AES-based calculations for the same address. The cache is bounded to
+// AnonymizationCacheSize addresses, evicting the least recently used ones.
+type CryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+	mu    sync.Mutex
+	cache map[string]*list.Element // cached anonymized addresses.
+	lru   *list.List               // cache entries, most recently used first.
+}
+
+// cryptoPAnEntry is a cached anonymized address.
+type cryptoPAnEntry struct {
+	addr string
+	anon []byte
+}
+
+// NewCryptoPAn returns a new Crypto-PAn anonymizer using the specified key of
+// AnonymizationKeyLen octets.
+func NewCryptoPAn(key []byte) (*CryptoPAn, error) {
+	if len(key) != AnonymizationKeyLen {
+		return nil, fmt.Errorf("anonymization key must be %d octets, not %d",
+			AnonymizationKeyLen, len(key))
+	}
+	block, err := aes.NewCipher(key[:aes.BlockSize])
+	if err != nil {
+		return nil, err
+	}
+	c := &CryptoPAn{
+		block: block,
+		cache: map[string]*list.Element{},
+		lru:   list.New(),
+	}
+	block.Encrypt(c.pad[:], key[aes.BlockSize:])
+	return c, nil
+}
+
+// Anonymize returns the anonymized form of the specified address, which can
+// be of any length up to 16 octets (such as IPv4, IPv6, and MAC addresses).
+func (c *CryptoPAn) Anonymize(addr []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.cache[string(addr)]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*cryptoPAnEntry).anon
+	}
+	bits := len(addr) * 8
+	anon := make([]byte, len(addr))
+	var input, output [aes.BlockSize]byte
+	for pos := 0; pos < bits; pos++ {
+		// Form the input block from the first pos bits of the original
+		// address, and the remaining bits from the secret pad.
+		input = c.pad
+		for i := 0; i < pos/8; i++ {
+			input[i] = addr[i]
+		}
+		if rem := pos % 8; rem != 0 {
+			mask := byte(0xff) << (8 - rem)
+			input[pos/8] = addr[pos/8]&mask | c.pad[pos/8]&^mask
+		}
+		c.block.Encrypt(output[:], input[:])
+		// The most significant bit of the output is the one-time pad bit for
+		// the bit at position pos.
+		anon[pos/8] |= (output[0] >> 7) << (7 - pos%8)
+	}
+	for i := range anon {
+		anon[i] ^= addr[i]
+	}
+	c.cache[string(addr)] = c.lru.PushFront(&cryptoPAnEntry{addr: string(addr), anon: anon})
+	if c.lru.Len() > AnonymizationCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.cache, oldest.Value.(*cryptoPAnEntry).addr)
+	}
+	return anon
+}
+
+// NewAnonymizationKey returns a fresh random anonymization key.
+func NewAnonymizationKey() ([]byte, error) {
+	key := make([]byte, AnonymizationKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseAnonymizationKey decodes a hex-encoded anonymization key.
+func ParseAnonymizationKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid anonymization key: %s", err.Error())
+	}
+	if len(key) != AnonymizationKeyLen {
+		return nil, fmt.Errorf("anonymization key must be %d hex-encoded octets",
+			AnonymizationKeyLen)
+	}
+	return key, nil
+}
+
+// LoadAnonymizationKey reads a hex-encoded anonymization key from the
+// specified file.
+func LoadAnonymizationKey(path string) ([]byte, error) {
+	s, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read anonymization key: %s", err.Error())
+	}
+	return ParseAnonymizationKey(string(s))
+}
+
+// Anonymizer is a pcapng block editor rewriting the addresses in packets as
+// well as in interface descriptions, marking the section header as
+// anonymized, and dropping any name resolution blocks.
+type Anonymizer struct {
+	pan *CryptoPAn
+}
+
+// NewAnonymizer returns a new block editor anonymizing addresses using the
+// specified key.
+func NewAnonymizer(key []byte) (*Anonymizer, error) {
+	pan, err := NewCryptoPAn(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Anonymizer{pan: pan}, nil
+}
+
+// EditBlock anonymizes the addresses in the specified block.
+func (a *Anonymizer) EditBlock(s *BlockStream, blk *Block) []*Block {
+	switch blk.Type {
+	case BlockTypeSHB:
+		return []*Block{AppendOptions(blk, 16, s.Endian, &pcapng.Option{
+			Code:  pcapng.OptComment,
+			Value: []byte(AnonymizedComment),
+		})}
+	case BlockTypeIDB:
+		return []*Block{a.editIDB(blk, s.Endian)}
+	case BlockTypeNRB:
+		// Name resolution blocks would give away the original addresses.
+		return nil
+	case BlockTypeEPB:
+		pkt := ParseEnhancedPacket(blk, s.Endian)
+		if pkt == nil {
+			return nil
+		}
+		nif := s.Interface(pkt.InterfaceID)
+		if nif == nil {
+			return nil
+		}
+		pkt.Data = append([]byte{}, pkt.Data...)
+		a.anonymizePacket(DecodePacket(nif.LinkType, pkt.Data))
+		return []*Block{pkt.Block(s.Endian)}
+	case BlockTypeSPB:
+		// We cannot be sure about the link type of simple packet blocks
+		// without an interface description, so play safe.
+		return nil
+	}
+	return []*Block{blk}
+}
+
+// editIDB anonymizes the address options of an Interface Description Block
+// and drops its filter options.
+func (a *Anonymizer) editIDB(blk *Block, endian binary.ByteOrder) *Block {
+	if len(blk.Body) < 8 {
+		return blk
+	}
+	var opts []*pcapng.Option
+	for _, opt := range ParseOptions(blk.Body[8:], endian) {
+		// Filter expressions might contain original addresses.
+		if opt.Code != OptIfFilter {
+			opts = append(opts, opt)
+		}
+	}
+	for idx, opt := range opts {
+		var addrlen int
+		switch opt.Code {
+		case OptIfIPv4Addr:
+			addrlen = 4
+		case OptIfIPv6Addr:
+			addrlen = 16
+		case OptIfMACAddr:
+			addrlen = 6
+		default:
+			continue
+		}
+		if len(opt.Value) < addrlen {
+			continue
+		}
+		value := append([]byte{}, opt.Value...)
+		if opt.Code == OptIfMACAddr {
+			a.replaceMAC(value[:addrlen])
+		} else {
+			copy(value, a.pan.Anonymize(value[:addrlen]))
+		}
+		opts[idx] = &pcapng.Option{Code: opt.Code, Value: value}
+	}
+	body := append([]byte{}, blk.Body[:8]...)
+	body = append(body, OptionsBytes(opts, endian)...)
+	return &Block{Type: blk.Type, Body: body}
+}
+
+// anonymizePacket rewrites the link layer and network layer addresses of the
+// specified (decoded) packet in place, fixing checksums as necessary.
+func (a *Anonymizer) anonymizePacket(p *PacketLayers) {
+	data := p.Data
+	switch {
+	case p.LinkType == LinkTypeEthernet && len(data) >= 12:
+		a.replaceMAC(data[0:6])
+		a.replaceMAC(data[6:12])
+	case p.LinkType == LinkTypeLinuxSLL && len(data) >= 16:
+		if halen := binary.BigEndian.Uint16(data[4:6]); halen == 6 {
+			a.replaceMAC(data[6:12])
+		}
+	case p.LinkType == LinkTypeLinuxSLL2 && len(data) >= 20:
+		if halen := data[11]; halen == 6 {
+			a.replaceMAC(data[12:18])
+		}
+	}
+	switch p.L3Proto {
+	case EtherTypeIPv4:
+		rewriteIP(p, data[p.L3Offset:], 12, 4, a.replace)
+	case EtherTypeIPv6:
+		rewriteIP(p, data[p.L3Offset:], 8, 16, a.replace)
+	case EtherTypeARP:
+		arp := data[p.L3Offset:]
+		hlen, plen := int(arp[4]), int(arp[5])
+		if hlen == 6 && (plen == 4 || plen == 16) {
+			offset := 8
+			for i := 0; i < 2; i++ {
+				a.replaceMAC(arp[offset : offset+hlen])
+				offset += hlen
+				a.replace(arp[offset : offset+plen])
+				offset += plen
+			}
+		}
+	}
+}
+
+// rewriteIP rewrites the source and destination addresses of an IPv4 or IPv6
+// header, as well as of any IP header embedded in ICMP error messages, using
+// the specified replace function. The replace function gets passed the
+// address to replace in place, as well as the IPv4 header checksum and
+// transport layer checksums covering the address, which it then needs to
+// update incrementally.
+func rewriteIP(p *PacketLayers, iphdr []byte, addroffset, addrlen int, replace func(addr []byte, csums ...[]byte)) {
+	var l4csum []byte
+	if p.L4Offset >= 0 {
+		l4 := p.Data[p.L4Offset:]
+		switch p.L4Proto {
+		case IPProtoTCP:
+			l4csum = l4[16:18]
+		case IPProtoUDP:
+			// An all-zero UDP checksum means no checksum in case of IPv4.
+			if binary.BigEndian.Uint16(l4[6:8]) != 0 || addrlen != 4 {
+				l4csum = l4[6:8]
+			}
+		case IPProtoICMPv6:
+			l4csum = l4[2:4]
+		}
+	}
+	var ipcsum []byte
+	if addrlen == 4 {
+		ipcsum = iphdr[10:12]
+	}
+	for i := 0; i < 2; i++ {
+		addr := iphdr[addroffset+i*addrlen : addroffset+(i+1)*addrlen]
+		replace(addr, ipcsum, l4csum)
+	}
+	if p.L4Proto == IPProtoUDP && l4csum != nil && binary.BigEndian.Uint16(l4csum) == 0 {
+		binary.BigEndian.PutUint16(l4csum, 0xffff)
+	}
+	// ICMP error messages carry (part of) the offending IP header, so we need
+	// to rewrite these addresses too, as well as to update the checksums.
+	if p.L4Offset < 0 {
+		return
+	}
+	icmp := p.Data[p.L4Offset:]
+	switch {
+	case p.L4Proto == IPProtoICMP && len(icmp) >= 8+20 && isICMPError(icmp[0]):
+		inner := icmp[8:]
+		if inner[0]>>4 != 4 {
+			return
+		}
+		// As we incrementally update the embedded IPv4 header checksum, the
+		// sum over the embedded header stays the same, so the ICMP checksum
+		// doesn't change.
+		for i := 0; i < 2; i++ {
+			addr := inner[12+i*4 : 16+i*4]
+			replace(addr, inner[10:12])
+		}
+	case p.L4Proto == IPProtoICMPv6 && len(icmp) >= 8+40 && icmp[0] < 128:
+		inner := icmp[8:]
+		if inner[0]>>4 != 6 {
+			return
+		}
+		for i := 0; i < 2; i++ {
+			addr := inner[8+i*16 : 24+i*16]
+			replace(addr, icmp[2:4])
+		}
+	}
+}
+
+// isICMPError returns true if the specified ICMPv4 type is an error message
+// embedding the offending IP header.
+func isICMPError(icmptype uint8) bool {
+	switch icmptype {
+	case 3, 4, 5, 11, 12: // unreachable, quench, redirect, time exceeded, parameter problem
+		return true
+	}
+	return false
+}
+
+// replace anonymizes the specified address in place and then incrementally
+// updates the specified checksums (if any) covering the address. Addresses
+// consisting only of zeros or ones are left untouched.
+func (a *Anonymizer) replace(addr []byte, csums ...[]byte) {
+	zeros, ones := true, true
+	for _, b := range addr {
+		zeros = zeros && b == 0
+		ones = ones && b == 0xff
+	}
+	if zeros || ones {
+		return
+	}
+	anon := a.pan.Anonymize(addr)
+	for _, csum := range csums {
+		if csum == nil {
+			continue
+		}
+		binary.BigEndian.PutUint16(csum, updateChecksum(binary.BigEndian.Uint16(csum), addr, anon))
+	}
+	copy(addr, anon)
+}
+
+// replaceMAC anonymizes the specified MAC address in place, but keeps the
+// individual/group and universal/local address bits, so that unicast addresses
+// stay unicast addresses, and multicast addresses stay multicast addresses.
+func (a *Anonymizer) replaceMAC(mac []byte) {
+	flags := mac[0] & 0x03
+	a.replace(mac)
+	mac[0] = mac[0]&^0x03 | flags
+}
+
+// updateChecksum incrementally updates an Internet checksum after replacing
+// the specified (16 bit aligned) old octets by new octets, see RFC 1624.
+func updateChecksum(csum uint16, old, new []byte) uint16 {
+	sum := uint32(^csum)
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
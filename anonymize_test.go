@@ -0,0 +1,173 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	pcapng "github.com/siemens/csharg/pcapng"
+)
+
+// cryptoPAnTestKey is the key of the Crypto-PAn reference implementation's
+// sample, with the AES key in the first and the pad in the second half.
+var cryptoPAnTestKey = []byte{
+	21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+	216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2,
+}
+
+func TestCryptoPAn(t *testing.T) {
+	pan, err := NewCryptoPAn(cryptoPAnTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Test vectors from the sample trace of the Crypto-PAn reference
+	// implementation.
+	for _, tt := range []struct {
+		addr, anon string
+	}{
+		{"128.11.68.132", "135.242.180.132"},
+		{"129.118.74.4", "134.136.186.123"},
+		{"130.132.252.244", "133.68.164.234"},
+		{"141.223.7.43", "141.167.8.160"},
+		{"141.233.145.108", "141.129.237.235"},
+		{"152.163.225.39", "151.140.114.167"},
+		{"156.29.3.236", "147.225.12.42"},
+		{"165.247.96.84", "162.9.99.234"},
+		{"166.107.77.190", "160.132.178.185"},
+		{"192.102.249.13", "252.138.62.131"},
+		{"192.215.32.125", "252.43.47.189"},
+		{"192.233.80.103", "252.25.108.8"},
+		{"192.41.57.43", "252.222.221.184"},
+		{"193.150.244.223", "253.169.52.216"},
+		{"195.205.63.100", "255.186.223.5"},
+		{"198.200.171.101", "249.199.68.213"},
+		{"198.26.132.101", "249.36.123.202"},
+		{"198.36.213.5", "249.7.21.132"},
+		{"198.51.77.238", "249.18.186.254"},
+		{"199.217.79.101", "248.38.184.213"},
+		{"202.49.198.20", "245.206.7.234"},
+		{"203.12.160.252", "244.248.163.4"},
+		{"204.184.162.189", "243.192.77.90"},
+		{"204.202.136.230", "243.178.4.198"},
+		{"204.29.20.4", "243.33.20.123"},
+		{"205.178.38.67", "242.108.198.51"},
+		{"207.105.49.5", "241.118.205.138"},
+		{"208.147.89.59", "227.237.98.191"},
+		{"209.12.231.7", "226.243.167.8"},
+		{"212.120.124.31", "228.135.163.231"},
+		{"216.148.237.145", "235.84.194.111"},
+		{"24.0.250.221", "100.15.198.226"},
+		{"38.15.67.68", "64.3.66.187"},
+		{"4.3.88.225", "124.60.155.63"},
+		{"63.14.55.111", "95.9.215.7"},
+		{"64.14.118.196", "0.255.183.58"},
+		{"64.39.15.238", "0.219.7.41"},
+	} {
+		addr := netip.MustParseAddr(tt.addr).As4()
+		anon, _ := netip.AddrFromSlice(pan.Anonymize(addr[:]))
+		if anon.String() != tt.anon {
+			t.Errorf("Anonymize(%s) = %s, want %s", tt.addr, anon, tt.anon)
+		}
+	}
+}
+
+// commonPrefixLen returns the number of leading bits the specified addresses
+// of the same length have in common.
+func commonPrefixLen(a, b []byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return len(a) * 8
+}
+
+func TestCryptoPAnPrefixPreserving(t *testing.T) {
+	pan, _ := NewCryptoPAn(cryptoPAnTestKey)
+	addrs := [][]byte{}
+	for _, s := range []string{
+		"2001:db8::1", "2001:db8::2", "2001:db8:0:1::1", "2001:db9::1",
+		"fd00::1", "fe80::1", "::1",
+	} {
+		addr := netip.MustParseAddr(s).As16()
+		addrs = append(addrs, addr[:])
+	}
+	addrs = append(addrs,
+		[]byte{0x02, 0x42, 0xac, 0x11, 0x00, 0x02},
+		[]byte{0x02, 0x42, 0xac, 0x11, 0x00, 0x03})
+	for _, a := range addrs {
+		for _, b := range addrs {
+			if len(a) != len(b) {
+				continue
+			}
+			want := commonPrefixLen(a, b)
+			if got := commonPrefixLen(pan.Anonymize(a), pan.Anonymize(b)); got != want {
+				t.Errorf("anonymized %x and %x share %d prefix bits, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestCryptoPAnCache(t *testing.T) {
+	pan, _ := NewCryptoPAn(cryptoPAnTestKey)
+	first := append([]byte{}, pan.Anonymize([]byte{10, 0, 0, 1})...)
+	for i := 0; i <= AnonymizationCacheSize; i++ {
+		pan.Anonymize(binary.BigEndian.AppendUint32(nil, uint32(0x0b000000+i)))
+	}
+	if pan.lru.Len() != AnonymizationCacheSize || len(pan.cache) != AnonymizationCacheSize {
+		t.Errorf("cache holds %d/%d entries, want %d", pan.lru.Len(), len(pan.cache), AnonymizationCacheSize)
+	}
+	if _, ok := pan.cache[string([]byte{10, 0, 0, 1})]; ok {
+		t.Error("least recently used address not evicted")
+	}
+	if again := pan.Anonymize([]byte{10, 0, 0, 1}); !bytes.Equal(again, first) {
+		t.Errorf("evicted address anonymized to %x, before %x", again, first)
+	}
+}
+
+func TestNewCryptoPAnInvalidKey(t *testing.T) {
+	for _, n := range []int{0, 16, 31, 33} {
+		if _, err := NewCryptoPAn(make([]byte, n)); err == nil {
+			t.Errorf("NewCryptoPAn accepted key of %d octets", n)
+		}
+	}
+}
+
+func TestAnonymizerIDB(t *testing.T) {
+	endian := binary.LittleEndian
+	a, _ := NewAnonymizer(cryptoPAnTestKey)
+	fixed := make([]byte, 8)
+	endian.PutUint16(fixed[0:2], LinkTypeEthernet)
+	ipv4 := []byte{128, 11, 68, 132, 255, 255, 255, 0}
+	blk := &Block{Type: BlockTypeIDB, Body: append(fixed, OptionsBytes([]*pcapng.Option{
+		{Code: OptIfName, Value: []byte("eth0")},
+		{Code: OptIfFilter, Value: []byte("\x00host 128.11.68.132")},
+		{Code: OptIfIPv4Addr, Value: ipv4},
+	}, endian)...)}
+	edited := a.EditBlock(&BlockStream{Endian: endian}, blk)
+	if len(edited) != 1 {
+		t.Fatalf("got %d blocks, want 1", len(edited))
+	}
+	opts := ParseOptions(edited[0].Body[8:], endian)
+	codes := []uint16{}
+	for _, opt := range opts {
+		codes = append(codes, opt.Code)
+		if opt.Code == OptIfIPv4Addr &&
+			!bytes.Equal(opt.Value, []byte{135, 242, 180, 132, 255, 255, 255, 0}) {
+			t.Errorf("if_IPv4addr not anonymized: %v", opt.Value)
+		}
+	}
+	if len(codes) != 2 || codes[0] != OptIfName || codes[1] != OptIfIPv4Addr {
+		t.Errorf("got options %v, want if_name and if_IPv4addr only", codes)
+	}
+}
@@ -0,0 +1,320 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Runs long-running background captures without any capture client, such as
+// ring buffers and uploads, which feed the packet capture stream into a block
+// editor of their own. Background captures of the same kind are kept in a
+// set, which also serves their API endpoint for listing, starting, and
+// stopping them.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	pcapng "github.com/siemens/csharg/pcapng"
+	log "github.com/sirupsen/logrus"
+	"github.com/thediveo/lxkns/ops/relations"
+)
+
+// BackgroundCapture is the part common to all kinds of background captures.
+type BackgroundCapture struct {
+	ID      string
+	Args    *Args
+	Started time.Time
+	Owner   string // principal who started the background capture.
+
+	kind string  // kind of background capture, such as "ring buffer".
+	conn *WSConn // for logging and terminating the capture process.
+	done chan struct{}
+}
+
+// newBackgroundCapture returns a new background capture of the specified kind
+// for the specified capture target. The background capture takes on the ID
+// of the specified (unconnected) connection, which is also used for logging
+// and terminating the capture process.
+func newBackgroundCapture(kind string, conn *WSConn, args *Args) BackgroundCapture {
+	return BackgroundCapture{
+		ID:      conn.ID,
+		Args:    args,
+		Started: time.Now(),
+		kind:    kind,
+		conn:    conn,
+		done:    make(chan struct{}),
+	}
+}
+
+// background returns the background capture itself, so that it can be found
+// inside the different kinds of background captures embedding it.
+func (b *BackgroundCapture) background() *BackgroundCapture {
+	return b
+}
+
+// Stop terminates the background capture's capture process; the background
+// capture gets removed after its capture process has terminated.
+func (b *BackgroundCapture) Stop() {
+	b.conn.Debugf("stopping %s", b.kind)
+	b.conn.Terminate()
+	Reaper.SessionEnded(b.conn)
+}
+
+// Done returns a channel that gets closed after the background capture's
+// capture process has terminated and the background capture has wrapped up.
+func (b *BackgroundCapture) Done() <-chan struct{} {
+	return b.done
+}
+
+// start starts the capture process feeding the specified block editor. The
+// background capture keeps the target network namespace locked, and releases
+// it as well as the session quota after its capture process has terminated.
+// The started function gets called after the capture process has been
+// started, with the locked target network namespace and a channel getting
+// closed when the capture process terminates. The ended function gets called
+// after the capture process has terminated.
+func (b *BackgroundCapture) start(client *ClientIdentity, release func(), editor BlockEditor,
+	started func(netns relations.Relation, captureDone <-chan struct{}), ended func()) (err error) {
+	conn := b.conn
+	args := b.Args
+	defer func() {
+		if err != nil {
+			release()
+			if args.NetnsFile != nil {
+				args.NetnsFile.Close()
+			}
+		}
+	}()
+	netnsref := targetNetnsPath(conn, args)
+	if len(netnsref) == 0 {
+		return fmt.Errorf("could not locate network namespace for container")
+	}
+	conn.Debugf("referencing netns:[%d] as \"%s\"", args.Target.NetNS, netnsref)
+	lockednetns, unlocker, err := lockTargetNetns(args, netnsref)
+	if err != nil {
+		conn.Errorf("cannot not lock netns:[%d], reason: %s", args.Target.NetNS, err.Error())
+		return fmt.Errorf("cannot lock target network stack")
+	}
+	defer func() {
+		if err != nil {
+			unlocker()
+		}
+	}()
+
+	cmd := exec.Command(CaptureProgram, captureArgs(conn, args)...)
+	stream := NewBlockStream(io.Discard)
+	stream.AddEditor(targetMetadataEditor(conn, args, client, lockednetns))
+	if args.TsResol != 0 {
+		stream.AddEditor(NewTimestampEditor(args.TsResol))
+	}
+	if args.AnonymizationKey != nil {
+		anonymizer, err := NewAnonymizer(args.AnonymizationKey)
+		if err != nil {
+			return fmt.Errorf("cannot anonymize: %s", err.Error())
+		}
+		stream.AddEditor(anonymizer)
+	}
+	if args.SnapLen != 0 || args.HeadersOnly {
+		stream.AddEditor(NewTruncator(args.SnapLen, args.HeadersOnly))
+	}
+	stream.AddEditor(editor)
+	cmd.Stdout = pcapng.NewStreamEditor(stream, args.Target, args.CaptureFilter, args.KeepChaste)
+	grrr := NewGrumbler(conn)
+	cmd.Stderr = grrr
+	cgroup, err := confineCapture(conn, cmd)
+	if err != nil {
+		return fmt.Errorf("cannot confine capture process: %s", err.Error())
+	}
+	err, starterr := startCapture(conn, cmd, lockednetns)
+	if err == nil {
+		err = starterr
+	}
+	if err != nil {
+		if cgroup != nil {
+			cgroup.Remove()
+		}
+		return fmt.Errorf("cannot start capture process: %s", err.Error())
+	}
+	captureDone := make(chan struct{})
+	conn.Exited = captureDone
+	conn.Process = cmd.Process
+	Reaper.Track(conn, cmd.Process, cgroup)
+	started(lockednetns, captureDone)
+
+	go func() {
+		err := cmd.Wait()
+		close(captureDone)
+		Reaper.SessionEnded(conn)
+		Reaper.Reaped(conn)
+		if err != nil && grrr.Reason() != "" {
+			conn.Errorf("%s capture process failure: %s", b.kind, grrr.Reason())
+		} else {
+			conn.Debugf("%s capture process terminated", b.kind)
+		}
+		ended()
+		close(b.done)
+		unlocker()
+		if args.NetnsFile != nil {
+			args.NetnsFile.Close()
+		}
+		release()
+	}()
+	return nil
+}
+
+// backgroundCapture is implemented by all kinds of background captures, with
+// I being the type of information about a background capture.
+type backgroundCapture[I any] interface {
+	background() *BackgroundCapture
+	Start(client *ClientIdentity, release func()) error
+	Info() I
+}
+
+// BackgroundCaptureSet is a set of running background captures of the same
+// kind, indexed by their IDs.
+type BackgroundCaptureSet[T backgroundCapture[I], I any] struct {
+	kind     string // kind of the background captures, such as "ring buffer".
+	mu       sync.Mutex
+	captures map[string]T
+}
+
+// NewBackgroundCaptureSet returns a new and empty set of background captures
+// of the specified kind.
+func NewBackgroundCaptureSet[T backgroundCapture[I], I any](kind string) *BackgroundCaptureSet[T, I] {
+	return &BackgroundCaptureSet[T, I]{kind: kind, captures: map[string]T{}}
+}
+
+// Add adds the specified background capture to the set.
+func (s *BackgroundCaptureSet[T, I]) Add(c T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captures[c.background().ID] = c
+}
+
+// Remove removes the specified background capture from the set.
+func (s *BackgroundCaptureSet[T, I]) Remove(c T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := c.background().ID
+	if other, ok := s.captures[id]; ok && other.background() == c.background() {
+		delete(s.captures, id)
+	}
+}
+
+// Get returns the background capture with the specified ID, and whether
+// there is such a background capture.
+func (s *BackgroundCaptureSet[T, I]) Get(id string) (T, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.captures[id]
+	return c, ok
+}
+
+// List returns the running background captures, sorted by their start times.
+func (s *BackgroundCaptureSet[T, I]) List() []T {
+	s.mu.Lock()
+	captures := make([]T, 0, len(s.captures))
+	for _, c := range s.captures {
+		captures = append(captures, c)
+	}
+	s.mu.Unlock()
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i].background().Started.Before(captures[j].background().Started)
+	})
+	return captures
+}
+
+// Serve handles the API endpoint of the background captures in the set: GET
+// lists the running background captures, POST starts a new one using the
+// specified function for creating it from the request, and DELETE stops a
+// background capture, but only if requested by its owner.
+func (s *BackgroundCaptureSet[T, I]) Serve(w http.ResponseWriter, req *http.Request,
+	newFromParams func(conn *WSConn, args *Args, req *http.Request) (T, error)) {
+	switch req.Method {
+	case http.MethodGet:
+		infos := []I{}
+		for _, c := range s.List() {
+			infos = append(infos, c.Info())
+		}
+		writeJSON(w, http.StatusOK, infos)
+	case http.MethodPost:
+		s.start(w, req, newFromParams)
+	case http.MethodDelete:
+		c, ok := s.Get(req.URL.Query().Get("id"))
+		if !ok {
+			http.Error(w, "no such "+s.kind, http.StatusNotFound)
+			return
+		}
+		b := c.background()
+		if principal := NewClientIdentity(req).Principal(); principal != b.Owner {
+			log.Errorf("rejecting stopping %s %s of %s by %s", s.kind, b.ID, b.Owner, principal)
+			http.Error(w, "not the owner of the "+s.kind, http.StatusForbidden)
+			return
+		}
+		b.Stop()
+		select {
+		case <-b.Done():
+		case <-time.After(ClosingDeadline):
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// start starts a new background capture with the capture target and
+// parameters from the request.
+func (s *BackgroundCaptureSet[T, I]) start(w http.ResponseWriter, req *http.Request,
+	newFromParams func(conn *WSConn, args *Args, req *http.Request) (T, error)) {
+	conn := NewWSConn()
+	args, err := parseCaptureParams(req, conn)
+	if err != nil {
+		conn.Errorf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := newFromParams(conn, args, req)
+	if err != nil {
+		if args.NetnsFile != nil {
+			args.NetnsFile.Close()
+		}
+		conn.Errorf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := c.background()
+	client := NewClientIdentity(req)
+	b.Owner = client.Principal()
+	release, err := Sessions.Acquire(b.Owner, uint64(args.Target.NetNS))
+	if err != nil {
+		if args.NetnsFile != nil {
+			args.NetnsFile.Close()
+		}
+		conn.Errorf("rejecting %s of %s: %s", s.kind, b.Owner, err.Error())
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err := c.Start(client, release); err != nil {
+		conn.Errorf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, c.Info())
+}
+
+// checkBackgroundParams returns an error if the specified capture parameters
+// ask for per-packet annotations or anything else that needs a live capture
+// client, as background captures of the specified kind don't support them.
+func checkBackgroundParams(kind string, args *Args) error {
+	if args.StatsInterval != 0 || args.ProcessInfo || args.KeyLogPath != "" ||
+		args.Names || args.RateLimit != 0 {
+		return fmt.Errorf("stats, statsjson, procinfo, keylog, names, and ratelimit are not supported for %ss", kind)
+	}
+	return nil
+}
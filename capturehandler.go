@@ -15,10 +15,13 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	pcapng "github.com/siemens/csharg/pcapng"
@@ -29,15 +32,16 @@ import (
 	"github.com/thediveo/lxkns/model"
 	"github.com/thediveo/lxkns/ops"
 	"github.com/thediveo/lxkns/ops/portable"
+	"github.com/thediveo/lxkns/ops/relations"
 	"github.com/thediveo/lxkns/species"
 )
 
 var wsupgrader = websocket.Upgrader{}
 
-// Handle the /capture API endpoint. This upgrades the connection to a
-// websocket and then checks the request parameters (which might be in the
-// headers in order to work around a bug in the Kubernetes pod proxy verb of
-// the remote API.)
+// Handle the /capture, /mirror, /flows, and /stats API endpoints. This
+// upgrades the connection to a websocket and then checks the request
+// parameters (which might be in the headers in order to work around a bug in
+// the Kubernetes pod proxy verb of the remote API.)
 func captureHandler(w http.ResponseWriter, req *http.Request) {
 	started := time.Now()
 	conn := NewWSConn()
@@ -77,7 +81,23 @@ func captureHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	target := args.Target
 	conn.Debugf("%s to capture from: %#v", target.Type, *target)
-	netnsref := netnsPath(uint64(target.NetNS))
+	// Enforce the session quotas before spending any further effort on this
+	// capture session.
+	client := NewClientIdentity(req)
+	release, err := Sessions.Acquire(client.Principal(), uint64(target.NetNS))
+	if err != nil {
+		if args.NetnsFile != nil {
+			args.NetnsFile.Close()
+		}
+		conn.Errorf("rejecting capture session of %s: %s", client.Principal(), err.Error())
+		conn.GracefullyClose(websocket.CloseTryAgainLater, err.Error())
+		return
+	}
+	defer release()
+	if args.NetnsFile != nil {
+		defer args.NetnsFile.Close()
+	}
+	netnsref := targetNetnsPath(conn, args)
 	if len(netnsref) == 0 {
 		reason := "could not locate network namespace for container"
 		conn.Errorf(reason)
@@ -91,20 +111,7 @@ func captureHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	conn.Debugf("referencing netns:[%d] as \"%s\"", target.NetNS, netnsref)
 
-	// With the target information we can now create a "portable namespace
-	// reference": it allows us to open, validate and "lock" a namespace based
-	// on the supplied information, as well as use the locked reference to
-	// switch a separate Go routine starting dumpcap into the desired network
-	// namespace. "Locked" here means that we keep a file descriptor reference
-	// open to the network namespace, so it cannot vanish between the time we
-	// validate it and we later switch into it.
-	portref := portable.PortableReference{
-		ID:        species.NamespaceIDfromInode(uint64(target.NetNS)),
-		Type:      species.CLONE_NEWNET,
-		PID:       model.PIDType(target.Pid),
-		Starttime: uint64(target.StartTime),
-	}
-	lockednetns, unlocker, err := portref.Open()
+	lockednetns, unlocker, err := lockTargetNetns(args, netnsref)
 	if err != nil {
 		conn.Errorf(fmt.Sprintf("cannot not lock netns:[%d], reason: %s", target.NetNS, err.Error()))
 		conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot lock target network stack")
@@ -114,64 +121,158 @@ func captureHandler(w http.ResponseWriter, req *http.Request) {
 	// With the target network namespace under lock and key, prepare the
 	// nsenter/packet capture commands (and their arguments) we want to start
 	// soon.
-	captargs := []string{
-		// write packet capture stream to stdout.
-		"-w", "-",
-		// use pcapng format anyway.
-		"-n",
-		// keep (almost) quiet: no packet capture count, but still some initial messages :(
-		"-q",
+	//
+	// Wire the capture command's stdout to the websocket, and sneak in a pcapng
+	// stream editor to inject capture target meta information. Behind the
+	// stream editor, the pcapng block stream allows us to further edit the
+	// individual blocks and to inject our own blocks.
+	cmd := exec.Command(CaptureProgram, captureArgs(conn, args)...)
+	// When mirroring or exporting flows, the packets go to the collector
+	// instead of the capture client; when reporting traffic statistics, they
+	// go nowhere.
+	piper := NewPiper(conn)
+	var sink io.Writer = piper
+	if args.Collector != "" || args.TrafficStats {
+		sink = io.Discard
 	}
-	// As we want to apply "avoid promiscuous mode" to all network interfaces, we need
-	// to specify it *before* the list of network interfaces.
-	if args.KeepChaste {
-		conn.Debugf("avoiding promiscuous mode, if possible, on all network interfaces")
-		captargs = append(captargs, "-p")
+	stream := NewBlockStream(sink)
+	// The meta data needs to go in before anonymization, so that the
+	// interface addresses get anonymized too.
+	stream.AddEditor(targetMetadataEditor(conn, args, client, lockednetns))
+	if args.TsResol != 0 {
+		conn.Debugf("timestamp resolution 10^-%d s", args.TsResol)
+		stream.AddEditor(NewTimestampEditor(args.TsResol))
 	}
-	for _, nif := range target.NetworkInterfaces {
-		captargs = append(captargs, "-i", nif)
+	var names *NameResolver
+	if args.Names {
+		conn.Debugf("emitting name resolution blocks")
+		names = NewNameResolver(conn, stream)
+		stream.AddEditor(names)
 	}
-	if len(args.CaptureFilter) > 0 {
-		conn.Debugf("capture filter: %s", args.CaptureFilter)
-		captargs = append(captargs, "-f", args.CaptureFilter)
+	// Socket owners need to be determined on the original addresses, so
+	// before any anonymization.
+	if args.ProcessInfo {
+		conn.Debugf("annotating packets with their socket owners")
+		stream.AddEditor(NewSocketAnnotator(conn, uint64(target.NetNS)))
 	}
-
-	// Wire the capture command's stdout to the websocket, and sneak in a pcapng
-	// stream editor to inject capture target meta information.
-	cmd := exec.Command(CaptureProgram, captargs...)
-	piper := NewPiper(conn)
-	cmd.Stdout = pcapng.NewStreamEditor(piper, target, args.CaptureFilter, args.KeepChaste)
+	// Anonymization needs to come before truncation, as it needs to see the
+	// transport layer headers in full in order to correctly update checksums.
+	if args.AnonymizationKey != nil {
+		anonymizer, err := NewAnonymizer(args.AnonymizationKey)
+		if err != nil {
+			conn.Errorf("cannot anonymize: %s", err.Error())
+			conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot anonymize")
+			return
+		}
+		conn.Debugf("anonymizing addresses")
+		stream.AddEditor(anonymizer)
+	}
+	if args.SnapLen != 0 || args.HeadersOnly {
+		if args.HeadersOnly {
+			conn.Debugf("truncating packets after transport layer headers")
+		}
+		stream.AddEditor(NewTruncator(args.SnapLen, args.HeadersOnly))
+	}
+	var stats *CaptureStats
+	if args.StatsInterval > 0 {
+		stats = NewCaptureStats(conn, stream, args.StatsJSON)
+		stream.AddEditor(stats.Accepted)
+	}
+	var traffic *TrafficStats
+	if args.TrafficStats {
+		traffic = NewTrafficStats(conn, args.TrafficTop)
+		stream.AddEditor(traffic)
+	}
+	// Throttling comes last, right before the packet capture stream goes out
+	// to the capture client or collector; only the packets finally delivered
+	// get counted after throttling.
+	if args.RateLimit != 0 {
+		conn.Debugf("limiting capture to %d octets/s, strategy %s", args.RateLimit, args.Throttle)
+		stream.AddEditor(NewThrottler(args.RateLimit, args.Throttle))
+	}
+	if stats != nil {
+		stream.AddEditor(stats.Delivered)
+	}
+	var flows *FlowExporter
+	if args.ExportFlows {
+		var err error
+		flows, err = NewFlowExporter(conn, args.Collector, args)
+		if err != nil {
+			conn.Errorf("%s", err.Error())
+			conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot reach collector")
+			return
+		}
+		defer flows.Close()
+		conn.Debugf("exporting flow records to %s, active timeout %s, inactive timeout %s",
+			args.Collector, args.FlowActiveTimeout, args.FlowInactiveTimeout)
+		stream.AddEditor(flows)
+	} else if args.Collector != "" {
+		mirror, err := NewMirror(conn, args.Collector, args.MirrorEncap, args.MirrorVNI, args.MirrorSession)
+		if err != nil {
+			conn.Errorf("%s", err.Error())
+			conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot reach collector")
+			return
+		}
+		defer mirror.Close()
+		conn.Debugf("mirroring packets to %s using %s", args.Collector, args.MirrorEncap)
+		stream.AddEditor(mirror)
+	}
+	// Connection tracking events need to be monitored from inside the target
+	// network namespace.
+	var conntrack *ConntrackSocket
+	if args.Conntrack {
+		var err error
+		conntrack, err = OpenConntrackSocket(lockednetns)
+		if err != nil {
+			conn.Errorf("%s", err.Error())
+			conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot monitor connection tracking")
+			return
+		}
+		defer conntrack.Close()
+		conn.Debugf("injecting connection tracking events")
+	}
+	// Packet drops are traced kernel-wide, so the tracer only needs to know
+	// the target network namespace.
+	var drops *DropTracer
+	if args.Drops != "" {
+		var err error
+		drops, err = OpenDropTracer(uint64(target.NetNS))
+		if err != nil {
+			conn.Errorf("%s", err.Error())
+			conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot trace packet drops")
+			return
+		}
+		defer drops.Close()
+		conn.Debugf("reporting packet drops as %s", args.Drops)
+	}
+	cmd.Stdout = pcapng.NewStreamEditor(stream, target, args.CaptureFilter, args.KeepChaste)
 	grrr := NewGrumbler(conn)
 	cmd.Stderr = grrr
+	cgroup, err := confineCapture(conn, cmd)
+	if err != nil {
+		conn.Errorf("cannot confine capture process: %s", err.Error())
+		conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot confine capture process")
+		return
+	}
 
 	// With everything prepared as far as we can, we now run the packet
 	// capture command (including network namespace changeover) and wait for
 	// it to terminate, for good or bad.
 	conn.Debugf("starting capture command...")
-	res, err := ops.Execute(
-		func() interface{} {
-			// This will be executed in a separate OS-locked Go routine,
-			// switched into the target's network namespace. dumpcap thus will
-			// run attached to the target's network stack. All animal magic
-			// thanks to lxkns ;)
-			netnsid, _ := ops.NamespacePath(fmt.Sprintf("/proc/%d/ns/net", unix.Gettid())).ID()
-			conn.Debugf("running %s inside locked net:[%d]", CaptureProgram, netnsid.Ino)
-			// In order to run the unprivileged dumpcap binary with the
-			// necessary capabilities, we need to transfer them via the ambient
-			// capabilities. If you don't know what ambient capabilities are,
-			// then you really don't want to know anyway.
-			SetAmbient(caps.CAP_NET_ADMIN, caps.CAP_NET_RAW)
-			return cmd.Start()
-		},
-		lockednetns)
+	err, starterr := startCapture(conn, cmd, lockednetns)
 	if err != nil {
+		if cgroup != nil {
+			cgroup.Remove()
+		}
 		conn.Errorf("cannot switch to target network stack, reason: %s", err.Error)
 		conn.InitiateGracefulClose(websocket.CloseAbnormalClosure, "cannot switch to target network stack")
 		conn.Watch() // finishes the graceful close.
 		return
 	}
-	err, _ = res.(error)
-	if err != nil {
+	if err = starterr; err != nil {
+		if cgroup != nil {
+			cgroup.Remove()
+		}
 		conn.Errorf("cannot start capture process: %s", err.Error())
 		conn.InitiateGracefulClose(websocket.CloseAbnormalClosure, "cannot start capture process")
 		conn.Watch() // finishes the graceful close.
@@ -179,8 +280,74 @@ func captureHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	// So far, so good. While things can still go south from here on, we passed
 	// at least the first few hurdles...
+	// The capture process gets killed if it doesn't terminate within the
+	// kill grace period after the session ended; and the reaper reports it
+	// if it even outlives that.
+	captureDone := make(chan struct{})
+	conn.Exited = captureDone
 	conn.Process = cmd.Process
+	Reaper.Track(conn, cmd.Process, cgroup)
+	// Periodic capture statistics (if enabled) are reported until the capture
+	// process terminates.
+	if stats != nil {
+		go stats.Run(cmd.Process.Pid, args.StatsInterval, captureDone)
+	}
+	// Ditto for traffic statistics and TLS key log secrets.
+	if traffic != nil {
+		go traffic.Run(args.TrafficInterval, captureDone)
+	}
+	if args.KeyLogPath != "" {
+		go NewKeyLogTailer(conn, stream, target.Pid, args.KeyLogPath).Run(captureDone)
+	}
+	// Without a known "root" process of the capture target, take any process
+	// attached to the target's network namespace in order to read its hosts.
+	if names != nil {
+		pid := target.Pid
+		if pid <= 0 {
+			if pids := Netnses.Processes(uint64(target.NetNS), time.Now().Add(-NetnsProcessesMaxAge)); len(pids) > 0 {
+				pid = pids[0]
+			}
+		}
+		go names.Run(pid, captureDone)
+	}
 	var wg sync.WaitGroup
+	// Flow records are exported until the capture process terminates, when
+	// all remaining flows get exported; this needs to finish before the
+	// connection to the collector gets closed.
+	if flows != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			flows.Run(captureDone)
+		}()
+	}
+	// Connection tracking events are injected until the capture process
+	// terminates; the monitor needs to finish before its socket gets closed.
+	if conntrack != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			monitor := NewConntrackMonitor(conn, conntrack)
+			if err := monitor.Run(captureDone, NewConntrackInjector(stream).Emit); err != nil {
+				conn.Errorf("cannot monitor connection tracking: %s", err.Error())
+			}
+		}()
+	}
+	// Ditto for packet drops; the drops interface gets announced only after
+	// all interfaces of the capture process.
+	if drops != nil {
+		emit := NewDropInjector(stream, len(target.NetworkInterfaces)).Emit
+		if args.Drops == DropsJSON {
+			emit = DropJSONEmitter(conn)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := NewDropMonitor(conn, drops).Run(captureDone, emit); err != nil {
+				conn.Errorf("cannot trace packet drops: %s", err.Error())
+			}
+		}()
+	}
 	wg.Add(2)
 	// The watcher/reader go routine will terminate after the websocket
 	// connection has been closed (gracefully or not) and it will terminate
@@ -188,6 +355,7 @@ func captureHandler(w http.ResponseWriter, req *http.Request) {
 	go func() {
 		defer wg.Done()
 		conn.Watch()
+		Reaper.SessionEnded(conn)
 	}()
 	// The waiter go routine waits for the capture process to terminate. It
 	// then will try to initiate a graceful close ... which will fail and be
@@ -197,6 +365,8 @@ func captureHandler(w http.ResponseWriter, req *http.Request) {
 	go func() {
 		defer wg.Done()
 		err := cmd.Wait()
+		close(captureDone)
+		Reaper.Reaped(conn)
 		if err != nil {
 			conn.Errorf("capture process failure: %s", err.Error())
 			r := grrr.Reason()
@@ -216,3 +386,146 @@ func captureHandler(w http.ResponseWriter, req *http.Request) {
 	// Wait for both the watcher/reader and the process waiter to finish.
 	wg.Wait()
 }
+
+// targetNetnsPath returns a filesystem path referencing the network namespace
+// of the capture target, or an empty string if the network namespace cannot be
+// located. Named and bind-mounted network namespaces have already been opened,
+// so they cannot vanish anymore; otherwise, it searches for a suitable
+// reference.
+func targetNetnsPath(conn *WSConn, args *Args) string {
+	if args.NetnsFile != nil {
+		return args.NetnsPath
+	}
+	lookupStarted := time.Now()
+	netnsref := netnsPath(uint64(args.Target.NetNS))
+	conn.Debugf("netns:[%d] lookup took %s", args.Target.NetNS, time.Since(lookupStarted))
+	return netnsref
+}
+
+// lockTargetNetns opens and locks the network namespace of the capture target
+// using the specified reference. With the target information we create a
+// "portable namespace reference": it allows us to open, validate and "lock" a
+// namespace based on the supplied information, as well as use the locked
+// reference to switch a separate Go routine starting dumpcap into the desired
+// network namespace. "Locked" here means that we keep a file descriptor
+// reference open to the network namespace, so it cannot vanish between the
+// time we validate it and we later switch into it.
+func lockTargetNetns(args *Args, netnsref string) (relations.Relation, func(), error) {
+	portref := portable.PortableReference{
+		ID:        species.NamespaceIDfromInode(uint64(args.Target.NetNS)),
+		Type:      species.CLONE_NEWNET,
+		PID:       model.PIDType(args.Target.Pid),
+		Starttime: uint64(args.Target.StartTime),
+	}
+	if args.NetnsFile != nil {
+		portref.Path = fmt.Sprintf("/proc/self/fd/%d", args.NetnsFile.Fd())
+	} else {
+		portref.Path = netnsref
+	}
+	lockednetns, unlocker, err := portref.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return lockednetns, func() { unlocker() }, nil
+}
+
+// targetMetadataEditor returns a new meta data editor with the meta data about
+// the captured network interfaces, gathered from inside the (locked) target
+// network namespace, as well as about the containers attached to it, as known
+// to the watched container engines. The client identity is left out of
+// anonymized captures.
+func targetMetadataEditor(conn *WSConn, args *Args, client *ClientIdentity, netns relations.Relation) *MetadataEditor {
+	if args.AnonymizationKey != nil {
+		client = nil
+	}
+	var nifs map[string]*InterfaceInfo
+	if res, err := ops.Execute(func() interface{} { return NetnsInterfaces() }, netns); err == nil {
+		nifs, _ = res.(map[string]*InterfaceInfo)
+	} else {
+		conn.Debugf("cannot query network interface details: %s", err.Error())
+	}
+	netnsino := uint64(args.Target.NetNS)
+	return NewMetadataEditor(
+		NewSessionInfo(args.Target, client, args.CaptureFilter),
+		nifs,
+		func() []*ContainerDetails { return ContainerEngines.NetnsContainers(netnsino) })
+}
+
+// captureArgs returns the arguments for the capture program, according to the
+// specified capture arguments.
+func captureArgs(conn *WSConn, args *Args) []string {
+	captargs := []string{
+		// write packet capture stream to stdout.
+		"-w", "-",
+		// use pcapng format anyway.
+		"-n",
+		// keep (almost) quiet: no packet capture count, but still some initial messages :(
+		"-q",
+	}
+	// As we want to apply "avoid promiscuous mode" to all network interfaces, we need
+	// to specify it *before* the list of network interfaces.
+	if args.KeepChaste {
+		conn.Debugf("avoiding promiscuous mode, if possible, on all network interfaces")
+		captargs = append(captargs, "-p")
+	}
+	if args.TimestampType != "" {
+		conn.Debugf("using timestamp source %s on all network interfaces", args.TimestampType)
+		captargs = append(captargs, "--time-stamp-type", args.TimestampType)
+	}
+	for _, nif := range args.Target.NetworkInterfaces {
+		captargs = append(captargs, "-i", nif)
+	}
+	if len(args.CaptureFilter) > 0 {
+		conn.Debugf("capture filter: %s", args.CaptureFilter)
+		captargs = append(captargs, "-f", args.CaptureFilter)
+	}
+	if args.SnapLen != 0 {
+		conn.Debugf("snap length: %d", args.SnapLen)
+		captargs = append(captargs, "-s", strconv.FormatUint(uint64(args.SnapLen), 10))
+	}
+	return captargs
+}
+
+// confineCapture optionally confines the capture process to its own cgroup
+// with CPU and memory limits, placing it into its cgroup already when cloning
+// it. It returns a nil cgroup if capture processes are not to be confined.
+func confineCapture(conn *WSConn, cmd *exec.Cmd) (*CaptureCgroup, error) {
+	cgroup, err := NewCaptureCgroup(fmt.Sprintf("capture-%s-%d", conn.ID, time.Now().UnixNano()))
+	if err != nil || cgroup == nil {
+		return nil, err
+	}
+	conn.Debugf("confining capture process to cgroup %s", cgroup.Path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		UseCgroupFD: true,
+		CgroupFD:    cgroup.Fd(),
+	}
+	return cgroup, nil
+}
+
+// startCapture starts the specified capture command attached to the specified
+// (locked) network namespace. It returns an error if switching into the
+// network namespace failed, and a separate error if starting the capture
+// command failed.
+func startCapture(conn *WSConn, cmd *exec.Cmd, netns relations.Relation) (err error, starterr error) {
+	res, err := ops.Execute(
+		func() interface{} {
+			// This will be executed in a separate OS-locked Go routine,
+			// switched into the target's network namespace. dumpcap thus will
+			// run attached to the target's network stack. All animal magic
+			// thanks to lxkns ;)
+			netnsid, _ := ops.NamespacePath(fmt.Sprintf("/proc/%d/ns/net", unix.Gettid())).ID()
+			conn.Debugf("running %s inside locked net:[%d]", CaptureProgram, netnsid.Ino)
+			// In order to run the unprivileged dumpcap binary with the
+			// necessary capabilities, we need to transfer them via the ambient
+			// capabilities. If you don't know what ambient capabilities are,
+			// then you really don't want to know anyway.
+			SetAmbient(caps.CAP_NET_ADMIN, caps.CAP_NET_RAW)
+			return cmd.Start()
+		},
+		netns)
+	if err != nil {
+		return err, nil
+	}
+	starterr, _ = res.(error)
+	return nil, starterr
+}
@@ -9,14 +9,16 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/siemens/csharg/api"
 )
@@ -25,46 +27,187 @@ import (
 type Args struct {
 	// Details of the capture target.
 	*api.Target
+	// Opened bind-mounted network namespace, if the capture target has been
+	// specified by its network namespace name or path; nil otherwise.
+	NetnsFile *os.File
+	// Path of the bind-mounted network namespace, as seen by the host.
+	NetnsPath string
 	// Optional packet filter expression.
 	CaptureFilter string
 	// No promiscuous mode, please!
 	KeepChaste bool
+	// Interval for periodic capture statistics; zero if disabled.
+	StatsInterval time.Duration
+	// Mirror periodic capture statistics as websocket text messages.
+	StatsJSON bool
+	// Maximum number of octets to capture per packet; zero if unlimited.
+	SnapLen uint32
+	// Truncate packets after their transport layer headers.
+	HeadersOnly bool
+	// Key for anonymizing addresses; nil if not anonymizing.
+	AnonymizationKey []byte
+	// Timestamp resolution (as if_tsresol) of the packet capture stream; zero
+	// if to be left to the capture process.
+	TsResol uint8
+	// Timestamp source (type) to use when capturing; empty for default.
+	TimestampType string
+	// Annotate packets with the processes owning their sockets.
+	ProcessInfo bool
+	// Path of a TLS key log file inside the capture target; empty if none.
+	KeyLogPath string
+	// Emit Name Resolution Blocks with the capture target's view on names.
+	Names bool
+	// Inject the connection tracking events as Custom Blocks.
+	Conntrack bool
+	// Report the packets dropped by the kernel, either as annotated packets
+	// or as websocket text messages; empty if not reporting drops.
+	Drops string
+	// Maximum packet capture stream rate in octets per second; zero if
+	// unlimited.
+	RateLimit uint64
+	// Throttling strategy when exceeding the rate limit.
+	Throttle string
+	// Address of the collector to mirror packets or export flow records to
+	// instead of streaming packets; empty if neither mirroring nor exporting.
+	Collector string
+	// Encapsulation of mirrored packets.
+	MirrorEncap string
+	// VXLAN network identifier of mirrored packets.
+	MirrorVNI uint32
+	// ERSPAN session ID of mirrored packets.
+	MirrorSession uint16
+	// Export flow records instead of mirroring packets to the collector.
+	ExportFlows bool
+	// Flow export timeouts for long-lasting flows and for flows without
+	// further packets.
+	FlowActiveTimeout   time.Duration
+	FlowInactiveTimeout time.Duration
+	// Report traffic statistics instead of streaming packets.
+	TrafficStats bool
+	// Interval between traffic statistics reports.
+	TrafficInterval time.Duration
+	// Number of top entries per traffic statistics table.
+	TrafficTop int
+}
+
+// paramHeaders maps the service-specific HTTP headers onto their corresponding
+// URL query parameters.
+var paramHeaders = map[string]string{
+	"Clustershark-Container":   "container",
+	"Clustershark-Nif":         "nif",
+	"Clustershark-Filter":      "filter",
+	"Clustershark-Chaste":      "chaste",
+	"Clustershark-Stats":       "stats",
+	"Clustershark-Statsjson":   "statsjson",
+	"Clustershark-Snaplen":     "snaplen",
+	"Clustershark-Headersonly": "headersonly",
+	"Clustershark-Anonymize":   "anonymize",
+	"Clustershark-Anonkey":     "anonkey",
+	"Clustershark-Tsprecision": "tsprecision",
+	"Clustershark-Tstype":      "tstype",
+	"Clustershark-Procinfo":    "procinfo",
+	"Clustershark-Keylog":      "keylog",
+	"Clustershark-Names":       "names",
+	"Clustershark-Conntrack":   "conntrack",
+	"Clustershark-Drops":       "drops",
+	"Clustershark-Netnsname":   "netnsname",
+	"Clustershark-Pid":         "pid",
+	"Clustershark-Starttime":   "starttime",
+	"Clustershark-Cgroup":      "cgroup",
+	"Clustershark-Ratelimit":   "ratelimit",
+	"Clustershark-Throttle":    "throttle",
+	"Clustershark-Collector":   "collector",
+	"Clustershark-Encap":       "encap",
+	"Clustershark-Vni":         "vni",
+	"Clustershark-Session":     "session",
+	"Clustershark-Active":      "active",
+	"Clustershark-Inactive":    "inactive",
+	"Clustershark-Interval":    "interval",
+	"Clustershark-Top":         "top",
+	"Clustershark-File":        "file",
+	"Clustershark-Speed":       "speed",
+	"Clustershark-Start":       "start",
+	"Clustershark-End":         "end",
+	"Clustershark-Pps":         "pps",
+	"Clustershark-Rewrite":     "rewrite",
+	"Clustershark-Rewritemac":  "rewritemac",
+}
+
+// requestParams returns the URL query parameters of the specified request.
+//
+// "Würgs" (works) around a bug in the Kubernetes remote API pod proxy verb:
+// this bug drops the URL query parameters from a websocket connect. So to get
+// our job done, we resort to use application-specific (service-specific) HTTP
+// headers, which we then here map back onto their original URL query
+// parameters. In consequence, the service-specific HTTP headers always take
+// precedence.
+//
+// Nota bene: the Go http package insists of canonical header keys, see:
+// https://godoc.org/net/http#CanonicalHeaderKey. This means that the first
+// letter as well as any letters immediately following a hyphen will be upper
+// case.
+func requestParams(req *http.Request) url.Values {
+	params := req.URL.Query()
+	for header, param := range paramHeaders {
+		if values, ok := req.Header[header]; ok {
+			params[param] = values
+		}
+	}
+	return params
+}
+
+// discoveredTargets returns the capture targets currently known to the local
+// discovery service.
+func discoveredTargets() (api.Targets, error) {
+	httpc := &http.Client{Timeout: DiscoveryDeadline}
+	resp, err := httpc.Get(fmt.Sprintf("http://%s:%d/mobyshark", DiscoveryService, DiscoveryPort))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var targets api.GwTargetList
+	if err := json.Unmarshal(body, &targets); err != nil {
+		return nil, err
+	}
+	return targets.Targets, nil
 }
 
 // parseCaptureParams parses the capture parameters from the HTTP request.
 func parseCaptureParams(req *http.Request, conn *WSConn) (
 	args *Args, err error) {
-	params := req.URL.Query()
-	// "Würgs" (works) around a bug in the Kubernetes remote API pod proxy verb:
-	// this bug drops the URL query parameters from a websocket connect. So to
-	// get our job done, we resort to use application-specific
-	// (service-specific) HTTP headers, which we then here map back onto their
-	// original URL query parameters. In consequence, the service-specific HTTP
-	// headers always take precedence.
-	//
-	// Nota bene: the Go http package insists of canonical header keys, see:
-	// https://godoc.org/net/http#CanonicalHeaderKey. This means that the first
-	// letter as well as any letters immediately following a hyphen will be
-	// upper case.
-	if cntr, ok := req.Header["Clustershark-Container"]; ok {
-		params["container"] = cntr
-	}
-	if nifs, ok := req.Header["Clustershark-Nif"]; ok {
-		params["nif"] = nifs
-	}
-	if filter, ok := req.Header["Clustershark-Filter"]; ok {
-		params["filter"] = filter
-	}
-	if chaste, ok := req.Header["Clustershark-Chaste"]; ok {
-		params["chaste"] = chaste
-	}
-
-	// Please note that the "container" and "netns" URL query parameters are
-	// mutually exclusive: there can be only one of them present.
+	// Don't leak an opened bind-mounted network namespace when bailing out
+	// after the capture target has already been determined.
+	var netnsf *os.File
+	defer func() {
+		if err != nil && netnsf != nil {
+			netnsf.Close()
+		}
+	}()
+	params := requestParams(req)
+
+	// Please note that the "container", "netns", "netnsname", "pid", and
+	// "cgroup" URL query parameters are mutually exclusive: there can be only
+	// one of them present.
 	cp, cok := params["container"]
 	netnsp, netnsok := params["netns"]
-	if cok && netnsok {
-		return nil, fmt.Errorf("container and netns query parameters are mutually exclusive")
+	namep, nameok := params["netnsname"]
+	pidp, pidok := params["pid"]
+	cgp, cgok := params["cgroup"]
+	targets := 0
+	for _, ok := range []bool{cok, netnsok, nameok, pidok, cgok} {
+		if ok {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return nil, fmt.Errorf("container, netns, netnsname, pid, and cgroup query parameters are mutually exclusive")
+	}
+	if _, ok := params["starttime"]; ok && !pidok {
+		return nil, fmt.Errorf("starttime query parameter requires pid")
 	}
 	if cok {
 		// If a full-blown container meta data query parameter is present, then use
@@ -84,8 +227,65 @@ func parseCaptureParams(req *http.Request, conn *WSConn) (
 		} else {
 			return nil, fmt.Errorf("invalid netns \"%s\"", netnsp[0])
 		}
+	} else if nameok {
+		// ...else open a named or bind-mounted network namespace, which
+		// usually has no processes attached, so there is no PID to check
+		// against and the discovery service might not know about it either.
+		f, netns, path, err := OpenNetnsName(namep[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid netnsname \"%s\": %s", namep[0], err.Error())
+		}
+		netnsf = f
+		args = new(Args)
+		args.Target = new(api.Target)
+		args.Target.NetNS = int(netns)
+		args.Target.Name = namep[0]
+		args.Target.Type = "bindmount"
+		args.NetnsFile = f
+		args.NetnsPath = path
+	} else if pidok || cgok {
+		// ...else capture from the network namespace of a process, either
+		// specified directly or as the first process in a cgroup. Its start
+		// time then protects against capturing from the wrong network
+		// namespace in case the process terminates and its PID gets reused.
+		var pid int
+		args = new(Args)
+		args.Target = new(api.Target)
+		if pidok {
+			pid, err = strconv.Atoi(pidp[0])
+			if err != nil || pid <= 0 {
+				return nil, fmt.Errorf("invalid pid \"%s\"", pidp[0])
+			}
+			args.Target.Type = "process"
+		} else {
+			pid, err = Netnses.CgroupProcess(cgp[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid cgroup \"%s\": %s", cgp[0], err.Error())
+			}
+			args.Target.Name = cgp[0]
+			args.Target.Type = "cgroup"
+		}
+		starttime, err := processStarttime(pid)
+		if err != nil {
+			return nil, fmt.Errorf("no process with PID %d", pid)
+		}
+		if st, ok := params["starttime"]; ok {
+			if expected, err := strconv.ParseInt(st[0], 10, 64); err != nil || expected != starttime {
+				return nil, fmt.Errorf("process PID %d has different starttime than \"%s\"", pid, st[0])
+			}
+		}
+		netns, err := processNetns(pid)
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine network namespace of process PID %d: %s", pid, err.Error())
+		}
+		if args.Target.Name == "" {
+			args.Target.Name = newSocketOwner(pid).Comm
+		}
+		args.Target.Pid = pid
+		args.Target.StartTime = starttime
+		args.Target.NetNS = int(netns)
 	} else {
-		return nil, fmt.Errorf("either container or netns query parameter required")
+		return nil, fmt.Errorf("either container, netns, netnsname, pid, or cgroup query parameter required")
 	}
 
 	// With all (or only some) information gathered into the container meta data
@@ -93,52 +293,26 @@ func parseCaptureParams(req *http.Request, conn *WSConn) (
 	// stale. This can be verified on the basis of the given PID (usually the
 	// "root" process inside a container) and its corresponding start time.
 	if args.Target.Pid > 0 && args.Target.StartTime > 0 {
-		stf, err := os.Open(fmt.Sprintf("/proc/%d/stat", args.Target.Pid))
-		if err != nil {
-			// We cannot verify the PID and start time, so we assume it to be
-			// stale in order to trigger a meta data refresh below.
+		// In case of issues verifying the start time, play safe here and
+		// assume it to be stale in order to trigger a meta data refresh below.
+		if starttime, err := processStarttime(args.Target.Pid); err != nil || starttime != args.Target.StartTime {
 			args.Target.NetNS = 0
-		} else {
-			// Just read the first (and only) line from the process stats and break
-			// it down into its fields...
-			line, _ := bufio.NewReader(stf).ReadString('\n')
-			// /proc/PID/stat has the process name in the second field, and the
-			// name is enclosed in brackets because it may contain spaces, so we
-			// look for the final ')' and only afterwards start splitting the
-			// remaining line contents into fields.
-			stats := strings.Fields(string(line)[strings.Index(string(line), ")")+2:])
-			// starttime is field #22 (counting from #1), so we need to take
-			// into account that Go slice indices start at zero.
-			if starttime, err := strconv.ParseInt(stats[22-3], 10, 64); err == nil {
-				if int64(starttime) != args.Target.StartTime {
-					args.Target.NetNS = 0
-				}
-			} else {
-				// In case of issues verifying the start time, play safe here.
-				args.Target.NetNS = 0
-			}
 		}
 	}
 
 	// If we got unlucky, then we now need to fetch up-to-date information from
 	// the discovery service: we need a correct network namespace identifier.
+	// This only works for containers, but not for plain processes.
+	if args.Target.NetNS == 0 && (pidok || cgok) {
+		return nil, fmt.Errorf("process PID %d is gone", args.Target.Pid)
+	}
 	if args.Target.NetNS == 0 {
 		conn.Debugf("updating container meta data from local discovery service (at port %d)", DiscoveryPort)
-		httpc := &http.Client{Timeout: DiscoveryDeadline}
-		resp, err := httpc.Get(fmt.Sprintf("http://%s:%d/mobyshark", DiscoveryService, DiscoveryPort))
-		if err != nil {
-			return nil, fmt.Errorf("cannot update container meta data: %s", err.Error())
-		}
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
+		targets, err := discoveredTargets()
 		if err != nil {
 			return nil, fmt.Errorf("cannot update container meta data: %s", err.Error())
 		}
-		var targets api.GwTargetList
-		if err := json.Unmarshal(body, &targets); err != nil {
-			return nil, fmt.Errorf("cannot update container/target meta data: %s", err.Error())
-		}
-		for _, t := range targets.Targets {
+		for _, t := range targets {
 			if t.Name == args.Target.Name && t.Prefix == args.Target.Prefix {
 				// We've found the desired container, so we can now update its
 				// meta data.
@@ -192,5 +366,263 @@ func parseCaptureParams(req *http.Request, conn *WSConn) (
 		args.KeepChaste = true
 	}
 
+	// Periodic capture statistics are opt-in, with an optional reporting
+	// interval in seconds. Mirroring statistics as JSON text messages implies
+	// periodic capture statistics.
+	if st, ok := params["stats"]; ok {
+		args.StatsInterval = DefaultStatsInterval
+		if st[0] != "" {
+			secs, err := strconv.ParseUint(st[0], 10, 16)
+			if err != nil || secs == 0 {
+				return nil, fmt.Errorf("invalid stats interval \"%s\"", st[0])
+			}
+			args.StatsInterval = time.Duration(secs) * time.Second
+		}
+	}
+	if _, ok := params["statsjson"]; ok {
+		args.StatsJSON = true
+		if args.StatsInterval == 0 {
+			args.StatsInterval = DefaultStatsInterval
+		}
+	}
+
+	// Limit the amount of packet data per packet, either by a maximum length
+	// and/or by cutting off all payload after the transport layer headers.
+	if sl, ok := params["snaplen"]; ok {
+		snaplen, err := strconv.ParseUint(sl[0], 10, 32)
+		if err != nil || snaplen == 0 || snaplen > MaxSnapLen {
+			return nil, fmt.Errorf("invalid snaplen \"%s\"", sl[0])
+		}
+		args.SnapLen = uint32(snaplen)
+	}
+	if _, ok := params["headersonly"]; ok {
+		args.HeadersOnly = true
+	}
+
+	// Anonymize addresses either with an explicitly specified key, or with the
+	// configured default key, or as the last resort with a per-session key.
+	if k, ok := params["anonkey"]; ok {
+		key, err := ParseAnonymizationKey(k[0])
+		if err != nil {
+			return nil, err
+		}
+		args.AnonymizationKey = key
+	} else if _, ok := params["anonymize"]; ok {
+		args.AnonymizationKey = AnonymizationKey
+		if args.AnonymizationKey == nil {
+			key, err := NewAnonymizationKey()
+			if err != nil {
+				return nil, fmt.Errorf("cannot create anonymization key: %s", err.Error())
+			}
+			args.AnonymizationKey = key
+		}
+	}
+
+	// Timestamp precision and source.
+	if p, ok := params["tsprecision"]; ok {
+		tsresol, ok := TimestampPrecisions[p[0]]
+		if !ok {
+			return nil, fmt.Errorf("invalid tsprecision \"%s\"", p[0])
+		}
+		args.TsResol = tsresol
+	}
+	if t, ok := params["tstype"]; ok {
+		if !TimestampTypes[t[0]] {
+			return nil, fmt.Errorf("invalid tstype \"%s\"", t[0])
+		}
+		args.TimestampType = t[0]
+	}
+
+	// Correlating packets with their processes (sockets) is opt-in, as it
+	// costs additional CPU cycles per packet.
+	if _, ok := params["procinfo"]; ok {
+		args.ProcessInfo = true
+	}
+
+	// A TLS key log file is always located inside the filesystem view of the
+	// capture target's "root" process, so we need to know this process.
+	if kl, ok := params["keylog"]; ok {
+		if !filepath.IsAbs(kl[0]) {
+			return nil, fmt.Errorf("invalid keylog path \"%s\", must be absolute", kl[0])
+		}
+		if args.Target.Pid <= 0 {
+			return nil, fmt.Errorf("keylog requires a capture target with pid")
+		}
+		args.KeyLogPath = filepath.Clean(kl[0])
+	}
+
+	// Capture filter expressions end up in the section header and interface
+	// description blocks, where they would give away the original addresses
+	// of an anonymized capture.
+	if args.CaptureFilter != "" && args.AnonymizationKey != nil {
+		return nil, fmt.Errorf("filter and anonymization are mutually exclusive")
+	}
+
+	// Name resolution blocks would give away the original addresses of an
+	// anonymized capture.
+	if _, ok := params["names"]; ok {
+		if args.AnonymizationKey != nil {
+			return nil, fmt.Errorf("names and anonymization are mutually exclusive")
+		}
+		args.Names = true
+	}
+
+	// Ditto for connection tracking events; these only make sense in packet
+	// capture streams going to capture clients.
+	if _, ok := params["conntrack"]; ok {
+		if args.AnonymizationKey != nil {
+			return nil, fmt.Errorf("conntrack and anonymization are mutually exclusive")
+		}
+		if req.URL.Path != "/capture" {
+			return nil, fmt.Errorf("conntrack is only supported for /capture")
+		}
+		args.Conntrack = true
+	}
+
+	// Ditto for packets dropped by the kernel, which get reported either as
+	// annotated packets or as JSON text messages.
+	if d, ok := params["drops"]; ok {
+		if args.AnonymizationKey != nil {
+			return nil, fmt.Errorf("drops and anonymization are mutually exclusive")
+		}
+		if req.URL.Path != "/capture" {
+			return nil, fmt.Errorf("drops is only supported for /capture")
+		}
+		switch d[0] {
+		case "", DropsPackets:
+			args.Drops = DropsPackets
+		case DropsJSON:
+			args.Drops = DropsJSON
+		default:
+			return nil, fmt.Errorf("invalid drops \"%s\"", d[0])
+		}
+	}
+
+	// Limit the bandwidth of the packet capture stream, either by dropping
+	// excess packets, or by sampling.
+	if rl, ok := params["ratelimit"]; ok {
+		rate, err := strconv.ParseUint(rl[0], 10, 64)
+		if err != nil || rate == 0 {
+			return nil, fmt.Errorf("invalid ratelimit \"%s\"", rl[0])
+		}
+		args.RateLimit = rate
+		args.Throttle = ThrottleDrop
+	}
+	if th, ok := params["throttle"]; ok {
+		if !ThrottleStrategies[th[0]] {
+			return nil, fmt.Errorf("invalid throttle \"%s\"", th[0])
+		}
+		if args.RateLimit == 0 {
+			return nil, fmt.Errorf("throttle requires ratelimit")
+		}
+		args.Throttle = th[0]
+	}
+
+	// Mirroring packets and exporting flow records to a collector are only
+	// available on their own API paths, and only to the collectors configured
+	// by the operator: clients only get to choose between them.
+	mirroring := req.URL.Path == "/mirror"
+	args.ExportFlows = req.URL.Path == "/flows"
+	c, ok := params["collector"]
+	if ok && c[0] != "" && !mirroring && !args.ExportFlows {
+		return nil, fmt.Errorf("collector is only supported by /mirror and /flows")
+	}
+	if mirroring {
+		if args.Collector, err = configuredCollector(c, MirrorCollectors); err != nil {
+			return nil, err
+		}
+	} else if args.ExportFlows {
+		if args.Collector, err = configuredCollector(c, FlowCollectors); err != nil {
+			return nil, err
+		}
+	}
+	if mirroring {
+		args.MirrorEncap = MirrorVXLAN
+		if e, ok := params["encap"]; ok {
+			if !MirrorEncapsulations[e[0]] {
+				return nil, fmt.Errorf("invalid encap \"%s\"", e[0])
+			}
+			args.MirrorEncap = e[0]
+		}
+		if v, ok := params["vni"]; ok {
+			vni, err := strconv.ParseUint(v[0], 10, 24)
+			if err != nil || args.MirrorEncap != MirrorVXLAN {
+				return nil, fmt.Errorf("invalid vni \"%s\", requires vxlan encap", v[0])
+			}
+			args.MirrorVNI = uint32(vni)
+		}
+		if s, ok := params["session"]; ok {
+			session, err := strconv.ParseUint(s[0], 10, 16)
+			if err != nil || session > MaxERSPANSession ||
+				(args.MirrorEncap != MirrorERSPAN2 && args.MirrorEncap != MirrorERSPAN3) {
+				return nil, fmt.Errorf("invalid session \"%s\", requires erspan encap", s[0])
+			}
+			args.MirrorSession = uint16(session)
+		}
+	}
+	if args.ExportFlows {
+		args.FlowActiveTimeout = DefaultFlowActiveTimeout
+		if a, ok := params["active"]; ok {
+			secs, err := strconv.ParseUint(a[0], 10, 16)
+			if err != nil || secs == 0 || secs > MaxFlowTimeout {
+				return nil, fmt.Errorf("invalid active \"%s\"", a[0])
+			}
+			args.FlowActiveTimeout = time.Duration(secs) * time.Second
+		}
+		args.FlowInactiveTimeout = DefaultFlowInactiveTimeout
+		if i, ok := params["inactive"]; ok {
+			secs, err := strconv.ParseUint(i[0], 10, 16)
+			if err != nil || secs == 0 || secs > MaxFlowTimeout {
+				return nil, fmt.Errorf("invalid inactive \"%s\"", i[0])
+			}
+			args.FlowInactiveTimeout = time.Duration(secs) * time.Second
+		}
+	}
+
+	// Traffic statistics are only available on their own API path; they need
+	// only the packet headers, so there's no point in capturing more.
+	if req.URL.Path == "/stats" {
+		args.TrafficStats = true
+		args.HeadersOnly = true
+		if args.SnapLen == 0 || args.SnapLen > TrafficStatsSnapLen {
+			args.SnapLen = TrafficStatsSnapLen
+		}
+		args.TrafficInterval = DefaultStatsInterval
+		if i, ok := params["interval"]; ok {
+			secs, err := strconv.ParseUint(i[0], 10, 16)
+			if err != nil || secs == 0 || secs > MaxTrafficInterval {
+				return nil, fmt.Errorf("invalid interval \"%s\"", i[0])
+			}
+			args.TrafficInterval = time.Duration(secs) * time.Second
+		}
+		args.TrafficTop = DefaultTrafficTop
+		if t, ok := params["top"]; ok {
+			top, err := strconv.ParseUint(t[0], 10, 16)
+			if err != nil || top == 0 || top > MaxTrafficTop {
+				return nil, fmt.Errorf("invalid top \"%s\"", t[0])
+			}
+			args.TrafficTop = int(top)
+		}
+	}
+
 	return
 }
+
+// configuredCollector returns the collector requested by the specified
+// collector query parameter values, which must be one of the specified
+// configured collectors. Without a requested collector, the first configured
+// collector is returned.
+func configuredCollector(requested []string, configured []string) (string, error) {
+	if len(configured) == 0 {
+		return "", fmt.Errorf("no collector configured")
+	}
+	if len(requested) == 0 || requested[0] == "" {
+		return configured[0], nil
+	}
+	for _, collector := range configured {
+		if collector == requested[0] {
+			return collector, nil
+		}
+	}
+	return "", fmt.Errorf("collector \"%s\" not configured", requested[0])
+}
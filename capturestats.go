@@ -0,0 +1,258 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Periodically reports capture statistics while a capture is still running,
+// instead of only at the end of a capture. The statistics get injected into
+// the packet capture stream in form of pcapng Interface Statistics Blocks and
+// optionally are mirrored as JSON text messages on the websocket.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	pcapng "github.com/siemens/csharg/pcapng"
+)
+
+// DefaultStatsInterval is the default interval between capture statistics
+// reports, if not explicitly specified.
+const DefaultStatsInterval = 5 * time.Second
+
+// netDevCounters are the packet counters of a network interface as reported
+// by the Linux kernel in /proc/[PID]/net/dev.
+type netDevCounters struct {
+	Packets uint64 // received and transmitted packets.
+	Dropped uint64 // dropped received and transmitted packets.
+}
+
+// InterfaceStats are the capture statistics for a single network interface, as
+// mirrored in JSON text messages. Please note that IfRecv and IfDrop are the
+// kernel's network interface counters from /proc/[PID]/net/dev, not the
+// counters of the capture socket: they thus count the packets in both
+// directions, including packets not matching the capture filter, as well as
+// packets dropped by other sockets. FilterDrop thus is only an estimate of the
+// packets not matching the capture filter.
+type InterfaceStats struct {
+	Interface    string `json:"interface"`
+	IfRecv       uint64 `json:"ifrecv"`
+	IfDrop       uint64 `json:"ifdrop"`
+	FilterDrop   uint64 `json:"filterdrop"`
+	FilterAccept uint64 `json:"filteraccept"`
+	Delivered    uint64 `json:"delivered"`
+}
+
+// StatsMessage is a capture statistics report sent as a websocket text
+// message.
+type StatsMessage struct {
+	Type       string            `json:"type"` // always "statistics".
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Interfaces []*InterfaceStats `json:"interfaces"`
+}
+
+// PacketCounter is a pcapng block editor counting the packets per interface,
+// passing all blocks through unmodified.
+type PacketCounter struct {
+	mu     sync.Mutex        // protects counts.
+	counts map[uint32]uint64 // packets per interface ID.
+}
+
+// NewPacketCounter returns a new packet counter with all counts zero.
+func NewPacketCounter() *PacketCounter {
+	return &PacketCounter{counts: map[uint32]uint64{}}
+}
+
+// EditBlock counts the packets per interface.
+func (pc *PacketCounter) EditBlock(s *BlockStream, blk *Block) []*Block {
+	switch blk.Type {
+	case BlockTypeEPB:
+		if len(blk.Body) >= 4 {
+			pc.mu.Lock()
+			pc.counts[s.Endian.Uint32(blk.Body[0:4])]++
+			pc.mu.Unlock()
+		}
+	case BlockTypeSPB:
+		// Simple packet blocks always belong to the first interface.
+		pc.mu.Lock()
+		pc.counts[0]++
+		pc.mu.Unlock()
+	}
+	return []*Block{blk}
+}
+
+// Count returns the number of packets counted for the specified interface.
+func (pc *PacketCounter) Count(id uint32) uint64 {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.counts[id]
+}
+
+// CaptureStats counts the packets accepted by the capture filter as well as
+// the packets delivered in the packet capture stream per interface, and
+// periodically reports them together with the interface counters of the
+// capture target's network interfaces. The Accepted and Delivered packet
+// counters need to be added to the packet capture stream before and after
+// throttling, respectively.
+type CaptureStats struct {
+	Accepted  *PacketCounter // packets accepted by the capture filter.
+	Delivered *PacketCounter // packets delivered after throttling.
+	conn      *WSConn
+	stream    *BlockStream
+	json      bool                      // mirror as websocket text messages?
+	baseline  map[string]netDevCounters // interface counters at capture start.
+	start     time.Time
+	pid       int
+}
+
+// NewCaptureStats returns a new capture statistics reporter that injects its
+// Interface Statistics Blocks into the specified pcapng block stream.
+func NewCaptureStats(conn *WSConn, stream *BlockStream, mirrorJSON bool) *CaptureStats {
+	return &CaptureStats{
+		Accepted:  NewPacketCounter(),
+		Delivered: NewPacketCounter(),
+		conn:      conn,
+		stream:    stream,
+		json:      mirrorJSON,
+	}
+}
+
+// Run periodically reports the capture statistics of the capture process with
+// the specified PID until the done channel gets closed. The capture process
+// must be attached to the capture target's network namespace, as the interface
+// counters are taken from its view on the network interfaces.
+func (cs *CaptureStats) Run(pid int, interval time.Duration, done <-chan struct{}) {
+	cs.pid = pid
+	cs.start = time.Now()
+	cs.baseline, _ = readNetDev(pid)
+	cs.conn.Debugf("reporting capture statistics every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			cs.report()
+		}
+	}
+}
+
+// report injects a set of Interface Statistics Blocks, one for each of the
+// interfaces known in the current section of the packet capture stream.
+func (cs *CaptureStats) report() {
+	counters, err := readNetDev(cs.pid)
+	if err != nil {
+		cs.conn.Debugf("cannot read interface counters: %s", err.Error())
+		return
+	}
+	now := time.Now()
+	endian, nifs := cs.stream.Section()
+	if endian == nil || len(nifs) == 0 {
+		return
+	}
+	msg := &StatsMessage{Type: "statistics", Start: cs.start, End: now}
+	isbs := make([]*Block, 0, len(nifs))
+	for id, nif := range nifs {
+		accepted := cs.Accepted.Count(uint32(id))
+		delivered := cs.Delivered.Count(uint32(id))
+		var recv, drop uint64
+		if nif.Name == "any" {
+			for name, c := range counters {
+				recv += counterDelta(c.Packets, cs.baseline[name].Packets)
+				drop += counterDelta(c.Dropped, cs.baseline[name].Dropped)
+			}
+		} else if c, ok := counters[nif.Name]; ok {
+			recv = counterDelta(c.Packets, cs.baseline[nif.Name].Packets)
+			drop = counterDelta(c.Dropped, cs.baseline[nif.Name].Dropped)
+		}
+		var filterdrop uint64
+		if recv > drop+accepted {
+			filterdrop = recv - drop - accepted
+		}
+		msg.Interfaces = append(msg.Interfaces, &InterfaceStats{
+			Interface:    nif.Name,
+			IfRecv:       recv,
+			IfDrop:       drop,
+			FilterDrop:   filterdrop,
+			FilterAccept: accepted,
+			Delivered:    delivered,
+		})
+		ticks := nif.Timestamp(now)
+		body := make([]byte, 12)
+		endian.PutUint32(body[0:4], uint32(id))
+		endian.PutUint32(body[4:8], uint32(ticks>>32))
+		endian.PutUint32(body[8:12], uint32(ticks))
+		body = append(body, OptionsBytes([]*pcapng.Option{
+			{Code: pcapng.OptComment, Value: []byte("periodic packetflix capture statistics (network interface counters)")},
+			TimestampOption(OptISBStartTime, nif.Timestamp(cs.start), endian),
+			TimestampOption(OptISBEndTime, ticks, endian),
+			Uint64Option(OptISBIfRecv, recv, endian),
+			Uint64Option(OptISBIfDrop, drop, endian),
+			Uint64Option(OptISBFilterAccept, accepted, endian),
+			Uint64Option(OptISBUsrDeliv, delivered, endian),
+		}, endian)...)
+		isbs = append(isbs, &Block{Type: BlockTypeISB, Body: body})
+	}
+	cs.stream.Inject(isbs...)
+	if cs.json {
+		if j, err := json.Marshal(msg); err == nil {
+			_ = cs.conn.WriteMessage(websocket.TextMessage, j)
+		}
+	}
+}
+
+// counterDelta returns the difference between the current and the baseline
+// value of an interface counter. If the counter has been reset in the
+// meantime, such as when the network interface got recreated, then the
+// current value is returned instead of an underflowed difference.
+func counterDelta(current, baseline uint64) uint64 {
+	if current < baseline {
+		return current
+	}
+	return current - baseline
+}
+
+// readNetDev returns the packet counters of the network interfaces in the
+// network namespace of the process with the specified PID.
+func readNetDev(pid int) (map[string]netDevCounters, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	counters := map[string]netDevCounters{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Skip the two header lines, which don't have any ":" in them.
+		name, values, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(values)
+		if len(fields) < 12 {
+			continue
+		}
+		// Receive and transmit packets are fields #2 and #10, the dropped
+		// packets are fields #4 and #12 (counting from #1).
+		var c netDevCounters
+		for _, idx := range []int{1, 9} {
+			v, _ := strconv.ParseUint(fields[idx], 10, 64)
+			c.Packets += v
+		}
+		for _, idx := range []int{3, 11} {
+			v, _ := strconv.ParseUint(fields[idx], 10, 64)
+			c.Dropped += v
+		}
+		counters[strings.TrimSpace(name)] = c
+	}
+	return counters, scanner.Err()
+}
@@ -0,0 +1,111 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Confines capture processes to their own (unified hierarchy, v2) cgroups with
+// CPU and memory limits, so that runaway captures on busy nodes cannot starve
+// the workloads they are capturing from.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CgroupCPUPeriod is the CPU bandwidth control period in microseconds.
+const CgroupCPUPeriod = 100000
+
+// CaptureCgroup is a cgroup for a single capture process.
+type CaptureCgroup struct {
+	Path string // filesystem path of the cgroup.
+	fd   int    // open cgroup directory for placing processes into it.
+}
+
+// NewCaptureCgroup creates a new cgroup with the specified name below the
+// configured parent cgroup, applying the configured CPU and memory limits. It
+// returns a nil cgroup without error if capture cgroups are disabled.
+func NewCaptureCgroup(name string) (*CaptureCgroup, error) {
+	if CaptureCgroupParent == "" {
+		return nil, nil
+	}
+	// Enable the controllers we need for our child cgroups; they might
+	// already be enabled, so ignore any errors here and instead report
+	// later when failing to set limits.
+	_ = os.WriteFile(filepath.Join(CaptureCgroupParent, "cgroup.subtree_control"),
+		[]byte("+cpu +memory"), 0)
+	path := filepath.Join(CaptureCgroupParent, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create cgroup: %s", err.Error())
+	}
+	cg := &CaptureCgroup{Path: path, fd: -1}
+	if CaptureCPULimit > 0 {
+		quota := int(CaptureCPULimit * CgroupCPUPeriod)
+		if err := cg.write("cpu.max", fmt.Sprintf("%d %d", quota, CgroupCPUPeriod)); err != nil {
+			cg.Remove()
+			return nil, err
+		}
+	}
+	if CaptureMemoryLimit > 0 {
+		if err := cg.write("memory.max", strconv.FormatUint(CaptureMemoryLimit<<20, 10)); err != nil {
+			cg.Remove()
+			return nil, err
+		}
+	}
+	// Please note that we cannot use an O_PATH file descriptor here, as
+	// clone3(2) doesn't accept it.
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		cg.Remove()
+		return nil, fmt.Errorf("cannot open cgroup: %s", err.Error())
+	}
+	cg.fd = fd
+	return cg, nil
+}
+
+// Fd returns the file descriptor referencing the cgroup, for use with
+// syscall.SysProcAttr.CgroupFD.
+func (cg *CaptureCgroup) Fd() int {
+	return cg.fd
+}
+
+// Kill kills all processes in the cgroup.
+func (cg *CaptureCgroup) Kill() error {
+	return cg.write("cgroup.kill", "1")
+}
+
+// Populated returns true if there are still processes in the cgroup.
+func (cg *CaptureCgroup) Populated() bool {
+	events, err := os.ReadFile(filepath.Join(cg.Path, "cgroup.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		if line == "populated 1" {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove removes the cgroup, which must not contain any processes anymore.
+func (cg *CaptureCgroup) Remove() error {
+	if cg.fd >= 0 {
+		unix.Close(cg.fd)
+		cg.fd = -1
+	}
+	return unix.Rmdir(cg.Path)
+}
+
+// write writes the specified value to a cgroup control file.
+func (cg *CaptureCgroup) write(control string, value string) error {
+	if err := os.WriteFile(filepath.Join(cg.Path, control), []byte(value), 0); err != nil {
+		return fmt.Errorf("cannot set cgroup %s: %s", control, err.Error())
+	}
+	return nil
+}
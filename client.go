@@ -0,0 +1,117 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Identifies capture clients. As Packetflix doesn't authenticate clients
+// itself, but instead relies on a TLS-terminating and authenticating proxy in
+// front of it, we take the authenticated user from the headers set by such
+// proxies, if present. However, these headers are only honored when the
+// request comes from one of the configured trusted proxies, as otherwise any
+// client could simply claim to be someone else.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// UserHeaders lists the HTTP headers commonly set by authenticating proxies
+// to pass on the authenticated user, in order of preference.
+var UserHeaders = []string{
+	"X-Forwarded-User",
+	"X-Remote-User",
+	"Remote-User",
+	"X-Auth-Request-User",
+}
+
+// ClientIdentity describes who is asking for a capture.
+type ClientIdentity struct {
+	Address      string `yaml:"address"`                 // (proxy) client IP address.
+	ForwardedFor string `yaml:"forwarded-for,omitempty"` // original client IP address(es) as forwarded by proxies.
+	User         string `yaml:"user,omitempty"`          // authenticated user, if any.
+}
+
+// ParseTrustedProxies parses the specified IP addresses and CIDR prefixes of
+// trusted proxies.
+func ParseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy returns true if the specified address belongs to one of the
+// configured trusted proxies.
+func isTrustedProxy(address string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSpace(address))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range TrustedProxyPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewClientIdentity returns the identity of the client making the specified
+// HTTP request. The proxy headers are only taken into account if the request
+// comes from a trusted proxy.
+func NewClientIdentity(req *http.Request) *ClientIdentity {
+	id := &ClientIdentity{Address: req.RemoteAddr}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		id.Address = host
+	}
+	if !isTrustedProxy(id.Address) {
+		return id
+	}
+	id.ForwardedFor = strings.TrimSpace(req.Header.Get("X-Forwarded-For"))
+	for _, header := range UserHeaders {
+		if user := strings.TrimSpace(req.Header.Get(header)); user != "" {
+			id.User = user
+			break
+		}
+	}
+	return id
+}
+
+// Authenticated returns true if the client has been authenticated by a
+// trusted proxy.
+func (id *ClientIdentity) Authenticated() bool {
+	return id.User != ""
+}
+
+// Principal returns the authenticated user if known, otherwise the
+// (original) client address. As clients can prepend arbitrary addresses to
+// X-Forwarded-For, the original client address is the right-most address
+// not belonging to a trusted proxy.
+func (id *ClientIdentity) Principal() string {
+	if id.User != "" {
+		return "user:" + id.User
+	}
+	if id.ForwardedFor != "" {
+		addrs := strings.Split(id.ForwardedFor, ",")
+		for idx := len(addrs) - 1; idx >= 0; idx-- {
+			addr := strings.TrimSpace(addrs[idx])
+			if addr != "" && (idx == 0 || !isTrustedProxy(addr)) {
+				return "address:" + addr
+			}
+		}
+	}
+	return "address:" + id.Address
+}
@@ -0,0 +1,397 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Monitors the netfilter connection tracking events inside a capture target's
+// network namespace. Packet captures don't show NAT decisions or the state of
+// the connection tracking table, so these events complement captures when
+// debugging kube-proxy and CNI NAT issues. The events are either streamed as
+// JSON text messages, or injected into packet capture streams.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/thediveo/lxkns/ops"
+	"github.com/thediveo/lxkns/ops/relations"
+	"golang.org/x/sys/unix"
+)
+
+// BlockTypeCB is the block type of copyable pcapng Custom Blocks.
+const BlockTypeCB = uint32(0x00000bad)
+
+// ConntrackReceiveTimeout specifies how long to wait for conntrack events
+// before checking whether monitoring has been stopped.
+const ConntrackReceiveTimeout = 500 * time.Millisecond
+
+// ConntrackReceiveBuffer is the size of the socket receive buffer for
+// conntrack events, so that bursts of events don't get lost.
+const ConntrackReceiveBuffer = 4 << 20
+
+// MaxPendingConntrackEvents limits the number of conntrack events waiting to
+// be injected into a packet capture stream not yet ready.
+const MaxPendingConntrackEvents = 1000
+
+// ctnetlink message types, multicast groups, and attribute types, see
+// include/uapi/linux/netfilter/nfnetlink_conntrack.h.
+const (
+	nfnlSubsysCtnetlink = 1
+	ipctnlMsgCtNew      = 0
+	ipctnlMsgCtDelete   = 2
+
+	nfnlgrpConntrackNew     = 1
+	nfnlgrpConntrackUpdate  = 2
+	nfnlgrpConntrackDestroy = 3
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+	ctaStatus     = 3
+	ctaProtoinfo  = 4
+	ctaTimeout    = 7
+	ctaMark       = 8
+	ctaID         = 12
+	ctaZone       = 18
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+	ctaTupleZone  = 3
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum        = 1
+	ctaProtoSrcPort    = 2
+	ctaProtoDstPort    = 3
+	ctaProtoICMPID     = 4
+	ctaProtoICMPType   = 5
+	ctaProtoICMPCode   = 6
+	ctaProtoICMPv6ID   = 7
+	ctaProtoICMPv6Type = 8
+	ctaProtoICMPv6Code = 9
+
+	ctaProtoinfoTCP      = 1
+	ctaProtoinfoTCPState = 1
+)
+
+// conntrackStatus names the connection status bits.
+var conntrackStatus = []string{
+	"EXPECTED", "SEEN_REPLY", "ASSURED", "CONFIRMED", "SRC_NAT", "DST_NAT",
+	"SEQ_ADJUST", "SRC_NAT_DONE", "DST_NAT_DONE", "DYING", "FIXED_TIMEOUT",
+	"TEMPLATE", "UNTRACKED", "HELPER", "OFFLOAD", "HW_OFFLOAD",
+}
+
+// conntrackTCPStates names the TCP connection tracking states.
+var conntrackTCPStates = []string{
+	"NONE", "SYN_SENT", "SYN_RECV", "ESTABLISHED", "FIN_WAIT", "CLOSE_WAIT",
+	"LAST_ACK", "TIME_WAIT", "CLOSE", "SYN_SENT2",
+}
+
+// ConntrackEvent describes a connection tracking event.
+type ConntrackEvent struct {
+	Type     string          `json:"type"`  // always "conntrack".
+	Event    string          `json:"event"` // "new", "update", or "destroy".
+	Time     time.Time       `json:"time"`
+	Family   string          `json:"family"`
+	Protocol string          `json:"protocol"`
+	Original *ConntrackTuple `json:"original,omitempty"`
+	Reply    *ConntrackTuple `json:"reply,omitempty"`
+	Status   []string        `json:"status,omitempty"`
+	State    string          `json:"state,omitempty"`   // TCP only.
+	Timeout  uint32          `json:"timeout,omitempty"` // in seconds.
+	Mark     uint32          `json:"mark,omitempty"`
+	Zone     uint16          `json:"zone,omitempty"`
+	ID       uint32          `json:"id,omitempty"`
+}
+
+// ConntrackTuple describes the original or reply direction of a connection.
+type ConntrackTuple struct {
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	SrcPort  uint16 `json:"sport,omitempty"`
+	DstPort  uint16 `json:"dport,omitempty"`
+	ICMPType *uint8 `json:"icmptype,omitempty"`
+	ICMPCode *uint8 `json:"icmpcode,omitempty"`
+	ICMPID   uint16 `json:"icmpid,omitempty"`
+	Zone     uint16 `json:"zone,omitempty"`
+}
+
+// ConntrackSocket is a netlink socket subscribed to the connection tracking
+// events of the network namespace it was created in.
+type ConntrackSocket struct {
+	fd   int
+	buff []byte
+}
+
+// OpenConntrackSocket returns a new netlink socket receiving the connection
+// tracking events of the specified (locked) network namespace.
+func OpenConntrackSocket(netns relations.Relation) (*ConntrackSocket, error) {
+	res, err := ops.Execute(func() interface{} {
+		fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+		if err != nil {
+			return os.NewSyscallError("socket", err)
+		}
+		// Try to force a larger receive buffer, falling back to what we're
+		// allowed to.
+		if unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, ConntrackReceiveBuffer) != nil {
+			_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, ConntrackReceiveBuffer)
+		}
+		timeout := unix.NsecToTimeval(int64(ConntrackReceiveTimeout))
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+			unix.Close(fd)
+			return os.NewSyscallError("setsockopt", err)
+		}
+		if err := unix.Bind(fd, &unix.SockaddrNetlink{
+			Family: unix.AF_NETLINK,
+			Groups: 1<<(nfnlgrpConntrackNew-1) | 1<<(nfnlgrpConntrackUpdate-1) | 1<<(nfnlgrpConntrackDestroy-1),
+		}); err != nil {
+			unix.Close(fd)
+			return os.NewSyscallError("bind", err)
+		}
+		return &ConntrackSocket{fd: fd, buff: make([]byte, 64*1024)}
+	}, netns)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := res.(error); ok {
+		return nil, fmt.Errorf("cannot monitor connection tracking: %s", err.Error())
+	}
+	return res.(*ConntrackSocket), nil
+}
+
+// Receive returns the next connection tracking events, or none if the receive
+// timeout passed. If events got lost because the receive buffer overflowed,
+// unix.ENOBUFS is returned; the socket can still be used afterwards.
+func (s *ConntrackSocket) Receive() ([]*ConntrackEvent, error) {
+	n, _, err := unix.Recvfrom(s.fd, s.buff, 0)
+	if err != nil {
+		if err == unix.EAGAIN || err == unix.EINTR {
+			return nil, nil
+		}
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(s.buff[:n])
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	events := []*ConntrackEvent{}
+	for _, msg := range msgs {
+		if event := parseConntrackEvent(msg, now); event != nil {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// Close closes the netlink socket.
+func (s *ConntrackSocket) Close() error {
+	return unix.Close(s.fd)
+}
+
+// parseConntrackEvent returns the connection tracking event described by the
+// specified netlink message, or nil if it isn't a connection tracking event.
+func parseConntrackEvent(msg syscall.NetlinkMessage, now time.Time) *ConntrackEvent {
+	if msg.Header.Type>>8 != nfnlSubsysCtnetlink || len(msg.Data) < 4 {
+		return nil
+	}
+	event := &ConntrackEvent{
+		Type:   "conntrack",
+		Time:   now,
+		Family: familyName(msg.Data[0]), // nfgenmsg: family, version, resource ID.
+	}
+	switch msg.Header.Type & 0xff {
+	case ipctnlMsgCtNew:
+		event.Event = "update"
+		if msg.Header.Flags&(unix.NLM_F_CREATE|unix.NLM_F_EXCL) != 0 {
+			event.Event = "new"
+		}
+	case ipctnlMsgCtDelete:
+		event.Event = "destroy"
+	default:
+		return nil
+	}
+	// Contrary to the netlink headers, the attribute values are in network
+	// byte order.
+	attrs := netlinkAttrs(msg.Data[4:])
+	var proto uint8
+	event.Original, proto = parseConntrackTuple(attrs[ctaTupleOrig])
+	event.Reply, _ = parseConntrackTuple(attrs[ctaTupleReply])
+	event.Protocol = transportName(proto)
+	if status, ok := attrs[ctaStatus]; ok && len(status) >= 4 {
+		bits := binary.BigEndian.Uint32(status)
+		for bit, name := range conntrackStatus {
+			if bits&(1<<bit) != 0 {
+				event.Status = append(event.Status, name)
+			}
+		}
+	}
+	if info, ok := attrs[ctaProtoinfo]; ok {
+		tcp := netlinkAttrs(netlinkAttrs(info)[ctaProtoinfoTCP])
+		if state, ok := tcp[ctaProtoinfoTCPState]; ok && len(state) >= 1 && int(state[0]) < len(conntrackTCPStates) {
+			event.State = conntrackTCPStates[state[0]]
+		}
+	}
+	if timeout, ok := attrs[ctaTimeout]; ok && len(timeout) >= 4 {
+		event.Timeout = binary.BigEndian.Uint32(timeout)
+	}
+	if mark, ok := attrs[ctaMark]; ok && len(mark) >= 4 {
+		event.Mark = binary.BigEndian.Uint32(mark)
+	}
+	if zone, ok := attrs[ctaZone]; ok && len(zone) >= 2 {
+		event.Zone = binary.BigEndian.Uint16(zone)
+	}
+	if id, ok := attrs[ctaID]; ok && len(id) >= 4 {
+		event.ID = binary.BigEndian.Uint32(id)
+	}
+	return event
+}
+
+// parseConntrackTuple returns the connection tuple described by the specified
+// nested attributes, as well as its transport protocol.
+func parseConntrackTuple(b []byte) (*ConntrackTuple, uint8) {
+	if b == nil {
+		return nil, 0
+	}
+	attrs := netlinkAttrs(b)
+	tuple := &ConntrackTuple{}
+	ip := netlinkAttrs(attrs[ctaTupleIP])
+	for _, addr := range []struct {
+		v4, v6 uint16
+		s      *string
+	}{{ctaIPv4Src, ctaIPv6Src, &tuple.Src}, {ctaIPv4Dst, ctaIPv6Dst, &tuple.Dst}} {
+		if a, ok := netip.AddrFromSlice(ip[addr.v4]); ok {
+			*addr.s = a.String()
+		} else if a, ok := netip.AddrFromSlice(ip[addr.v6]); ok {
+			*addr.s = a.String()
+		}
+	}
+	proto := netlinkAttrs(attrs[ctaTupleProto])
+	var num uint8
+	if p := proto[ctaProtoNum]; len(p) >= 1 {
+		num = p[0]
+	}
+	if port := proto[ctaProtoSrcPort]; len(port) >= 2 {
+		tuple.SrcPort = binary.BigEndian.Uint16(port)
+	}
+	if port := proto[ctaProtoDstPort]; len(port) >= 2 {
+		tuple.DstPort = binary.BigEndian.Uint16(port)
+	}
+	for _, icmp := range []struct{ id, typ, code uint16 }{
+		{ctaProtoICMPID, ctaProtoICMPType, ctaProtoICMPCode},
+		{ctaProtoICMPv6ID, ctaProtoICMPv6Type, ctaProtoICMPv6Code},
+	} {
+		if id := proto[icmp.id]; len(id) >= 2 {
+			tuple.ICMPID = binary.BigEndian.Uint16(id)
+		}
+		if typ := proto[icmp.typ]; len(typ) >= 1 {
+			t := typ[0]
+			tuple.ICMPType = &t
+		}
+		if code := proto[icmp.code]; len(code) >= 1 {
+			c := code[0]
+			tuple.ICMPCode = &c
+		}
+	}
+	if zone := attrs[ctaTupleZone]; len(zone) >= 2 {
+		tuple.Zone = binary.BigEndian.Uint16(zone)
+	}
+	return tuple, num
+}
+
+// ConntrackMonitor receives the connection tracking events from its socket
+// and hands them to its emitter.
+type ConntrackMonitor struct {
+	conn   *WSConn
+	sock   *ConntrackSocket
+	events uint64
+	lost   uint64 // number of times events got lost.
+}
+
+// NewConntrackMonitor returns a new connection tracking monitor for the
+// specified socket.
+func NewConntrackMonitor(conn *WSConn, sock *ConntrackSocket) *ConntrackMonitor {
+	return &ConntrackMonitor{conn: conn, sock: sock}
+}
+
+// Run hands the connection tracking events to the specified emitter until the
+// done channel gets closed, the emitter fails, or the socket fails.
+func (m *ConntrackMonitor) Run(done <-chan struct{}, emit func(*ConntrackEvent) error) error {
+	defer func() {
+		m.conn.Debugf("monitored %d conntrack events, lost events %d times", m.events, m.lost)
+	}()
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		events, err := m.sock.Receive()
+		if err == unix.ENOBUFS {
+			m.lost++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			m.events++
+			if err := emit(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ConntrackInjector injects connection tracking events as JSON-encoded Custom
+// Blocks into a packet capture stream.
+type ConntrackInjector struct {
+	stream  *BlockStream
+	pending [][]byte // events waiting for the stream to become ready.
+}
+
+// NewConntrackInjector returns a new injector of connection tracking events
+// into the specified packet capture stream.
+func NewConntrackInjector(stream *BlockStream) *ConntrackInjector {
+	return &ConntrackInjector{stream: stream}
+}
+
+// Emit injects the specified connection tracking event, or keeps it pending
+// as long as the stream isn't ready yet. Pending events beyond the limit get
+// dropped.
+func (i *ConntrackInjector) Emit(event *ConntrackEvent) error {
+	j, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if len(i.pending) < MaxPendingConntrackEvents {
+		i.pending = append(i.pending, j)
+	}
+	endian, _ := i.stream.Section()
+	if endian == nil {
+		return nil
+	}
+	blks := make([]*Block, 0, len(i.pending))
+	for _, j := range i.pending {
+		// The custom data has no length of its own, so pad the JSON with
+		// white space instead of letting the block get padded with zeros.
+		for len(j)&0x3 != 0 {
+			j = append(j, ' ')
+		}
+		body := make([]byte, 4, 4+len(j))
+		endian.PutUint32(body[0:4], SiemensPEN)
+		blks = append(blks, &Block{Type: BlockTypeCB, Body: append(body, j...)})
+	}
+	if i.stream.Inject(blks...) {
+		i.pending = nil
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Handles the /conntrack API endpoint for streaming the connection tracking
+// events of a capture target.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Handle the /conntrack API endpoint: a websocket connect streams the
+// connection tracking events in the network namespace of the capture target,
+// specified in the same way as for captures, as JSON text messages until the
+// client closes the websocket.
+func conntrackHandler(w http.ResponseWriter, req *http.Request) {
+	conn := NewWSConn()
+	cnx, err := wsupgrader.Upgrade(w, req, nil)
+	if err != nil {
+		conn.Errorf("websocket upgrade process failed: %s", err.Error())
+		return
+	}
+	conn.Conn = cnx
+	defer conn.Close()
+
+	args, err := parseCaptureParams(req, conn)
+	if err != nil {
+		conn.Errorf("%s", err.Error())
+		conn.GracefullyClose(websocket.CloseAbnormalClosure, err.Error())
+		return
+	}
+	if args.NetnsFile != nil {
+		defer args.NetnsFile.Close()
+	}
+	client := NewClientIdentity(req)
+	release, err := Sessions.Acquire(client.Principal(), uint64(args.Target.NetNS))
+	if err != nil {
+		conn.Errorf("rejecting conntrack session of %s: %s", client.Principal(), err.Error())
+		conn.GracefullyClose(websocket.CloseTryAgainLater, err.Error())
+		return
+	}
+	defer release()
+	netns, unlock, err := lockTargetNetns(args, targetNetnsPath(conn, args))
+	if err != nil {
+		conn.Errorf("cannot lock netns:[%d]: %s", args.Target.NetNS, err.Error())
+		conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot lock target network stack")
+		return
+	}
+	defer unlock()
+	sock, err := OpenConntrackSocket(netns)
+	if err != nil {
+		conn.Errorf("%s", err.Error())
+		conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot monitor connection tracking")
+		return
+	}
+	defer sock.Close()
+	conn.Debugf("streaming connection tracking events of netns:[%d]", args.Target.NetNS)
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Watch()
+		close(closed)
+	}()
+	err = NewConntrackMonitor(conn, sock).Run(closed, func(event *ConntrackEvent) error {
+		j, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.TextMessage, j)
+	})
+	if err != nil {
+		conn.Errorf("cannot stream connection tracking events: %s", err.Error())
+		conn.InitiateGracefulClose(websocket.CloseAbnormalClosure, "cannot stream connection tracking events")
+	}
+	<-closed
+}
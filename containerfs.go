@@ -0,0 +1,64 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Accesses files inside the filesystem view of containers (that is, their mount
+// namespaces) without having to switch mount namespaces, which Go programs
+// cannot do anyway once they've become multi-threaded.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenInContainer opens the file with the specified absolute path as seen by
+// the process with the specified PID, that is, inside the process' mount
+// namespace and root directory, using the specified open flags (O_CLOEXEC is
+// always added). Symbolic links are resolved relative to the process' root
+// directory, so they cannot escape from it.
+func OpenInContainer(pid int, path string, flags int) (*os.File, error) {
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("path %q must be absolute", path)
+	}
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	rootfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open root of process PID %d: %s", pid, err.Error())
+	}
+	defer unix.Close(rootfd)
+	fd, err := unix.Openat2(rootfd, path, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s of process PID %d: %s", path, pid, err.Error())
+	}
+	return os.NewFile(uintptr(fd), root+path), nil
+}
+
+// OpenRegularFileInContainer opens the regular file with the specified
+// absolute path as seen by the process with the specified PID for reading,
+// similar to OpenInContainer. The file is opened non-blocking, so that FIFOs
+// cannot block the caller, and then rejected unless it is a regular file, so
+// that device nodes and other special files are never read.
+func OpenRegularFileInContainer(pid int, path string) (*os.File, error) {
+	f, err := OpenInContainer(pid, path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOCTTY)
+	if err != nil {
+		return nil, err
+	}
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &stat); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot stat %s of process PID %d: %s", path, pid, err.Error())
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		f.Close()
+		return nil, fmt.Errorf("%s of process PID %d is not a regular file", path, pid)
+	}
+	return f, nil
+}
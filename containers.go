@@ -0,0 +1,151 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Watches the container engines on this host for their alive containers, such
+// as Docker, containerd, and CRI engines (including CRI-O). Container details,
+// such as names, images, and labels, are then taken from the watched
+// containers, so that starting captures never has to wait for container
+// engines to respond.
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/docker/docker/api/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/thediveo/whalewatcher"
+	cdengine "github.com/thediveo/whalewatcher/engineclient/containerd"
+	mobyengine "github.com/thediveo/whalewatcher/engineclient/moby"
+	"github.com/thediveo/whalewatcher/watcher"
+	"github.com/thediveo/whalewatcher/watcher/containerd"
+	"github.com/thediveo/whalewatcher/watcher/cri"
+	"github.com/thediveo/whalewatcher/watcher/moby"
+)
+
+// ContainerDetails describes a container, as far as needed for capture meta
+// data.
+type ContainerDetails struct {
+	ID     string            `yaml:"id"`
+	Name   string            `yaml:"name,omitempty"`
+	Engine string            `yaml:"engine,omitempty"`
+	Image  string            `yaml:"image,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// DefaultCRISockets are the usual paths of the CRI API sockets of containerd
+// and CRI-O.
+var DefaultCRISockets = []string{"/run/containerd/containerd.sock", "/run/crio/crio.sock"}
+
+// ContainerEngines are the watched container engines on this host.
+var ContainerEngines = &EngineWatchers{}
+
+// EngineWatchers keeps track of the alive containers of multiple container
+// engines.
+type EngineWatchers struct {
+	mu       sync.RWMutex // protects watchers.
+	watchers []watcher.Watcher
+}
+
+// imagePacker packs the image reference of containers into their rucksacks,
+// where the container engine tells us.
+type imagePacker struct{}
+
+// Pack picks the image reference from the engine-specific container
+// inspection data.
+func (imagePacker) Pack(container *whalewatcher.Container, inspection interface{}) {
+	switch details := inspection.(type) {
+	case types.ContainerJSON:
+		if details.Config != nil {
+			container.Rucksack = details.Config.Image
+		}
+	case cdengine.InspectionDetails:
+		if details.Container != nil {
+			container.Rucksack = details.Container.Image
+		}
+	}
+}
+
+// Start starts watching the container engines at the specified API sockets,
+// as far as these sockets exist; empty socket paths are skipped. The watchers
+// keep (re)connecting to their engines in the background until the context
+// gets cancelled.
+func (e *EngineWatchers) Start(ctx context.Context, dockersock, containerdsock string, crisocks []string) {
+	start := func(kind string, sock string, newWatcher func() (watcher.Watcher, error)) {
+		if sock == "" {
+			return
+		}
+		if _, err := os.Stat(sock); err != nil {
+			log.Debugf("not watching %s engine: %s", kind, err.Error())
+			return
+		}
+		w, err := newWatcher()
+		if err != nil {
+			log.Errorf("cannot watch %s engine at %s: %s", kind, sock, err.Error())
+			return
+		}
+		log.Infof("watching %s engine at %s", kind, sock)
+		e.mu.Lock()
+		e.watchers = append(e.watchers, w)
+		e.mu.Unlock()
+		go func() {
+			_ = w.Watch(ctx)
+			w.Close()
+		}()
+	}
+	start("Docker", dockersock, func() (watcher.Watcher, error) {
+		return moby.New("unix://"+dockersock, backoff.NewExponentialBackOff(),
+			mobyengine.WithRucksackPacker(imagePacker{}))
+	})
+	start("containerd", containerdsock, func() (watcher.Watcher, error) {
+		return containerd.New(containerdsock, backoff.NewExponentialBackOff(),
+			cdengine.WithRucksackPacker(imagePacker{}))
+	})
+	for _, sock := range crisocks {
+		sock := sock
+		start("CRI", sock, func() (watcher.Watcher, error) {
+			return cri.New(sock, backoff.NewExponentialBackOff())
+		})
+	}
+}
+
+// NetnsContainers returns the details about the containers attached to the
+// network namespace with the specified inode number, as currently known to
+// the watched container engines. NetnsContainers doesn't talk to the
+// container engines, but only checks the network namespaces of the watched
+// containers' initial processes.
+func (e *EngineWatchers) NetnsContainers(netns uint64) []*ContainerDetails {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	containers := []*ContainerDetails{}
+	for _, w := range e.watchers {
+		portfolio := w.Portfolio()
+		for _, projname := range portfolio.Names() {
+			project := portfolio.Project(projname)
+			if project == nil {
+				continue
+			}
+			for _, c := range project.Containers() {
+				if c.PID <= 0 {
+					continue
+				}
+				if cnetns, err := processNetns(c.PID); err != nil || cnetns != netns {
+					continue
+				}
+				image, _ := c.Rucksack.(string)
+				containers = append(containers, &ContainerDetails{
+					ID:     c.ID,
+					Name:   c.Name,
+					Engine: w.Type(),
+					Image:  image,
+					Labels: c.Labels,
+				})
+			}
+		}
+	}
+	return containers
+}
@@ -7,6 +7,7 @@
 package main
 
 import (
+	"net/netip"
 	"time"
 )
 
@@ -61,4 +62,95 @@ var (
 	// LogRequestHeaders enables logging HTTP/WS request headers to the frontend.
 	// Includes LogRequests.
 	LogRequestHeaders = false
+	// AnonymizationKeyFile ("--anonymization-key-file") optionally specifies a
+	// file with the hex-encoded default key for anonymizing captures.
+	AnonymizationKeyFile = ""
+	// AnonymizationKey is the default key for anonymizing captures, as read
+	// from the AnonymizationKeyFile. If nil, then anonymized captures without
+	// an explicit key use a random per-session key.
+	AnonymizationKey []byte
+	// DockerSocket ("--docker-socket") specifies the path of the Docker engine
+	// API socket for watching containers. If empty or not existing, Docker
+	// containers are not watched.
+	DockerSocket = "/var/run/docker.sock"
+	// ContainerdSocket ("--containerd-socket") specifies the path of the
+	// containerd API socket for watching containers. If empty or not existing,
+	// containerd containers are not watched.
+	ContainerdSocket = "/run/containerd/containerd.sock"
+	// CRISockets ("--cri-socket") specifies the paths of the CRI API sockets
+	// for watching Kubernetes pod containers; non-existing sockets are
+	// skipped. If empty, the DefaultCRISockets are used.
+	CRISockets []string
+	// KillGracePeriod ("--kill-grace") specifies how long to wait for a
+	// capture process to terminate after SIGTERM before sending SIGKILL.
+	KillGracePeriod = DefaultKillGracePeriod
+	// CaptureCgroupParent ("--capture-cgroup") optionally specifies the path
+	// of the (unified hierarchy) parent cgroup in which to create a separate
+	// cgroup for each capture process. If empty, capture processes stay in
+	// Packetflix's cgroup.
+	CaptureCgroupParent = ""
+	// CaptureCPULimit ("--capture-cpu-limit") specifies the maximum number of
+	// CPUs per capture process; zero if unlimited.
+	CaptureCPULimit float64
+	// CaptureMemoryLimit ("--capture-memory-limit") specifies the maximum
+	// memory per capture process in MiB; zero if unlimited.
+	CaptureMemoryLimit uint64
+	// MaxSessions ("--max-sessions") limits the number of concurrent capture
+	// sessions; zero if unlimited.
+	MaxSessions int
+	// MaxSessionsPerClient ("--max-sessions-per-client") limits the number of
+	// concurrent capture sessions per authenticated user or, without
+	// authentication, per client address; zero if unlimited.
+	MaxSessionsPerClient int
+	// MaxSessionsPerNetns ("--max-sessions-per-target") limits the number of
+	// concurrent capture sessions per capture target network namespace; zero
+	// if unlimited.
+	MaxSessionsPerNetns int
+	// SnapshotDir ("--snapshot-dir") optionally specifies the directory where
+	// to save ring buffer snapshots. If empty, snapshots cannot be saved and
+	// ring buffers cannot have triggers.
+	SnapshotDir = ""
+	// RPCAPPort ("--rpcap-port") optionally specifies the TCP port of the
+	// RPCAP server; zero if disabled.
+	RPCAPPort uint16
+	// RPCAPUsersFile ("--rpcap-users") specifies a file with the users allowed
+	// to authenticate with the RPCAP server; required for the RPCAP server.
+	RPCAPUsersFile = ""
+	// S3Endpoint ("--s3-endpoint") optionally specifies the URL of an
+	// S3-compatible object store, such as MinIO; if empty, AWS S3 is used.
+	S3Endpoint = ""
+	// S3Bucket ("--s3-bucket") optionally specifies the bucket to upload
+	// capture segments to. If empty, uploads are disabled.
+	S3Bucket = ""
+	// S3Region ("--s3-region") specifies the region of the object store.
+	S3Region = "us-east-1"
+	// SpoolDir ("--spool-dir") specifies the directory where capture segments
+	// are spooled until they have been uploaded; required for uploads.
+	SpoolDir = ""
+	// SpoolMegabytes ("--spool-megabytes") specifies the maximum total size
+	// in MiB of the spooled capture segments; when exceeded, the oldest
+	// segments get dropped.
+	SpoolMegabytes = uint64(10240)
+	// ReplayDir ("--replay-dir") optionally specifies the directory with the
+	// pcapng files available for replay. If empty, replays are disabled.
+	ReplayDir = ""
+	// InjectPrincipals ("--inject-allow") optionally specifies the principals
+	// allowed to inject packets into capture targets, such as "user:alice". If
+	// empty, packet injection is disabled.
+	InjectPrincipals []string
+	// MirrorCollectors ("--mirror-collector") specifies the collectors that
+	// packets may be mirrored to; the first one is the default collector. If
+	// empty, mirroring is disabled.
+	MirrorCollectors []string
+	// FlowCollectors ("--flow-collector") specifies the IPFIX collectors that
+	// flow records may be exported to; the first one is the default collector.
+	// If empty, flow export is disabled.
+	FlowCollectors []string
+	// TrustedProxies ("--trusted-proxy") optionally specifies the IP addresses
+	// and CIDR prefixes of the authenticating proxies whose headers are
+	// trusted to identify clients. If empty, proxy headers are ignored and
+	// packet injection is disabled.
+	TrustedProxies []string
+	// TrustedProxyPrefixes are the parsed TrustedProxies.
+	TrustedProxyPrefixes []netip.Prefix
 )
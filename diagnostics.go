@@ -0,0 +1,676 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Collects a snapshot of the network configuration and state inside a capture
+// target's network namespace: network interfaces and addresses, routes and
+// routing rules, neighbor tables, sockets, packet filter rules, and network
+// related sysctls. This avoids having to exec into containers, which usually
+// lack the ip and ss tools anyway.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	caps "github.com/syndtr/gocapability/capability"
+	"github.com/thediveo/lxkns/ops"
+	"github.com/thediveo/lxkns/ops/relations"
+	"golang.org/x/sys/unix"
+)
+
+// DiagnosticsCommandTimeout limits how long the external packet filter tools
+// may take to list their rules.
+const DiagnosticsCommandTimeout = 10 * time.Second
+
+// Diagnostics is a snapshot of the network configuration and state inside a
+// network namespace. Parts that cannot be collected are listed in Errors.
+type Diagnostics struct {
+	Netns      uint64            `json:"netns"`
+	Collected  time.Time         `json:"collected"`
+	Interfaces []*DiagInterface  `json:"interfaces"`
+	Routes     []*DiagRoute      `json:"routes"`
+	Rules      []*DiagRule       `json:"rules"`
+	Neighbors  []*DiagNeighbor   `json:"neighbors"`
+	Sockets    []*DiagSocket     `json:"sockets"`
+	Nftables   json.RawMessage   `json:"nftables,omitempty"`  // "nft -j list ruleset" output.
+	Iptables   string            `json:"iptables,omitempty"`  // "iptables-save" output.
+	Ip6tables  string            `json:"ip6tables,omitempty"` // "ip6tables-save" output.
+	Sysctls    map[string]string `json:"sysctls"`
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+// DiagInterface describes a network interface with its addresses.
+type DiagInterface struct {
+	Name      string   `json:"name"`
+	Index     int      `json:"index"`
+	MTU       int      `json:"mtu"`
+	MAC       string   `json:"mac,omitempty"`
+	Flags     []string `json:"flags"`
+	Addresses []string `json:"addresses"` // in CIDR notation.
+}
+
+// DiagRoute describes a route, with multipath routes having next hops instead
+// of a gateway and device.
+type DiagRoute struct {
+	Family   string         `json:"family"`
+	Table    string         `json:"table"`
+	Type     string         `json:"type"`
+	Dst      string         `json:"dst"` // "default" for the default route.
+	Gateway  string         `json:"gateway,omitempty"`
+	Dev      string         `json:"dev,omitempty"`
+	Src      string         `json:"src,omitempty"`
+	Metric   uint32         `json:"metric,omitempty"`
+	Protocol string         `json:"protocol"`
+	Scope    string         `json:"scope"`
+	Nexthops []*DiagNexthop `json:"nexthops,omitempty"`
+}
+
+// DiagNexthop describes a next hop of a multipath route.
+type DiagNexthop struct {
+	Gateway string `json:"gateway,omitempty"`
+	Dev     string `json:"dev,omitempty"`
+	Weight  int    `json:"weight"`
+}
+
+// DiagRule describes a routing policy rule.
+type DiagRule struct {
+	Family   string `json:"family"`
+	Priority uint32 `json:"priority"`
+	Not      bool   `json:"not,omitempty"`
+	Src      string `json:"src,omitempty"`
+	Dst      string `json:"dst,omitempty"`
+	Iif      string `json:"iif,omitempty"`
+	Oif      string `json:"oif,omitempty"`
+	Fwmark   string `json:"fwmark,omitempty"` // "mark/mask" in hex.
+	Action   string `json:"action"`
+	Table    string `json:"table,omitempty"`
+}
+
+// DiagNeighbor describes a neighbor table entry.
+type DiagNeighbor struct {
+	Family  string   `json:"family"`
+	Address string   `json:"address"`
+	LLAddr  string   `json:"lladdr,omitempty"`
+	Dev     string   `json:"dev"`
+	State   []string `json:"state"`
+}
+
+// DiagSocket describes a TCP or UDP socket with its owning process, if known.
+type DiagSocket struct {
+	Protocol string       `json:"protocol"`
+	Local    string       `json:"local"`
+	Remote   string       `json:"remote,omitempty"`
+	State    string       `json:"state"`
+	Inode    uint64       `json:"inode"`
+	Owner    *SocketOwner `json:"owner,omitempty"`
+}
+
+// netlink attribute types used when parsing route, rule, and neighbor
+// messages.
+const (
+	rtaDst       = 1
+	rtaOif       = 4
+	rtaGateway   = 5
+	rtaPriority  = 6
+	rtaPrefSrc   = 7
+	rtaMultipath = 9
+	rtaTable     = 15
+
+	fraDst      = 1
+	fraSrc      = 2
+	fraIifname  = 3
+	fraPriority = 6
+	fraFwmark   = 10
+	fraTable    = 15
+	fraFwmask   = 16
+	fraOifname  = 17
+
+	ndaDst    = 1
+	ndaLLAddr = 2
+)
+
+// routeTypes, routeProtocols, routeScopes, and routeTables name the most
+// common route attribute values in the same way as the ip tool.
+var (
+	routeTypes = map[uint8]string{
+		1: "unicast", 2: "local", 3: "broadcast", 4: "anycast", 5: "multicast",
+		6: "blackhole", 7: "unreachable", 8: "prohibit", 9: "throw", 10: "nat",
+	}
+	routeProtocols = map[uint8]string{
+		1: "redirect", 2: "kernel", 3: "boot", 4: "static", 8: "gated", 9: "ra",
+		11: "zebra", 12: "bird", 16: "dhcp", 186: "bgp", 188: "ospf",
+	}
+	routeScopes = map[uint8]string{
+		0: "global", 200: "site", 253: "link", 254: "host", 255: "nowhere",
+	}
+	routeTables = map[uint32]string{
+		253: "default", 254: "main", 255: "local",
+	}
+)
+
+// neighborStates names the neighbor states in the order of their bits.
+var neighborStates = []string{
+	"INCOMPLETE", "REACHABLE", "STALE", "DELAY", "PROBE", "FAILED", "NOARP", "PERMANENT",
+}
+
+// tcpStates names the TCP socket states as used in /proc/net/tcp*.
+var tcpStates = map[uint64]string{
+	0x01: "ESTABLISHED", 0x02: "SYN-SENT", 0x03: "SYN-RECV", 0x04: "FIN-WAIT-1",
+	0x05: "FIN-WAIT-2", 0x06: "TIME-WAIT", 0x07: "CLOSE", 0x08: "CLOSE-WAIT",
+	0x09: "LAST-ACK", 0x0a: "LISTEN", 0x0b: "CLOSING",
+}
+
+// diagSysctls lists the network namespace specific sysctls to report, if
+// present. Additionally, the forwarding and reverse path filtering sysctls of
+// each network interface get reported.
+var diagSysctls = []string{
+	"net.ipv4.ip_forward",
+	"net.ipv4.conf.all.forwarding",
+	"net.ipv4.conf.all.rp_filter",
+	"net.ipv4.conf.default.rp_filter",
+	"net.ipv4.conf.all.accept_local",
+	"net.ipv4.conf.all.route_localnet",
+	"net.ipv4.conf.all.arp_ignore",
+	"net.ipv4.conf.all.arp_announce",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.ip_unprivileged_port_start",
+	"net.ipv4.ping_group_range",
+	"net.ipv4.tcp_syncookies",
+	"net.ipv6.conf.all.forwarding",
+	"net.ipv6.conf.all.disable_ipv6",
+	"net.ipv6.conf.default.disable_ipv6",
+	"net.core.somaxconn",
+	"net.netfilter.nf_conntrack_count",
+	"net.netfilter.nf_conntrack_max",
+}
+
+// CollectDiagnostics returns a diagnostics snapshot of the specified (locked)
+// network namespace with the specified inode number.
+func CollectDiagnostics(netns relations.Relation, netnsino uint64) (*Diagnostics, error) {
+	res, err := ops.Execute(func() interface{} {
+		d := &Diagnostics{
+			Netns:     netnsino,
+			Collected: time.Now().UTC(),
+			Sysctls:   map[string]string{},
+		}
+		d.collect()
+		return d
+	}, netns)
+	if err != nil {
+		return nil, err
+	}
+	d := res.(*Diagnostics)
+	// The socket owners are determined from the outside, using the processes
+	// attached to the network namespace.
+	tables := readSocketTables(netnsino)
+	for _, sock := range d.Sockets {
+		sock.Owner = tables.owners[sock.Inode]
+	}
+	return d, nil
+}
+
+// collect collects the diagnostics from inside the network namespace, that
+// is, it must be run on an OS thread attached to the network namespace.
+func (d *Diagnostics) collect() {
+	nifnames := d.collectInterfaces()
+	d.collectRoutes(nifnames)
+	d.collectRules()
+	d.collectNeighbors(nifnames)
+	d.collectSockets()
+	d.collectFirewall()
+	d.collectSysctls()
+}
+
+// failed records that the specified part of the diagnostics couldn't be
+// collected.
+func (d *Diagnostics) failed(part string, err error) {
+	d.Errors = append(d.Errors, fmt.Sprintf("%s: %s", part, err.Error()))
+}
+
+// collectInterfaces collects the network interfaces with their addresses,
+// returning the interface names indexed by interface index.
+func (d *Diagnostics) collectInterfaces() map[int]string {
+	nifnames := map[int]string{}
+	d.Interfaces = []*DiagInterface{}
+	nifs, err := net.Interfaces()
+	if err != nil {
+		d.failed("interfaces", err)
+		return nifnames
+	}
+	for _, nif := range nifs {
+		nifnames[nif.Index] = nif.Name
+		info := &DiagInterface{
+			Name:      nif.Name,
+			Index:     nif.Index,
+			MTU:       nif.MTU,
+			MAC:       nif.HardwareAddr.String(),
+			Flags:     []string{},
+			Addresses: []string{},
+		}
+		if nif.Flags != 0 {
+			info.Flags = strings.Split(nif.Flags.String(), "|")
+		}
+		if addrs, err := nif.Addrs(); err == nil {
+			for _, addr := range addrs {
+				info.Addresses = append(info.Addresses, addr.String())
+			}
+		}
+		d.Interfaces = append(d.Interfaces, info)
+	}
+	return nifnames
+}
+
+// collectRoutes collects the IPv4 and IPv6 routes of all routing tables.
+func (d *Diagnostics) collectRoutes(nifnames map[int]string) {
+	d.Routes = []*DiagRoute{}
+	msgs, err := netlinkDump(unix.RTM_GETROUTE)
+	if err != nil {
+		d.failed("routes", err)
+		return
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWROUTE || len(msg.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		// family, dst_len, src_len, tos, table, protocol, scope, type, flags.
+		hdr := msg.Data[:unix.SizeofRtMsg]
+		if hdr[0] != unix.AF_INET && hdr[0] != unix.AF_INET6 {
+			continue
+		}
+		attrs := netlinkAttrs(msg.Data[unix.SizeofRtMsg:])
+		route := &DiagRoute{
+			Family:   familyName(hdr[0]),
+			Table:    tableName(uint32(hdr[4])),
+			Type:     lookupName(routeTypes, hdr[7]),
+			Dst:      "default",
+			Protocol: lookupName(routeProtocols, hdr[5]),
+			Scope:    lookupName(routeScopes, hdr[6]),
+		}
+		if table, ok := attrs[rtaTable]; ok && len(table) >= 4 {
+			route.Table = tableName(hostEndian.Uint32(table))
+		}
+		if dst, ok := attrs[rtaDst]; ok {
+			route.Dst = prefixString(dst, int(hdr[1]))
+		} else if hdr[1] != 0 {
+			route.Dst = fmt.Sprintf("0/%d", hdr[1])
+		}
+		route.Gateway = addrString(attrs[rtaGateway])
+		route.Src = addrString(attrs[rtaPrefSrc])
+		if oif, ok := attrs[rtaOif]; ok && len(oif) >= 4 {
+			route.Dev = nifName(nifnames, int(hostEndian.Uint32(oif)))
+		}
+		if metric, ok := attrs[rtaPriority]; ok && len(metric) >= 4 {
+			route.Metric = hostEndian.Uint32(metric)
+		}
+		// Multipath routes consist of a list of next hops, each with its own
+		// attributes.
+		mp := attrs[rtaMultipath]
+		for len(mp) >= 8 {
+			// len, flags, hops (weight-1), ifindex.
+			nhlen := int(hostEndian.Uint16(mp[0:2]))
+			if nhlen < 8 || nhlen > len(mp) {
+				break
+			}
+			nhattrs := netlinkAttrs(mp[8:nhlen])
+			route.Nexthops = append(route.Nexthops, &DiagNexthop{
+				Gateway: addrString(nhattrs[rtaGateway]),
+				Dev:     nifName(nifnames, int(hostEndian.Uint32(mp[4:8]))),
+				Weight:  int(mp[3]) + 1,
+			})
+			mp = mp[netlinkAlign(nhlen):]
+		}
+		d.Routes = append(d.Routes, route)
+	}
+}
+
+// collectRules collects the IPv4 and IPv6 routing policy rules.
+func (d *Diagnostics) collectRules() {
+	d.Rules = []*DiagRule{}
+	msgs, err := netlinkDump(unix.RTM_GETRULE)
+	if err != nil {
+		d.failed("rules", err)
+		return
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWRULE || len(msg.Data) < 12 {
+			continue
+		}
+		// family, dst_len, src_len, tos, table, res1, res2, action, flags.
+		hdr := msg.Data[:12]
+		if hdr[0] != unix.AF_INET && hdr[0] != unix.AF_INET6 {
+			continue // such as multicast routing rules.
+		}
+		attrs := netlinkAttrs(msg.Data[12:])
+		rule := &DiagRule{
+			Family: familyName(hdr[0]),
+			Not:    hostEndian.Uint32(hdr[8:12])&unix.FIB_RULE_INVERT != 0,
+			Src:    prefixString(attrs[fraSrc], int(hdr[2])),
+			Dst:    prefixString(attrs[fraDst], int(hdr[1])),
+			Iif:    cString(attrs[fraIifname]),
+			Oif:    cString(attrs[fraOifname]),
+		}
+		if prio, ok := attrs[fraPriority]; ok && len(prio) >= 4 {
+			rule.Priority = hostEndian.Uint32(prio)
+		}
+		if mark, ok := attrs[fraFwmark]; ok && len(mark) >= 4 {
+			rule.Fwmark = fmt.Sprintf("0x%x", hostEndian.Uint32(mark))
+			if mask, ok := attrs[fraFwmask]; ok && len(mask) >= 4 {
+				rule.Fwmark += fmt.Sprintf("/0x%x", hostEndian.Uint32(mask))
+			}
+		}
+		switch hdr[7] {
+		case unix.FR_ACT_TO_TBL:
+			rule.Action = "lookup"
+			table := uint32(hdr[4])
+			if t, ok := attrs[fraTable]; ok && len(t) >= 4 {
+				table = hostEndian.Uint32(t)
+			}
+			rule.Table = tableName(table)
+		case unix.FR_ACT_GOTO:
+			rule.Action = "goto"
+		case unix.FR_ACT_NOP:
+			rule.Action = "nop"
+		case unix.FR_ACT_BLACKHOLE:
+			rule.Action = "blackhole"
+		case unix.FR_ACT_UNREACHABLE:
+			rule.Action = "unreachable"
+		case unix.FR_ACT_PROHIBIT:
+			rule.Action = "prohibit"
+		default:
+			rule.Action = strconv.Itoa(int(hdr[7]))
+		}
+		d.Rules = append(d.Rules, rule)
+	}
+}
+
+// collectNeighbors collects the ARP and NDP neighbor table entries.
+func (d *Diagnostics) collectNeighbors(nifnames map[int]string) {
+	d.Neighbors = []*DiagNeighbor{}
+	msgs, err := netlinkDump(unix.RTM_GETNEIGH)
+	if err != nil {
+		d.failed("neighbors", err)
+		return
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWNEIGH || len(msg.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		// family, pad1, pad2, ifindex, state, flags, type.
+		hdr := msg.Data[:unix.SizeofNdMsg]
+		if hdr[0] != unix.AF_INET && hdr[0] != unix.AF_INET6 {
+			continue
+		}
+		attrs := netlinkAttrs(msg.Data[unix.SizeofNdMsg:])
+		neigh := &DiagNeighbor{
+			Family:  familyName(hdr[0]),
+			Address: addrString(attrs[ndaDst]),
+			Dev:     nifName(nifnames, int(hostEndian.Uint32(hdr[4:8]))),
+			State:   []string{},
+		}
+		if lladdr := attrs[ndaLLAddr]; len(lladdr) > 0 {
+			neigh.LLAddr = net.HardwareAddr(lladdr).String()
+		}
+		state := hostEndian.Uint16(hdr[8:10])
+		for bit, name := range neighborStates {
+			if state&(1<<bit) != 0 {
+				neigh.State = append(neigh.State, name)
+			}
+		}
+		d.Neighbors = append(d.Neighbors, neigh)
+	}
+}
+
+// collectSockets collects the TCP and UDP sockets from the socket tables of
+// the network namespace the current OS thread is attached to.
+func (d *Diagnostics) collectSockets() {
+	d.Sockets = []*DiagSocket{}
+	for _, table := range []struct {
+		name  string
+		proto string
+	}{
+		{"tcp", "tcp"}, {"tcp6", "tcp"}, {"udp", "udp"}, {"udp6", "udp"},
+	} {
+		if err := d.readSocketTable("/proc/thread-self/net/"+table.name, table.proto); err != nil {
+			d.failed("sockets", err)
+		}
+	}
+}
+
+// readSocketTable reads the specified /proc/thread-self/net/{tcp,udp}* socket
+// table.
+func (d *Diagnostics) readSocketTable(path string, proto string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // IPv6 disabled.
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // skip header line.
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, err1 := parseProcNetAddr(fields[1])
+		remote, err2 := parseProcNetAddr(fields[2])
+		st, err3 := strconv.ParseUint(fields[3], 16, 8)
+		inode, err4 := strconv.ParseUint(fields[9], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		sock := &DiagSocket{
+			Protocol: proto,
+			Local:    netip.AddrPortFrom(local.Addr().Unmap(), local.Port()).String(),
+			State:    tcpStates[st],
+			Inode:    inode,
+		}
+		if remote.Port() != 0 {
+			sock.Remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port()).String()
+		}
+		if proto == "udp" {
+			// UDP sockets are either connected or not.
+			sock.State = "UNCONN"
+			if st == 0x01 {
+				sock.State = "ESTAB"
+			}
+		}
+		d.Sockets = append(d.Sockets, sock)
+	}
+	return scanner.Err()
+}
+
+// collectFirewall collects the nftables and iptables rules using the nft and
+// {ip,ip6}tables-save tools, if available.
+func (d *Diagnostics) collectFirewall() {
+	// The tools need CAP_NET_ADMIN, yet they aren't privileged binaries.
+	if err := SetAmbient(caps.CAP_NET_ADMIN); err != nil {
+		d.failed("firewall", err)
+		return
+	}
+	if out, err := runDiagnosticsCommand("nft", "-j", "list", "ruleset"); err != nil {
+		d.failed("nftables", err)
+	} else if json.Valid(out) {
+		d.Nftables = out
+	} else {
+		d.failed("nftables", fmt.Errorf("invalid JSON output"))
+	}
+	for _, tool := range []struct {
+		name  string
+		rules *string
+	}{{"iptables-save", &d.Iptables}, {"ip6tables-save", &d.Ip6tables}} {
+		out, err := runDiagnosticsCommand(tool.name)
+		if err != nil {
+			d.failed(tool.name, err)
+			continue
+		}
+		*tool.rules = string(out)
+	}
+}
+
+// runDiagnosticsCommand runs the specified command, returning its output.
+func runDiagnosticsCommand(name string, args ...string) ([]byte, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s not available", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DiagnosticsCommandTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", err.Error(), msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// collectSysctls collects the network namespace specific sysctls, including
+// the per-interface forwarding and reverse path filtering sysctls.
+func (d *Diagnostics) collectSysctls() {
+	sysctls := append([]string{}, diagSysctls...)
+	for _, nif := range d.Interfaces {
+		sysctls = append(sysctls,
+			"net.ipv4.conf."+nif.Name+".forwarding",
+			"net.ipv4.conf."+nif.Name+".rp_filter",
+			"net.ipv6.conf."+nif.Name+".forwarding",
+			"net.ipv6.conf."+nif.Name+".disable_ipv6")
+	}
+	for _, sysctl := range sysctls {
+		// Interface names might contain dots, but not slashes, so we need to
+		// split the sysctl name carefully.
+		elems := strings.SplitN(sysctl, ".", 4)
+		if len(elems) == 4 && elems[2] == "conf" {
+			setting := elems[3][strings.LastIndex(elems[3], ".")+1:]
+			elems = append(elems[:3], strings.TrimSuffix(elems[3], "."+setting), setting)
+		} else {
+			elems = strings.Split(sysctl, ".")
+		}
+		value, err := os.ReadFile("/proc/sys/" + strings.Join(elems, "/"))
+		if err != nil {
+			continue
+		}
+		d.Sysctls[sysctl] = strings.Join(strings.Fields(string(value)), " ")
+	}
+}
+
+// netlinkDump dumps the routing netlink objects of the specified type for all
+// address families in the network namespace the current OS thread is attached
+// to.
+func netlinkDump(msgtype int) ([]syscall.NetlinkMessage, error) {
+	rib, err := syscall.NetlinkRIB(msgtype, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, os.NewSyscallError("netlink", err)
+	}
+	return syscall.ParseNetlinkMessage(rib)
+}
+
+// netlinkAttrs returns the netlink attributes found in the specified octets,
+// indexed by their types. Please note that netlink uses the host's byte order.
+func netlinkAttrs(b []byte) map[uint16][]byte {
+	attrs := map[uint16][]byte{}
+	for len(b) >= unix.SizeofNlAttr {
+		attrlen := int(hostEndian.Uint16(b[0:2]))
+		if attrlen < unix.SizeofNlAttr || attrlen > len(b) {
+			break
+		}
+		attrs[hostEndian.Uint16(b[2:4])&^(unix.NLA_F_NESTED|unix.NLA_F_NET_BYTEORDER)] = b[unix.SizeofNlAttr:attrlen]
+		if netlinkAlign(attrlen) >= len(b) {
+			break
+		}
+		b = b[netlinkAlign(attrlen):]
+	}
+	return attrs
+}
+
+// netlinkAlign returns the specified length aligned to netlink's 4 octets.
+func netlinkAlign(length int) int {
+	return (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
+
+// familyName returns the name of the specified address family, as used by the
+// ip tool.
+func familyName(family uint8) string {
+	switch family {
+	case unix.AF_INET:
+		return "inet"
+	case unix.AF_INET6:
+		return "inet6"
+	}
+	return strconv.Itoa(int(family))
+}
+
+// tableName returns the name of the specified routing table.
+func tableName(table uint32) string {
+	if name, ok := routeTables[table]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(table), 10)
+}
+
+// lookupName returns the name of the specified value, or the value itself if
+// unnamed.
+func lookupName(names map[uint8]string, value uint8) string {
+	if name, ok := names[value]; ok {
+		return name
+	}
+	return strconv.Itoa(int(value))
+}
+
+// nifName returns the name of the network interface with the specified index,
+// or the index itself if unknown.
+func nifName(nifnames map[int]string, index int) string {
+	if name, ok := nifnames[index]; ok {
+		return name
+	}
+	if index == 0 {
+		return ""
+	}
+	return fmt.Sprintf("if%d", index)
+}
+
+// addrString returns the textual representation of the specified IPv4 or IPv6
+// address octets, or an empty string if invalid.
+func addrString(b []byte) string {
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return ""
+	}
+	return addr.String()
+}
+
+// prefixString returns the textual representation of the specified address
+// octets and prefix length, or an empty string if invalid.
+func prefixString(b []byte, bits int) string {
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return ""
+	}
+	return netip.PrefixFrom(addr, bits).String()
+}
+
+// cString returns the specified zero-terminated string octets as a string.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,57 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Handles the /diagnostics API endpoint for taking a snapshot of the network
+// configuration and state of a capture target.
+
+package main
+
+import (
+	"net/http"
+)
+
+// Handle the /diagnostics API endpoint: GET returns a diagnostics snapshot of
+// the network namespace of the capture target specified in the same way as
+// for captures. As collecting diagnostics runs commands inside the target
+// network namespace, diagnostics count against the session quotas.
+func diagnosticsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	conn := NewWSConn()
+	args, err := parseCaptureParams(req, conn)
+	if err != nil {
+		conn.Errorf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if args.NetnsFile != nil {
+		defer args.NetnsFile.Close()
+	}
+	principal := NewClientIdentity(req).Principal()
+	release, err := Sessions.Acquire(principal, uint64(args.Target.NetNS))
+	if err != nil {
+		conn.Errorf("rejecting diagnostics of %s: %s", principal, err.Error())
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+	netns, unlock, err := lockTargetNetns(args, targetNetnsPath(conn, args))
+	if err != nil {
+		conn.Errorf("cannot lock netns:[%d]: %s", args.Target.NetNS, err.Error())
+		http.Error(w, "cannot lock target network namespace", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+	diags, err := CollectDiagnostics(netns, uint64(args.Target.NetNS))
+	if err != nil {
+		conn.Errorf("cannot collect diagnostics of netns:[%d]: %s", args.Target.NetNS, err.Error())
+		http.Error(w, "cannot collect diagnostics", http.StatusInternalServerError)
+		return
+	}
+	conn.Debugf("collected diagnostics of netns:[%d]", args.Target.NetNS)
+	writeJSON(w, http.StatusOK, diags)
+}
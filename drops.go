@@ -0,0 +1,693 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Traces the packets the kernel drops inside a capture target's network
+// namespace, using an eBPF program attached to the kernel's kfree_skb
+// tracepoint. Dropped packets never show up in packet captures, so the drop
+// reports answer the "the packet arrived but the application never saw it"
+// questions. The drops are either injected as annotated packets into the
+// packet capture stream, or sent as JSON text messages.
+//
+// The eBPF program gets assembled at runtime, taking the offsets of the kernel
+// structures it needs to look into from the kernel's BTF information, so
+// there is no need for a compiler toolchain nor for kernel headers.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/gorilla/websocket"
+	pcapng "github.com/siemens/csharg/pcapng"
+	"golang.org/x/sys/unix"
+)
+
+// DropReceiveTimeout specifies how long to wait for drop events before
+// checking whether tracing has been stopped.
+const DropReceiveTimeout = 500 * time.Millisecond
+
+// DropRingBufferSize is the size of the eBPF ring buffer for drop events, so
+// that bursts of drops don't get lost; must be a power of two multiple of the
+// page size.
+const DropRingBufferSize = 1 << 20
+
+// MaxPendingDropEvents limits the number of drop events waiting to be
+// injected into a packet capture stream not yet ready.
+const MaxPendingDropEvents = 1000
+
+// Drop modes, as specified by the "drops" capture parameter.
+const (
+	DropsPackets = "packets" // inject annotated packets.
+	DropsJSON    = "json"    // send JSON text messages.
+)
+
+// Layout of the drop event records the eBPF program writes into its ring
+// buffer: the network and transport layer headers of the dropped packet
+// follow the fixed-size part.
+const (
+	dropEvKtime     = 0  // u64 monotonic time of drop in ns.
+	dropEvLocation  = 8  // u64 kernel address where the packet got dropped.
+	dropEvNetns     = 16 // u32 network namespace inode number.
+	dropEvIfindex   = 20 // u32 network interface index, if any.
+	dropEvReason    = 24 // u32 enum skb_drop_reason.
+	dropEvLen       = 28 // u32 packet length.
+	dropEvProtocol  = 32 // be16 EtherType.
+	dropEvCaplen    = 34 // u16 length of headers.
+	dropEvIfname    = 40 // [16]char network interface name.
+	dropEvHeaders   = 56 // [dropHeadersLen]u8 headers.
+	dropHeadersLen  = 128
+	dropEventSize   = dropEvHeaders + dropHeadersLen
+	dropSLL2HdrLen  = 20
+	dropArphrdNone  = 0xfffe
+	dropReasonMagic = "SKB_DROP_REASON_"
+)
+
+// DropEvent describes a single packet dropped by the kernel.
+type DropEvent struct {
+	Type      string    `json:"type"` // always "drop".
+	Time      time.Time `json:"time"`
+	Reason    string    `json:"reason"`
+	Location  string    `json:"location,omitempty"` // kernel function dropping the packet, if known.
+	Interface string    `json:"interface,omitempty"`
+	Ifindex   uint32    `json:"ifindex,omitempty"`
+	Length    uint32    `json:"length"`
+	Protocol  string    `json:"protocol,omitempty"`  // network layer protocol.
+	Transport string    `json:"transport,omitempty"` // transport layer protocol.
+	Src       string    `json:"src,omitempty"`
+	Dst       string    `json:"dst,omitempty"`
+	SrcPort   uint16    `json:"sport,omitempty"`
+	DstPort   uint16    `json:"dport,omitempty"`
+	Headers   []byte    `json:"headers,omitempty"` // starting with the network layer.
+
+	ethertype uint16
+}
+
+// DropTracer traces the packets the kernel drops inside a particular network
+// namespace.
+type DropTracer struct {
+	events  *ebpf.Map
+	prog    *ebpf.Program
+	link    link.Link
+	reader  *ringbuf.Reader
+	reasons map[uint32]string
+	boot    time.Time // wall clock time of the monotonic clock's zero.
+}
+
+// dropOffsets are the offsets of the kernel structure members the eBPF
+// program needs to read, in octets.
+type dropOffsets struct {
+	skbDev, skbSk, skbHead, skbLen, skbProtocol, skbNetworkHeader, skbTail uint32
+	devIfindex, devName, devNet                                            uint32
+	skNet                                                                  uint32
+	netInum                                                                uint32
+}
+
+// OpenDropTracer starts tracing the packets dropped inside the network
+// namespace with the specified inode number. The tracer needs a kernel 5.17
+// or later with BTF information, as well as CAP_BPF and CAP_PERFMON (or
+// CAP_SYS_ADMIN).
+func OpenDropTracer(netnsino uint64) (t *DropTracer, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cannot trace packet drops: %w", err)
+		}
+	}()
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := kernelDropOffsets(spec)
+	if err != nil {
+		return nil, err
+	}
+	reasons, consumed, err := kernelDropReasons(spec)
+	if err != nil {
+		return nil, err
+	}
+	// Older kernels account eBPF memory against the locked memory limit.
+	_ = rlimit.RemoveMemlock()
+	t = &DropTracer{reasons: reasons}
+	defer func() {
+		if err != nil {
+			t.Close()
+		}
+	}()
+	t.events, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "pfx_drops",
+		Type:       ebpf.RingBuf,
+		MaxEntries: DropRingBufferSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.prog, err = ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "pfx_kfree_skb",
+		Type:         ebpf.RawTracepoint,
+		License:      "Dual MIT/GPL",
+		Instructions: dropProgram(offsets, t.events.FD(), uint32(netnsino), consumed),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.link, err = link.AttachRawTracepoint(link.RawTracepointOptions{
+		Name:    "kfree_skb",
+		Program: t.prog,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.reader, err = ringbuf.NewReader(t.events)
+	if err != nil {
+		return nil, err
+	}
+	var mono, wall unix.Timespec
+	_ = unix.ClockGettime(unix.CLOCK_MONOTONIC, &mono)
+	_ = unix.ClockGettime(unix.CLOCK_REALTIME, &wall)
+	t.boot = time.Unix(0, wall.Nano()-mono.Nano())
+	return t, nil
+}
+
+// Receive returns the next drop event, or nil if the receive timeout passed.
+func (t *DropTracer) Receive() (*DropEvent, error) {
+	t.reader.SetDeadline(time.Now().Add(DropReceiveTimeout))
+	rec, err := t.reader.Read()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.parse(rec.RawSample), nil
+}
+
+// Close stops tracing and releases the eBPF program and ring buffer.
+func (t *DropTracer) Close() error {
+	if t.reader != nil {
+		t.reader.Close()
+	}
+	if t.link != nil {
+		t.link.Close()
+	}
+	if t.prog != nil {
+		t.prog.Close()
+	}
+	if t.events != nil {
+		t.events.Close()
+	}
+	return nil
+}
+
+// parse returns the drop event from the specified ring buffer record.
+func (t *DropTracer) parse(b []byte) *DropEvent {
+	if len(b) < dropEventSize {
+		return nil
+	}
+	reason := hostEndian.Uint32(b[dropEvReason:])
+	event := &DropEvent{
+		Type:      "drop",
+		Time:      t.boot.Add(time.Duration(hostEndian.Uint64(b[dropEvKtime:]))),
+		Reason:    t.reasons[reason],
+		Location:  kernelSymbol(hostEndian.Uint64(b[dropEvLocation:])),
+		Interface: cString(b[dropEvIfname : dropEvIfname+16]),
+		Ifindex:   hostEndian.Uint32(b[dropEvIfindex:]),
+		Length:    hostEndian.Uint32(b[dropEvLen:]),
+		ethertype: binary.BigEndian.Uint16(b[dropEvProtocol:]),
+	}
+	if event.Reason == "" {
+		event.Reason = strconv.FormatUint(uint64(reason), 10)
+	}
+	caplen := int(hostEndian.Uint16(b[dropEvCaplen:]))
+	if caplen > dropHeadersLen {
+		caplen = dropHeadersLen
+	}
+	event.Headers = append([]byte{}, b[dropEvHeaders:dropEvHeaders+caplen]...)
+	// Packets on their way out might not have their protocol set yet, so
+	// fall back to the IP version.
+	if event.ethertype == 0 && caplen > 0 {
+		switch event.Headers[0] >> 4 {
+		case 4:
+			event.ethertype = EtherTypeIPv4
+		case 6:
+			event.ethertype = EtherTypeIPv6
+		}
+	}
+	switch event.ethertype {
+	case EtherTypeIPv4:
+		event.Protocol = "ipv4"
+	case EtherTypeIPv6:
+		event.Protocol = "ipv6"
+	case EtherTypeARP:
+		event.Protocol = "arp"
+	case 0:
+	default:
+		event.Protocol = fmt.Sprintf("0x%04x", event.ethertype)
+	}
+	// The skb length counts from where the kernel currently is in the
+	// packet, so prefer the length from the IP header.
+	p := &PacketLayers{Data: event.Headers, L3Offset: -1, L4Offset: -1}
+	p.network(event.ethertype, 0)
+	switch p.L3Proto {
+	case EtherTypeIPv4:
+		event.Length = uint32(binary.BigEndian.Uint16(p.Data[2:4]))
+	case EtherTypeIPv6:
+		event.Length = 40 + uint32(binary.BigEndian.Uint16(p.Data[4:6]))
+	}
+	if event.Length < uint32(caplen) {
+		event.Length = uint32(caplen)
+	}
+	if src, dst := p.Addresses(); src != nil {
+		event.Src, event.Dst = src.String(), dst.String()
+	}
+	if p.L4Offset >= 0 {
+		event.Transport = transportName(p.L4Proto)
+		if p.L4Offset+4 <= len(p.Data) {
+			event.SrcPort, event.DstPort = p.Ports()
+		}
+	}
+	return event
+}
+
+// dropProgram returns the eBPF program for the kfree_skb raw tracepoint,
+// writing drop event records for the packets dropped in the network namespace
+// with the specified inode number into the ring buffer map. Packets freed
+// with a drop reason up to the specified "consumed" reason weren't dropped.
+func dropProgram(o *dropOffsets, events int, netnsino uint32, consumed uint64) asm.Instructions {
+	const (
+		ev      = int16(-dropEventSize) // stack offset of the event record.
+		scratch = ev - 8                // ...of a kernel pointer just read.
+		hdr     = ev - 16               // ...of the network header and tail offsets.
+	)
+	// The raw tracepoint arguments are: skb, location, reason.
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R7, asm.R6, 0, asm.DWord),
+		asm.LoadMem(asm.R8, asm.R6, 16, asm.DWord),
+		asm.JLE.Imm(asm.R8, int32(consumed), "exit"),
+	}
+	for off := hdr; off < 0; off += 8 {
+		insns = append(insns, asm.StoreImm(asm.RFP, off, 0, asm.DWord))
+	}
+	insns = append(insns,
+		asm.StoreMem(asm.RFP, ev+dropEvReason, asm.R8, asm.Word),
+		asm.LoadMem(asm.R0, asm.R6, 8, asm.DWord),
+		asm.StoreMem(asm.RFP, ev+dropEvLocation, asm.R0, asm.DWord),
+	)
+	// The network namespace is taken from the network device, if any, or
+	// otherwise from the socket.
+	insns = append(insns, probeRead(scratch, 8, asm.R7, o.skbDev)...)
+	insns = append(insns,
+		asm.LoadMem(asm.R9, asm.RFP, scratch, asm.DWord),
+		asm.JEq.Imm(asm.R9, 0, "nodev"),
+	)
+	insns = append(insns, probeRead(ev+dropEvIfindex, 4, asm.R9, o.devIfindex)...)
+	insns = append(insns, probeRead(ev+dropEvIfname, 16, asm.R9, o.devName)...)
+	insns = append(insns, probeRead(scratch, 8, asm.R9, o.devNet)...)
+	insns = append(insns, asm.Ja.Label("netns"))
+	nodev := probeRead(scratch, 8, asm.R7, o.skbSk)
+	nodev[0] = nodev[0].WithSymbol("nodev")
+	insns = append(insns, nodev...)
+	insns = append(insns,
+		asm.LoadMem(asm.R9, asm.RFP, scratch, asm.DWord),
+		asm.JEq.Imm(asm.R9, 0, "exit"),
+	)
+	insns = append(insns, probeRead(scratch, 8, asm.R9, o.skNet)...)
+	insns = append(insns,
+		asm.LoadMem(asm.R9, asm.RFP, scratch, asm.DWord).WithSymbol("netns"),
+		asm.JEq.Imm(asm.R9, 0, "exit"),
+	)
+	insns = append(insns, probeRead(ev+dropEvNetns, 4, asm.R9, o.netInum)...)
+	insns = append(insns,
+		asm.LoadMem(asm.R0, asm.RFP, ev+dropEvNetns, asm.Word),
+		asm.LoadImm(asm.R1, int64(netnsino), asm.DWord),
+		asm.JNE.Reg(asm.R0, asm.R1, "exit"),
+	)
+	// Copy the network and transport layer headers, as far as present.
+	insns = append(insns, probeRead(ev+dropEvLen, 4, asm.R7, o.skbLen)...)
+	insns = append(insns, probeRead(ev+dropEvProtocol, 2, asm.R7, o.skbProtocol)...)
+	insns = append(insns, probeRead(hdr, 2, asm.R7, o.skbNetworkHeader)...)
+	insns = append(insns, probeRead(hdr+4, 4, asm.R7, o.skbTail)...)
+	insns = append(insns, probeRead(scratch, 8, asm.R7, o.skbHead)...)
+	insns = append(insns,
+		asm.LoadMem(asm.R3, asm.RFP, hdr, asm.Half),
+		asm.JEq.Imm(asm.R3, 0xffff, "emit"),
+		asm.LoadMem(asm.R2, asm.RFP, hdr+4, asm.Word),
+		asm.JLE.Reg(asm.R2, asm.R3, "emit"),
+		asm.Sub.Reg(asm.R2, asm.R3),
+		asm.JLE.Imm(asm.R2, dropHeadersLen, "caplen"),
+		asm.Mov.Imm(asm.R2, dropHeadersLen),
+		asm.StoreMem(asm.RFP, ev+dropEvCaplen, asm.R2, asm.Half).WithSymbol("caplen"),
+		asm.LoadMem(asm.R1, asm.RFP, scratch, asm.DWord),
+		asm.Add.Reg(asm.R3, asm.R1),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, int32(ev+dropEvHeaders)),
+		asm.FnProbeReadKernel.Call(),
+		asm.JSGE.Imm(asm.R0, 0, "emit"),
+		asm.StoreImm(asm.RFP, ev+dropEvCaplen, 0, asm.Half),
+		// Finally timestamp and emit the drop event record.
+		asm.FnKtimeGetNs.Call().WithSymbol("emit"),
+		asm.StoreMem(asm.RFP, ev+dropEvKtime, asm.R0, asm.DWord),
+		asm.LoadMapPtr(asm.R1, events),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, int32(ev)),
+		asm.Mov.Imm(asm.R3, dropEventSize),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnRingbufOutput.Call(),
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("exit"),
+		asm.Return(),
+	)
+	return insns
+}
+
+// probeRead returns the instructions for reading the specified number of
+// octets from the kernel memory at the specified offset from the pointer in
+// the src register into the stack at the specified offset. The instructions
+// clobber the registers R0 to R5.
+func probeRead(stackoff int16, size int32, src asm.Register, offset uint32) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, int32(stackoff)),
+		asm.Mov.Imm(asm.R2, size),
+		asm.Mov.Reg(asm.R3, src),
+		asm.Add.Imm(asm.R3, int32(offset)),
+		asm.FnProbeReadKernel.Call(),
+	}
+}
+
+// kernelDropOffsets returns the offsets of the kernel structure members the
+// eBPF drop tracing program needs, as found in the kernel's BTF information.
+func kernelDropOffsets(spec *btf.Spec) (*dropOffsets, error) {
+	o := &dropOffsets{}
+	for _, member := range []struct {
+		offset *uint32
+		typ    string
+		path   []string
+	}{
+		{&o.skbDev, "sk_buff", []string{"dev"}},
+		{&o.skbSk, "sk_buff", []string{"sk"}},
+		{&o.skbHead, "sk_buff", []string{"head"}},
+		{&o.skbLen, "sk_buff", []string{"len"}},
+		{&o.skbProtocol, "sk_buff", []string{"protocol"}},
+		{&o.skbNetworkHeader, "sk_buff", []string{"network_header"}},
+		{&o.skbTail, "sk_buff", []string{"tail"}},
+		{&o.devIfindex, "net_device", []string{"ifindex"}},
+		{&o.devName, "net_device", []string{"name"}},
+		{&o.devNet, "net_device", []string{"nd_net", "net"}},
+		{&o.skNet, "sock", []string{"__sk_common", "skc_net", "net"}},
+		{&o.netInum, "net", []string{"ns", "inum"}},
+	} {
+		offset, typ, err := btfMemberOffset(spec, member.typ, member.path...)
+		if err != nil {
+			return nil, err
+		}
+		// The eBPF program expects the skb's header positions to be offsets
+		// instead of pointers.
+		if member.offset == &o.skbTail {
+			if size, err := btf.Sizeof(typ); err != nil || size != 4 {
+				return nil, errors.New("unsupported sk_buff tail type")
+			}
+		}
+		*member.offset = offset
+	}
+	return o, nil
+}
+
+// btfMemberOffset returns the offset in octets and the type of the member at
+// the specified path inside the named kernel struct, looking also into
+// anonymous struct and union members.
+func btfMemberOffset(spec *btf.Spec, typename string, path ...string) (uint32, btf.Type, error) {
+	var s *btf.Struct
+	if err := spec.TypeByName(typename, &s); err != nil {
+		return 0, nil, err
+	}
+	var typ btf.Type = s
+	offset := uint32(0)
+	for _, name := range path {
+		off, mtyp, ok := btfMember(btf.UnderlyingType(typ), name)
+		if !ok {
+			return 0, nil, fmt.Errorf("kernel struct %s lacks member %s",
+				typename, strings.Join(path, "."))
+		}
+		offset += off
+		typ = mtyp
+	}
+	return offset, typ, nil
+}
+
+// btfMember returns the offset in octets and the type of the named member of
+// the specified struct or union type.
+func btfMember(typ btf.Type, name string) (uint32, btf.Type, bool) {
+	var members []btf.Member
+	switch t := typ.(type) {
+	case *btf.Struct:
+		members = t.Members
+	case *btf.Union:
+		members = t.Members
+	default:
+		return 0, nil, false
+	}
+	for _, m := range members {
+		if m.Name == name {
+			return m.Offset.Bytes(), m.Type, true
+		}
+		if m.Name == "" {
+			if off, mtyp, ok := btfMember(btf.UnderlyingType(m.Type), name); ok {
+				return m.Offset.Bytes() + off, mtyp, true
+			}
+		}
+	}
+	return 0, nil, false
+}
+
+// kernelDropReasons returns the names of the kernel's packet drop reasons, as
+// well as the reason value for packets that were consumed instead of dropped.
+func kernelDropReasons(spec *btf.Spec) (map[uint32]string, uint64, error) {
+	var reasons *btf.Enum
+	if err := spec.TypeByName("skb_drop_reason", &reasons); err != nil {
+		return nil, 0, err
+	}
+	names := map[uint32]string{}
+	consumed := uint64(0)
+	for _, value := range reasons.Values {
+		names[uint32(value.Value)] = strings.TrimPrefix(value.Name, dropReasonMagic)
+		if value.Name == "SKB_CONSUMED" {
+			consumed = value.Value
+		}
+	}
+	return names, consumed, nil
+}
+
+// kernelSymbols maps kernel text addresses to their function names, as read
+// once from /proc/kallsyms.
+var kernelSymbols struct {
+	once  sync.Once
+	addrs []uint64
+	names []string
+}
+
+// kernelSymbol returns the kernel function containing the specified address,
+// in the form "function+0xoffset", or an empty string if unknown. Raw kernel
+// addresses aren't returned, as they would defeat KASLR.
+func kernelSymbol(addr uint64) string {
+	kernelSymbols.once.Do(loadKernelSymbols)
+	idx := sort.Search(len(kernelSymbols.addrs), func(i int) bool {
+		return kernelSymbols.addrs[i] > addr
+	}) - 1
+	if idx < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s+0x%x", kernelSymbols.names[idx], addr-kernelSymbols.addrs[idx])
+}
+
+// loadKernelSymbols reads the kernel text symbols. Without sufficient
+// privileges, the kernel reports all addresses as zero, so the symbols are
+// useless and thus ignored.
+func loadKernelSymbols() {
+	f, err := os.Open("/proc/kallsyms")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	type symbol struct {
+		addr uint64
+		name string
+	}
+	symbols := []symbol{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || (fields[1] != "t" && fields[1] != "T") {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil || addr == 0 {
+			continue
+		}
+		symbols = append(symbols, symbol{addr: addr, name: fields[2]})
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].addr < symbols[j].addr })
+	kernelSymbols.addrs = make([]uint64, len(symbols))
+	kernelSymbols.names = make([]string, len(symbols))
+	for idx, sym := range symbols {
+		kernelSymbols.addrs[idx], kernelSymbols.names[idx] = sym.addr, sym.name
+	}
+}
+
+// DropMonitor receives the drop events from its tracer and hands them to its
+// emitter.
+type DropMonitor struct {
+	conn   *WSConn
+	tracer *DropTracer
+	drops  uint64
+}
+
+// NewDropMonitor returns a new packet drop monitor for the specified tracer.
+func NewDropMonitor(conn *WSConn, tracer *DropTracer) *DropMonitor {
+	return &DropMonitor{conn: conn, tracer: tracer}
+}
+
+// Run hands the drop events to the specified emitter until the done channel
+// gets closed, the emitter fails, or the tracer fails. Whenever the receive
+// timeout passes without any drop event, the emitter gets a nil event, so
+// that it can flush any pending events.
+func (m *DropMonitor) Run(done <-chan struct{}, emit func(*DropEvent) error) error {
+	defer func() {
+		m.conn.Debugf("traced %d packet drops", m.drops)
+	}()
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		event, err := m.tracer.Receive()
+		if err != nil {
+			return err
+		}
+		if event != nil {
+			m.drops++
+		}
+		if err := emit(event); err != nil {
+			return err
+		}
+	}
+}
+
+// DropInjector injects drop events as annotated packets of an additional
+// "drops" interface into a packet capture stream. The dropped packets have
+// Linux cooked capture v2 headers, followed by the network and transport
+// layer headers; their comments give the drop reason, location, and network
+// interface.
+type DropInjector struct {
+	stream  *BlockStream
+	nifs    int          // number of interfaces from the capture process.
+	id      uint32       // interface ID of the drops interface.
+	ready   bool         // drops interface has been announced.
+	pending []*DropEvent // events waiting for the stream to become ready.
+}
+
+// NewDropInjector returns a new injector of drop events into the specified
+// packet capture stream, which gets the specified number of interfaces from
+// the capture process.
+func NewDropInjector(stream *BlockStream, nifs int) *DropInjector {
+	return &DropInjector{stream: stream, nifs: nifs}
+}
+
+// Emit injects the specified drop event, or keeps it pending as long as the
+// capture process hasn't announced all its interfaces yet, so that the drops
+// interface doesn't get in their way. Pending events beyond the limit get
+// dropped. A nil event just injects the pending events, if possible.
+func (i *DropInjector) Emit(event *DropEvent) error {
+	if event != nil && len(i.pending) < MaxPendingDropEvents {
+		i.pending = append(i.pending, event)
+	}
+	if len(i.pending) == 0 {
+		return nil
+	}
+	endian, nifs := i.stream.Section()
+	if endian == nil {
+		return nil
+	}
+	blks := make([]*Block, 0, len(i.pending)+1)
+	if !i.ready {
+		if len(nifs) < i.nifs {
+			return nil
+		}
+		i.id = uint32(len(nifs))
+		body := make([]byte, 8)
+		endian.PutUint16(body[0:2], LinkTypeLinuxSLL2)
+		endian.PutUint32(body[4:8], dropSLL2HdrLen+dropHeadersLen)
+		body = append(body, OptionsBytes([]*pcapng.Option{
+			{Code: pcapng.OptComment, Value: []byte("packets dropped by the kernel, traced by packetflix")},
+			{Code: OptIfName, Value: []byte("drops")},
+			{Code: OptIfTsResol, Value: []byte{9}},
+		}, endian)...)
+		blks = append(blks, &Block{Type: BlockTypeIDB, Body: body})
+	}
+	for _, event := range i.pending {
+		blks = append(blks, i.packet(event, endian))
+	}
+	if i.stream.Inject(blks...) {
+		i.ready = true
+		i.pending = nil
+	}
+	return nil
+}
+
+// packet returns the Enhanced Packet Block for the specified drop event.
+func (i *DropInjector) packet(event *DropEvent, endian binary.ByteOrder) *Block {
+	data := make([]byte, dropSLL2HdrLen, dropSLL2HdrLen+len(event.Headers))
+	binary.BigEndian.PutUint16(data[0:2], event.ethertype)
+	binary.BigEndian.PutUint32(data[4:8], event.Ifindex)
+	binary.BigEndian.PutUint16(data[8:10], dropArphrdNone)
+	data = append(data, event.Headers...)
+	comment := "dropped: reason=" + event.Reason
+	if event.Location != "" {
+		comment += " location=" + event.Location
+	}
+	if event.Interface != "" {
+		comment += " dev=" + event.Interface
+	}
+	pkt := &EnhancedPacket{
+		InterfaceID: i.id,
+		Timestamp:   timeToTicks(event.Time, 9),
+		OrigLen:     dropSLL2HdrLen + event.Length,
+		Data:        data,
+		Options:     []*pcapng.Option{{Code: pcapng.OptComment, Value: []byte(comment)}},
+	}
+	return pkt.Block(endian)
+}
+
+// DropJSONEmitter returns an emitter sending drop events as JSON text
+// messages over the specified websocket connection. Similar to the capture
+// statistics, failing to send a message doesn't stop the tracing, as the
+// capture might still be winding down.
+func DropJSONEmitter(conn *WSConn) func(*DropEvent) error {
+	return func(event *DropEvent) error {
+		if event == nil {
+			return nil
+		}
+		j, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_ = conn.WriteMessage(websocket.TextMessage, j)
+		return nil
+	}
+}
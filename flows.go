@@ -0,0 +1,373 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Aggregates captured packets into unidirectional flow records and exports
+// them as IPFIX (RFC 7011) over UDP to a collector, instead of streaming the
+// packets to the capture client. Flow records additionally carry the identity
+// of the capture target in enterprise-specific information elements.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Flow export defaults and limits.
+const (
+	IPFIXPort                  = 4739             // well-known IPFIX port.
+	DefaultFlowActiveTimeout   = 60 * time.Second // exports long-lasting flows periodically.
+	DefaultFlowInactiveTimeout = 15 * time.Second // exports flows without packets.
+	MaxFlowTimeout             = 3600             // maximum timeout in seconds.
+	MaxFlows                   = 65536            // maximum number of flows tracked at a time.
+	FlowExportInterval         = time.Second      // how often to check for expired flows.
+	IPFIXTemplateInterval      = time.Minute      // how often to resend templates.
+	IPFIXMaxMessageSize        = 1400             // stay below common path MTUs.
+	IPFIXMaxNameLen            = 255              // maximum length of exported target names.
+)
+
+// SiemensPEN is the IANA private enterprise number of Siemens AG, used for the
+// enterprise-specific information elements.
+const SiemensPEN = uint32(4329)
+
+// Enterprise-specific information elements identifying the capture target.
+const (
+	IETargetName  = uint16(1) // name of the capture target, with prefix if any (string).
+	IETargetType  = uint16(2) // type of the capture target (string).
+	IETargetNetns = uint16(3) // inode number of the target's network namespace (unsigned64).
+)
+
+// IPFIX template IDs for IPv4 and IPv6 flows.
+const (
+	IPFIXTemplateIPv4 = uint16(256)
+	IPFIXTemplateIPv6 = uint16(257)
+)
+
+// IPFIX flow end reasons.
+const (
+	FlowEndIdle   = uint8(1)
+	FlowEndActive = uint8(2)
+	FlowEndOfFlow = uint8(3)
+	FlowEndForced = uint8(4)
+)
+
+// ipfixField is an IPFIX field specifier; enterprise-specific if pen is
+// non-zero. Variable-length fields have a length of 0xffff.
+type ipfixField struct {
+	id     uint16
+	length uint16
+	pen    uint32
+}
+
+// ipfixFields returns the field specifiers of the IPv4 or IPv6 flow template.
+func ipfixFields(ipv6 bool) []ipfixField {
+	fields := []ipfixField{{8, 4, 0}, {12, 4, 0}} // sourceIPv4Address, destinationIPv4Address
+	if ipv6 {
+		fields = []ipfixField{{27, 16, 0}, {28, 16, 0}} // sourceIPv6Address, destinationIPv6Address
+	}
+	return append(fields,
+		ipfixField{7, 2, 0},   // sourceTransportPort
+		ipfixField{11, 2, 0},  // destinationTransportPort
+		ipfixField{4, 1, 0},   // protocolIdentifier
+		ipfixField{6, 2, 0},   // tcpControlBits
+		ipfixField{1, 8, 0},   // octetDeltaCount
+		ipfixField{2, 8, 0},   // packetDeltaCount
+		ipfixField{152, 8, 0}, // flowStartMilliseconds
+		ipfixField{153, 8, 0}, // flowEndMilliseconds
+		ipfixField{136, 1, 0}, // flowEndReason
+		ipfixField{IETargetName, 0xffff, SiemensPEN},
+		ipfixField{IETargetType, 0xffff, SiemensPEN},
+		ipfixField{IETargetNetns, 8, SiemensPEN},
+	)
+}
+
+// flowKey identifies a unidirectional flow.
+type flowKey struct {
+	src, dst         netip.Addr
+	srcPort, dstPort uint16
+	proto            uint8
+}
+
+// flow is the state of a unidirectional flow.
+type flow struct {
+	start, end time.Time // timestamps of the first and last packets.
+	seen       time.Time // when the last packet was seen.
+	octets     uint64
+	packets    uint64
+	tcpFlags   uint8
+	ended      bool // FIN or RST seen.
+}
+
+// FlowExporter is a pcapng block editor aggregating the captured packets into
+// flows, which get exported as IPFIX flow records to a collector. All blocks
+// pass unchanged.
+type FlowExporter struct {
+	conn     *WSConn
+	sock     net.Conn
+	active   time.Duration
+	inactive time.Duration
+	identity []byte // encoded capture target identity fields.
+
+	mu        sync.Mutex
+	flows     map[flowKey]*flow
+	overflows uint64 // packets not accounted for as there were too many flows.
+	seq       uint32 // number of data records exported so far.
+	templates time.Time
+	exported  uint64 // number of flow records exported.
+}
+
+// NewFlowExporter returns a new flow exporter sending flow records to the
+// specified collector, which is either a host name or address, or a host with
+// port, defaulting to the well-known IPFIX port.
+func NewFlowExporter(conn *WSConn, collector string, args *Args) (*FlowExporter, error) {
+	addr := collector
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(IPFIXPort))
+	}
+	sock, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach collector %s: %s", collector, err.Error())
+	}
+	name := args.Target.Name
+	if args.Target.Prefix != "" {
+		name = args.Target.Prefix + ":" + name
+	}
+	// Keep the target identity short enough for data records to always fit
+	// into IPFIX messages.
+	if len(name) > IPFIXMaxNameLen {
+		name = name[:IPFIXMaxNameLen]
+	}
+	identity := ipfixString(nil, name)
+	identity = ipfixString(identity, args.Target.Type)
+	identity = binary.BigEndian.AppendUint64(identity, uint64(args.Target.NetNS))
+	return &FlowExporter{
+		conn:     conn,
+		sock:     sock,
+		active:   args.FlowActiveTimeout,
+		inactive: args.FlowInactiveTimeout,
+		identity: identity,
+		flows:    map[flowKey]*flow{},
+	}, nil
+}
+
+// EditBlock accounts for packet blocks in their flows, passing all blocks on
+// unchanged.
+func (x *FlowExporter) EditBlock(s *BlockStream, blk *Block) []*Block {
+	if blk.Type != BlockTypeEPB {
+		return []*Block{blk}
+	}
+	pkt := ParseEnhancedPacket(blk, s.Endian)
+	if pkt == nil {
+		return []*Block{blk}
+	}
+	nif := s.Interface(pkt.InterfaceID)
+	if nif == nil {
+		return []*Block{blk}
+	}
+	p := DecodePacket(nif.LinkType, pkt.Data)
+	if p.L3Offset < 0 || (p.L3Proto != EtherTypeIPv4 && p.L3Proto != EtherTypeIPv6) {
+		return []*Block{blk}
+	}
+	src, dst := p.Addresses()
+	key := flowKey{proto: p.L4Proto}
+	key.src, _ = netip.AddrFromSlice(src)
+	key.dst, _ = netip.AddrFromSlice(dst)
+	key.src, key.dst = key.src.Unmap(), key.dst.Unmap()
+	if p.L4Offset >= 0 {
+		key.srcPort, key.dstPort = p.Ports()
+	}
+	// Account for the original IP packet lengths, as the captured packet data
+	// might have been truncated.
+	var octets uint64
+	if p.L3Proto == EtherTypeIPv4 {
+		octets = uint64(binary.BigEndian.Uint16(p.Data[p.L3Offset+2:]))
+	} else {
+		octets = uint64(binary.BigEndian.Uint16(p.Data[p.L3Offset+4:])) + 40
+	}
+	var tcpFlags uint8
+	if p.L4Proto == IPProtoTCP && p.L4Offset >= 0 && len(p.Data) > p.L4Offset+13 {
+		tcpFlags = p.Data[p.L4Offset+13]
+	}
+	ts := time.Unix(0, int64(ticksToNanos(pkt.Timestamp, nif.TsResol)))
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	f, ok := x.flows[key]
+	if !ok {
+		if len(x.flows) >= MaxFlows {
+			x.overflows++
+			return []*Block{blk}
+		}
+		f = &flow{start: ts}
+		x.flows[key] = f
+	}
+	f.end = ts
+	f.seen = time.Now()
+	f.octets += octets
+	f.packets++
+	f.tcpFlags |= tcpFlags
+	if tcpFlags&0x05 != 0 { // FIN or RST
+		f.ended = true
+	}
+	return []*Block{blk}
+}
+
+// Run periodically exports expired flows until the specified channel gets
+// closed, then exports all remaining flows.
+func (x *FlowExporter) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(FlowExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			x.export(false)
+		case <-done:
+			x.export(true)
+			return
+		}
+	}
+}
+
+// export exports the flows that have ended, have been inactive for too long,
+// or have been active for too long; or all flows if forced to.
+func (x *FlowExporter) export(force bool) {
+	now := time.Now()
+	x.mu.Lock()
+	var v4, v6 []byte
+	for key, f := range x.flows {
+		reason := FlowEndForced
+		switch {
+		case f.ended:
+			reason = FlowEndOfFlow
+		case now.Sub(f.seen) >= x.inactive:
+			reason = FlowEndIdle
+		case f.end.Sub(f.start) >= x.active:
+			reason = FlowEndActive
+		case !force:
+			continue
+		}
+		if f.packets == 0 {
+			// Nothing left to export after an active timeout.
+			delete(x.flows, key)
+			continue
+		}
+		if key.src.Is4() {
+			v4 = x.record(v4, key, f, reason)
+		} else {
+			v6 = x.record(v6, key, f, reason)
+		}
+		x.exported++
+		if reason == FlowEndActive {
+			// Long-lasting flows continue with a fresh record.
+			*f = flow{start: f.end, end: f.end, seen: f.seen}
+			continue
+		}
+		delete(x.flows, key)
+	}
+	x.mu.Unlock()
+	x.send(IPFIXTemplateIPv4, v4, 4+4+2+2+1+2+8+8+8+8+1)
+	x.send(IPFIXTemplateIPv6, v6, 16+16+2+2+1+2+8+8+8+8+1)
+}
+
+// record appends the IPFIX data record of the specified flow.
+func (x *FlowExporter) record(b []byte, key flowKey, f *flow, reason uint8) []byte {
+	b = append(b, key.src.AsSlice()...)
+	b = append(b, key.dst.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, key.srcPort)
+	b = binary.BigEndian.AppendUint16(b, key.dstPort)
+	b = append(b, key.proto)
+	b = binary.BigEndian.AppendUint16(b, uint16(f.tcpFlags))
+	b = binary.BigEndian.AppendUint64(b, f.octets)
+	b = binary.BigEndian.AppendUint64(b, f.packets)
+	b = binary.BigEndian.AppendUint64(b, uint64(f.start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(f.end.UnixMilli()))
+	b = append(b, reason)
+	return append(b, x.identity...)
+}
+
+// send sends the specified data records of the specified template in as many
+// IPFIX messages as necessary, preceded by the templates when due. fixedlen
+// is the length of the fixed-length fields of each record.
+func (x *FlowExporter) send(template uint16, records []byte, fixedlen int) {
+	reclen := fixedlen + len(x.identity)
+	if IPFIXMaxMessageSize-16-len(ipfixTemplateSet())-4 < reclen {
+		x.conn.Errorf("cannot export flow records: records too large for IPFIX messages")
+		return
+	}
+	for len(records) > 0 {
+		var sets []byte
+		if time.Since(x.templates) >= IPFIXTemplateInterval {
+			sets = ipfixTemplateSet()
+			x.templates = time.Now()
+		}
+		n := len(records) / reclen
+		if fit := (IPFIXMaxMessageSize - 16 - len(sets) - 4) / reclen; n > fit {
+			n = fit
+		}
+		sets = binary.BigEndian.AppendUint16(sets, template)
+		sets = binary.BigEndian.AppendUint16(sets, uint16(4+n*reclen))
+		sets = append(sets, records[:n*reclen]...)
+		records = records[n*reclen:]
+		msg := make([]byte, 16, 16+len(sets))
+		binary.BigEndian.PutUint16(msg[0:2], 10) // IPFIX version
+		binary.BigEndian.PutUint16(msg[2:4], uint16(16+len(sets)))
+		binary.BigEndian.PutUint32(msg[4:8], uint32(time.Now().Unix()))
+		binary.BigEndian.PutUint32(msg[8:12], x.seq)
+		binary.BigEndian.PutUint32(msg[12:16], 1) // observation domain ID
+		x.seq += uint32(n)
+		if _, err := x.sock.Write(append(msg, sets...)); err != nil {
+			x.conn.Debugf("cannot export flow records: %s", err.Error())
+		}
+	}
+}
+
+// Close closes the connection to the collector and logs the export
+// statistics.
+func (x *FlowExporter) Close() {
+	x.sock.Close()
+	x.conn.Debugf("exported %d flow records to %s, %d packets not accounted for",
+		x.exported, x.sock.RemoteAddr(), x.overflows)
+}
+
+// ipfixTemplateSet returns the template set with the IPv4 and IPv6 flow
+// templates.
+func ipfixTemplateSet() []byte {
+	set := []byte{0, 2, 0, 0} // set ID 2: template set; length filled in below.
+	for _, template := range []uint16{IPFIXTemplateIPv4, IPFIXTemplateIPv6} {
+		fields := ipfixFields(template == IPFIXTemplateIPv6)
+		set = binary.BigEndian.AppendUint16(set, template)
+		set = binary.BigEndian.AppendUint16(set, uint16(len(fields)))
+		for _, field := range fields {
+			if field.pen != 0 {
+				set = binary.BigEndian.AppendUint16(set, field.id|0x8000)
+				set = binary.BigEndian.AppendUint16(set, field.length)
+				set = binary.BigEndian.AppendUint32(set, field.pen)
+				continue
+			}
+			set = binary.BigEndian.AppendUint16(set, field.id)
+			set = binary.BigEndian.AppendUint16(set, field.length)
+		}
+	}
+	binary.BigEndian.PutUint16(set[2:4], uint16(len(set)))
+	return set
+}
+
+// ipfixString appends the specified string as a variable-length IPFIX field.
+func ipfixString(b []byte, s string) []byte {
+	if len(s) > 0xffff {
+		s = s[:0xffff]
+	}
+	if len(s) < 255 {
+		b = append(b, byte(len(s)))
+	} else {
+		b = append(b, 255)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	}
+	return append(b, s...)
+}
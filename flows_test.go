@@ -0,0 +1,279 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siemens/csharg/api"
+)
+
+func TestIPFIXString(t *testing.T) {
+	tests := []struct {
+		len    int
+		prefix []byte
+	}{
+		{0, []byte{0}},
+		{3, []byte{3}},
+		{254, []byte{254}},
+		{255, []byte{255, 0, 255}},
+		{300, []byte{255, 1, 44}},
+		{0x10000, []byte{255, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		s := strings.Repeat("x", tt.len)
+		b := ipfixString([]byte{42}, s)
+		if b[0] != 42 || !bytes.HasPrefix(b[1:], tt.prefix) {
+			t.Errorf("string of %d octets: got prefix %v, want %v", tt.len, b[1:1+len(tt.prefix)], tt.prefix)
+			continue
+		}
+		want := tt.len
+		if want > 0xffff {
+			want = 0xffff
+		}
+		if l := len(b) - 1 - len(tt.prefix); l != want {
+			t.Errorf("string of %d octets: got %d octets of string, want %d", tt.len, l, want)
+		}
+	}
+}
+
+// fixedRecordLen returns the length of the fields of the specified template
+// preceding the target identity fields.
+func fixedRecordLen(fields []ipfixField) int {
+	n := 0
+	for _, field := range fields {
+		if field.pen == 0 {
+			n += int(field.length)
+		}
+	}
+	return n
+}
+
+func TestIPFIXTemplateSet(t *testing.T) {
+	set := ipfixTemplateSet()
+	if id := binary.BigEndian.Uint16(set[0:2]); id != 2 {
+		t.Fatalf("got set ID %d, want 2", id)
+	}
+	if l := binary.BigEndian.Uint16(set[2:4]); int(l) != len(set) {
+		t.Fatalf("got set length %d, want %d", l, len(set))
+	}
+	b := set[4:]
+	for _, template := range []uint16{IPFIXTemplateIPv4, IPFIXTemplateIPv6} {
+		want := ipfixFields(template == IPFIXTemplateIPv6)
+		if id := binary.BigEndian.Uint16(b[0:2]); id != template {
+			t.Fatalf("got template ID %d, want %d", id, template)
+		}
+		if n := binary.BigEndian.Uint16(b[2:4]); int(n) != len(want) {
+			t.Fatalf("template %d: got %d fields, want %d", template, n, len(want))
+		}
+		b = b[4:]
+		for _, field := range want {
+			id, length := binary.BigEndian.Uint16(b[0:2]), binary.BigEndian.Uint16(b[2:4])
+			b = b[4:]
+			var pen uint32
+			if id&0x8000 != 0 {
+				id &^= 0x8000
+				pen = binary.BigEndian.Uint32(b[0:4])
+				b = b[4:]
+			}
+			if got := (ipfixField{id, length, pen}); got != field {
+				t.Errorf("template %d: got field %+v, want %+v", template, got, field)
+			}
+		}
+	}
+	if len(b) != 0 {
+		t.Errorf("%d trailing octets in template set", len(b))
+	}
+	// The fixed record lengths used when exporting must match the templates.
+	if n := fixedRecordLen(ipfixFields(false)); n != 4+4+2+2+1+2+8+8+8+8+1 {
+		t.Errorf("IPv4 template has %d octets of fixed-length fields", n)
+	}
+	if n := fixedRecordLen(ipfixFields(true)); n != 16+16+2+2+1+2+8+8+8+8+1 {
+		t.Errorf("IPv6 template has %d octets of fixed-length fields", n)
+	}
+}
+
+// ipfixRecord is a decoded IPFIX flow data record.
+type ipfixRecord struct {
+	src, dst         netip.Addr
+	srcPort, dstPort uint16
+	proto            uint8
+	tcpFlags         uint16
+	octets, packets  uint64
+	start, end       uint64
+	reason           uint8
+	name, typ        string
+	netns            uint64
+}
+
+// decodeIPFIXString decodes a variable-length IPFIX string field, returning
+// it together with the remaining octets.
+func decodeIPFIXString(b []byte) (string, []byte) {
+	n, b := int(b[0]), b[1:]
+	if n == 255 {
+		n, b = int(binary.BigEndian.Uint16(b[0:2])), b[2:]
+	}
+	return string(b[:n]), b[n:]
+}
+
+// decodeIPFIXRecords decodes the data records of the specified data set.
+func decodeIPFIXRecords(template uint16, b []byte) []ipfixRecord {
+	alen := 4
+	if template == IPFIXTemplateIPv6 {
+		alen = 16
+	}
+	records := []ipfixRecord{}
+	for len(b) > 0 {
+		var r ipfixRecord
+		r.src, _ = netip.AddrFromSlice(b[0:alen])
+		r.dst, _ = netip.AddrFromSlice(b[alen : 2*alen])
+		b = b[2*alen:]
+		r.srcPort = binary.BigEndian.Uint16(b[0:2])
+		r.dstPort = binary.BigEndian.Uint16(b[2:4])
+		r.proto = b[4]
+		r.tcpFlags = binary.BigEndian.Uint16(b[5:7])
+		r.octets = binary.BigEndian.Uint64(b[7:15])
+		r.packets = binary.BigEndian.Uint64(b[15:23])
+		r.start = binary.BigEndian.Uint64(b[23:31])
+		r.end = binary.BigEndian.Uint64(b[31:39])
+		r.reason = b[39]
+		r.name, b = decodeIPFIXString(b[40:])
+		r.typ, b = decodeIPFIXString(b)
+		r.netns, b = binary.BigEndian.Uint64(b[0:8]), b[8:]
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestFlowExporter(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	args := &Args{
+		Target: &api.Target{
+			Name:   "web",
+			Prefix: "pod",
+			Type:   "docker",
+			NetNS:  4026531992,
+		},
+		FlowActiveTimeout:   DefaultFlowActiveTimeout,
+		FlowInactiveTimeout: DefaultFlowInactiveTimeout,
+	}
+	x, err := NewFlowExporter(&WSConn{ID: "test"}, collector.LocalAddr().String(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	s := &BlockStream{
+		Endian:     binary.LittleEndian,
+		Interfaces: []*Interface{{LinkType: LinkTypeRaw, TsResol: 6}},
+	}
+	const start = uint64(1700000000000000) // in microseconds.
+	syn := testIPv4Packet(IPProtoTCP, "10.0.0.1", "10.0.0.2", 1234, 80, 0).Data
+	syn[33] = 0x02
+	fin := append(testIPv4Packet(IPProtoTCP, "10.0.0.1", "10.0.0.2", 1234, 80, 0).Data, make([]byte, 100)...)
+	binary.BigEndian.PutUint16(fin[2:4], uint16(len(fin)))
+	fin[33] = 0x11
+	// The original IP packet length counts, not the captured length.
+	udp6 := testIPv6Packet(IPProtoUDP, "fd00::1", "fd00::2", 5353, 53, false).Data
+	binary.BigEndian.PutUint16(udp6[4:6], 1000)
+	for idx, data := range [][]byte{syn, fin, udp6} {
+		pkt := &EnhancedPacket{
+			Timestamp: start + uint64(idx)*250000,
+			OrigLen:   uint32(len(data)),
+			Data:      data,
+		}
+		if blks := x.EditBlock(s, pkt.Block(s.Endian)); len(blks) != 1 {
+			t.Fatalf("packet %d: got %d blocks, want 1", idx, len(blks))
+		}
+	}
+	// Non-IP packets don't create flows.
+	arp := &EnhancedPacket{Data: testARPPacket().Data}
+	s.Interfaces = append(s.Interfaces, &Interface{LinkType: LinkTypeEthernet, TsResol: 6})
+	arp.InterfaceID = 1
+	x.EditBlock(s, arp.Block(s.Endian))
+	if len(x.flows) != 2 {
+		t.Fatalf("got %d flows, want 2", len(x.flows))
+	}
+
+	x.export(true)
+	records := map[uint16][]ipfixRecord{}
+	templates := 0
+	buf := make([]byte, 65536)
+	for len(records) < 2 {
+		collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := collector.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := buf[:n]
+		if v := binary.BigEndian.Uint16(msg[0:2]); v != 10 {
+			t.Fatalf("got IPFIX version %d, want 10", v)
+		}
+		if l := binary.BigEndian.Uint16(msg[2:4]); int(l) != n {
+			t.Fatalf("got message length %d, want %d", l, n)
+		}
+		for sets := msg[16:]; len(sets) > 0; {
+			id, l := binary.BigEndian.Uint16(sets[0:2]), binary.BigEndian.Uint16(sets[2:4])
+			switch id {
+			case 2:
+				templates++
+			case IPFIXTemplateIPv4, IPFIXTemplateIPv6:
+				if templates == 0 {
+					t.Fatalf("data set %d before template set", id)
+				}
+				records[id] = append(records[id], decodeIPFIXRecords(id, sets[4:l])...)
+			default:
+				t.Fatalf("unexpected set ID %d", id)
+			}
+			sets = sets[l:]
+		}
+	}
+	if templates != 1 {
+		t.Errorf("got %d template sets, want 1", templates)
+	}
+
+	startms := start / 1000
+	want := map[uint16][]ipfixRecord{
+		IPFIXTemplateIPv4: {{
+			src: netip.MustParseAddr("10.0.0.1"), dst: netip.MustParseAddr("10.0.0.2"),
+			srcPort: 1234, dstPort: 80, proto: IPProtoTCP, tcpFlags: 0x13,
+			octets: 40 + 140, packets: 2, start: startms, end: startms + 250,
+			reason: FlowEndOfFlow, name: "pod:web", typ: "docker", netns: 4026531992,
+		}},
+		IPFIXTemplateIPv6: {{
+			src: netip.MustParseAddr("fd00::1"), dst: netip.MustParseAddr("fd00::2"),
+			srcPort: 5353, dstPort: 53, proto: IPProtoUDP,
+			octets: 1040, packets: 1, start: startms + 500, end: startms + 500,
+			reason: FlowEndForced, name: "pod:web", typ: "docker", netns: 4026531992,
+		}},
+	}
+	for template, recs := range want {
+		if len(records[template]) != len(recs) {
+			t.Errorf("template %d: got %d records, want %d", template, len(records[template]), len(recs))
+			continue
+		}
+		for idx, rec := range recs {
+			if records[template][idx] != rec {
+				t.Errorf("template %d: got record\n%+v\nwant\n%+v", template, records[template][idx], rec)
+			}
+		}
+	}
+	if len(x.flows) != 0 {
+		t.Errorf("%d flows left after forced export", len(x.flows))
+	}
+	if x.seq != 2 {
+		t.Errorf("got sequence number %d, want 2", x.seq)
+	}
+}
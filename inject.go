@@ -0,0 +1,433 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Injects the packets from recorded packet captures into the network
+// interfaces of capture targets, in order to reproduce problems in test
+// clusters. The packets get transmitted on the network interface inside the
+// target's network namespace, optionally paced, rate limited, and with their
+// addresses rewritten.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	pcapng "github.com/siemens/csharg/pcapng"
+	"github.com/thediveo/lxkns/ops"
+	"github.com/thediveo/lxkns/ops/relations"
+	"golang.org/x/sys/unix"
+)
+
+// MaxInjectRate is the maximum packet rate of injections in packets/s.
+const MaxInjectRate = 1000000
+
+// pcap file header magic numbers for microsecond and nanosecond timestamps.
+const (
+	pcapMagicMicro = uint32(0xa1b2c3d4)
+	pcapMagicNano  = uint32(0xa1b23c4d)
+)
+
+// InjectSocket is a packet socket for transmitting frames on a network
+// interface. As the socket is created inside the target's network namespace,
+// it stays attached to this network namespace.
+type InjectSocket struct {
+	Ethernet bool // network interface transmits Ethernet frames, otherwise IP packets.
+	fd       int
+	ifindex  int
+}
+
+// OpenInjectSocket returns a new packet socket for the specified network
+// interface in the specified (locked) network namespace.
+func OpenInjectSocket(nif string, netns relations.Relation) (*InjectSocket, error) {
+	res, err := ops.Execute(func() interface{} {
+		netif, err := net.InterfaceByName(nif)
+		if err != nil {
+			return err
+		}
+		// Using protocol zero, the socket doesn't receive any packets.
+		fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return os.NewSyscallError("socket", err)
+		}
+		return &InjectSocket{
+			Ethernet: netif.Flags&net.FlagLoopback != 0 || len(netif.HardwareAddr) == 6,
+			fd:       fd,
+			ifindex:  netif.Index,
+		}
+	}, netns)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := res.(error); ok {
+		return nil, fmt.Errorf("cannot open network interface %s: %s", nif, err.Error())
+	}
+	return res.(*InjectSocket), nil
+}
+
+// Send transmits the specified frame carrying the specified network layer
+// protocol.
+func (s *InjectSocket) Send(frame []byte, ethertype uint16) error {
+	var proto [2]byte
+	binary.BigEndian.PutUint16(proto[:], ethertype)
+	return unix.Sendto(s.fd, frame, 0, &unix.SockaddrLinklayer{
+		Protocol: hostEndian.Uint16(proto[:]),
+		Ifindex:  s.ifindex,
+	})
+}
+
+// Close closes the packet socket.
+func (s *InjectSocket) Close() error {
+	return unix.Close(s.fd)
+}
+
+// Injector is a pcapng block editor transmitting the packets of the stream on
+// its packet socket, consuming the packet blocks.
+type Injector struct {
+	Rate     float64          // maximum packets/s; zero if unlimited.
+	Rewriter *AddressRewriter // nil if addresses are kept.
+
+	sock     *InjectSocket   // packet socket to transmit on.
+	cancel   <-chan struct{} // stops waiting for the rate limit when closed.
+	next     time.Time       // when the next packet may be sent when rate limited.
+	injected uint64
+	skipped  uint64
+	octets   uint64
+	err      error // first transmission error.
+}
+
+// EditBlock transmits the packets of enhanced and simple packet blocks,
+// skipping truncated packets as well as packets that cannot be transmitted on
+// the network interface. Packet blocks are consumed, while all other blocks
+// pass unchanged, so that the stream keeps track of the interfaces.
+func (i *Injector) EditBlock(s *BlockStream, blk *Block) []*Block {
+	var data []byte
+	var length int
+	var nif *Interface
+	switch blk.Type {
+	case BlockTypeEPB:
+		pkt := ParseEnhancedPacket(blk, s.Endian)
+		if pkt == nil {
+			i.skipped++
+			return nil
+		}
+		nif = s.Interface(pkt.InterfaceID)
+		data, length = pkt.Data, int(pkt.OrigLen)
+	case BlockTypeSPB:
+		if len(blk.Body) < 4 {
+			i.skipped++
+			return nil
+		}
+		nif = s.Interface(0)
+		data, length = blk.Body[4:], int(s.Endian.Uint32(blk.Body[0:4]))
+		if length < len(data) {
+			data = data[:length]
+		}
+	default:
+		return []*Block{blk}
+	}
+	if nif == nil || len(data) < length {
+		i.skipped++
+		return nil
+	}
+	frame, ethertype := i.frame(nif.LinkType, data)
+	if frame == nil {
+		i.skipped++
+		return nil
+	}
+	i.throttle()
+	if err := i.sock.Send(frame, ethertype); err != nil {
+		if i.err == nil {
+			i.err = err
+		}
+		i.skipped++
+		return nil
+	}
+	i.injected++
+	i.octets += uint64(len(frame))
+	return nil
+}
+
+// frame returns a copy of the specified packet data of the specified link
+// type, converted as necessary for the network interface and with its
+// addresses rewritten, as well as its network layer protocol. If the packet
+// cannot be converted, nil is returned.
+func (i *Injector) frame(linktype uint16, data []byte) ([]byte, uint16) {
+	var p *PacketLayers
+	if i.sock.Ethernet {
+		eth := ethernetFrame(linktype, data)
+		if eth == nil {
+			return nil, 0
+		}
+		p = DecodePacket(LinkTypeEthernet, append([]byte{}, eth...))
+	} else {
+		p = DecodePacket(linktype, data)
+		if p.L3Proto != EtherTypeIPv4 && p.L3Proto != EtherTypeIPv6 {
+			return nil, 0
+		}
+		p = DecodePacket(LinkTypeRaw, append([]byte{}, data[p.L3Offset:]...))
+	}
+	if i.Rewriter != nil {
+		i.Rewriter.Rewrite(p)
+	}
+	return p.Data, p.L3Proto
+}
+
+// throttle waits until the next packet may be sent according to the rate
+// limit.
+func (i *Injector) throttle() {
+	if i.Rate <= 0 {
+		return
+	}
+	now := time.Now()
+	if i.next.Before(now) {
+		i.next = now
+	}
+	wait := i.next.Sub(now)
+	i.next = i.next.Add(time.Duration(float64(time.Second) / i.Rate))
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-i.cancel:
+	}
+}
+
+// InjectStats describes the outcome of an injection.
+type InjectStats struct {
+	Injected uint64 `json:"injected"`
+	Skipped  uint64 `json:"skipped"`
+	Octets   uint64 `json:"octets"`
+	Error    string `json:"error,omitempty"` // first transmission error, if any.
+}
+
+// Stats returns the injection statistics so far.
+func (i *Injector) Stats() *InjectStats {
+	stats := &InjectStats{
+		Injected: i.injected,
+		Skipped:  i.skipped,
+		Octets:   i.octets,
+	}
+	if i.err != nil {
+		stats.Error = i.err.Error()
+	}
+	return stats
+}
+
+// AddressRewriter rewrites IP and MAC addresses of packets according to its
+// address maps.
+type AddressRewriter struct {
+	ips  map[netip.Addr]netip.Addr
+	macs map[[6]byte][6]byte
+}
+
+// NewAddressRewriter returns a new address rewriter for the specified IP and
+// MAC address rewrites in "OLD=NEW" notation. IP addresses can only be
+// rewritten to IP addresses of the same family.
+func NewAddressRewriter(iprewrites, macrewrites []string) (*AddressRewriter, error) {
+	r := &AddressRewriter{
+		ips:  map[netip.Addr]netip.Addr{},
+		macs: map[[6]byte][6]byte{},
+	}
+	for _, rewrite := range iprewrites {
+		from, to, _ := strings.Cut(rewrite, "=")
+		old, err1 := netip.ParseAddr(from)
+		new, err2 := netip.ParseAddr(to)
+		old, new = old.Unmap(), new.Unmap()
+		if err1 != nil || err2 != nil || old.Is4() != new.Is4() ||
+			old.Zone() != "" || new.Zone() != "" {
+			return nil, fmt.Errorf("invalid rewrite \"%s\"", rewrite)
+		}
+		r.ips[old] = new
+	}
+	for _, rewrite := range macrewrites {
+		from, to, _ := strings.Cut(rewrite, "=")
+		old, err1 := net.ParseMAC(from)
+		new, err2 := net.ParseMAC(to)
+		if err1 != nil || err2 != nil || len(old) != 6 || len(new) != 6 {
+			return nil, fmt.Errorf("invalid rewritemac \"%s\"", rewrite)
+		}
+		r.macs[[6]byte(old)] = [6]byte(new)
+	}
+	return r, nil
+}
+
+// Rewrite rewrites the link layer and network layer addresses of the
+// specified (decoded) packet in place, fixing checksums as necessary.
+func (r *AddressRewriter) Rewrite(p *PacketLayers) {
+	data := p.Data
+	if p.LinkType == LinkTypeEthernet && len(data) >= 12 {
+		r.replaceMAC(data[0:6])
+		r.replaceMAC(data[6:12])
+	}
+	switch p.L3Proto {
+	case EtherTypeIPv4:
+		rewriteIP(p, data[p.L3Offset:], 12, 4, r.replaceIP)
+	case EtherTypeIPv6:
+		rewriteIP(p, data[p.L3Offset:], 8, 16, r.replaceIP)
+	case EtherTypeARP:
+		arp := data[p.L3Offset:]
+		hlen, plen := int(arp[4]), int(arp[5])
+		if hlen == 6 && (plen == 4 || plen == 16) {
+			offset := 8
+			for i := 0; i < 2; i++ {
+				r.replaceMAC(arp[offset : offset+hlen])
+				offset += hlen
+				r.replaceIP(arp[offset : offset+plen])
+				offset += plen
+			}
+		}
+	}
+}
+
+// replaceIP rewrites the specified IP address in place if it is to be
+// rewritten, and then incrementally updates the specified checksums (if any)
+// covering the address.
+func (r *AddressRewriter) replaceIP(addr []byte, csums ...[]byte) {
+	old, _ := netip.AddrFromSlice(addr)
+	new, ok := r.ips[old.Unmap()]
+	if !ok {
+		return
+	}
+	var newaddr []byte
+	if len(addr) == 4 {
+		a4 := new.As4()
+		newaddr = a4[:]
+	} else {
+		a16 := new.As16()
+		newaddr = a16[:]
+	}
+	for _, csum := range csums {
+		if csum == nil {
+			continue
+		}
+		binary.BigEndian.PutUint16(csum, updateChecksum(binary.BigEndian.Uint16(csum), addr, newaddr))
+	}
+	copy(addr, newaddr)
+}
+
+// replaceMAC rewrites the specified MAC address in place if it is to be
+// rewritten.
+func (r *AddressRewriter) replaceMAC(mac []byte) {
+	if new, ok := r.macs[[6]byte(mac)]; ok {
+		copy(mac, new[:])
+	}
+}
+
+// InjectBlocks reads a pcapng or pcap file from the specified reader, writing
+// each pcapng block separately to the specified writer. pcap files get
+// converted into pcapng blocks on the fly. It returns when reaching the end of
+// the reader, the writer fails, or the specified channel gets closed.
+func InjectBlocks(w io.Writer, r io.Reader, cancel <-chan struct{}) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	magic, err := br.Peek(4)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case BlockTypeSHB:
+		return ReplayBlocks(w, br, cancel)
+	case pcapMagicMicro, pcapMagicNano:
+		return pcapBlocks(w, br, binary.LittleEndian, cancel)
+	}
+	switch binary.BigEndian.Uint32(magic) {
+	case pcapMagicMicro, pcapMagicNano:
+		return pcapBlocks(w, br, binary.BigEndian, cancel)
+	}
+	return fmt.Errorf("neither a pcapng nor a pcap file")
+}
+
+// pcapBlocks converts a pcap file of the specified endianness into pcapng
+// blocks, writing each block separately to the specified writer.
+func pcapBlocks(w io.Writer, r io.Reader, endian binary.ByteOrder, cancel <-chan struct{}) error {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return fmt.Errorf("truncated pcap file header: %s", err.Error())
+	}
+	tsresol := TsResolMicro
+	if endian.Uint32(hdr[0:4]) == pcapMagicNano {
+		tsresol = 9
+	}
+	snaplen := endian.Uint32(hdr[16:20])
+	// The upper bits of the link type field carry FCS information, which we
+	// don't support.
+	linktype := uint16(endian.Uint32(hdr[20:24]))
+
+	shb := make([]byte, 16)
+	endian.PutUint32(shb[0:4], byteOrderMagic)
+	endian.PutUint16(shb[4:6], 1)
+	endian.PutUint64(shb[8:16], ^uint64(0)) // unknown section length.
+	idb := make([]byte, 8)
+	endian.PutUint16(idb[0:2], linktype)
+	endian.PutUint32(idb[4:8], snaplen)
+	idb = append(idb, OptionsBytes([]*pcapng.Option{
+		{Code: OptIfTsResol, Value: []byte{tsresol}},
+	}, endian)...)
+	for _, blk := range []*Block{{Type: BlockTypeSHB, Body: shb}, {Type: BlockTypeIDB, Body: idb}} {
+		if _, err := w.Write(blk.Bytes(endian)); err != nil {
+			return err
+		}
+	}
+
+	rechdr := make([]byte, 16)
+	for {
+		select {
+		case <-cancel:
+			return nil
+		default:
+		}
+		if _, err := io.ReadFull(r, rechdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("truncated pcap record header: %s", err.Error())
+		}
+		caplen := endian.Uint32(rechdr[8:12])
+		if caplen > MaxReplayBlockSize {
+			return fmt.Errorf("invalid pcap record length %d", caplen)
+		}
+		pkt := &EnhancedPacket{
+			Timestamp: uint64(endian.Uint32(rechdr[0:4]))*ticksPerSecond(tsresol) +
+				uint64(endian.Uint32(rechdr[4:8])),
+			OrigLen: endian.Uint32(rechdr[12:16]),
+			Data:    make([]byte, caplen),
+		}
+		if _, err := io.ReadFull(r, pkt.Data); err != nil {
+			return fmt.Errorf("truncated pcap record: %s", err.Error())
+		}
+		if _, err := w.Write(pkt.Block(endian).Bytes(endian)); err != nil {
+			return err
+		}
+	}
+}
+
+// ticksPerSecond returns the number of timestamp ticks per second for the
+// specified (decimal) if_tsresol encoding.
+func ticksPerSecond(tsresol uint8) uint64 {
+	ticks := uint64(1)
+	for i := uint8(0); i < tsresol; i++ {
+		ticks *= 10
+	}
+	return ticks
+}
+
+// injectTarget describes the injection target for logging purposes.
+func injectTarget(args *Args) string {
+	return fmt.Sprintf("%s in netns:[%d] of %s %s",
+		args.Target.NetworkInterfaces[0], args.Target.NetNS,
+		args.Target.Type, args.Target.Name)
+}
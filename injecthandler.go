@@ -0,0 +1,212 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Handles the /inject API endpoint for injecting the packets from uploaded or
+// streamed packet captures into a network interface of a capture target.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Handle the /inject API endpoint: a POST injects the packets from the pcapng
+// or pcap file in the request body, while a websocket connect injects the
+// packets streamed in binary messages until the client sends a text message.
+// Only explicitly allowed principals authenticated by a trusted proxy may
+// inject packets; without trusted proxies, injection is always disabled.
+func injectHandler(w http.ResponseWriter, req *http.Request) {
+	if len(InjectPrincipals) == 0 || len(TrustedProxyPrefixes) == 0 {
+		http.Error(w, "packet injection disabled", http.StatusNotFound)
+		return
+	}
+	client := NewClientIdentity(req)
+	principal := client.Principal()
+	if !client.Authenticated() || !injectAllowed(principal) {
+		log.Errorf("rejecting packet injection by %s", principal)
+		http.Error(w, "packet injection not allowed", http.StatusForbidden)
+		return
+	}
+	streaming := websocket.IsWebSocketUpgrade(req)
+	if !streaming && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conn := NewWSConn()
+	args, err := parseCaptureParams(req, conn)
+	if err != nil {
+		conn.Errorf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if args.NetnsFile != nil {
+		defer args.NetnsFile.Close()
+	}
+	cancel := req.Context().Done()
+	replayer := NewReplayer(cancel)
+	injector, err := newInjectorParams(req, replayer)
+	if err == nil && (len(args.Target.NetworkInterfaces) != 1 || args.Target.NetworkInterfaces[0] == "any") {
+		err = fmt.Errorf("nif query parameter with a single network interface required")
+	}
+	if err != nil {
+		conn.Errorf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, err := Sessions.Acquire(principal, uint64(args.Target.NetNS))
+	if err != nil {
+		conn.Errorf("rejecting packet injection by %s: %s", principal, err.Error())
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	// Lock the target network namespace and open a packet socket inside it;
+	// the socket then stays attached to the target network namespace.
+	netns, unlock, err := lockTargetNetns(args, targetNetnsPath(conn, args))
+	if err != nil {
+		conn.Errorf("cannot lock netns:[%d]: %s", args.Target.NetNS, err.Error())
+		http.Error(w, "cannot lock target network namespace", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+	sock, err := OpenInjectSocket(args.Target.NetworkInterfaces[0], netns)
+	if err != nil {
+		conn.Errorf("%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer sock.Close()
+	injector.sock, injector.cancel = sock, cancel
+	log.Infof("(%s) %s injecting packets into %s", conn.ID, principal, injectTarget(args))
+
+	var r io.Reader = req.Body
+	if streaming {
+		cnx, err := wsupgrader.Upgrade(w, req, nil)
+		if err != nil {
+			conn.Errorf("websocket upgrade process failed: %s", err.Error())
+			return
+		}
+		conn.Conn = cnx
+		defer conn.Close()
+		r = &wsMessageReader{conn: conn}
+	}
+	stream := NewBlockStream(io.Discard, replayer, injector)
+	err = InjectBlocks(stream, r, cancel)
+	stats := injector.Stats()
+	conn.Debugf("injected %d packets with %d octets, skipped %d packets",
+		stats.Injected, stats.Octets, stats.Skipped)
+	if err != nil {
+		conn.Errorf("cannot inject packets: %s", err.Error())
+		stats.Error = err.Error()
+	}
+	if !streaming {
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, stats)
+		return
+	}
+	if reader := r.(*wsMessageReader); reader.closed {
+		return
+	}
+	if j, err := json.Marshal(stats); err == nil {
+		_ = conn.WriteMessage(websocket.TextMessage, j)
+	}
+	if err != nil {
+		conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot inject packets")
+	} else {
+		conn.GracefullyClose(websocket.CloseNormalClosure, "injection complete")
+	}
+}
+
+// injectAllowed returns true if the specified principal is allowed to inject
+// packets.
+func injectAllowed(principal string) bool {
+	for _, allowed := range InjectPrincipals {
+		if allowed == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// newInjectorParams returns a new injector with the injection parameters from
+// the request, and configures the specified replayer's pacing and filtering.
+// The injector still needs its packet socket.
+func newInjectorParams(req *http.Request, replayer *Replayer) (*Injector, error) {
+	params := requestParams(req)
+	if err := parseReplayerParams(params, replayer); err != nil {
+		return nil, err
+	}
+	injector := &Injector{}
+	if p, ok := params["pps"]; ok {
+		rate, err := strconv.ParseFloat(p[0], 64)
+		if err != nil || !(rate > 0 && rate <= MaxInjectRate) {
+			return nil, fmt.Errorf("invalid pps \"%s\"", p[0])
+		}
+		injector.Rate = rate
+	}
+	if len(params["rewrite"]) > 0 || len(params["rewritemac"]) > 0 {
+		rewriter, err := NewAddressRewriter(params["rewrite"], params["rewritemac"])
+		if err != nil {
+			return nil, err
+		}
+		injector.Rewriter = rewriter
+	}
+	return injector, nil
+}
+
+// wsMessageReader reads the contents of the binary messages of a websocket
+// connection as a single stream, ending with the first text message or when
+// the client closes the connection.
+type wsMessageReader struct {
+	conn   *WSConn
+	msg    io.Reader // current binary message, if any.
+	ended  bool      // stream has ended.
+	closed bool      // client closed the websocket connection.
+}
+
+// Read reads from the current binary message, moving on to the next binary
+// message as necessary.
+func (r *wsMessageReader) Read(b []byte) (int, error) {
+	for !r.ended {
+		if r.msg != nil {
+			n, err := r.msg.Read(b)
+			if err == io.EOF {
+				r.msg = nil
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		mt, msg, err := r.conn.NextReader()
+		if err != nil {
+			r.ended, r.closed = true, true
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		switch mt {
+		case websocket.BinaryMessage:
+			r.msg = msg
+		case websocket.TextMessage:
+			r.ended = true
+		}
+	}
+	return 0, io.EOF
+}
@@ -0,0 +1,165 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Tails a TLS key log file inside the capture target and injects the key log
+// lines into the packet capture stream in form of pcapng Decryption Secrets
+// Blocks. This turns live captures of TLS traffic into decryptable captures,
+// without capture clients needing to fetch key logs separately.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"time"
+)
+
+// BlockTypeDSB is the block type of pcapng Decryption Secrets Blocks.
+const BlockTypeDSB = uint32(0x0000000a)
+
+// SecretsTypeTLSKeyLog identifies NSS key log formatted secrets in Decryption
+// Secrets Blocks.
+const SecretsTypeTLSKeyLog = uint32(0x544c534b)
+
+// KeyLogPollInterval specifies how often to check the key log file for new
+// secrets.
+const KeyLogPollInterval = 500 * time.Millisecond
+
+// KeyLogMaxRead limits the amount of key log data read per poll; any remaining
+// data gets read in subsequent polls.
+const KeyLogMaxRead = 256 * 1024
+
+// KeyLogMaxLineLen is the maximum length of key log lines; longer lines cannot
+// be well-formed key log lines and thus get dropped.
+const KeyLogMaxLineLen = 1024
+
+// keyLogLineRegexp matches well-formed NSS key log lines: a known label,
+// followed by the hex-encoded client random (or encrypted pre-master secret
+// prefix in case of "RSA" lines) and the hex-encoded secret. See also:
+// https://www.ietf.org/archive/id/draft-thomson-tls-keylogfile-00.html
+var keyLogLineRegexp = regexp.MustCompile(
+	`^(CLIENT_RANDOM|RSA|CLIENT_EARLY_TRAFFIC_SECRET|EARLY_EXPORTER_(MASTER_)?SECRET|` +
+		`(CLIENT|SERVER)_HANDSHAKE_TRAFFIC_SECRET|(CLIENT|SERVER)_TRAFFIC_SECRET_[0-9]+|` +
+		`EXPORTER_SECRET|ECH_SECRET|ECH_CONFIG) [0-9a-fA-F]+ [0-9a-fA-F]+$`)
+
+// KeyLogTailer tails an NSS key log file inside the filesystem view of a
+// process and injects new complete key log lines as DSBs into a pcapng block
+// stream. Only regular files are tailed, and only well-formed key log lines
+// get injected, while anything else gets dropped.
+type KeyLogTailer struct {
+	conn    *WSConn
+	stream  *BlockStream
+	pid     int
+	path    string
+	offset  int64  // offset of next octets to read from the key log file.
+	pending []byte // complete key log lines yet to be injected.
+	partial []byte // incomplete key log line.
+	skip    bool   // skip the remainder of an overlong line?
+}
+
+// NewKeyLogTailer returns a new key log file tailer for the key log file at
+// the specified path inside the filesystem view of the specified process.
+func NewKeyLogTailer(conn *WSConn, stream *BlockStream, pid int, path string) *KeyLogTailer {
+	return &KeyLogTailer{
+		conn:   conn,
+		stream: stream,
+		pid:    pid,
+		path:   path,
+	}
+}
+
+// Run tails the key log file until the done channel gets closed. The key log
+// file doesn't need to exist yet, and it might even get truncated, in which
+// case the tailer starts over from the beginning.
+func (k *KeyLogTailer) Run(done <-chan struct{}) {
+	k.conn.Debugf("tailing TLS key log %s of PID %d", k.path, k.pid)
+	ticker := time.NewTicker(KeyLogPollInterval)
+	defer ticker.Stop()
+	missing := false
+	for {
+		if err := k.poll(); err != nil {
+			if !missing {
+				k.conn.Debugf("TLS key log: %s", err.Error())
+			}
+			missing = true
+		} else {
+			missing = false
+		}
+		k.inject()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll reads any new octets from the key log file, up to KeyLogMaxRead octets
+// at a time, keeping only the well-formed key log lines.
+func (k *KeyLogTailer) poll() error {
+	f, err := OpenRegularFileInContainer(k.pid, k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Size() < k.offset {
+		k.conn.Debugf("TLS key log has been truncated, starting over")
+		k.offset = 0
+		k.partial = nil
+		k.skip = false
+	}
+	if _, err := f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(f, KeyLogMaxRead))
+	if err != nil {
+		return err
+	}
+	k.offset += int64(len(data))
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			k.partial = append(k.partial, data...)
+			if len(k.partial) > KeyLogMaxLineLen {
+				k.partial = nil
+				k.skip = true
+			}
+			break
+		}
+		line := append(k.partial, data[:idx]...)
+		data = data[idx+1:]
+		k.partial = nil
+		if k.skip {
+			k.skip = false
+			continue
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) > KeyLogMaxLineLen || !keyLogLineRegexp.Match(line) {
+			continue
+		}
+		k.pending = append(append(k.pending, line...), '\n')
+	}
+	return nil
+}
+
+// inject injects any pending key log lines as a DSB into the packet capture
+// stream. If the stream isn't yet ready, the key log lines are kept pending.
+func (k *KeyLogTailer) inject() {
+	if len(k.pending) == 0 {
+		return
+	}
+	endian, _ := k.stream.Section()
+	if endian == nil {
+		return
+	}
+	body := make([]byte, 8, 8+len(k.pending))
+	endian.PutUint32(body[0:4], SecretsTypeTLSKeyLog)
+	endian.PutUint32(body[4:8], uint32(len(k.pending)))
+	body = append(body, k.pending...)
+	if k.stream.Inject(&Block{Type: BlockTypeDSB, Body: body}) {
+		k.conn.Debugf("injected %d octets of TLS key log secrets", len(k.pending))
+		k.pending = nil
+	}
+}
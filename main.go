@@ -14,9 +14,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"runtime"
 	"strings"
 	"time"
@@ -107,6 +109,63 @@ func main() {
 	flaggy.Bool(&ProxyDiscoveryService, "", "proxy-discovery",
 		fmt.Sprintf("enable/disable proxy discovery service SPA and API (default: %t)", ProxyDiscoveryService))
 
+	flaggy.String(&AnonymizationKeyFile, "", "anonymization-key-file",
+		"file with hex-encoded 32 octet key for anonymizing captures")
+	flaggy.String(&DockerSocket, "", "docker-socket",
+		"path of Docker engine API socket for container meta data")
+	flaggy.String(&ContainerdSocket, "", "containerd-socket",
+		"path of containerd API socket for container meta data")
+	flaggy.StringSlice(&CRISockets, "", "cri-socket",
+		"path of CRI API socket for container meta data (repeatable)")
+
+	flaggy.Duration(&KillGracePeriod, "", "kill-grace",
+		"grace period for capture processes to terminate before getting killed")
+	flaggy.String(&CaptureCgroupParent, "", "capture-cgroup",
+		"parent cgroup (v2) path for per-capture cgroups")
+	flaggy.Float64(&CaptureCPULimit, "", "capture-cpu-limit",
+		"maximum number of CPUs per capture process")
+	flaggy.UInt64(&CaptureMemoryLimit, "", "capture-memory-limit",
+		"maximum memory in MiB per capture process")
+
+	flaggy.Int(&MaxSessions, "", "max-sessions",
+		"maximum number of concurrent capture sessions")
+	flaggy.Int(&MaxSessionsPerClient, "", "max-sessions-per-client",
+		"maximum number of concurrent capture sessions per client")
+	flaggy.Int(&MaxSessionsPerNetns, "", "max-sessions-per-target",
+		"maximum number of concurrent capture sessions per capture target")
+
+	flaggy.String(&SnapshotDir, "", "snapshot-dir",
+		"directory for saving ring buffer snapshots")
+
+	flaggy.UInt16(&RPCAPPort, "", "rpcap-port",
+		fmt.Sprintf("port to expose RPCAP remote capture service on, such as %d", DefaultRPCAPPort))
+	flaggy.String(&RPCAPUsersFile, "", "rpcap-users",
+		"file with users allowed to authenticate with the RPCAP service")
+
+	flaggy.String(&S3Endpoint, "", "s3-endpoint",
+		"URL of S3-compatible object store to upload capture segments to")
+	flaggy.String(&S3Bucket, "", "s3-bucket",
+		"object store bucket to upload capture segments to")
+	flaggy.String(&S3Region, "", "s3-region",
+		"object store region")
+	flaggy.String(&SpoolDir, "", "spool-dir",
+		"directory for spooling capture segments until uploaded")
+	flaggy.UInt64(&SpoolMegabytes, "", "spool-megabytes",
+		"maximum total size in MiB of spooled capture segments")
+
+	flaggy.String(&ReplayDir, "", "replay-dir",
+		"directory with pcapng files available for replay")
+
+	flaggy.StringSlice(&MirrorCollectors, "", "mirror-collector",
+		"collector address to allow mirroring packets to (repeatable)")
+	flaggy.StringSlice(&FlowCollectors, "", "flow-collector",
+		"IPFIX collector address to allow exporting flow records to (repeatable)")
+
+	flaggy.StringSlice(&InjectPrincipals, "", "inject-allow",
+		"principal allowed to inject packets, such as user:alice (repeatable)")
+	flaggy.StringSlice(&TrustedProxies, "", "trusted-proxy",
+		"address or CIDR of an authenticating proxy whose headers to trust (repeatable)")
+
 	flaggy.Parse()
 
 	if Debug {
@@ -114,6 +173,107 @@ func main() {
 		log.Debug("debugging messages enabled")
 	}
 
+	if AnonymizationKeyFile != "" {
+		key, err := LoadAnonymizationKey(AnonymizationKeyFile)
+		if err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+		AnonymizationKey = key
+		log.Info("using configured default anonymization key")
+	}
+
+	// Watch the container engines for their containers in order to add
+	// container meta data to captures.
+	if len(CRISockets) == 0 {
+		CRISockets = DefaultCRISockets
+	}
+	ContainerEngines.Start(context.Background(), DockerSocket, ContainerdSocket, CRISockets)
+
+	if CaptureCgroupParent != "" {
+		log.Infof("confining capture processes to cgroups below %s", CaptureCgroupParent)
+	} else if CaptureCPULimit > 0 || CaptureMemoryLimit > 0 {
+		log.Fatalf("capture CPU and memory limits require --capture-cgroup")
+	}
+	if CaptureCPULimit < 0 {
+		log.Fatalf("invalid capture CPU limit %g", CaptureCPULimit)
+	}
+	go Reaper.Run(ReaperInterval)
+
+	if SnapshotDir != "" {
+		if finfo, err := os.Stat(SnapshotDir); err != nil || !finfo.IsDir() {
+			log.Fatalf("invalid snapshot directory %s", SnapshotDir)
+		}
+		log.Infof("saving ring buffer snapshots to %s", SnapshotDir)
+	}
+
+	// Optionally upload capture segments to an object store, spooling them
+	// locally until uploaded.
+	if S3Bucket != "" {
+		if SpoolDir == "" {
+			log.Fatalf("--s3-bucket requires --spool-dir")
+		}
+		client, err := NewS3Client(S3Endpoint, S3Bucket, S3Region)
+		if err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+		if Spool, err = NewSpooler(SpoolDir, int64(SpoolMegabytes)<<20, client); err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+		log.Infof("uploading capture segments to bucket %s at %s, spooling in %s",
+			S3Bucket, client.Endpoint, SpoolDir)
+		go Spool.Run()
+	} else if SpoolDir != "" || S3Endpoint != "" {
+		log.Fatalf("--spool-dir and --s3-endpoint require --s3-bucket")
+	}
+
+	if ReplayDir != "" {
+		if finfo, err := os.Stat(ReplayDir); err != nil || !finfo.IsDir() {
+			log.Fatalf("invalid replay directory %s", ReplayDir)
+		}
+		log.Infof("replaying pcapng files from %s", ReplayDir)
+	}
+
+	// Only trust the client identification headers of the configured
+	// authenticating proxies.
+	prefixes, err := ParseTrustedProxies(TrustedProxies)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	TrustedProxyPrefixes = prefixes
+	if len(TrustedProxyPrefixes) != 0 {
+		log.Infof("trusting client identification by proxies %s", strings.Join(TrustedProxies, ", "))
+	}
+
+	if len(InjectPrincipals) != 0 {
+		if len(TrustedProxyPrefixes) == 0 {
+			log.Warn("packet injection disabled: --inject-allow requires --trusted-proxy")
+		} else {
+			log.Warnf("allowing packet injection by %s", strings.Join(InjectPrincipals, ", "))
+		}
+	}
+
+	// Optionally serve the capture targets' network interfaces also via RPCAP
+	// to stock capture clients.
+	if RPCAPUsersFile != "" {
+		if RPCAPPort == 0 {
+			log.Fatalf("--rpcap-users requires --rpcap-port")
+		}
+		users, err := LoadRPCAPUsers(RPCAPUsersFile)
+		if err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+		RPCAPUsers = users
+		log.Infof("loaded %d RPCAP users", len(users))
+	}
+	if RPCAPPort != 0 {
+		if len(RPCAPUsers) == 0 {
+			log.Fatalf("--rpcap-port requires --rpcap-users with at least one user")
+		}
+		go func() {
+			log.Fatalf("cannot serve RPCAP: %s", ServeRPCAP(RPCAPPort).Error())
+		}()
+	}
+
 	// For unknown reasons the "thing" reponsible for demultiplexing incomming
 	// HTTP requests onto HTTP handlers is termaed a "multiplexer". Yet, this is
 	// a demultiplexer. Confusing.
@@ -121,7 +281,17 @@ func main() {
 	// See: https://en.wikipedia.org/wiki/Multiplexer
 	demux := http.NewServeMux()
 	demux.HandleFunc("/capture", captureHandler)
+	demux.HandleFunc("/mirror", captureHandler)
+	demux.HandleFunc("/flows", captureHandler)
+	demux.HandleFunc("/stats", captureHandler)
 	demux.HandleFunc("/version", versionHandler)
+	demux.HandleFunc("/ringbuffers", ringBuffersHandler)
+	demux.HandleFunc("/snapshot", snapshotHandler)
+	demux.HandleFunc("/uploads", uploadsHandler)
+	demux.HandleFunc("/replay", replayHandler)
+	demux.HandleFunc("/inject", injectHandler)
+	demux.HandleFunc("/diagnostics", diagnosticsHandler)
+	demux.HandleFunc("/conntrack", conntrackHandler)
 	if ProxyDiscoveryService {
 		// Enable reverse proxying to the associated GhostWire discovery service
 		// instance at (fixed) path "/" ... everything not handled otherwise
@@ -0,0 +1,205 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Enriches the pcapng section header and interface description blocks with
+// meta data about the capture session, the captured network interfaces and the
+// containers attached to the captured network stack. This turns saved packet
+// captures into self-describing records for later (forensic) review. The meta
+// data is stored in form of YAML document comments, similar to the capture
+// target information already added by csharg's pcapng stream editor.
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/siemens/csharg/api"
+	pcapng "github.com/siemens/csharg/pcapng"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// sessionmarker describes the "magic" signature of a capture session YAML
+	// document.
+	sessionmarker = "---\n# capture session information\n"
+	// interfacemarker describes the "magic" signature of a network interface
+	// YAML document.
+	interfacemarker = "---\n# capture interface information\n"
+)
+
+// SessionInfo represents the capture session information to be added to the
+// section header block of a packet capture stream.
+type SessionInfo struct {
+	NodeName      string          `yaml:"node-name"`
+	Packetflix    string          `yaml:"packetflix-version"`
+	Start         time.Time       `yaml:"capture-start"`
+	Client        *ClientIdentity `yaml:"client,omitempty"`
+	CaptureFilter string          `yaml:"capture-filter,omitempty"`
+}
+
+// InterfaceInfo represents the network interface information to be added to
+// the interface description blocks of a packet capture stream. The interface
+// addresses are not part of the YAML document, but instead become the
+// standard if_IPv4addr, if_IPv6addr, and if_MACaddr options.
+type InterfaceInfo struct {
+	Index      int                 `yaml:"index,omitempty"`
+	MTU        int                 `yaml:"mtu,omitempty"`
+	Containers []*ContainerDetails `yaml:"containers,omitempty"`
+	MAC        net.HardwareAddr    `yaml:"-"`
+	Prefixes   []netip.Prefix      `yaml:"-"`
+}
+
+// NewSessionInfo returns the capture session information for the specified
+// capture target, client, and capture filter.
+func NewSessionInfo(target *api.Target, client *ClientIdentity, filter string) *SessionInfo {
+	nodename := target.NodeName
+	if nodename == "" {
+		nodename, _ = os.Hostname()
+	}
+	return &SessionInfo{
+		NodeName:      nodename,
+		Packetflix:    SemVersion,
+		Start:         time.Now().UTC(),
+		Client:        client,
+		CaptureFilter: filter,
+	}
+}
+
+// NetnsInterfaces returns the details of the network interfaces of the current
+// network namespace, indexed by interface name. Please note that this must be
+// called from inside the network namespace in question.
+func NetnsInterfaces() map[string]*InterfaceInfo {
+	nifs, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	infos := map[string]*InterfaceInfo{}
+	for _, nif := range nifs {
+		info := &InterfaceInfo{
+			Index: nif.Index,
+			MTU:   nif.MTU,
+			MAC:   nif.HardwareAddr,
+		}
+		if addrs, err := nif.Addrs(); err == nil {
+			for _, addr := range addrs {
+				ipnet, ok := addr.(*net.IPNet)
+				if !ok {
+					continue
+				}
+				ip, ok := netip.AddrFromSlice(ipnet.IP)
+				if !ok {
+					continue
+				}
+				ones, _ := ipnet.Mask.Size()
+				info.Prefixes = append(info.Prefixes, netip.PrefixFrom(ip.Unmap(), ones))
+			}
+		}
+		infos[nif.Name] = info
+	}
+	return infos
+}
+
+// MetadataEditor is a pcapng block editor that adds capture session meta data
+// to section header blocks and network interface meta data to interface
+// description blocks.
+type MetadataEditor struct {
+	session        *SessionInfo
+	interfaces     map[string]*InterfaceInfo
+	containersOnce sync.Once
+	containersFn   func() []*ContainerDetails
+	containers     []*ContainerDetails
+}
+
+// NewMetadataEditor returns a new meta data editor for the specified capture
+// session, network interfaces (indexed by name), and the containers attached
+// to the captured network stack. The containers are only gathered when the
+// first interface description block passes, so as to not delay starting the
+// capture.
+func NewMetadataEditor(session *SessionInfo, interfaces map[string]*InterfaceInfo, containers func() []*ContainerDetails) *MetadataEditor {
+	return &MetadataEditor{
+		session:      session,
+		interfaces:   interfaces,
+		containersFn: containers,
+	}
+}
+
+// EditBlock adds meta data to SHBs and IDBs.
+func (m *MetadataEditor) EditBlock(s *BlockStream, blk *Block) []*Block {
+	switch blk.Type {
+	case BlockTypeSHB:
+		y, err := yaml.Marshal(m.session)
+		if err != nil {
+			log.Errorf("cannot create capture session YAML meta data: %s", err.Error())
+			return []*Block{blk}
+		}
+		return []*Block{AppendOptions(blk, 16, s.Endian, &pcapng.Option{
+			Code:  pcapng.OptComment,
+			Value: []byte(sessionmarker + string(y)),
+		})}
+	case BlockTypeIDB:
+		return []*Block{m.editIDB(blk, s.Endian)}
+	}
+	return []*Block{blk}
+}
+
+// editIDB adds the address options and network interface meta data to an
+// Interface Description Block.
+func (m *MetadataEditor) editIDB(blk *Block, endian binary.ByteOrder) *Block {
+	if len(blk.Body) < 8 {
+		return blk
+	}
+	var name string
+	for _, opt := range ParseOptions(blk.Body[8:], endian) {
+		if opt.Code == OptIfName {
+			name = string(opt.Value)
+			break
+		}
+	}
+	// Pseudo network interfaces, such as "any", are unknown to the network
+	// stack, but still belong to the containers.
+	info := m.interfaces[name]
+	if info == nil {
+		info = &InterfaceInfo{}
+	}
+	opts := []*pcapng.Option{}
+	for _, prefix := range info.Prefixes {
+		addr := prefix.Addr()
+		if addr.Is4() {
+			mask := net.CIDRMask(prefix.Bits(), 32)
+			opts = append(opts, &pcapng.Option{
+				Code:  OptIfIPv4Addr,
+				Value: append(addr.AsSlice(), mask...),
+			})
+		} else {
+			opts = append(opts, &pcapng.Option{
+				Code:  OptIfIPv6Addr,
+				Value: append(addr.AsSlice(), byte(prefix.Bits())),
+			})
+		}
+	}
+	if len(info.MAC) == 6 {
+		opts = append(opts, &pcapng.Option{
+			Code:  OptIfMACAddr,
+			Value: append([]byte{}, info.MAC...),
+		})
+	}
+	m.containersOnce.Do(func() { m.containers = m.containersFn() })
+	details := *info
+	details.Containers = m.containers
+	if y, err := yaml.Marshal(&details); err == nil {
+		opts = append(opts, &pcapng.Option{
+			Code:  pcapng.OptComment,
+			Value: []byte(interfacemarker + string(y)),
+		})
+	} else {
+		log.Errorf("cannot create network interface YAML meta data: %s", err.Error())
+	}
+	return AppendOptions(blk, 8, endian, opts...)
+}
@@ -0,0 +1,196 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Mirrors captured packets to a collector, such as an IDS appliance, instead
+// of streaming them to the capture client. The packets get encapsulated as
+// Ethernet frames in VXLAN, GRE (transparent Ethernet bridging), or ERSPAN
+// type II or III. GRE and ERSPAN are sent either directly over IP, or in UDP
+// (GRE-in-UDP) if the collector is specified including a port.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// Mirror encapsulations.
+const (
+	MirrorVXLAN   = "vxlan"
+	MirrorGRE     = "gre"
+	MirrorERSPAN2 = "erspan2"
+	MirrorERSPAN3 = "erspan3"
+)
+
+// MirrorEncapsulations lists the supported mirror encapsulations.
+var MirrorEncapsulations = map[string]bool{
+	MirrorVXLAN:   true,
+	MirrorGRE:     true,
+	MirrorERSPAN2: true,
+	MirrorERSPAN3: true,
+}
+
+// Well-known ports and protocol numbers of the mirror encapsulations.
+const (
+	VXLANPort       = 4789
+	IPProtoGRE      = 47
+	GREProtoTEB     = uint16(0x6558) // transparent Ethernet bridging.
+	GREProtoERSPAN2 = uint16(0x88be) // ERSPAN type II.
+	GREProtoERSPAN3 = uint16(0x22eb) // ERSPAN type III.
+	GREFlagSeq      = uint16(0x1000) // sequence number present.
+)
+
+// MaxERSPANSession is the maximum ERSPAN session ID.
+const MaxERSPANSession = 1023
+
+// Mirror is a pcapng block editor that sends the captured packets
+// encapsulated to a collector. All blocks pass unchanged.
+type Mirror struct {
+	conn    *WSConn
+	encap   string
+	sock    net.Conn
+	vni     uint32 // VXLAN network identifier.
+	session uint16 // ERSPAN session ID.
+	seq     uint32 // GRE sequence number for ERSPAN.
+	sent    atomic.Uint64
+	octets  atomic.Uint64
+	skipped atomic.Uint64 // packets that couldn't be turned into Ethernet frames.
+	failed  atomic.Uint64 // packets that couldn't be sent.
+}
+
+// NewMirror returns a new mirror sending packets to the specified collector
+// address, which is either a host name or address, or a host with port. For
+// VXLAN, the port defaults to the well-known VXLAN port; for GRE and ERSPAN,
+// a port switches from sending over IP to GRE-in-UDP.
+func NewMirror(conn *WSConn, collector string, encap string, vni uint32, session uint16) (*Mirror, error) {
+	host, port, err := net.SplitHostPort(collector)
+	if err != nil {
+		host, port = collector, ""
+		if encap == MirrorVXLAN {
+			port = strconv.Itoa(VXLANPort)
+		}
+	}
+	var sock net.Conn
+	if port != "" {
+		sock, err = net.Dial("udp", net.JoinHostPort(host, port))
+	} else {
+		// Raw IP needs the network to be explicit about the IP version.
+		var addr *net.IPAddr
+		if addr, err = net.ResolveIPAddr("ip", host); err == nil {
+			network := "ip4"
+			if addr.IP.To4() == nil {
+				network = "ip6"
+			}
+			sock, err = net.DialIP(fmt.Sprintf("%s:%d", network, IPProtoGRE), nil, addr)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach collector %s: %s", collector, err.Error())
+	}
+	return &Mirror{
+		conn:    conn,
+		encap:   encap,
+		sock:    sock,
+		vni:     vni,
+		session: session,
+	}, nil
+}
+
+// EditBlock mirrors packet blocks, passing all blocks on unchanged.
+func (m *Mirror) EditBlock(s *BlockStream, blk *Block) []*Block {
+	if blk.Type != BlockTypeEPB {
+		return []*Block{blk}
+	}
+	pkt := ParseEnhancedPacket(blk, s.Endian)
+	if pkt == nil {
+		return []*Block{blk}
+	}
+	nif := s.Interface(pkt.InterfaceID)
+	if nif == nil {
+		return []*Block{blk}
+	}
+	frame := ethernetFrame(nif.LinkType, pkt.Data)
+	if frame == nil {
+		m.skipped.Add(1)
+		return []*Block{blk}
+	}
+	var hdr []byte
+	switch m.encap {
+	case MirrorVXLAN:
+		hdr = make([]byte, 8)
+		hdr[0] = 0x08 // VNI present.
+		binary.BigEndian.PutUint32(hdr[4:8], m.vni<<8)
+	case MirrorGRE:
+		hdr = make([]byte, 4)
+		binary.BigEndian.PutUint16(hdr[2:4], GREProtoTEB)
+	case MirrorERSPAN2:
+		hdr = m.greSeq(GREProtoERSPAN2, 8)
+		erspan := hdr[8:]
+		binary.BigEndian.PutUint16(erspan[0:2], 1<<12) // version 1, no VLAN.
+		binary.BigEndian.PutUint16(erspan[2:4], m.session&0x3ff)
+		binary.BigEndian.PutUint32(erspan[4:8], pkt.InterfaceID&0xfffff)
+	case MirrorERSPAN3:
+		hdr = m.greSeq(GREProtoERSPAN3, 12)
+		erspan := hdr[8:]
+		binary.BigEndian.PutUint16(erspan[0:2], 2<<12) // version 2, no VLAN.
+		binary.BigEndian.PutUint16(erspan[2:4], m.session&0x3ff)
+		// Timestamp with 100µs granularity (Gra=0), Ethernet frame (FT=0),
+		// hardware ID from the interface.
+		ns := ticksToNanos(pkt.Timestamp, nif.TsResol)
+		binary.BigEndian.PutUint32(erspan[4:8], uint32(ns/100000))
+		binary.BigEndian.PutUint16(erspan[10:12], uint16(pkt.InterfaceID&0x3f)<<4)
+	}
+	if _, err := m.sock.Write(append(hdr, frame...)); err != nil {
+		if m.failed.Add(1) == 1 {
+			m.conn.Errorf("cannot mirror packet: %s", err.Error())
+		}
+		return []*Block{blk}
+	}
+	m.sent.Add(1)
+	m.octets.Add(uint64(len(frame)))
+	return []*Block{blk}
+}
+
+// greSeq returns a new GRE header with sequence number for the specified
+// protocol, followed by room for the specified number of octets.
+func (m *Mirror) greSeq(proto uint16, room int) []byte {
+	hdr := make([]byte, 8+room)
+	binary.BigEndian.PutUint16(hdr[0:2], GREFlagSeq)
+	binary.BigEndian.PutUint16(hdr[2:4], proto)
+	binary.BigEndian.PutUint32(hdr[4:8], m.seq)
+	m.seq++
+	return hdr
+}
+
+// Close closes the connection to the collector and logs the mirror
+// statistics.
+func (m *Mirror) Close() {
+	m.sock.Close()
+	m.conn.Debugf("mirrored %d packets (%d octets) to %s, %d skipped, %d failed",
+		m.sent.Load(), m.octets.Load(), m.sock.RemoteAddr(),
+		m.skipped.Load(), m.failed.Load())
+}
+
+// ethernetFrame returns the specified packet data as an Ethernet frame. Packet
+// data of other link types gets a synthesized Ethernet header, using the
+// source link-layer address if known. If the network layer protocol cannot be
+// determined, nil is returned.
+func ethernetFrame(linktype uint16, data []byte) []byte {
+	if linktype == LinkTypeEthernet {
+		return data
+	}
+	p := DecodePacket(linktype, data)
+	if p.L3Offset < 0 {
+		return nil
+	}
+	frame := make([]byte, 14, 14+len(data)-p.L3Offset)
+	if linktype == LinkTypeLinuxSLL && binary.BigEndian.Uint16(data[4:6]) == 6 {
+		copy(frame[6:12], data[6:12])
+	}
+	binary.BigEndian.PutUint16(frame[12:14], p.L3Proto)
+	return append(frame, data[p.L3Offset:]...)
+}
@@ -0,0 +1,131 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEthernetFrame(t *testing.T) {
+	tcp4 := testIPv4Packet(IPProtoTCP, "10.0.0.1", "10.0.0.2", 1234, 80, 0).Data
+	udp6 := testIPv6Packet(IPProtoUDP, "fd00::1", "fd00::2", 5353, 53, false).Data
+	eth := testEthernet(EtherTypeIPv4, tcp4)
+	copy(eth[0:12], []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1})
+
+	sll := testLinuxSLL(EtherTypeIPv4, tcp4)
+	binary.BigEndian.PutUint16(sll[4:6], 6) // link-layer address length
+	copy(sll[6:12], []byte{2, 0, 0, 0, 0, 1})
+	sllnoaddr := testLinuxSLL(EtherTypeIPv6, udp6)
+
+	withHeader := func(src []byte, ethertype uint16, payload []byte) []byte {
+		frame := make([]byte, 14, 14+len(payload))
+		copy(frame[6:12], src)
+		binary.BigEndian.PutUint16(frame[12:14], ethertype)
+		return append(frame, payload...)
+	}
+
+	tests := []struct {
+		name     string
+		linktype uint16
+		data     []byte
+		frame    []byte
+	}{
+		{"Ethernet", LinkTypeEthernet, eth, eth},
+		{"raw IPv4", LinkTypeRaw, tcp4, withHeader(nil, EtherTypeIPv4, tcp4)},
+		{"raw IPv6", LinkTypeIPv6, udp6, withHeader(nil, EtherTypeIPv6, udp6)},
+		{"Linux SLL with source address", LinkTypeLinuxSLL, sll,
+			withHeader([]byte{2, 0, 0, 0, 0, 1}, EtherTypeIPv4, tcp4)},
+		{"Linux SLL without source address", LinkTypeLinuxSLL, sllnoaddr,
+			withHeader(nil, EtherTypeIPv6, udp6)},
+		{"Linux SLL2", LinkTypeLinuxSLL2, testLinuxSLL2(EtherTypeIPv4, tcp4),
+			withHeader(nil, EtherTypeIPv4, tcp4)},
+		{"raw unknown version", LinkTypeRaw, []byte{0x50, 0, 0, 0}, nil},
+	}
+	for _, tt := range tests {
+		if frame := ethernetFrame(tt.linktype, tt.data); !bytes.Equal(frame, tt.frame) {
+			t.Errorf("%s: got frame\n%x\nwant\n%x", tt.name, frame, tt.frame)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	tcp4 := testIPv4Packet(IPProtoTCP, "10.0.0.1", "10.0.0.2", 1234, 80, 0).Data
+	frame := append([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x08, 0x00}, tcp4...)
+
+	// The interface ID exceeds the ERSPAN type III hardware ID field, so that
+	// it gets masked; the timestamp is 1.234567s in microseconds.
+	const ifid = 0x47
+	tests := []struct {
+		encap string
+		hdr   func(seq uint32) []byte
+	}{
+		{MirrorVXLAN, func(uint32) []byte {
+			return []byte{0x08, 0, 0, 0, 0x12, 0x34, 0x56, 0}
+		}},
+		{MirrorGRE, func(uint32) []byte {
+			return []byte{0, 0, 0x65, 0x58}
+		}},
+		{MirrorERSPAN2, func(seq uint32) []byte {
+			return []byte{
+				0x10, 0, 0x88, 0xbe, 0, 0, 0, byte(seq), // GRE with sequence number
+				0x10, 0, 0x01, 0x23, // version 1, session 0x123
+				0, 0, 0, 0x47, // index
+			}
+		}},
+		{MirrorERSPAN3, func(seq uint32) []byte {
+			return []byte{
+				0x10, 0, 0x22, 0xeb, 0, 0, 0, byte(seq), // GRE with sequence number
+				0x20, 0, 0x01, 0x23, // version 2, session 0x123
+				0, 0, 0x30, 0x39, // timestamp in 100µs
+				0, 0, 0x00, 0x70, // SGT, hardware ID
+			}
+		}},
+	}
+	for _, tt := range tests {
+		collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := NewMirror(&WSConn{ID: "test"}, collector.LocalAddr().String(), tt.encap, 0x123456, 0x1123)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &BlockStream{
+			Endian:     binary.LittleEndian,
+			Interfaces: make([]*Interface, ifid+1),
+		}
+		s.Interfaces[ifid] = &Interface{LinkType: LinkTypeRaw, TsResol: 6}
+		pkt := &EnhancedPacket{
+			InterfaceID: ifid,
+			Timestamp:   1234567,
+			OrigLen:     uint32(len(tcp4)),
+			Data:        tcp4,
+		}
+		buf := make([]byte, 2048)
+		for seq := uint32(0); seq < 2; seq++ {
+			if blks := m.EditBlock(s, pkt.Block(s.Endian)); len(blks) != 1 {
+				t.Fatalf("%s: got %d blocks, want 1", tt.encap, len(blks))
+			}
+			collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := collector.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.encap, err.Error())
+			}
+			if want := append(tt.hdr(seq), frame...); !bytes.Equal(buf[:n], want) {
+				t.Errorf("%s: got\n%x\nwant\n%x", tt.encap, buf[:n], want)
+			}
+		}
+		m.Close()
+		collector.Close()
+		if m.sent.Load() != 2 || m.octets.Load() != uint64(2*len(frame)) {
+			t.Errorf("%s: got %d packets (%d octets) sent, want 2 (%d octets)",
+				tt.encap, m.sent.Load(), m.octets.Load(), 2*len(frame))
+		}
+	}
+}
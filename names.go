@@ -0,0 +1,302 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Emits pcapng Name Resolution Blocks with the host names as known to the
+// capture target, instead of leaving name resolution to the capture client,
+// which usually has a completely different (DNS) view. The host names come
+// from the capture target's /etc/hosts, from the other capture targets known
+// to the discovery service, and from DNS responses in the captured traffic.
+
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name Resolution Block record types.
+const (
+	NRBRecordEnd  = uint16(0)
+	NRBRecordIPv4 = uint16(1)
+	NRBRecordIPv6 = uint16(2)
+)
+
+// NameCacheSize is the maximum number of name entries remembered per name
+// resolver in order to not emit them repeatedly; the least recently seen name
+// entries get evicted first, and are thus emitted again when seen again.
+const NameCacheSize = 4096
+
+// dnsPorts are the UDP ports of DNS and multicast DNS.
+var dnsPorts = map[uint16]bool{53: true, 5353: true}
+
+// NameEntry maps an IP address to a host name.
+type NameEntry struct {
+	Addr netip.Addr
+	Name string
+}
+
+// NameResolver is a pcapng block editor that learns host names from DNS
+// responses in the packet capture stream, and emits Name Resolution Blocks
+// for new host names. Additionally, it injects Name Resolution Blocks with the
+// names from the capture target's /etc/hosts and from other capture targets.
+// The name entries already emitted are bounded to NameCacheSize entries,
+// evicting the least recently seen ones.
+type NameResolver struct {
+	conn   *WSConn
+	stream *BlockStream
+	mu     sync.Mutex                  // protects known and lru.
+	known  map[NameEntry]*list.Element // name entries already emitted.
+	lru    *list.List                  // name entries, most recently seen first.
+}
+
+// NewNameResolver returns a new name resolver emitting Name Resolution Blocks
+// into the specified block stream.
+func NewNameResolver(conn *WSConn, stream *BlockStream) *NameResolver {
+	return &NameResolver{
+		conn:   conn,
+		stream: stream,
+		known:  map[NameEntry]*list.Element{},
+		lru:    list.New(),
+	}
+}
+
+// EditBlock looks for DNS responses in Enhanced Packet Blocks, adding a Name
+// Resolution Block with new host names after the packet.
+func (r *NameResolver) EditBlock(s *BlockStream, blk *Block) []*Block {
+	if blk.Type != BlockTypeEPB {
+		return []*Block{blk}
+	}
+	pkt := ParseEnhancedPacket(blk, s.Endian)
+	if pkt == nil {
+		return []*Block{blk}
+	}
+	nif := s.Interface(pkt.InterfaceID)
+	if nif == nil {
+		return []*Block{blk}
+	}
+	p := DecodePacket(nif.LinkType, pkt.Data)
+	if p.L4Proto != IPProtoUDP {
+		return []*Block{blk}
+	}
+	if srcport, _ := p.Ports(); !dnsPorts[srcport] {
+		return []*Block{blk}
+	}
+	entries := r.fresh(parseDNSResponse(p.Payload()))
+	if len(entries) == 0 {
+		return []*Block{blk}
+	}
+	return []*Block{blk, NameResolutionBlock(entries, s.Endian)}
+}
+
+// Run gathers the host names from the capture target's /etc/hosts (as seen by
+// the process with the specified PID, if non-zero), as well as from the other
+// capture targets known to the discovery service, and then injects them as
+// soon as the packet capture stream is ready, or until the done channel gets
+// closed.
+func (r *NameResolver) Run(pid int, done <-chan struct{}) {
+	entries := []NameEntry{}
+	if pid > 0 {
+		if f, err := OpenRegularFileInContainer(pid, "/etc/hosts"); err == nil {
+			entries = append(entries, parseHosts(f)...)
+			f.Close()
+		} else {
+			r.conn.Debugf("cannot read capture target's hosts: %s", err.Error())
+		}
+	}
+	if targets, err := discoveredTargets(); err == nil {
+		for _, t := range targets {
+			if t.Pid <= 0 || t.Name == "" {
+				continue
+			}
+			for _, addr := range NetnsAddresses(t.Pid) {
+				entries = append(entries, NameEntry{Addr: addr, Name: t.Name})
+			}
+		}
+	} else {
+		r.conn.Debugf("cannot query discovery service for capture targets: %s", err.Error())
+	}
+	entries = r.fresh(entries)
+	if len(entries) == 0 {
+		return
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if endian, nifs := r.stream.Section(); endian != nil && len(nifs) > 0 {
+			if r.stream.Inject(NameResolutionBlock(entries, endian)) {
+				r.conn.Debugf("injected %d name resolution entries", len(entries))
+			}
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fresh returns only those entries not seen before, remembering them.
+func (r *NameResolver) fresh(entries []NameEntry) []NameEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	freshies := []NameEntry{}
+	for _, entry := range entries {
+		if el, ok := r.known[entry]; ok {
+			r.lru.MoveToFront(el)
+			continue
+		}
+		r.known[entry] = r.lru.PushFront(entry)
+		if r.lru.Len() > NameCacheSize {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.known, oldest.Value.(NameEntry))
+		}
+		freshies = append(freshies, entry)
+	}
+	return freshies
+}
+
+// NameResolutionBlock returns a Name Resolution Block with the specified name
+// entries.
+func NameResolutionBlock(entries []NameEntry, endian binary.ByteOrder) *Block {
+	body := []byte{}
+	record := func(typ uint16, value []byte) {
+		hdr := make([]byte, 4)
+		endian.PutUint16(hdr[0:2], typ)
+		endian.PutUint16(hdr[2:4], uint16(len(value)))
+		body = append(body, hdr...)
+		body = append(body, value...)
+		if pad := len(value) & 0x3; pad != 0 {
+			body = append(body, make([]byte, 4-pad)...)
+		}
+	}
+	for _, entry := range entries {
+		addr := entry.Addr.Unmap()
+		value := append(addr.AsSlice(), entry.Name...)
+		value = append(value, 0)
+		if addr.Is4() {
+			record(NRBRecordIPv4, value)
+		} else {
+			record(NRBRecordIPv6, value)
+		}
+	}
+	record(NRBRecordEnd, nil)
+	return &Block{Type: BlockTypeNRB, Body: body}
+}
+
+// parseHosts returns the name entries from a hosts file.
+func parseHosts(r io.Reader) (entries []NameEntry) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || addr.IsLoopback() {
+			continue
+		}
+		for _, name := range fields[1:] {
+			entries = append(entries, NameEntry{Addr: addr, Name: name})
+		}
+	}
+	return
+}
+
+// parseDNSResponse returns the A and AAAA name entries from a DNS response
+// message. Additionally, if the response answers a question via a CNAME chain,
+// the question name is also mapped onto the addresses.
+func parseDNSResponse(msg []byte) (entries []NameEntry) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 { // not a response
+		return nil
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+	offset := 12
+	questions := []string{}
+	for i := 0; i < qdcount; i++ {
+		name, next, ok := dnsName(msg, offset)
+		if !ok || next+4 > len(msg) {
+			return nil
+		}
+		questions = append(questions, name)
+		offset = next + 4
+	}
+	for i := 0; i < ancount; i++ {
+		name, next, ok := dnsName(msg, offset)
+		if !ok || next+10 > len(msg) {
+			return
+		}
+		rrtype := binary.BigEndian.Uint16(msg[next:])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		if rdata+rdlen > len(msg) {
+			return
+		}
+		var addr netip.Addr
+		switch {
+		case rrtype == 1 && rdlen == 4: // A
+			addr = netip.AddrFrom4([4]byte(msg[rdata : rdata+4]))
+		case rrtype == 28 && rdlen == 16: // AAAA
+			addr = netip.AddrFrom16([16]byte(msg[rdata : rdata+16]))
+		}
+		if addr.IsValid() && name != "" {
+			entries = append(entries, NameEntry{Addr: addr, Name: name})
+			for _, q := range questions {
+				if !strings.EqualFold(q, name) && q != "" {
+					entries = append(entries, NameEntry{Addr: addr, Name: q})
+				}
+			}
+		}
+		offset = rdata + rdlen
+	}
+	return
+}
+
+// dnsName decodes the (possibly compressed) domain name at the specified
+// offset in a DNS message, returning the name and the offset following the
+// name.
+func dnsName(msg []byte, offset int) (name string, next int, ok bool) {
+	labels := []string{}
+	next = -1
+	for jumps := 0; jumps < 16; {
+		if offset >= len(msg) {
+			return "", 0, false
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, true
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, false
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+		case length&0xc0 != 0:
+			return "", 0, false
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, false
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+	return "", 0, false
+}
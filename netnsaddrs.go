@@ -0,0 +1,98 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Determines the IP addresses assigned to the network interfaces inside a
+// network namespace, based on the procfs view of a process attached to this
+// network namespace. This avoids having to switch into the network namespace
+// first.
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// NetnsAddresses returns the (non-loopback and non-link-local) IPv4 and IPv6
+// addresses assigned to the network interfaces in the network namespace of the
+// process with the specified PID.
+func NetnsAddresses(pid int) (addrs []netip.Addr) {
+	// IPv4 addresses are the "/32 host LOCAL" entries in the local routing
+	// table, where each entry follows the line with its address.
+	if f, err := os.Open(fmt.Sprintf("/proc/%d/net/fib_trie", pid)); err == nil {
+		seen := map[netip.Addr]bool{}
+		var last netip.Addr
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if ip, ok := strings.CutPrefix(line, "|-- "); ok {
+				last, _ = netip.ParseAddr(ip)
+				continue
+			}
+			if line == "/32 host LOCAL" && last.IsValid() && !seen[last] && usableAddress(last) {
+				seen[last] = true
+				addrs = append(addrs, last)
+			}
+		}
+		f.Close()
+	}
+	// IPv6 addresses are conveniently listed in if_inet6.
+	for _, ifaddr := range netnsIPv6Addresses(pid) {
+		if usableAddress(ifaddr.Addr) {
+			addrs = append(addrs, ifaddr.Addr)
+		}
+	}
+	return
+}
+
+// InterfaceAddr is an IP address with prefix length assigned to a specific
+// network interface.
+type InterfaceAddr struct {
+	Interface string
+	Prefix    netip.Prefix
+	Addr      netip.Addr
+}
+
+// netnsIPv6Addresses returns the IPv6 addresses of all network interfaces in
+// the network namespace of the process with the specified PID.
+func netnsIPv6Addresses(pid int) (addrs []InterfaceAddr) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/if_inet6", pid))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address, ifindex, prefix length, scope, flags, interface name.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[0])
+		if err != nil || len(raw) != 16 {
+			continue
+		}
+		var plen int
+		if _, err := fmt.Sscanf(fields[2], "%x", &plen); err != nil {
+			continue
+		}
+		addr := netip.AddrFrom16([16]byte(raw))
+		addrs = append(addrs, InterfaceAddr{
+			Interface: fields[5],
+			Prefix:    netip.PrefixFrom(addr, plen),
+			Addr:      addr,
+		})
+	}
+	return
+}
+
+// usableAddress returns true if the specified address is neither a loopback
+// nor a link-local address, so it is useful to others.
+func usableAddress(addr netip.Addr) bool {
+	return !addr.IsLoopback() && !addr.IsLinkLocalUnicast() && !addr.IsUnspecified()
+}
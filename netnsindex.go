@@ -0,0 +1,327 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Maintains an index of the network namespaces and processes on this host, so
+// that locating a network namespace by its inode number, or the processes
+// attached to it, doesn't need to walk all processes and mounts each time a
+// capture starts. The index is based on lxkns namespace discoveries, which are
+// only rerun lazily whenever a lookup misses the index, and never more often
+// than once per NetnsDiscoveryHoldoff.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thediveo/go-mntinfo"
+	"github.com/thediveo/lxkns/discover"
+	"github.com/thediveo/lxkns/model"
+	"github.com/thediveo/lxkns/species"
+)
+
+// mntnsRefRegexp matches process-based mount namespace references, capturing
+// the PID.
+var mntnsRefRegexp = regexp.MustCompile(`^/proc/(\d+)/ns/mnt$`)
+
+// NetnsDiscoveryHoldoff is the minimum time between two discoveries of the
+// network namespaces, so that lookups of bogus network namespaces or frequent
+// process lookups cannot cause a discovery storm.
+const NetnsDiscoveryHoldoff = 2 * time.Second
+
+// NetnsProcessesMaxAge is the maximum age of the indexed processes before
+// looking up the processes attached to a network namespace rediscovers them,
+// in order to pick up processes that have been started in the meantime.
+const NetnsProcessesMaxAge = 30 * time.Second
+
+// Netnses is the index of the network namespaces on this host.
+var Netnses = NewNetnsIndex()
+
+// NetnsRef is a stable reference to a network namespace: either by a process
+// attached to the network namespace, which is protected against PID reuse by
+// its start time, or by the paths where the network namespace is
+// bind-mounted.
+type NetnsRef struct {
+	Netns      uint64   // inode number of the network namespace.
+	PID        int      // PID of the most senior process attached; zero if none.
+	Starttime  int64    // start time of the process PID.
+	Bindmounts []string // paths of bind-mounts of the network namespace.
+}
+
+// Path returns a currently valid filesystem path referencing the network
+// namespace, or an empty string if none of the references is valid anymore.
+func (r *NetnsRef) Path() string {
+	if r.PID > 0 {
+		if starttime, err := processStarttime(r.PID); err == nil && starttime == r.Starttime {
+			if netns, err := processNetns(r.PID); err == nil && netns == r.Netns {
+				return fmt.Sprintf("/proc/%d/ns/net", r.PID)
+			}
+		}
+	}
+	for _, path := range r.Bindmounts {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(path, &stat); err == nil && stat.Ino == r.Netns {
+			return path
+		}
+	}
+	return ""
+}
+
+// IndexedProcess is a process known to the index, protected against PID reuse
+// by its start time.
+type IndexedProcess struct {
+	PID       int
+	Starttime int64
+	Netns     uint64 // inode number of the process' network namespace.
+	Cgroup    string // (unified or CPU controller) cgroup path.
+}
+
+// Alive returns true if the indexed process is still alive and still attached
+// to the same network namespace.
+func (p *IndexedProcess) Alive() bool {
+	if starttime, err := processStarttime(p.PID); err != nil || starttime != p.Starttime {
+		return false
+	}
+	netns, err := processNetns(p.PID)
+	return err == nil && netns == p.Netns
+}
+
+// NetnsIndex indexes network namespaces by their inode numbers, as well as
+// the processes attached to them.
+type NetnsIndex struct {
+	mu        sync.RWMutex // protects refs and procs.
+	refs      map[uint64]*NetnsRef
+	procs     map[uint64][]*IndexedProcess // processes, by network namespace.
+	refreshMu sync.Mutex                   // serializes discoveries and protects refreshed.
+	refreshed time.Time                    // when the last discovery finished.
+}
+
+// NewNetnsIndex returns a new, yet empty network namespace index. The index
+// gets populated lazily on the first lookup.
+func NewNetnsIndex() *NetnsIndex {
+	return &NetnsIndex{
+		refs:  map[uint64]*NetnsRef{},
+		procs: map[uint64][]*IndexedProcess{},
+	}
+}
+
+// Lookup returns a stable reference to the network namespace with the
+// specified inode number, as well as a currently valid filesystem path to it.
+// If the network namespace isn't indexed, or its references have turned
+// invalid, then Lookup rediscovers the network namespaces once before giving
+// up, returning a nil reference.
+func (x *NetnsIndex) Lookup(netns uint64) (*NetnsRef, string) {
+	started := time.Now()
+	for attempt := 0; attempt < 2; attempt++ {
+		x.mu.RLock()
+		ref := x.refs[netns]
+		x.mu.RUnlock()
+		if ref != nil {
+			if path := ref.Path(); path != "" {
+				return ref, path
+			}
+		}
+		if attempt == 0 {
+			x.refresh(started)
+		}
+	}
+	return nil, ""
+}
+
+// Processes returns the PIDs of the (still alive) processes attached to the
+// network namespace with the specified inode number, ordered by their start
+// times. Processes rediscovers the network namespaces only if the index is
+// older than the specified point in time, but not when there are no (alive)
+// indexed processes, as network namespaces without any processes are
+// perfectly fine.
+func (x *NetnsIndex) Processes(netns uint64, notBefore time.Time) []int {
+	x.refreshMu.Lock()
+	stale := x.refreshed.Before(notBefore)
+	x.refreshMu.Unlock()
+	if stale {
+		x.refresh(notBefore)
+	}
+	x.mu.RLock()
+	procs := x.procs[netns]
+	x.mu.RUnlock()
+	pids := []int{}
+	for _, proc := range procs {
+		if proc.Alive() {
+			pids = append(pids, proc.PID)
+		}
+	}
+	return pids
+}
+
+// CgroupProcess returns the PID of the process that belongs to the specified
+// cgroup (or any of its child cgroups) and has been started first. The cgroup
+// is either specified as an absolute cgroup path, such as
+// "/system.slice/sshd.service", or by its final path element only, such as
+// "sshd.service". If no indexed process matches, then CgroupProcess
+// rediscovers the processes once before giving up.
+func (x *NetnsIndex) CgroupProcess(cgroup string) (int, error) {
+	if strings.HasPrefix(cgroup, "/") {
+		cgroup = path.Clean(cgroup)
+	}
+	if cgroup == "" || cgroup == "/" || cgroup == "." || cgroup == ".." {
+		return 0, fmt.Errorf("invalid cgroup %q", cgroup)
+	}
+	matches := func(cgpath string) bool {
+		if !strings.HasPrefix(cgroup, "/") {
+			for cgpath != "/" && cgpath != "." && cgpath != "" {
+				if path.Base(cgpath) == cgroup {
+					return true
+				}
+				cgpath = path.Dir(cgpath)
+			}
+			return false
+		}
+		return cgpath == cgroup || strings.HasPrefix(cgpath, cgroup+"/")
+	}
+	started := time.Now()
+	for attempt := 0; attempt < 2; attempt++ {
+		alive := []*IndexedProcess{}
+		x.mu.RLock()
+		for _, procs := range x.procs {
+			for _, proc := range procs {
+				if matches(proc.Cgroup) {
+					alive = append(alive, proc)
+				}
+			}
+		}
+		x.mu.RUnlock()
+		// Prefer the process started first, as this usually is the "root"
+		// process, such as a service's main process. Skip processes that
+		// have terminated in the meantime.
+		sort.SliceStable(alive, func(a, b int) bool {
+			return alive[a].Starttime < alive[b].Starttime
+		})
+		for _, proc := range alive {
+			if proc.Alive() {
+				return proc.PID, nil
+			}
+		}
+		if attempt == 0 {
+			x.refresh(started)
+		}
+	}
+	return 0, fmt.Errorf("no processes in cgroup %q", cgroup)
+}
+
+// refresh rediscovers the network namespaces, unless there has been a
+// discovery finishing after the specified point in time. This way, concurrent
+// lookups missing the index cause only a single rediscovery. Discoveries are
+// globally rate-limited: if the last discovery finished less than
+// NetnsDiscoveryHoldoff ago, then refresh waits for the holdoff to pass.
+func (x *NetnsIndex) refresh(after time.Time) {
+	x.refreshMu.Lock()
+	defer x.refreshMu.Unlock()
+	if x.refreshed.After(after) {
+		return
+	}
+	if wait := NetnsDiscoveryHoldoff - time.Since(x.refreshed); wait > 0 {
+		time.Sleep(wait)
+	}
+	started := time.Now()
+	refs, procs := discoverNetnses()
+	x.mu.Lock()
+	added, removed := 0, 0
+	for netns := range x.refs {
+		if _, ok := refs[netns]; !ok {
+			removed++
+		}
+	}
+	for netns := range refs {
+		if _, ok := x.refs[netns]; !ok {
+			added++
+		}
+	}
+	x.refs = refs
+	x.procs = procs
+	x.mu.Unlock()
+	x.refreshed = time.Now()
+	log.Debugf("indexed %d network namespaces (%d new, %d gone) in %s",
+		len(refs), added, removed, x.refreshed.Sub(started))
+}
+
+// discoverNetnses discovers the network namespaces on this host, returning
+// stable references to them, as well as the processes attached to them.
+func discoverNetnses() (map[uint64]*NetnsRef, map[uint64][]*IndexedProcess) {
+	// We always need to discover mount namespaces in order to make the
+	// bind-mounts discovery work, even more so when we're containerized.
+	result := discover.Namespaces(
+		discover.FromProcs(),
+		discover.FromBindmounts(),
+		discover.WithNamespaceTypes(species.CLONE_NEWNET|species.CLONE_NEWNS),
+		discover.WithoutHierarchy(),
+		discover.WithoutOwnership(),
+		discover.WithoutMounts())
+	refs := map[uint64]*NetnsRef{}
+	for nsid, ns := range result.Namespaces[model.NetNS] {
+		ref := &NetnsRef{Netns: nsid.Ino}
+		if proc := ns.Ealdorman(); proc != nil {
+			ref.PID = int(proc.PID)
+			ref.Starttime = int64(proc.Starttime)
+		}
+		// Bind-mounts in other mount namespaces get referenced through the
+		// root directory of a process attached to that mount namespace.
+		switch nsref := ns.Ref(); {
+		case len(nsref) == 1 && !strings.HasPrefix(nsref[0], "/proc/"):
+			ref.Bindmounts = append(ref.Bindmounts, nsref[0])
+		case len(nsref) == 2:
+			if m := mntnsRefRegexp.FindStringSubmatch(nsref[0]); m != nil {
+				if pid, err := strconv.Atoi(m[1]); err == nil {
+					ref.Bindmounts = append(ref.Bindmounts, fmt.Sprintf("/proc/%d/root%s", pid, nsref[1]))
+				}
+			}
+		}
+		refs[nsid.Ino] = ref
+	}
+	procs := map[uint64][]*IndexedProcess{}
+	for _, proc := range result.Processes {
+		netns := proc.Namespaces[model.NetNS]
+		if netns == nil {
+			continue
+		}
+		nsid := netns.ID()
+		procs[nsid.Ino] = append(procs[nsid.Ino], &IndexedProcess{
+			PID:       int(proc.PID),
+			Starttime: int64(proc.Starttime),
+			Netns:     nsid.Ino,
+			Cgroup:    proc.CpuCgroup,
+		})
+	}
+	for _, netnsprocs := range procs {
+		sort.Slice(netnsprocs, func(a, b int) bool {
+			return netnsprocs[a].Starttime < netnsprocs[b].Starttime
+		})
+	}
+	// Bind-mounts in our own mount namespace are always a useful alternative.
+	for _, mount := range mntinfo.MountsOfType(-1, "nsfs") {
+		finfo, err := os.Stat(mount.MountPoint)
+		if err != nil {
+			continue
+		}
+		stat, ok := finfo.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+		ref, ok := refs[stat.Ino]
+		if !ok {
+			ref = &NetnsRef{Netns: stat.Ino}
+			refs[stat.Ino] = ref
+		}
+		ref.Bindmounts = append(ref.Bindmounts, mount.MountPoint)
+	}
+	return refs, procs
+}
@@ -8,58 +8,82 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
-	"syscall"
-	"unicode"
+	"path/filepath"
+	"strings"
 
-	log "github.com/sirupsen/logrus"
-	"github.com/thediveo/go-mntinfo"
+	"github.com/thediveo/lxkns/ops"
+	"github.com/thediveo/lxkns/species"
+	"golang.org/x/sys/unix"
 )
 
+// NetnsRunDir is the directory where iproute2 bind-mounts named network
+// namespaces.
+const NetnsRunDir = "/run/netns"
+
 // netnsPath returns a filesystem reference to the network namespace in question.
-// It searches both the processes as well as bindmount'ed network namespaces...
+// It looks up the network namespace in the index of network namespaces, which
+// covers both the processes as well as bindmount'ed network namespaces...
 func netnsPath(netns uint64) string {
-	// First search in processes for a suitable netns filesystem reference...
-	procpids, err := ioutil.ReadDir("/proc")
-	if err == nil {
-		for _, procpid := range procpids {
-			// Skip all non-process entries and aliases in /proc.
-			if r := rune(procpid.Name()[0]); !procpid.IsDir() || !unicode.IsDigit(r) {
-				continue
-			}
-			// See which network namespace this process is in -- ignoring
-			// the fact that individual threads might be elsewhere...
-			ref := fmt.Sprintf("/proc/%s/ns/net", procpid.Name())
-			finfo, err := os.Stat(ref)
-			if err != nil {
-				continue
-			}
-			stat, ok := finfo.Sys().(*syscall.Stat_t)
-			if !ok {
-				continue
-			}
-			if stat.Ino == netns {
-				return ref
-			}
-		}
-	} else {
-		log.Errorf("/proc failed: %s", err.Error())
+	_, path := Netnses.Lookup(netns)
+	return path
+}
+
+// OpenNetnsName opens the network namespace either bind-mounted under the
+// specified iproute2-style name in /run/netns, or bind-mounted at the
+// specified absolute path. As Packetflix usually runs in its own mount
+// namespace, the path is first resolved in the host's initial mount namespace,
+// as seen by PID 1, and only then in Packetflix's own mount namespace.
+// OpenNetnsName returns the opened network namespace, its inode number, as
+// well as the path it was found at.
+//
+// The path is opened only as a location (O_PATH) until it has been verified
+// to be an nsfs inode, so that device nodes, FIFOs, et cetera never get
+// actually opened.
+func OpenNetnsName(name string) (f *os.File, netns uint64, path string, err error) {
+	switch {
+	case filepath.IsAbs(name):
+		path = filepath.Clean(name)
+	case name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/'):
+		return nil, 0, "", fmt.Errorf("invalid network namespace name %q", name)
+	default:
+		path = filepath.Join(NetnsRunDir, name)
 	}
-	// Then search bindmount'ed network namespaces for a match...
-	for _, mount := range mntinfo.MountsOfType(-1, "nsfs") {
-		finfo, err := os.Stat(mount.MountPoint)
-		if err != nil {
-			continue
-		}
-		stat, ok := finfo.Sys().(*syscall.Stat_t)
-		if !ok {
-			continue
-		}
-		if stat.Ino == netns {
-			return mount.MountPoint
+	pathf, err := OpenInContainer(1, path, unix.O_PATH)
+	if err != nil {
+		var ownerr error
+		if pathf, ownerr = OpenInContainer(os.Getpid(), path, unix.O_PATH); ownerr != nil {
+			return nil, 0, "", fmt.Errorf("cannot open network namespace %s: %s, and %s",
+				path, err.Error(), ownerr.Error())
 		}
 	}
-	// Nope. Fail. Nothing found here.
-	return ""
+	defer pathf.Close()
+	var fsstat unix.Statfs_t
+	if err := unix.Fstatfs(int(pathf.Fd()), &fsstat); err != nil {
+		return nil, 0, "", fmt.Errorf("cannot stat filesystem of %s: %s", path, err.Error())
+	}
+	if fsstat.Type != unix.NSFS_MAGIC {
+		return nil, 0, "", fmt.Errorf("%s is not a network namespace", path)
+	}
+	// Now that we know that the path refers to a namespace, reopen it for
+	// real, so that it can be queried and entered.
+	f, err = os.Open(fmt.Sprintf("/proc/self/fd/%d", pathf.Fd()))
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("cannot open network namespace %s: %s", path, err.Error())
+	}
+	nsf, err := ops.NewNamespaceFile(f, nil)
+	if err != nil {
+		f.Close()
+		return nil, 0, "", fmt.Errorf("cannot use network namespace %s: %s", path, err.Error())
+	}
+	if nstype, err := nsf.Type(); err != nil || nstype != species.CLONE_NEWNET {
+		f.Close()
+		return nil, 0, "", fmt.Errorf("%s is not a network namespace", path)
+	}
+	nsid, err := nsf.ID()
+	if err != nil {
+		f.Close()
+		return nil, 0, "", fmt.Errorf("cannot identify network namespace %s: %s", path, err.Error())
+	}
+	return f, nsid.Ino, path, nil
 }
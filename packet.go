@@ -0,0 +1,238 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Decodes just enough of captured packets in order to locate their link,
+// network, and transport layer headers, so that we can later truncate, rewrite,
+// or otherwise inspect packets without needing a full-blown dissector.
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Link types of the packet data as used in pcapng Interface Description
+// Blocks; see also: https://www.tcpdump.org/linktypes.html
+const (
+	LinkTypeEthernet  = uint16(1)
+	LinkTypeRaw       = uint16(101)
+	LinkTypeLinuxSLL  = uint16(113)
+	LinkTypeIPv4      = uint16(228)
+	LinkTypeIPv6      = uint16(229)
+	LinkTypeLinuxSLL2 = uint16(276)
+)
+
+// EtherTypes of network layer protocols we know about.
+const (
+	EtherTypeIPv4 = uint16(0x0800)
+	EtherTypeARP  = uint16(0x0806)
+	EtherTypeVLAN = uint16(0x8100)
+	EtherTypeQinQ = uint16(0x88a8)
+	EtherTypeIPv6 = uint16(0x86dd)
+)
+
+// IP protocol numbers of transport layer protocols we know about.
+const (
+	IPProtoICMP   = uint8(1)
+	IPProtoTCP    = uint8(6)
+	IPProtoUDP    = uint8(17)
+	IPProtoICMPv6 = uint8(58)
+	IPProtoSCTP   = uint8(132)
+)
+
+// PacketLayers describes where the link, network, and transport layer headers
+// of a captured packet are located. Offsets are -1 for unknown or missing
+// layers.
+type PacketLayers struct {
+	Data          []byte // captured packet data.
+	LinkType      uint16 // link type of the packet data.
+	L3Proto       uint16 // EtherType of the network layer protocol.
+	L3Offset      int    // offset of the network layer header.
+	L4Proto       uint8  // IP protocol number of the transport layer protocol.
+	L4Offset      int    // offset of the transport layer header.
+	PayloadOffset int    // offset following the last known header.
+}
+
+// DecodePacket locates the link, network, and transport layer headers in the
+// specified packet data, which is of the specified link type.
+func DecodePacket(linktype uint16, data []byte) *PacketLayers {
+	p := &PacketLayers{
+		Data:     data,
+		LinkType: linktype,
+		L3Offset: -1,
+		L4Offset: -1,
+	}
+	switch linktype {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return p
+		}
+		offset := 12
+		ethertype := binary.BigEndian.Uint16(data[offset:])
+		for (ethertype == EtherTypeVLAN || ethertype == EtherTypeQinQ) && len(data) >= offset+6 {
+			offset += 4
+			ethertype = binary.BigEndian.Uint16(data[offset:])
+		}
+		p.PayloadOffset = offset + 2
+		p.network(ethertype, offset+2)
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return p
+		}
+		p.PayloadOffset = 16
+		p.network(binary.BigEndian.Uint16(data[14:16]), 16)
+	case LinkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return p
+		}
+		p.PayloadOffset = 20
+		p.network(binary.BigEndian.Uint16(data[0:2]), 20)
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		if len(data) < 1 {
+			return p
+		}
+		switch data[0] >> 4 {
+		case 4:
+			p.network(EtherTypeIPv4, 0)
+		case 6:
+			p.network(EtherTypeIPv6, 0)
+		}
+	}
+	return p
+}
+
+// network decodes the network layer header of the specified protocol at the
+// specified offset.
+func (p *PacketLayers) network(ethertype uint16, offset int) {
+	data := p.Data
+	switch ethertype {
+	case EtherTypeIPv4:
+		if len(data) < offset+20 || data[offset]>>4 != 4 {
+			return
+		}
+		ihl := int(data[offset]&0x0f) * 4
+		if ihl < 20 || len(data) < offset+ihl {
+			return
+		}
+		p.L3Proto, p.L3Offset, p.PayloadOffset = ethertype, offset, offset+ihl
+		// Only the first fragment carries the transport layer header.
+		if binary.BigEndian.Uint16(data[offset+6:])&0x1fff != 0 {
+			return
+		}
+		p.transport(data[offset+9], offset+ihl)
+	case EtherTypeIPv6:
+		if len(data) < offset+40 || data[offset]>>4 != 6 {
+			return
+		}
+		p.L3Proto, p.L3Offset = ethertype, offset
+		next := data[offset+6]
+		offset += 40
+		p.PayloadOffset = offset
+		// Skip over any extension headers we know of...
+		for {
+			switch next {
+			case 0, 43, 60: // hop-by-hop, routing, destination options
+				if len(data) < offset+2 {
+					return
+				}
+				next, offset = data[offset], offset+(int(data[offset+1])+1)*8
+			case 44: // fragment
+				if len(data) < offset+8 {
+					return
+				}
+				if binary.BigEndian.Uint16(data[offset+2:])&0xfff8 != 0 {
+					p.PayloadOffset = offset + 8
+					return
+				}
+				next, offset = data[offset], offset+8
+			case 51: // authentication header
+				if len(data) < offset+2 {
+					return
+				}
+				next, offset = data[offset], offset+(int(data[offset+1])+2)*4
+			default:
+				if offset > len(data) {
+					return
+				}
+				p.PayloadOffset = offset
+				p.transport(next, offset)
+				return
+			}
+			if offset > len(data) {
+				return
+			}
+			p.PayloadOffset = offset
+		}
+	case EtherTypeARP:
+		if len(data) < offset+8 {
+			return
+		}
+		arplen := 8 + 2*int(data[offset+4]) + 2*int(data[offset+5])
+		if len(data) < offset+arplen {
+			return
+		}
+		p.L3Proto, p.L3Offset, p.PayloadOffset = ethertype, offset, offset+arplen
+	}
+}
+
+// transport decodes the transport layer header of the specified protocol at
+// the specified offset.
+func (p *PacketLayers) transport(proto uint8, offset int) {
+	var hdrlen int
+	switch proto {
+	case IPProtoTCP:
+		if len(p.Data) < offset+20 {
+			return
+		}
+		hdrlen = int(p.Data[offset+12]>>4) * 4
+		if hdrlen < 20 {
+			return
+		}
+	case IPProtoUDP, IPProtoICMP, IPProtoICMPv6:
+		hdrlen = 8
+	case IPProtoSCTP:
+		hdrlen = 12
+	default:
+		return
+	}
+	if len(p.Data) < offset+hdrlen {
+		return
+	}
+	p.L4Proto, p.L4Offset, p.PayloadOffset = proto, offset, offset+hdrlen
+}
+
+// Addresses returns the source and destination IP addresses of the packet, if
+// it has a known IP network layer header; otherwise, nil addresses are
+// returned.
+func (p *PacketLayers) Addresses() (src, dst net.IP) {
+	switch p.L3Proto {
+	case EtherTypeIPv4:
+		return net.IP(p.Data[p.L3Offset+12 : p.L3Offset+16]),
+			net.IP(p.Data[p.L3Offset+16 : p.L3Offset+20])
+	case EtherTypeIPv6:
+		return net.IP(p.Data[p.L3Offset+8 : p.L3Offset+24]),
+			net.IP(p.Data[p.L3Offset+24 : p.L3Offset+40])
+	}
+	return nil, nil
+}
+
+// Ports returns the source and destination ports of TCP, UDP, and SCTP
+// packets; otherwise, zero ports are returned.
+func (p *PacketLayers) Ports() (src, dst uint16) {
+	switch p.L4Proto {
+	case IPProtoTCP, IPProtoUDP, IPProtoSCTP:
+		return binary.BigEndian.Uint16(p.Data[p.L4Offset:]),
+			binary.BigEndian.Uint16(p.Data[p.L4Offset+2:])
+	}
+	return 0, 0
+}
+
+// Payload returns the transport layer payload, if any.
+func (p *PacketLayers) Payload() []byte {
+	if p.L4Offset < 0 || p.PayloadOffset > len(p.Data) {
+		return nil
+	}
+	return p.Data[p.PayloadOffset:]
+}
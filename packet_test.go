@@ -0,0 +1,150 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// testEthernet returns an Ethernet frame with the specified VLAN tags (as
+// pairs of tag protocol identifier and tag control information) carrying the
+// specified network layer packet.
+func testEthernet(ethertype uint16, payload []byte, tags ...uint16) []byte {
+	frame := make([]byte, 12, 64)
+	for _, tag := range tags {
+		frame = binary.BigEndian.AppendUint16(frame, tag)
+	}
+	frame = binary.BigEndian.AppendUint16(frame, ethertype)
+	return append(frame, payload...)
+}
+
+// testLinuxSLL returns a Linux cooked capture (v1) frame carrying the
+// specified network layer packet.
+func testLinuxSLL(ethertype uint16, payload []byte) []byte {
+	frame := make([]byte, 16, 16+len(payload))
+	binary.BigEndian.PutUint16(frame[14:16], ethertype)
+	return append(frame, payload...)
+}
+
+// testLinuxSLL2 returns a Linux cooked capture v2 frame carrying the
+// specified network layer packet.
+func testLinuxSLL2(ethertype uint16, payload []byte) []byte {
+	frame := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(frame[0:2], ethertype)
+	return append(frame, payload...)
+}
+
+func TestDecodePacket(t *testing.T) {
+	tcp4 := testIPv4Packet(IPProtoTCP, "10.0.0.1", "10.0.0.2", 1234, 80, 0).Data
+	udp6 := testIPv6Packet(IPProtoUDP, "fd00::1", "fd00::2", 5353, 53, false).Data
+	exthdr6 := testIPv6Packet(IPProtoTCP, "fd00::1", "fd00::2", 1234, 80, true).Data
+
+	// IPv4 with a 4 octet option, and thus an IHL of 6.
+	opts4 := append([]byte{}, tcp4[:20]...)
+	opts4[0] = 0x46
+	opts4 = append(append(opts4, 1, 1, 1, 0), tcp4[20:]...)
+
+	// TCP with 12 octets of options, and thus a data offset of 8.
+	tcpopts4 := append(append([]byte{}, tcp4...), make([]byte, 12)...)
+	tcpopts4[20+12] = 8 << 4
+
+	// Non-first IPv6 fragment.
+	frag6 := append([]byte{}, udp6[:40]...)
+	frag6[6] = 44
+	frag6 = append(frag6, IPProtoUDP, 0, 0x01, 0x00, 0, 0, 0, 42)
+	frag6 = append(frag6, make([]byte, 16)...)
+
+	tests := []struct {
+		name     string
+		linktype uint16
+		data     []byte
+		l3proto  uint16
+		l3offset int
+		l4proto  uint8
+		l4offset int
+		payload  int
+	}{
+		{"Ethernet IPv4 TCP", LinkTypeEthernet, testEthernet(EtherTypeIPv4, tcp4),
+			EtherTypeIPv4, 14, IPProtoTCP, 34, 54},
+		{"Ethernet VLAN IPv6 UDP", LinkTypeEthernet, testEthernet(EtherTypeIPv6, udp6, EtherTypeVLAN, 42),
+			EtherTypeIPv6, 18, IPProtoUDP, 58, 66},
+		{"Ethernet QinQ IPv4 TCP", LinkTypeEthernet,
+			testEthernet(EtherTypeIPv4, tcp4, EtherTypeQinQ, 1, EtherTypeVLAN, 2),
+			EtherTypeIPv4, 22, IPProtoTCP, 42, 62},
+		{"Ethernet ARP", LinkTypeEthernet, testARPPacket().Data,
+			EtherTypeARP, 14, 0, -1, 42},
+		{"Ethernet unknown", LinkTypeEthernet, testEthernet(0x88cc, make([]byte, 20)),
+			0, -1, 0, -1, 14},
+		{"truncated Ethernet", LinkTypeEthernet, make([]byte, 13),
+			0, -1, 0, -1, 0},
+		{"Linux SLL IPv4 TCP", LinkTypeLinuxSLL, testLinuxSLL(EtherTypeIPv4, tcp4),
+			EtherTypeIPv4, 16, IPProtoTCP, 36, 56},
+		{"Linux SLL2 IPv6 UDP", LinkTypeLinuxSLL2, testLinuxSLL2(EtherTypeIPv6, udp6),
+			EtherTypeIPv6, 20, IPProtoUDP, 60, 68},
+		{"raw IPv4 TCP", LinkTypeRaw, tcp4,
+			EtherTypeIPv4, 0, IPProtoTCP, 20, 40},
+		{"raw IPv4 options", LinkTypeIPv4, opts4,
+			EtherTypeIPv4, 0, IPProtoTCP, 24, 44},
+		{"raw IPv4 TCP options", LinkTypeRaw, tcpopts4,
+			EtherTypeIPv4, 0, IPProtoTCP, 20, 52},
+		{"raw IPv4 fragment", LinkTypeRaw, testIPv4Packet(IPProtoTCP, "10.0.0.1", "10.0.0.2", 0, 0, 100).Data,
+			EtherTypeIPv4, 0, 0, -1, 20},
+		{"raw IPv4 unknown protocol", LinkTypeRaw, testIPv4Packet(47, "10.0.0.1", "10.0.0.2", 0, 0, 0).Data,
+			EtherTypeIPv4, 0, 0, -1, 20},
+		{"raw IPv4 truncated TCP", LinkTypeRaw, tcp4[:30],
+			EtherTypeIPv4, 0, 0, -1, 20},
+		{"raw IPv4 truncated header", LinkTypeRaw, tcp4[:19],
+			0, -1, 0, -1, 0},
+		{"raw IPv6 extension header", LinkTypeIPv6, exthdr6,
+			EtherTypeIPv6, 0, IPProtoTCP, 48, 68},
+		{"raw IPv6 fragment", LinkTypeRaw, frag6,
+			EtherTypeIPv6, 0, 0, -1, 48},
+		{"raw unknown version", LinkTypeRaw, []byte{0x50, 0, 0, 0},
+			0, -1, 0, -1, 0},
+	}
+	for _, tt := range tests {
+		p := DecodePacket(tt.linktype, tt.data)
+		if p.L3Proto != tt.l3proto || p.L3Offset != tt.l3offset ||
+			p.L4Proto != tt.l4proto || p.L4Offset != tt.l4offset ||
+			p.PayloadOffset != tt.payload {
+			t.Errorf("%s: got L3 %#04x@%d, L4 %d@%d, payload @%d; want L3 %#04x@%d, L4 %d@%d, payload @%d",
+				tt.name, p.L3Proto, p.L3Offset, p.L4Proto, p.L4Offset, p.PayloadOffset,
+				tt.l3proto, tt.l3offset, tt.l4proto, tt.l4offset, tt.payload)
+		}
+	}
+}
+
+func TestPacketAddressesPorts(t *testing.T) {
+	tests := []struct {
+		name       string
+		p          *PacketLayers
+		src, dst   net.IP
+		sport      uint16
+		dport      uint16
+		payloadlen int
+	}{
+		{"IPv4 TCP", testIPv4Packet(IPProtoTCP, "10.0.0.1", "10.0.0.2", 1234, 80, 0),
+			net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 1234, 80, 0},
+		{"IPv6 UDP", testIPv6Packet(IPProtoUDP, "fd00::1", "fd00::2", 5353, 53, false),
+			net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), 5353, 53, 12},
+		{"IPv4 ICMP", testIPv4Packet(IPProtoICMP, "10.0.0.1", "10.0.0.2", 0, 0, 0),
+			net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 0, 0, 12},
+		{"ARP", testARPPacket(), nil, nil, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		src, dst := tt.p.Addresses()
+		if !src.Equal(tt.src) || !dst.Equal(tt.dst) {
+			t.Errorf("%s: got addresses %s, %s; want %s, %s", tt.name, src, dst, tt.src, tt.dst)
+		}
+		if sport, dport := tt.p.Ports(); sport != tt.sport || dport != tt.dport {
+			t.Errorf("%s: got ports %d, %d; want %d, %d", tt.name, sport, dport, tt.sport, tt.dport)
+		}
+		if l := len(tt.p.Payload()); l != tt.payloadlen {
+			t.Errorf("%s: got %d payload octets, want %d", tt.name, l, tt.payloadlen)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Compiles capture filter expressions into packet filters that run inside
+// Packetflix itself, instead of inside the kernel. This is needed where there
+// is no live capture (and thus no libpcap) involved, such as when replaying
+// recorded packet captures. Only the commonly used subset of the pcap-filter
+// syntax is supported, matching packets the same way as libpcap does:
+//
+//   - protocols: ip, ip6, arp, tcp, udp, sctp, icmp, icmp6.
+//   - [ip|ip6] proto N|NAME, with N a protocol number and NAME one of the
+//     transport protocols above.
+//   - [ip|ip6] [src|dst] host ADDR, with ADDR a literal IPv4 or IPv6 address
+//     or CIDR prefix; host names aren't supported.
+//   - [ip|ip6] [src|dst] net CIDR, with CIDR an IPv4 or IPv6 prefix; neither
+//     "net N mask M" nor abbreviated networks, such as "net 10", are
+//     supported.
+//   - [tcp|udp|sctp] [src|dst] port N, and ... portrange N-M, with numeric
+//     ports only.
+//   - less N, greater N, comparing the original packet length.
+//   - not/!, and/&&, or/||, parentheses, and abbreviated primitives reusing
+//     the qualifiers of the preceding primitive, such as "port 80 or 443".
+//
+// Differences to libpcap: host and net only match IP packets, but not ARP
+// packets, and transport protocols are also identified behind IPv6 extension
+// headers. Anything else, such as link layer primitives, "src or dst",
+// "src and dst", and packet data accessors, such as "tcp[13]", is rejected.
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// PacketFilter returns true if the specified packet of the specified
+// original length matches.
+type PacketFilter func(p *PacketLayers, length int) bool
+
+// filterProtocols maps protocol qualifiers onto their packet filters. Just
+// as with libpcap, transport protocols also match non-first IP fragments.
+var filterProtocols = map[string]PacketFilter{
+	"ip":    func(p *PacketLayers, _ int) bool { return p.L3Proto == EtherTypeIPv4 },
+	"ip6":   func(p *PacketLayers, _ int) bool { return p.L3Proto == EtherTypeIPv6 },
+	"arp":   func(p *PacketLayers, _ int) bool { return p.L3Proto == EtherTypeARP },
+	"tcp":   ipProtoFilter(0, IPProtoTCP),
+	"udp":   ipProtoFilter(0, IPProtoUDP),
+	"sctp":  ipProtoFilter(0, IPProtoSCTP),
+	"icmp":  ipProtoFilter(EtherTypeIPv4, IPProtoICMP),
+	"icmp6": ipProtoFilter(EtherTypeIPv6, IPProtoICMPv6),
+}
+
+// filterProtocolNumbers maps the transport protocol qualifiers onto their IP
+// protocol numbers.
+var filterProtocolNumbers = map[string]uint8{
+	"tcp":   IPProtoTCP,
+	"udp":   IPProtoUDP,
+	"sctp":  IPProtoSCTP,
+	"icmp":  IPProtoICMP,
+	"icmp6": IPProtoICMPv6,
+}
+
+// ipProtoFilter returns a packet filter matching IP packets of the specified
+// network layer protocol (or any for zero) that carry the specified
+// transport protocol. Packets with a decoded transport layer header are
+// matched by it, so IPv6 extension headers get skipped; otherwise, the
+// protocol field of the IP header decides.
+func ipProtoFilter(l3proto uint16, proto uint8) PacketFilter {
+	return func(p *PacketLayers, _ int) bool {
+		if l3proto != 0 && p.L3Proto != l3proto {
+			return false
+		}
+		switch {
+		case p.L4Offset >= 0:
+			return p.L4Proto == proto
+		case p.L3Proto == EtherTypeIPv4:
+			return p.Data[p.L3Offset+9] == proto
+		case p.L3Proto == EtherTypeIPv6:
+			return p.Data[p.L3Offset+6] == proto
+		}
+		return false
+	}
+}
+
+// filterParser is a recursive descent parser for capture filter expressions.
+type filterParser struct {
+	tokens []string
+	pos    int
+	// qualifiers of the most recent primitive, for abbreviated primitives,
+	// such as "port 80 or 443".
+	proto, dir, kind string
+}
+
+// CompileFilter compiles the specified capture filter expression into a
+// packet filter. An empty expression matches all packets.
+func CompileFilter(expr string) (PacketFilter, error) {
+	fp := &filterParser{tokens: filterTokens(expr)}
+	if len(fp.tokens) == 0 {
+		return func(*PacketLayers, int) bool { return true }, nil
+	}
+	f, err := fp.or()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter \"%s\": %s", expr, err.Error())
+	}
+	if fp.pos < len(fp.tokens) {
+		return nil, fmt.Errorf("invalid filter \"%s\": unexpected \"%s\"", expr, fp.tokens[fp.pos])
+	}
+	return f, nil
+}
+
+// filterTokens splits the specified filter expression into its tokens.
+func filterTokens(expr string) []string {
+	for _, op := range []string{"(", ")", "&&", "||"} {
+		expr = strings.ReplaceAll(expr, op, " "+op+" ")
+	}
+	// "!" is an operator on its own, but "!=" isn't supported anyway.
+	expr = strings.ReplaceAll(expr, "!", " ! ")
+	return strings.Fields(expr)
+}
+
+// peek returns the current token, or an empty string at the end.
+func (fp *filterParser) peek() string {
+	if fp.pos >= len(fp.tokens) {
+		return ""
+	}
+	return fp.tokens[fp.pos]
+}
+
+// next consumes and returns the current token, or returns an empty string at
+// the end.
+func (fp *filterParser) next() string {
+	tok := fp.peek()
+	if tok != "" {
+		fp.pos++
+	}
+	return tok
+}
+
+// or parses alternatives.
+func (fp *filterParser) or() (PacketFilter, error) {
+	f, err := fp.and()
+	if err != nil {
+		return nil, err
+	}
+	for fp.peek() == "or" || fp.peek() == "||" {
+		fp.next()
+		g, err := fp.and()
+		if err != nil {
+			return nil, err
+		}
+		f1 := f
+		f = func(p *PacketLayers, l int) bool { return f1(p, l) || g(p, l) }
+	}
+	return f, nil
+}
+
+// and parses conjunctions.
+func (fp *filterParser) and() (PacketFilter, error) {
+	f, err := fp.not()
+	if err != nil {
+		return nil, err
+	}
+	for fp.peek() == "and" || fp.peek() == "&&" {
+		fp.next()
+		g, err := fp.not()
+		if err != nil {
+			return nil, err
+		}
+		f1 := f
+		f = func(p *PacketLayers, l int) bool { return f1(p, l) && g(p, l) }
+	}
+	return f, nil
+}
+
+// not parses negations, parenthesized expressions, and primitives.
+func (fp *filterParser) not() (PacketFilter, error) {
+	switch fp.peek() {
+	case "not", "!":
+		fp.next()
+		f, err := fp.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(p *PacketLayers, l int) bool { return !f(p, l) }, nil
+	case "(":
+		fp.next()
+		f, err := fp.or()
+		if err != nil {
+			return nil, err
+		}
+		if fp.next() != ")" {
+			return nil, fmt.Errorf("missing \")\"")
+		}
+		return f, nil
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	}
+	return fp.primitive()
+}
+
+// primitive parses a primitive with its optional protocol and direction
+// qualifiers. A lone value reuses the qualifiers of the preceding primitive.
+func (fp *filterParser) primitive() (PacketFilter, error) {
+	tok := fp.next()
+	switch tok {
+	case "less", "greater":
+		n, err := strconv.Atoi(fp.next())
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid length after \"%s\"", tok)
+		}
+		if tok == "less" {
+			return func(_ *PacketLayers, l int) bool { return l <= n }, nil
+		}
+		return func(_ *PacketLayers, l int) bool { return l >= n }, nil
+	}
+	if _, ok := filterProtocols[tok]; !ok && !isFilterKeyword(tok) {
+		// Abbreviated primitive, such as the "443" in "port 80 or 443".
+		if fp.kind == "" {
+			fp.kind = "host"
+		}
+		return fp.value(tok)
+	}
+	fp.proto, fp.dir, fp.kind = "", "", ""
+	if _, ok := filterProtocols[tok]; ok {
+		fp.proto = tok
+		tok = fp.peek()
+		if tok == "proto" && (fp.proto == "ip" || fp.proto == "ip6") {
+			fp.next()
+			return fp.ipProto()
+		}
+		if tok != "src" && tok != "dst" && tok != "host" && tok != "net" &&
+			tok != "port" && tok != "portrange" {
+			return filterProtocols[fp.proto], nil
+		}
+		tok = fp.next()
+	}
+	if tok == "proto" {
+		return fp.ipProto()
+	}
+	if tok == "src" || tok == "dst" {
+		fp.dir = tok
+		tok = fp.next()
+	}
+	switch tok {
+	case "host", "net", "port", "portrange":
+		fp.kind = tok
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	default:
+		if fp.dir == "" {
+			return nil, fmt.Errorf("unexpected \"%s\"", tok)
+		}
+		// "src 10.0.0.1" is short for "src host 10.0.0.1".
+		fp.kind = "host"
+		fp.pos--
+	}
+	return fp.value(fp.next())
+}
+
+// ipProto parses the protocol number or name of a "proto" primitive, which
+// is restricted to IPv4 or IPv6 by an "ip" or "ip6" qualifier.
+func (fp *filterParser) ipProto() (PacketFilter, error) {
+	tok := fp.next()
+	proto, err := strconv.ParseUint(tok, 10, 8)
+	if err != nil {
+		n, ok := filterProtocolNumbers[tok]
+		if !ok {
+			return nil, fmt.Errorf("invalid protocol \"%s\"", tok)
+		}
+		proto = uint64(n)
+	}
+	var l3proto uint16
+	switch fp.proto {
+	case "ip":
+		l3proto = EtherTypeIPv4
+	case "ip6":
+		l3proto = EtherTypeIPv6
+	}
+	return ipProtoFilter(l3proto, uint8(proto)), nil
+}
+
+// value parses the value of a host, net, port, or portrange primitive,
+// according to the current qualifiers.
+func (fp *filterParser) value(tok string) (PacketFilter, error) {
+	if tok == "" {
+		return nil, fmt.Errorf("missing %s", fp.kind)
+	}
+	proto := filterProtocols[fp.proto]
+	src, dst := fp.dir != "dst", fp.dir != "src"
+	var match PacketFilter
+	switch fp.kind {
+	case "host", "net":
+		if fp.proto != "" && fp.proto != "ip" && fp.proto != "ip6" {
+			return nil, fmt.Errorf("illegal qualifier \"%s\" of %s", fp.proto, fp.kind)
+		}
+		var prefix netip.Prefix
+		var err error
+		if fp.kind == "net" || strings.Contains(tok, "/") {
+			prefix, err = netip.ParsePrefix(tok)
+		} else {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(tok); err == nil {
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s \"%s\"", fp.kind, tok)
+		}
+		if (fp.proto == "ip" && !prefix.Addr().Is4()) || (fp.proto == "ip6" && !prefix.Addr().Is6()) {
+			return nil, fmt.Errorf("invalid %s %s \"%s\"", fp.proto, fp.kind, tok)
+		}
+		if prefix != prefix.Masked() {
+			return nil, fmt.Errorf("non-network bits set in \"%s\"", tok)
+		}
+		match = func(p *PacketLayers, _ int) bool {
+			s, d := p.Addresses()
+			if s == nil {
+				return false
+			}
+			sa, _ := netip.AddrFromSlice(s)
+			da, _ := netip.AddrFromSlice(d)
+			return (src && prefix.Contains(sa)) || (dst && prefix.Contains(da))
+		}
+	case "port", "portrange":
+		if fp.proto != "" && fp.proto != "tcp" && fp.proto != "udp" && fp.proto != "sctp" {
+			return nil, fmt.Errorf("illegal qualifier \"%s\" of %s", fp.proto, fp.kind)
+		}
+		lo, hi, ok := strings.Cut(tok, "-")
+		if fp.kind == "port" {
+			if ok {
+				return nil, fmt.Errorf("invalid port \"%s\"", tok)
+			}
+			hi = lo
+		} else if !ok {
+			return nil, fmt.Errorf("invalid portrange \"%s\"", tok)
+		}
+		from, err1 := strconv.ParseUint(lo, 10, 16)
+		to, err2 := strconv.ParseUint(hi, 10, 16)
+		if err1 != nil || err2 != nil || from > to {
+			return nil, fmt.Errorf("invalid %s \"%s\"", fp.kind, tok)
+		}
+		match = func(p *PacketLayers, _ int) bool {
+			if p.L4Offset < 0 {
+				return false
+			}
+			s, d := p.Ports()
+			return (src && uint64(s) >= from && uint64(s) <= to) ||
+				(dst && uint64(d) >= from && uint64(d) <= to)
+		}
+		if proto == nil {
+			proto = func(p *PacketLayers, _ int) bool {
+				return p.L4Proto == IPProtoTCP || p.L4Proto == IPProtoUDP || p.L4Proto == IPProtoSCTP
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected \"%s\"", tok)
+	}
+	if proto == nil {
+		return match, nil
+	}
+	return func(p *PacketLayers, l int) bool { return proto(p, l) && match(p, l) }, nil
+}
+
+// isFilterKeyword returns true if the specified token is a filter keyword
+// (other than a protocol).
+func isFilterKeyword(tok string) bool {
+	switch tok {
+	case "src", "dst", "host", "net", "port", "portrange", "proto",
+		"and", "or", "not", "less", "greater", "(", ")", "!", "&&", "||":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// testIPv4Packet returns a raw IPv4 packet of the specified protocol with a
+// minimal transport layer header carrying the specified ports. A non-zero
+// fragment offset makes it a non-first fragment without transport header.
+func testIPv4Packet(proto uint8, src, dst string, sport, dport uint16, fragoff uint16) *PacketLayers {
+	data := make([]byte, 20, 40)
+	data[0] = 0x45
+	binary.BigEndian.PutUint16(data[6:8], fragoff)
+	data[8] = 64
+	data[9] = proto
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(data[12:16], s[:])
+	copy(data[16:20], d[:])
+	if fragoff == 0 {
+		data = append(data, testTransportHeader(proto, sport, dport)...)
+	} else {
+		data = append(data, make([]byte, 20)...)
+	}
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	return DecodePacket(LinkTypeRaw, data)
+}
+
+// testIPv6Packet returns a raw IPv6 packet of the specified protocol, with
+// a destination options extension header if requested.
+func testIPv6Packet(proto uint8, src, dst string, sport, dport uint16, exthdr bool) *PacketLayers {
+	data := make([]byte, 40, 68)
+	data[0] = 0x60
+	data[6] = proto
+	data[7] = 64
+	s, d := netip.MustParseAddr(src).As16(), netip.MustParseAddr(dst).As16()
+	copy(data[8:24], s[:])
+	copy(data[24:40], d[:])
+	if exthdr {
+		data[6] = 60
+		data = append(data, proto, 0, 1, 4, 0, 0, 0, 0)
+	}
+	data = append(data, testTransportHeader(proto, sport, dport)...)
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(data)-40))
+	return DecodePacket(LinkTypeRaw, data)
+}
+
+// testTransportHeader returns a minimal transport layer header of the
+// specified protocol.
+func testTransportHeader(proto uint8, sport, dport uint16) []byte {
+	hdr := make([]byte, 20)
+	binary.BigEndian.PutUint16(hdr[0:2], sport)
+	binary.BigEndian.PutUint16(hdr[2:4], dport)
+	if proto == IPProtoTCP {
+		hdr[12] = 5 << 4
+	}
+	return hdr
+}
+
+// testARPPacket returns an Ethernet frame with an ARP request.
+func testARPPacket() *PacketLayers {
+	data := make([]byte, 14, 42)
+	for idx := range data[0:6] {
+		data[idx] = 0xff
+	}
+	binary.BigEndian.PutUint16(data[12:14], EtherTypeARP)
+	data = append(data,
+		0, 1, 8, 0, 6, 4, 0, 1, // Ethernet, IPv4, request
+		2, 0, 0, 0, 0, 1, 10, 0, 0, 1, // sender
+		0, 0, 0, 0, 0, 0, 10, 0, 0, 2) // target
+	return DecodePacket(LinkTypeEthernet, data)
+}
+
+func TestCompileFilter(t *testing.T) {
+	packets := map[string]*PacketLayers{
+		"tcp4":  testIPv4Packet(IPProtoTCP, "10.0.0.1", "192.168.1.2", 43210, 443, 0),
+		"udp4":  testIPv4Packet(IPProtoUDP, "10.0.0.1", "192.168.1.2", 5353, 53, 0),
+		"sctp4": testIPv4Packet(IPProtoSCTP, "10.0.0.1", "192.168.1.2", 3868, 3868, 0),
+		"icmp4": testIPv4Packet(IPProtoICMP, "10.0.0.1", "192.168.1.2", 0, 0, 0),
+		"gre4":  testIPv4Packet(47, "10.0.0.1", "192.168.1.2", 0, 0, 0),
+		"frag4": testIPv4Packet(IPProtoTCP, "10.0.0.1", "192.168.1.2", 0, 0, 100),
+		"tcp6":  testIPv6Packet(IPProtoTCP, "fd00::1", "2001:db8::2", 43210, 80, false),
+		"udp6":  testIPv6Packet(IPProtoUDP, "fd00::1", "2001:db8::2", 5353, 53, true),
+		"icmp6": testIPv6Packet(IPProtoICMPv6, "fd00::1", "2001:db8::2", 0, 0, false),
+		"arp":   testARPPacket(),
+	}
+	order := []string{"tcp4", "udp4", "sctp4", "icmp4", "gre4", "frag4", "tcp6", "udp6", "icmp6", "arp"}
+
+	tests := []struct {
+		expr    string
+		matches []string
+	}{
+		{"", order},
+		{"ip", []string{"tcp4", "udp4", "sctp4", "icmp4", "gre4", "frag4"}},
+		{"ip6", []string{"tcp6", "udp6", "icmp6"}},
+		{"arp", []string{"arp"}},
+		{"tcp", []string{"tcp4", "frag4", "tcp6"}},
+		{"udp", []string{"udp4", "udp6"}},
+		{"sctp", []string{"sctp4"}},
+		{"icmp", []string{"icmp4"}},
+		{"icmp6", []string{"icmp6"}},
+		{"proto 47", []string{"gre4"}},
+		{"ip proto 6", []string{"tcp4", "frag4"}},
+		{"ip6 proto 6", []string{"tcp6"}},
+		{"ip proto tcp", []string{"tcp4", "frag4"}},
+		{"ip6 proto udp", []string{"udp6"}},
+		{"proto icmp6", []string{"icmp6"}},
+		{"host 10.0.0.1", []string{"tcp4", "udp4", "sctp4", "icmp4", "gre4", "frag4"}},
+		{"src host 192.168.1.2", nil},
+		{"dst host 192.168.1.2", []string{"tcp4", "udp4", "sctp4", "icmp4", "gre4", "frag4"}},
+		{"src 10.0.0.1 and dst 192.168.1.2", []string{"tcp4", "udp4", "sctp4", "icmp4", "gre4", "frag4"}},
+		{"ip host 10.0.0.1", []string{"tcp4", "udp4", "sctp4", "icmp4", "gre4", "frag4"}},
+		{"ip6 host 2001:db8::2", []string{"tcp6", "udp6", "icmp6"}},
+		{"host fd00::1 and udp", []string{"udp6"}},
+		{"net 192.168.0.0/16", []string{"tcp4", "udp4", "sctp4", "icmp4", "gre4", "frag4"}},
+		{"src net 192.168.0.0/16", nil},
+		{"net 2001:db8::/32", []string{"tcp6", "udp6", "icmp6"}},
+		{"port 53", []string{"udp4", "udp6"}},
+		{"tcp port 443", []string{"tcp4"}},
+		{"udp port 443", nil},
+		{"dst port 3868", []string{"sctp4"}},
+		{"src port 443", nil},
+		{"port 80 or 443", []string{"tcp4", "tcp6"}},
+		{"tcp dst port 80 or 443", []string{"tcp4", "tcp6"}},
+		{"portrange 50-100", []string{"udp4", "tcp6", "udp6"}},
+		{"udp portrange 5000-6000", []string{"udp4", "udp6"}},
+		{"not port 443", []string{"udp4", "sctp4", "icmp4", "gre4", "frag4", "tcp6", "udp6", "icmp6", "arp"}},
+		{"port 53 and not 5353", nil},
+		{"!tcp && !udp", []string{"sctp4", "icmp4", "gre4", "icmp6", "arp"}},
+		{"tcp and (port 80 or port 443)", []string{"tcp4", "tcp6"}},
+		{"(tcp||udp)&&ip6", []string{"tcp6", "udp6"}},
+		{"icmp or arp", []string{"icmp4", "arp"}},
+		{"not not icmp", []string{"icmp4"}},
+		{"less 40", []string{"tcp4", "udp4", "sctp4", "icmp4", "gre4", "frag4"}},
+		{"greater 41 and less 59", []string{"arp"}},
+		{"greater 60", []string{"tcp6", "udp6", "icmp6"}},
+	}
+	lengths := map[string]int{}
+	for name, p := range packets {
+		lengths[name] = len(p.Data)
+	}
+	for _, tt := range tests {
+		f, err := CompileFilter(tt.expr)
+		if err != nil {
+			t.Errorf("CompileFilter(%q) failed: %s", tt.expr, err.Error())
+			continue
+		}
+		want := map[string]bool{}
+		for _, name := range tt.matches {
+			want[name] = true
+		}
+		for _, name := range order {
+			if got := f(packets[name], lengths[name]); got != want[name] {
+				t.Errorf("filter %q on %s packet: got %v, want %v", tt.expr, name, got, want[name])
+			}
+		}
+	}
+}
+
+func TestCompileFilterInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"foo",
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"not",
+		"host",
+		"host example.com",
+		"net 10",
+		"net 10.0.0.0 mask 255.0.0.0",
+		"port http",
+		"port 65536",
+		"port 80-90",
+		"portrange 90-80",
+		"portrange 80",
+		"ip port 80",
+		"icmp port 80",
+		"tcp host 10.0.0.1",
+		"arp host 10.0.0.1",
+		"ip host fd00::1",
+		"ip6 net 10.0.0.0/8",
+		"net 10.0.0.7/8",
+		"proto 256",
+		"proto foo",
+		"ip proto ip6",
+		"src or dst host 10.0.0.1",
+		"ether host 00:00:5e:00:53:01",
+		"tcp[13] & 2 != 0",
+		"less",
+		"greater -1",
+	} {
+		if _, err := CompileFilter(expr); err == nil {
+			t.Errorf("CompileFilter(%q) succeeded, expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// A BlockStream breaks the pcapng packet capture stream coming from the capture
+// process into its individual blocks, hands each block to a chain of block
+// editors, and finally writes the (edited) blocks to its sink. Additionally, it
+// allows injecting further blocks into the stream out-of-band, such as
+// statistics blocks, without ever tearing apart blocks from the capture
+// process.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	pcapng "github.com/siemens/csharg/pcapng"
+	log "github.com/sirupsen/logrus"
+)
+
+// pcapng block types we either need to look into or that we create ourselves.
+// See also: https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	BlockTypeSHB = uint32(0x0a0d0d0a) // Section Header Block
+	BlockTypeIDB = uint32(0x00000001) // Interface Description Block
+	BlockTypeSPB = uint32(0x00000003) // Simple Packet Block
+	BlockTypeNRB = uint32(0x00000004) // Name Resolution Block
+	BlockTypeISB = uint32(0x00000005) // Interface Statistics Block
+	BlockTypeEPB = uint32(0x00000006) // Enhanced Packet Block
+)
+
+// pcapng option codes of Interface Description Blocks.
+const (
+	OptIfName    = uint16(2)  // name of the network interface.
+	OptIfTsResol = uint16(9)  // resolution of timestamps.
+	OptIfFilter  = uint16(11) // filter used when capturing.
+)
+
+// pcapng option codes of Interface Statistics Blocks.
+const (
+	OptISBStartTime    = uint16(2) // begin of the statistics period.
+	OptISBEndTime      = uint16(3) // end of the statistics period.
+	OptISBIfRecv       = uint16(4) // number of packets received by the interface.
+	OptISBIfDrop       = uint16(5) // number of packets dropped by the interface.
+	OptISBFilterAccept = uint16(6) // number of packets accepted by the filter.
+	OptISBUsrDeliv     = uint16(8) // number of packets delivered to the user.
+)
+
+// byteOrderMagic is the well-known byte-order magic of section header blocks.
+const byteOrderMagic = uint32(0x1a2b3c4d)
+
+// Block is a single pcapng block, consisting of its block type and its
+// (unpadded) block body, that is, without the leading block type and total
+// length fields, as well as without the trailing total length field.
+type Block struct {
+	Type uint32
+	Body []byte
+}
+
+// Bytes returns the complete octets of a block, including type and length
+// fields, using the specified endianness.
+func (b *Block) Bytes(endian binary.ByteOrder) []byte {
+	bodylen := len(b.Body)
+	if bodylen&0x3 != 0 {
+		bodylen += 4 - (bodylen & 0x3)
+	}
+	total := 4 + 4 + bodylen + 4
+	octets := make([]byte, total)
+	endian.PutUint32(octets[0:4], b.Type)
+	endian.PutUint32(octets[4:8], uint32(total))
+	copy(octets[8:], b.Body)
+	endian.PutUint32(octets[total-4:], uint32(total))
+	return octets
+}
+
+// Interface describes a network interface as announced in the stream by an
+// Interface Description Block.
+type Interface struct {
+	LinkType uint16
+	SnapLen  uint32
+	Name     string
+	TsResol  uint8 // as encoded in if_tsresol; defaults to 6 (µs).
+}
+
+// Timestamp returns the specified point in time in ticks of this interface's
+// timestamp resolution.
+func (i *Interface) Timestamp(t time.Time) uint64 {
+	return timeToTicks(t, i.TsResol)
+}
+
+// BlockEditor gets handed each (complete) block from the packet capture
+// stream and returns the blocks that should take its place: these might be
+// the original block, an edited block, additional blocks, or nothing at all
+// in order to drop the block.
+type BlockEditor interface {
+	EditBlock(s *BlockStream, blk *Block) []*Block
+}
+
+// BlockStream splits a pcapng stream into its blocks, runs them through a
+// chain of block editors, and then writes them to its sink.
+type BlockStream struct {
+	Endian      binary.ByteOrder // endianness of the current section.
+	Interfaces  []*Interface     // interfaces of the current section.
+	sink        io.Writer
+	editors     []BlockEditor
+	mu          sync.Mutex // serializes stream writes and block injections.
+	buff        []byte     // incomplete block octets gathered so far.
+	passThrough bool       // stream is broken, so simply pass through.
+}
+
+// NewBlockStream returns a new pcapng block stream, passing blocks through the
+// specified chain of editors before writing them to the specified sink.
+func NewBlockStream(sink io.Writer, editors ...BlockEditor) *BlockStream {
+	return &BlockStream{
+		sink:    sink,
+		editors: editors,
+	}
+}
+
+// AddEditor appends another block editor to the chain of block editors. It
+// must be called before any data is written to the stream.
+func (s *BlockStream) AddEditor(editor BlockEditor) {
+	s.editors = append(s.editors, editor)
+}
+
+// Write gathers the pcapng stream octets into complete blocks and then
+// processes each complete block.
+func (s *BlockStream) Write(b []byte) (n int, err error) {
+	n = len(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.passThrough {
+		_, err = s.sink.Write(b)
+		return n, err
+	}
+	s.buff = append(s.buff, b...)
+	out := []byte{}
+	for len(s.buff) >= 12 {
+		blocktype := binary.LittleEndian.Uint32(s.buff[0:4])
+		if blocktype == BlockTypeSHB {
+			// Each new section might come with its own endianness, so we
+			// need to check the byte-order magic of each section header.
+			if binary.BigEndian.Uint32(s.buff[8:12]) == byteOrderMagic {
+				s.Endian = binary.BigEndian
+			} else {
+				s.Endian = binary.LittleEndian
+			}
+		} else if s.Endian == nil {
+			log.Error("invalid packet capture stream; must begin with section header block")
+			s.passThrough = true
+			out = append(out, s.buff...)
+			s.buff = nil
+			break
+		}
+		blocktype = s.Endian.Uint32(s.buff[0:4])
+		total := s.Endian.Uint32(s.buff[4:8])
+		if total < 12 || total&0x3 != 0 {
+			log.Errorf("invalid pcapng block length %d, passing through stream unedited", total)
+			s.passThrough = true
+			out = append(out, s.buff...)
+			s.buff = nil
+			break
+		}
+		if uint32(len(s.buff)) < total {
+			break
+		}
+		blk := &Block{
+			Type: blocktype,
+			Body: append([]byte{}, s.buff[8:total-4]...),
+		}
+		s.buff = s.buff[total:]
+		if blk.Type == BlockTypeSHB {
+			s.Interfaces = nil
+		}
+		for _, edited := range s.edit(blk, 0) {
+			if edited.Type == BlockTypeIDB {
+				s.Interfaces = append(s.Interfaces, s.newInterface(edited))
+			}
+			out = append(out, edited.Bytes(s.Endian)...)
+		}
+	}
+	if len(out) == 0 {
+		return n, nil
+	}
+	_, err = s.sink.Write(out)
+	return n, err
+}
+
+// edit runs the specified block through the chain of editors, starting with
+// the editor at the specified index.
+func (s *BlockStream) edit(blk *Block, idx int) []*Block {
+	if idx >= len(s.editors) {
+		return []*Block{blk}
+	}
+	blks := []*Block{}
+	for _, edited := range s.editors[idx].EditBlock(s, blk) {
+		blks = append(blks, s.edit(edited, idx+1)...)
+	}
+	return blks
+}
+
+// Inject writes the specified blocks into the stream, in between any blocks
+// from the capture process. Injected blocks bypass the editors, but injected
+// Interface Description Blocks still add to the interfaces of the current
+// section. Injection only succeeds after at least the section header has been
+// passed through the stream; otherwise, false is returned.
+func (s *BlockStream) Inject(blks ...*Block) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Endian == nil || s.passThrough {
+		return false
+	}
+	out := []byte{}
+	for _, blk := range blks {
+		out = append(out, blk.Bytes(s.Endian)...)
+	}
+	if _, err := s.sink.Write(out); err != nil {
+		return false
+	}
+	for _, blk := range blks {
+		if blk.Type == BlockTypeIDB {
+			s.Interfaces = append(s.Interfaces, s.newInterface(blk))
+		}
+	}
+	return true
+}
+
+// Section returns the endianness and the interfaces of the current section of
+// the stream. The endianness is nil as long as no section header has passed
+// through the stream yet.
+func (s *BlockStream) Section() (binary.ByteOrder, []*Interface) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Endian, append([]*Interface{}, s.Interfaces...)
+}
+
+// Interface returns the interface with the specified interface ID in the
+// current section, or nil if unknown. It must only be called from within
+// block editors or while otherwise holding the stream lock.
+func (s *BlockStream) Interface(id uint32) *Interface {
+	if int(id) >= len(s.Interfaces) {
+		return nil
+	}
+	return s.Interfaces[id]
+}
+
+// newInterface returns the interface description from the specified IDB.
+func (s *BlockStream) newInterface(idb *Block) *Interface {
+	nif := &Interface{TsResol: 6}
+	if len(idb.Body) < 8 {
+		return nif
+	}
+	nif.LinkType = s.Endian.Uint16(idb.Body[0:2])
+	nif.SnapLen = s.Endian.Uint32(idb.Body[4:8])
+	for _, opt := range ParseOptions(idb.Body[8:], s.Endian) {
+		switch opt.Code {
+		case OptIfName:
+			nif.Name = opt.String()
+		case OptIfTsResol:
+			if len(opt.Value) > 0 {
+				nif.TsResol = opt.Value[0]
+			}
+		}
+	}
+	return nif
+}
+
+// ParseOptions returns the list of options found in the specified octets,
+// stopping at the end-of-options option or at the end of the octets.
+func ParseOptions(b []byte, endian binary.ByteOrder) []*pcapng.Option {
+	opts := []*pcapng.Option{}
+	for len(b) >= 4 {
+		length := int(endian.Uint16(b[2:4]))
+		if 4+length > len(b) {
+			break
+		}
+		opt, skip := pcapng.NewOption(b, endian)
+		if opt == nil {
+			break
+		}
+		opts = append(opts, opt)
+		if int(skip) >= len(b) {
+			break
+		}
+		b = b[skip:]
+	}
+	return opts
+}
+
+// OptionsBytes returns the encoded list of options, including the final
+// end-of-options option. If there are no options, then no octets at all are
+// returned, as the pcapng format allows leaving out options altogether.
+func OptionsBytes(opts []*pcapng.Option, endian binary.ByteOrder) []byte {
+	if len(opts) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	for _, opt := range opts {
+		b.Write(opt.Bytes(endian))
+	}
+	b.Write((*pcapng.Option)(nil).Bytes(endian))
+	return b.Bytes()
+}
+
+// Uint64Option returns an option with a 64bit unsigned integer value.
+func Uint64Option(code uint16, value uint64, endian binary.ByteOrder) *pcapng.Option {
+	v := make([]byte, 8)
+	endian.PutUint64(v, value)
+	return &pcapng.Option{Code: code, Value: v}
+}
+
+// TimestampOption returns an option with a pcapng timestamp value, that is,
+// the upper 32 bits followed by the lower 32 bits.
+func TimestampOption(code uint16, ticks uint64, endian binary.ByteOrder) *pcapng.Option {
+	v := make([]byte, 8)
+	endian.PutUint32(v[0:4], uint32(ticks>>32))
+	endian.PutUint32(v[4:8], uint32(ticks))
+	return &pcapng.Option{Code: code, Value: v}
+}
+
+// timeToTicks converts a point in time into a pcapng timestamp using the
+// specified if_tsresol encoding.
+func timeToTicks(t time.Time, tsresol uint8) uint64 {
+	return nanosToTicks(uint64(t.UnixNano()), tsresol)
+}
+
+// nanosToTicks converts nanoseconds into pcapng timestamp ticks using the
+// specified if_tsresol encoding: if the most significant bit is clear, then
+// the resolution is 10^-tsresol, otherwise 2^-tsresol seconds.
+func nanosToTicks(ns uint64, tsresol uint8) uint64 {
+	if tsresol&0x80 != 0 {
+		exp := uint(tsresol & 0x7f)
+		secs := ns / 1e9
+		frac := ns % 1e9
+		return secs<<exp + (frac<<exp)/1e9
+	}
+	switch {
+	case tsresol == 9:
+		return ns
+	case tsresol < 9:
+		return ns / pow10(9-tsresol)
+	default:
+		return ns * pow10(tsresol-9)
+	}
+}
+
+// ticksToNanos converts pcapng timestamp ticks using the specified if_tsresol
+// encoding into nanoseconds.
+func ticksToNanos(ticks uint64, tsresol uint8) uint64 {
+	if tsresol&0x80 != 0 {
+		exp := uint(tsresol & 0x7f)
+		secs := ticks >> exp
+		frac := ticks & (1<<exp - 1)
+		return secs*1e9 + (frac*1e9)>>exp
+	}
+	switch {
+	case tsresol == 9:
+		return ticks
+	case tsresol < 9:
+		return ticks * pow10(9-tsresol)
+	default:
+		return ticks / pow10(tsresol-9)
+	}
+}
+
+// pow10 returns 10^exp.
+func pow10(exp uint8) uint64 {
+	v := uint64(1)
+	for ; exp > 0; exp-- {
+		v *= 10
+	}
+	return v
+}
+
+// EnhancedPacket is a decoded Enhanced Packet Block.
+type EnhancedPacket struct {
+	InterfaceID uint32
+	Timestamp   uint64 // in ticks of the interface's timestamp resolution.
+	OrigLen     uint32
+	Data        []byte // captured packet data.
+	Options     []*pcapng.Option
+}
+
+// ParseEnhancedPacket decodes the specified Enhanced Packet Block, returning
+// nil if the block is either not an EPB or is malformed.
+func ParseEnhancedPacket(blk *Block, endian binary.ByteOrder) *EnhancedPacket {
+	if blk.Type != BlockTypeEPB || len(blk.Body) < 20 {
+		return nil
+	}
+	caplen := endian.Uint32(blk.Body[12:16])
+	if uint64(caplen) > uint64(len(blk.Body)-20) {
+		return nil
+	}
+	optsoffset := 20 + int(caplen)
+	if optsoffset&0x3 != 0 {
+		optsoffset += 4 - (optsoffset & 0x3)
+	}
+	p := &EnhancedPacket{
+		InterfaceID: endian.Uint32(blk.Body[0:4]),
+		Timestamp:   uint64(endian.Uint32(blk.Body[4:8]))<<32 | uint64(endian.Uint32(blk.Body[8:12])),
+		OrigLen:     endian.Uint32(blk.Body[16:20]),
+		Data:        blk.Body[20 : 20+caplen],
+	}
+	if optsoffset < len(blk.Body) {
+		p.Options = ParseOptions(blk.Body[optsoffset:], endian)
+	}
+	return p
+}
+
+// Block returns the Enhanced Packet Block for this packet.
+func (p *EnhancedPacket) Block(endian binary.ByteOrder) *Block {
+	caplen := len(p.Data)
+	padded := caplen
+	if padded&0x3 != 0 {
+		padded += 4 - (padded & 0x3)
+	}
+	body := make([]byte, 20+padded)
+	endian.PutUint32(body[0:4], p.InterfaceID)
+	endian.PutUint32(body[4:8], uint32(p.Timestamp>>32))
+	endian.PutUint32(body[8:12], uint32(p.Timestamp))
+	endian.PutUint32(body[12:16], uint32(caplen))
+	endian.PutUint32(body[16:20], p.OrigLen)
+	copy(body[20:], p.Data)
+	body = append(body, OptionsBytes(p.Options, endian)...)
+	return &Block{Type: BlockTypeEPB, Body: body}
+}
+
+// AppendOptions returns a copy of the specified block with the specified
+// options appended to the block's existing options. The options of the block
+// begin after the specified fixed-size part of the block body.
+func AppendOptions(blk *Block, fixedlen int, endian binary.ByteOrder, opts ...*pcapng.Option) *Block {
+	if len(blk.Body) < fixedlen {
+		return blk
+	}
+	existing := ParseOptions(blk.Body[fixedlen:], endian)
+	body := append([]byte{}, blk.Body[:fixedlen]...)
+	body = append(body, OptionsBytes(append(existing, opts...), endian)...)
+	return &Block{Type: blk.Type, Body: body}
+}
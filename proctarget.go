@@ -0,0 +1,56 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Identifies capture targets by process or cgroup, instead of by container.
+// This allows capturing from the network namespaces of ordinary processes,
+// such as systemd services, on the same host.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// processStarttime returns the start time of the process with the specified
+// PID, in clock ticks since boot.
+func processStarttime(pid int) (int64, error) {
+	stf, err := os.Open(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer stf.Close()
+	// Just read the first (and only) line from the process stats and break
+	// it down into its fields...
+	line, _ := bufio.NewReader(stf).ReadString('\n')
+	// /proc/PID/stat has the process name in the second field, and the
+	// name is enclosed in brackets because it may contain spaces, so we
+	// look for the final ')' and only afterwards start splitting the
+	// remaining line contents into fields.
+	idx := strings.LastIndex(line, ")")
+	if idx < 0 || idx+2 > len(line) {
+		return 0, fmt.Errorf("malformed stat of process PID %d", pid)
+	}
+	stats := strings.Fields(line[idx+2:])
+	// starttime is field #22 (counting from #1), so we need to take
+	// into account that Go slice indices start at zero.
+	if len(stats) < 22-2 {
+		return 0, fmt.Errorf("malformed stat of process PID %d", pid)
+	}
+	return strconv.ParseInt(stats[22-3], 10, 64)
+}
+
+// processNetns returns the inode number of the network namespace the process
+// with the specified PID is attached to.
+func processNetns(pid int) (uint64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(fmt.Sprintf("/proc/%d/ns/net", pid), &stat); err != nil {
+		return 0, err
+	}
+	return stat.Ino, nil
+}
@@ -0,0 +1,73 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Limits the number of concurrent capture sessions in total, per client
+// principal, and per capture target network namespace, so that a single
+// misbehaving client cannot exhaust the node.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Sessions keeps track of the active capture sessions for enforcing quotas.
+var Sessions = NewSessionQuotas()
+
+// SessionQuotas counts the active capture sessions in total, per principal,
+// and per network namespace.
+type SessionQuotas struct {
+	mu         sync.Mutex
+	total      int
+	principals map[string]int
+	netnses    map[uint64]int
+}
+
+// NewSessionQuotas returns a new and empty session counter.
+func NewSessionQuotas() *SessionQuotas {
+	return &SessionQuotas{
+		principals: map[string]int{},
+		netnses:    map[uint64]int{},
+	}
+}
+
+// Acquire accounts for a new capture session of the specified principal
+// capturing from the specified network namespace, if permitted by the
+// configured quotas. If successful, it returns a function to release the
+// session when it has finished, otherwise an error describing the exceeded
+// quota.
+func (q *SessionQuotas) Acquire(principal string, netns uint64) (release func(), err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if MaxSessions > 0 && q.total >= MaxSessions {
+		return nil, fmt.Errorf("maximum of %d capture sessions reached", MaxSessions)
+	}
+	if MaxSessionsPerClient > 0 && q.principals[principal] >= MaxSessionsPerClient {
+		return nil, fmt.Errorf("maximum of %d capture sessions per client reached", MaxSessionsPerClient)
+	}
+	if MaxSessionsPerNetns > 0 && q.netnses[netns] >= MaxSessionsPerNetns {
+		return nil, fmt.Errorf("maximum of %d capture sessions per capture target reached", MaxSessionsPerNetns)
+	}
+	q.total++
+	q.principals[principal]++
+	q.netnses[netns]++
+	var once sync.Once
+	return func() {
+		once.Do(func() { q.release(principal, netns) })
+	}, nil
+}
+
+// release accounts for a finished capture session.
+func (q *SessionQuotas) release(principal string, netns uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.total--
+	if q.principals[principal]--; q.principals[principal] <= 0 {
+		delete(q.principals, principal)
+	}
+	if q.netnses[netns]--; q.netnses[netns] <= 0 {
+		delete(q.netnses, netns)
+	}
+}
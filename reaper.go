@@ -0,0 +1,146 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Keeps track of the capture processes and reports (and kills) those capture
+// processes that outlive their capture sessions, such as wedged dumpcaps
+// ignoring even SIGKILL for some time while stuck in the kernel. The reaper
+// also cleans up the per-capture cgroups.
+
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultKillGracePeriod specifies the default amount of time to wait for a
+// capture process to terminate after SIGTERM, before sending SIGKILL.
+const DefaultKillGracePeriod = 5 * time.Second
+
+// ReaperInterval specifies how often the reaper checks for capture processes
+// outliving their sessions.
+const ReaperInterval = 10 * time.Second
+
+// Reaper tracks all capture processes.
+var Reaper = NewCaptureReaper()
+
+// reapable is a capture process, or a leftover cgroup of a capture process.
+type reapable struct {
+	conn     *WSConn
+	proc     *os.Process    // nil after the capture process has been reaped.
+	cgroup   *CaptureCgroup // nil if not confined to its own cgroup.
+	ended    time.Time      // when the session ended; zero while active.
+	reported bool           // true if already reported as outliving its session.
+}
+
+// CaptureReaper keeps track of capture processes and their cgroups.
+type CaptureReaper struct {
+	mu        sync.Mutex
+	reapables map[*WSConn]*reapable
+}
+
+// NewCaptureReaper returns a new capture process reaper.
+func NewCaptureReaper() *CaptureReaper {
+	return &CaptureReaper{reapables: map[*WSConn]*reapable{}}
+}
+
+// Track starts tracking the capture process of the specified connection,
+// including its cgroup (if any).
+func (r *CaptureReaper) Track(conn *WSConn, proc *os.Process, cgroup *CaptureCgroup) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reapables[conn] = &reapable{conn: conn, proc: proc, cgroup: cgroup}
+}
+
+// SessionEnded notes that the capture session of the specified connection has
+// ended, so its capture process is expected to terminate soon.
+func (r *CaptureReaper) SessionEnded(conn *WSConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rp, ok := r.reapables[conn]; ok && rp.ended.IsZero() {
+		rp.ended = time.Now()
+	}
+}
+
+// Reaped notes that the capture process of the specified connection has been
+// reaped. Any remaining processes in the capture process' cgroup get killed
+// and the cgroup removed.
+func (r *CaptureReaper) Reaped(conn *WSConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rp, ok := r.reapables[conn]
+	if !ok {
+		return
+	}
+	rp.proc = nil
+	if rp.ended.IsZero() {
+		rp.ended = time.Now()
+	}
+	if r.cleanup(rp) {
+		delete(r.reapables, conn)
+	}
+}
+
+// Run periodically checks for capture processes outliving their sessions by
+// more than the kill grace period, reporting and killing them. Run never
+// returns.
+func (r *CaptureReaper) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		r.reap()
+	}
+}
+
+// reap reports and kills capture processes outliving their sessions, as well
+// as cleans up leftover cgroups.
+func (r *CaptureReaper) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for conn, rp := range r.reapables {
+		if rp.ended.IsZero() || time.Since(rp.ended) < KillGracePeriod {
+			continue
+		}
+		if rp.proc != nil {
+			if !rp.reported {
+				rp.reported = true
+				conn.Errorf("capture process PID %d outlived its session by %s",
+					rp.proc.Pid, time.Since(rp.ended).Round(time.Second))
+			}
+			_ = rp.proc.Kill()
+			if rp.cgroup != nil {
+				_ = rp.cgroup.Kill()
+			}
+			continue
+		}
+		if r.cleanup(rp) {
+			delete(r.reapables, conn)
+			continue
+		}
+		if !rp.reported {
+			rp.reported = true
+			conn.Errorf("cannot remove capture cgroup %s, processes linger", rp.cgroup.Path)
+		}
+	}
+}
+
+// cleanup kills any processes left in the cgroup of a reaped capture process
+// and then tries to remove the cgroup, returning true if successful. As
+// killing is asynchronous, removal might fail at first, so the reaper retries
+// later.
+func (r *CaptureReaper) cleanup(rp *reapable) bool {
+	if rp.cgroup == nil {
+		return true
+	}
+	if rp.cgroup.Populated() {
+		_ = rp.cgroup.Kill()
+	}
+	if err := rp.cgroup.Remove(); err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	log.Debugf("removed capture cgroup %s", rp.cgroup.Path)
+	return true
+}
@@ -0,0 +1,204 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Replays recorded pcapng files as packet capture streams, so that capture
+// clients can work with historic captures in the same way as with live
+// captures. Replays optionally get filtered, limited to a time range, and paced
+// according to the packet timestamps.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxReplayBlockSize is the maximum size of a single pcapng block in a replayed
+// file.
+const MaxReplayBlockSize = 16 << 20
+
+// MaxReplaySpeed is the maximum replay speed factor.
+const MaxReplaySpeed = 1000
+
+// ReplayFile describes a pcapng file available for replay.
+type ReplayFile struct {
+	Name     string    `json:"name"` // relative to the replay directory.
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// ReplayFiles returns the pcapng files in the replay directory and its
+// subdirectories, sorted by name.
+func ReplayFiles() ([]*ReplayFile, error) {
+	files := []*ReplayFile{}
+	err := filepath.WalkDir(ReplayDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), ".pcapng") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		name, _ := filepath.Rel(ReplayDir, path)
+		files = append(files, &ReplayFile{
+			Name:     filepath.ToSlash(name),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, err
+}
+
+// ReplayPath returns the path of the specified file in the replay directory,
+// rejecting names that would escape from it.
+func ReplayPath(name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if name == "" || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid file \"%s\"", name)
+	}
+	return filepath.Join(ReplayDir, name), nil
+}
+
+// Replayer is a pcapng block editor dropping the packets not matching its
+// filter or time range, and pacing the remaining packets according to their
+// timestamps.
+type Replayer struct {
+	Filter PacketFilter // nil if none.
+	Start  time.Time    // zero if unlimited.
+	End    time.Time    // zero if unlimited.
+	Speed  float64      // speed factor; zero if not paced.
+
+	cancel   <-chan struct{}
+	first    time.Time // timestamp of the first paced packet.
+	began    time.Time // when the first paced packet was replayed.
+	replayed uint64
+	dropped  uint64
+}
+
+// NewReplayer returns a new replayer that stops pacing when the specified
+// channel gets closed.
+func NewReplayer(cancel <-chan struct{}) *Replayer {
+	return &Replayer{cancel: cancel}
+}
+
+// EditBlock drops packets not matching the filter or time range, and delays
+// the remaining packets as necessary. All other blocks pass unchanged.
+func (r *Replayer) EditBlock(s *BlockStream, blk *Block) []*Block {
+	var data []byte
+	var length int
+	var nif *Interface
+	var ts time.Time
+	switch blk.Type {
+	case BlockTypeEPB:
+		pkt := ParseEnhancedPacket(blk, s.Endian)
+		if pkt == nil {
+			return []*Block{blk}
+		}
+		if nif = s.Interface(pkt.InterfaceID); nif == nil {
+			return []*Block{blk}
+		}
+		data, length = pkt.Data, int(pkt.OrigLen)
+		ts = time.Unix(0, int64(ticksToNanos(pkt.Timestamp, nif.TsResol)))
+	case BlockTypeSPB:
+		// Simple packet blocks always belong to the first interface and lack
+		// timestamps, so they can only be filtered.
+		if nif = s.Interface(0); nif == nil || len(blk.Body) < 4 {
+			return []*Block{blk}
+		}
+		data, length = blk.Body[4:], int(s.Endian.Uint32(blk.Body[0:4]))
+		if length < len(data) {
+			data = data[:length]
+		}
+	default:
+		return []*Block{blk}
+	}
+	if !ts.IsZero() && ((!r.Start.IsZero() && ts.Before(r.Start)) || (!r.End.IsZero() && ts.After(r.End))) {
+		r.dropped++
+		return nil
+	}
+	if r.Filter != nil && !r.Filter(DecodePacket(nif.LinkType, data), length) {
+		r.dropped++
+		return nil
+	}
+	if r.Speed > 0 && !ts.IsZero() {
+		r.pace(ts)
+	}
+	r.replayed++
+	return []*Block{blk}
+}
+
+// pace waits until it's time to replay a packet with the specified timestamp.
+func (r *Replayer) pace(ts time.Time) {
+	if r.first.IsZero() {
+		r.first, r.began = ts, time.Now()
+		return
+	}
+	due := r.began.Add(time.Duration(float64(ts.Sub(r.first)) / r.Speed))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.cancel:
+	}
+}
+
+// Stats returns the number of packets replayed and dropped so far.
+func (r *Replayer) Stats() (replayed, dropped uint64) {
+	return r.replayed, r.dropped
+}
+
+// ReplayBlocks reads the pcapng blocks from the specified reader, writing
+// each complete block separately to the specified writer, so that the blocks
+// can be paced individually. It returns when reaching the end of the reader,
+// the writer fails, or the specified channel gets closed.
+func ReplayBlocks(w io.Writer, r io.Reader, cancel <-chan struct{}) error {
+	var endian binary.ByteOrder
+	hdr := make([]byte, 12)
+	for {
+		select {
+		case <-cancel:
+			return nil
+		default:
+		}
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if binary.LittleEndian.Uint32(hdr[0:4]) == BlockTypeSHB {
+			if binary.BigEndian.Uint32(hdr[8:12]) == byteOrderMagic {
+				endian = binary.BigEndian
+			} else {
+				endian = binary.LittleEndian
+			}
+		} else if endian == nil {
+			return fmt.Errorf("not a pcapng file")
+		}
+		total := endian.Uint32(hdr[4:8])
+		if total < 12 || total&0x3 != 0 || total > MaxReplayBlockSize {
+			return fmt.Errorf("invalid pcapng block length %d", total)
+		}
+		blk := make([]byte, total)
+		copy(blk, hdr)
+		if _, err := io.ReadFull(r, blk[12:]); err != nil {
+			return fmt.Errorf("truncated pcapng block: %s", err.Error())
+		}
+		if _, err := w.Write(blk); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Handles the /replay API endpoint for listing the pcapng files available for
+// replay, and for replaying them via websockets in the same way as live
+// captures.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	pcapng "github.com/siemens/csharg/pcapng"
+)
+
+// Handle the /replay API endpoint: a websocket connect replays the specified
+// pcapng file, while a plain GET lists the files available for replay.
+func replayHandler(w http.ResponseWriter, req *http.Request) {
+	if ReplayDir == "" {
+		http.Error(w, "no replay directory configured", http.StatusNotFound)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(req) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		files, err := ReplayFiles()
+		if err != nil {
+			http.Error(w, "cannot list replay files", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, files)
+		return
+	}
+
+	conn := NewWSConn()
+	cnx, err := wsupgrader.Upgrade(w, req, nil)
+	if err != nil {
+		conn.Errorf("websocket upgrade process failed: %s", err.Error())
+		return
+	}
+	conn.Conn = cnx
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	replayer := NewReplayer(closed)
+	name, err := parseReplayParams(req, replayer)
+	if err != nil {
+		conn.Errorf("%s", err.Error())
+		conn.GracefullyClose(websocket.CloseAbnormalClosure, err.Error())
+		return
+	}
+	path, err := ReplayPath(name)
+	if err != nil {
+		conn.Errorf("%s", err.Error())
+		conn.GracefullyClose(websocket.CloseAbnormalClosure, err.Error())
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		conn.Errorf("cannot open replay file: %s", err.Error())
+		conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot open replay file")
+		return
+	}
+	defer f.Close()
+	conn.Debugf("replaying %s", path)
+
+	go func() {
+		conn.Watch()
+		close(closed)
+	}()
+	// Tell the capture client where the packets come from.
+	origin := replayOrigin{comment: fmt.Sprintf("packetflix replay of %s, requested by %s",
+		name, NewClientIdentity(req).Principal())}
+	stream := NewBlockStream(NewPiper(conn), &origin, replayer)
+	err = ReplayBlocks(stream, bufio.NewReaderSize(f, 64*1024), closed)
+	replayed, dropped := replayer.Stats()
+	conn.Debugf("replayed %d packets, dropped %d packets", replayed, dropped)
+	if err != nil {
+		conn.Errorf("cannot replay %s: %s", path, err.Error())
+		conn.InitiateGracefulClose(websocket.CloseAbnormalClosure, "cannot replay file")
+	} else {
+		conn.InitiateGracefulClose(websocket.CloseNormalClosure, "replay complete")
+	}
+	<-closed
+}
+
+// parseReplayParams configures the specified replayer from the request
+// parameters, returning the name of the file to replay.
+func parseReplayParams(req *http.Request, replayer *Replayer) (string, error) {
+	params := requestParams(req)
+	name := params.Get("file")
+	if name == "" {
+		return "", fmt.Errorf("file query parameter required")
+	}
+	if err := parseReplayerParams(params, replayer); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// parseReplayerParams configures the specified replayer's speed, filter, and
+// time range from the request parameters.
+func parseReplayerParams(params url.Values, replayer *Replayer) error {
+	if s, ok := params["speed"]; ok {
+		speed, err := strconv.ParseFloat(s[0], 64)
+		if err != nil || !(speed > 0 && speed <= MaxReplaySpeed) {
+			return fmt.Errorf("invalid speed \"%s\"", s[0])
+		}
+		replayer.Speed = speed
+	}
+	if f, ok := params["filter"]; ok {
+		filter, err := CompileFilter(f[0])
+		if err != nil {
+			return err
+		}
+		replayer.Filter = filter
+	}
+	for _, limit := range []struct {
+		param string
+		t     *time.Time
+	}{{"start", &replayer.Start}, {"end", &replayer.End}} {
+		if v, ok := params[limit.param]; ok {
+			t, err := time.Parse(time.RFC3339Nano, v[0])
+			if err != nil {
+				return fmt.Errorf("invalid %s \"%s\"", limit.param, v[0])
+			}
+			*limit.t = t
+		}
+	}
+	if !replayer.Start.IsZero() && !replayer.End.IsZero() && replayer.End.Before(replayer.Start) {
+		return fmt.Errorf("end before start")
+	}
+	return nil
+}
+
+// replayOrigin is a pcapng block editor adding a comment about the replay's
+// origin to the section headers.
+type replayOrigin struct {
+	comment string
+}
+
+// EditBlock adds the origin comment to section headers, passing all other
+// blocks unchanged.
+func (o *replayOrigin) EditBlock(s *BlockStream, blk *Block) []*Block {
+	if blk.Type != BlockTypeSHB {
+		return []*Block{blk}
+	}
+	return []*Block{AppendOptions(blk, 16, s.Endian, &pcapng.Option{
+		Code:  pcapng.OptComment,
+		Value: []byte(o.comment),
+	})}
+}
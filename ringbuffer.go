@@ -0,0 +1,405 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Keeps long-running background captures in pre-trigger ring buffers, holding
+// the last so many seconds or megabytes of a capture target's traffic in
+// memory. Snapshots of a ring buffer then catch what happened before an
+// intermittent problem was noticed, optionally followed by a post-trigger
+// window. Snapshots are taken on demand, or whenever live traffic matches a
+// trigger capture filter.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/siemens/csharg/api"
+	pcapng "github.com/siemens/csharg/pcapng"
+	"github.com/thediveo/lxkns/ops/relations"
+)
+
+// Ring buffer limits.
+const (
+	DefaultRingSeconds   = 60   // default amount of time to keep in a ring buffer.
+	DefaultRingMegabytes = 64   // default maximum size of a ring buffer in MiB.
+	MaxRingSeconds       = 3600 // maximum amount of time to keep in a ring buffer.
+	MaxRingMegabytes     = 1024 // maximum size of a ring buffer in MiB.
+	MaxPostSeconds       = 600  // maximum post-trigger window.
+)
+
+// RingFollowBacklog is the number of blocks a snapshot's post-trigger window
+// can lag behind the live capture before blocks are missed.
+const RingFollowBacklog = 4096
+
+// TriggerRetryInterval is the time to wait before rearming a trigger after
+// its capture process failed.
+const TriggerRetryInterval = 5 * time.Second
+
+// TriggerHoldoff is the minimum time between two triggered snapshots of the
+// same ring buffer; the trigger is only rearmed after this holdoff.
+const TriggerHoldoff = 60 * time.Second
+
+// MaxTriggeredSnapshots is the maximum number of snapshots a ring buffer's
+// trigger saves; afterwards, the trigger is disarmed for good, so that broad
+// triggers cannot fill up the snapshot directory.
+const MaxTriggeredSnapshots = 10
+
+// MaxRequestedSnapshots is the maximum number of snapshots of a ring buffer
+// that can be saved into the snapshot directory on request, so that clients
+// cannot fill up the snapshot directory either.
+const MaxRequestedSnapshots = 100
+
+// RingBuffers are the currently running ring buffers.
+var RingBuffers = NewBackgroundCaptureSet[*RingBuffer, *RingBufferInfo]("ring buffer")
+
+// ringEntry is a block kept in a ring buffer, together with its time of
+// arrival.
+type ringEntry struct {
+	blk  *Block
+	at   time.Time
+	size int
+}
+
+// RingBuffer is a pcapng block editor keeping the most recent blocks of a
+// packet capture stream, limited by age and total size. The section header
+// and interface descriptions are always kept, so that snapshots always form a
+// valid pcapng stream.
+type RingBuffer struct {
+	BackgroundCapture
+	MaxAge  time.Duration
+	MaxSize int           // in octets.
+	Trigger string        // capture filter triggering snapshots; empty if none.
+	Post    time.Duration // post-trigger window of triggered snapshots.
+
+	mu        sync.Mutex
+	endian    binary.ByteOrder
+	preamble  []*Block // section header and interface description blocks.
+	entries   []ringEntry
+	size      int
+	evicted   uint64
+	triggered uint64
+	requested int // number of snapshots saved on request.
+	followers map[chan *Block]struct{}
+}
+
+// RingBufferInfo describes a running ring buffer.
+type RingBufferInfo struct {
+	ID        string      `json:"id"`
+	Target    *api.Target `json:"target"`
+	Filter    string      `json:"filter,omitempty"`
+	Seconds   int         `json:"seconds"`
+	Megabytes int         `json:"megabytes"`
+	Trigger   string      `json:"trigger,omitempty"`
+	Post      int         `json:"post,omitempty"`
+	Started   time.Time   `json:"started"`
+	Owner     string      `json:"owner"`
+	Blocks    int         `json:"blocks"`    // number of blocks currently kept.
+	Octets    int         `json:"octets"`    // size of blocks currently kept.
+	Evicted   uint64      `json:"evicted"`   // number of blocks evicted so far.
+	Triggered uint64      `json:"triggered"` // number of trigger matches so far.
+}
+
+// NewRingBuffer returns a new ring buffer for the specified capture target,
+// keeping blocks for at most maxAge, up to maxSize octets in total. The ring
+// buffer takes on the ID of the specified (unconnected) connection, which is
+// also used for logging and terminating the capture process.
+func NewRingBuffer(conn *WSConn, args *Args, maxAge time.Duration, maxSize int) *RingBuffer {
+	return &RingBuffer{
+		BackgroundCapture: newBackgroundCapture("ring buffer", conn, args),
+		MaxAge:            maxAge,
+		MaxSize:           maxSize,
+		followers:         map[chan *Block]struct{}{},
+	}
+}
+
+// EditBlock keeps a block in the ring buffer, evicting the oldest blocks as
+// necessary, and then passes the block on unchanged.
+func (r *RingBuffer) EditBlock(s *BlockStream, blk *Block) []*Block {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch blk.Type {
+	case BlockTypeSHB:
+		r.endian = s.Endian
+		r.preamble = []*Block{blk}
+		r.entries = nil
+		r.size = 0
+		return []*Block{blk}
+	case BlockTypeIDB:
+		r.preamble = append(r.preamble, blk)
+	default:
+		size := len(blk.Body) + 12
+		r.entries = append(r.entries, ringEntry{blk: blk, at: now, size: size})
+		r.size += size
+		r.evict(now)
+	}
+	for follower := range r.followers {
+		select {
+		case follower <- blk:
+		default:
+		}
+	}
+	return []*Block{blk}
+}
+
+// evict evicts the oldest blocks that are either too old or exceed the
+// maximum size of the ring buffer.
+func (r *RingBuffer) evict(now time.Time) {
+	for len(r.entries) > 0 && (r.size > r.MaxSize || now.Sub(r.entries[0].at) > r.MaxAge) {
+		r.size -= r.entries[0].size
+		r.entries[0] = ringEntry{}
+		r.entries = r.entries[1:]
+		r.evicted++
+	}
+}
+
+// Captured returns true after the ring buffer has seen the beginning of its
+// packet capture stream, so that snapshots can be taken.
+func (r *RingBuffer) Captured() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.endian != nil
+}
+
+// reserveRequestedSave reserves saving a snapshot on request, returning false
+// if the ring buffer has already saved MaxRequestedSnapshots snapshots on
+// request.
+func (r *RingBuffer) reserveRequestedSave() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.requested >= MaxRequestedSnapshots {
+		return false
+	}
+	r.requested++
+	return true
+}
+
+// Info returns information about the ring buffer and its current contents.
+func (r *RingBuffer) Info() *RingBufferInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evict(time.Now())
+	return &RingBufferInfo{
+		ID:        r.ID,
+		Target:    r.Args.Target,
+		Filter:    r.Args.CaptureFilter,
+		Seconds:   int(r.MaxAge / time.Second),
+		Megabytes: r.MaxSize >> 20,
+		Trigger:   r.Trigger,
+		Post:      int(r.Post / time.Second),
+		Started:   r.Started,
+		Owner:     r.Owner,
+		Blocks:    len(r.entries),
+		Octets:    r.size,
+		Evicted:   r.evicted,
+		Triggered: r.triggered,
+	}
+}
+
+// Snapshot writes the current contents of the ring buffer as a pcapng stream
+// to the specified writer, followed by the live blocks of the specified
+// post-trigger window, if any. The section header gets a comment with the
+// reason for the snapshot.
+func (r *RingBuffer) Snapshot(w io.Writer, post time.Duration, reason string) error {
+	r.mu.Lock()
+	if r.endian == nil {
+		r.mu.Unlock()
+		return fmt.Errorf("ring buffer %s has not captured anything yet", r.ID)
+	}
+	now := time.Now()
+	r.evict(now)
+	endian := r.endian
+	shb := AppendOptions(r.preamble[0], 16, endian, &pcapng.Option{
+		Code: pcapng.OptComment,
+		Value: []byte(fmt.Sprintf("ring buffer %s snapshot taken at %s: %s",
+			r.ID, now.UTC().Format(time.RFC3339), reason)),
+	})
+	blks := append([]*Block{shb}, r.preamble[1:]...)
+	for _, entry := range r.entries {
+		blks = append(blks, entry.blk)
+	}
+	var follower chan *Block
+	if post > 0 {
+		follower = make(chan *Block, RingFollowBacklog)
+		r.followers[follower] = struct{}{}
+		defer func() {
+			r.mu.Lock()
+			delete(r.followers, follower)
+			r.mu.Unlock()
+		}()
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	for _, blk := range blks {
+		if _, err := bw.Write(blk.Bytes(endian)); err != nil {
+			return err
+		}
+	}
+	if post > 0 {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		timer := time.NewTimer(post)
+		defer timer.Stop()
+	following:
+		for {
+			select {
+			case blk := <-follower:
+				if _, err := bw.Write(blk.Bytes(endian)); err != nil {
+					return err
+				}
+			case <-timer.C:
+				break following
+			case <-r.done:
+				break following
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Save writes a snapshot of the ring buffer into a new pcapng file in the
+// snapshot directory, returning the file's path.
+func (r *RingBuffer) Save(post time.Duration, reason string) (string, error) {
+	if SnapshotDir == "" {
+		return "", fmt.Errorf("no snapshot directory configured")
+	}
+	path := filepath.Join(SnapshotDir,
+		fmt.Sprintf("%s-%s.pcapng", r.ID, time.Now().UTC().Format("20060102T150405.000Z")))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", fmt.Errorf("cannot create snapshot file: %s", err.Error())
+	}
+	err = r.Snapshot(f, post, reason)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("cannot write snapshot file: %s", err.Error())
+	}
+	r.conn.Debugf("saved snapshot to %s", path)
+	return path, nil
+}
+
+// Start starts the background capture feeding the ring buffer, as well as
+// the ring buffer's trigger, if any.
+func (r *RingBuffer) Start(client *ClientIdentity, release func()) error {
+	return r.start(client, release, r,
+		func(netns relations.Relation, _ <-chan struct{}) {
+			RingBuffers.Add(r)
+			r.conn.Debugf("ring buffer keeping %s, up to %d MiB, of netns:[%d] traffic",
+				r.MaxAge, r.MaxSize>>20, r.Args.Target.NetNS)
+			if r.Trigger != "" {
+				go r.watchTrigger(netns)
+			}
+		},
+		func() { RingBuffers.Remove(r) })
+}
+
+// errTriggerStopped is returned by runTrigger when the ring buffer stopped
+// before its trigger matched.
+var errTriggerStopped = errors.New("ring buffer stopped")
+
+// runTrigger runs a single trigger capture process inside the specified
+// (locked) target network namespace until it has captured the first packet
+// matching the trigger capture filter. Just like the ring buffer's capture
+// process, the trigger capture process is confined to its own cgroup and
+// tracked by the reaper.
+func (r *RingBuffer) runTrigger(netns relations.Relation, targs *Args) error {
+	// The reaper tracks capture processes by their connections, so the
+	// trigger capture process needs a connection of its own.
+	conn := &WSConn{ID: r.conn.ID + "/trigger"}
+	cmd := exec.Command(CaptureProgram, append(captureArgs(conn, targs), "-c", "1")...)
+	cmd.Stdout = io.Discard
+	grrr := NewGrumbler(conn)
+	cmd.Stderr = grrr
+	cgroup, err := confineCapture(conn, cmd)
+	if err != nil {
+		conn.Errorf("cannot confine trigger capture process: %s", err.Error())
+		return err
+	}
+	err, starterr := startCapture(conn, cmd, netns)
+	if err == nil {
+		err = starterr
+	}
+	if err != nil {
+		if cgroup != nil {
+			cgroup.Remove()
+		}
+		conn.Errorf("cannot start trigger capture process: %s", err.Error())
+		return err
+	}
+	conn.Process = cmd.Process
+	Reaper.Track(conn, cmd.Process, cgroup)
+	defer Reaper.Reaped(conn)
+	waited := make(chan error, 1)
+	go func() { waited <- cmd.Wait() }()
+	select {
+	case <-r.done:
+		Reaper.SessionEnded(conn)
+		_ = cmd.Process.Kill()
+		<-waited
+		return errTriggerStopped
+	case err = <-waited:
+		return err
+	}
+}
+
+// watchTrigger repeatedly runs a separate capture process inside the
+// specified (locked) target network namespace that terminates as soon as it
+// captures the first packet matching the trigger capture filter. Each match
+// then saves a snapshot, including the post-trigger window, before the
+// trigger gets rearmed after the TriggerHoldoff. After MaxTriggeredSnapshots
+// snapshots, the trigger gets disarmed.
+func (r *RingBuffer) watchTrigger(netns relations.Relation) {
+	targs := *r.Args
+	targs.CaptureFilter = r.Trigger
+	targs.SnapLen = 0
+	saved := 0
+	for {
+		err := r.runTrigger(netns, &targs)
+		if err == errTriggerStopped {
+			return
+		}
+		if err != nil {
+			select {
+			case <-r.done:
+				return
+			case <-time.After(TriggerRetryInterval):
+			}
+			continue
+		}
+		r.mu.Lock()
+		r.triggered++
+		r.mu.Unlock()
+		r.conn.Debugf("trigger \"%s\" matched", r.Trigger)
+		reason := fmt.Sprintf("trigger \"%s\" matched", r.Trigger)
+		savedAt := time.Now()
+		if _, err := r.Save(r.Post, reason); err != nil {
+			r.conn.Errorf("%s", err.Error())
+		} else {
+			saved++
+		}
+		if saved >= MaxTriggeredSnapshots {
+			r.conn.Errorf("disarming trigger \"%s\" after %d snapshots", r.Trigger, saved)
+			return
+		}
+		select {
+		case <-r.done:
+			return
+		case <-time.After(time.Until(savedAt.Add(TriggerHoldoff))):
+		}
+	}
+}
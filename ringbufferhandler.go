@@ -0,0 +1,174 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Handles the /ringbuffers API endpoint for starting, listing, and stopping
+// pre-trigger ring buffers, as well as the /snapshot API endpoint for taking
+// snapshots of ring buffers.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Handle the /ringbuffers API endpoint: GET lists the running ring buffers,
+// POST starts a new ring buffer, and DELETE stops a ring buffer, but only if
+// requested by the ring buffer's owner.
+func ringBuffersHandler(w http.ResponseWriter, req *http.Request) {
+	RingBuffers.Serve(w, req, newRingBufferFromParams)
+}
+
+// newRingBufferFromParams returns a new ring buffer with the ring buffer
+// specific parameters from the request. Per-packet annotations and anything
+// else that needs a live capture client are not supported by ring buffers.
+func newRingBufferFromParams(conn *WSConn, args *Args, req *http.Request) (*RingBuffer, error) {
+	if err := checkBackgroundParams("ring buffer", args); err != nil {
+		return nil, err
+	}
+	params := req.URL.Query()
+	seconds := DefaultRingSeconds
+	if s, ok := params["seconds"]; ok {
+		secs, err := strconv.ParseUint(s[0], 10, 16)
+		if err != nil || secs == 0 || secs > MaxRingSeconds {
+			return nil, fmt.Errorf("invalid seconds \"%s\"", s[0])
+		}
+		seconds = int(secs)
+	}
+	megabytes := DefaultRingMegabytes
+	if m, ok := params["megabytes"]; ok {
+		mibs, err := strconv.ParseUint(m[0], 10, 16)
+		if err != nil || mibs == 0 || mibs > MaxRingMegabytes {
+			return nil, fmt.Errorf("invalid megabytes \"%s\"", m[0])
+		}
+		megabytes = int(mibs)
+	}
+	ring := NewRingBuffer(conn, args, time.Duration(seconds)*time.Second, megabytes<<20)
+	if t, ok := params["trigger"]; ok {
+		if t[0] == "" {
+			return nil, fmt.Errorf("invalid empty trigger")
+		}
+		if SnapshotDir == "" {
+			return nil, fmt.Errorf("trigger requires a snapshot directory")
+		}
+		ring.Trigger = t[0]
+	}
+	if p, ok := params["post"]; ok {
+		if ring.Trigger == "" {
+			return nil, fmt.Errorf("post requires trigger")
+		}
+		post, err := parsePostSeconds(p[0])
+		if err != nil {
+			return nil, err
+		}
+		ring.Post = post
+	}
+	return ring, nil
+}
+
+// parsePostSeconds parses the length of a post-trigger window in seconds.
+func parsePostSeconds(s string) (time.Duration, error) {
+	secs, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || secs > MaxPostSeconds {
+		return 0, fmt.Errorf("invalid post \"%s\"", s)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// Handle the /snapshot API endpoint. Depending on the request, this either
+// saves a snapshot of a ring buffer into the snapshot directory, streams it
+// via a websocket, or returns it as a pcapng file download. Only the owner of
+// a ring buffer may take snapshots of it.
+func snapshotHandler(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	ring, ok := RingBuffers.Get(params.Get("id"))
+	if !ok {
+		http.Error(w, "no such ring buffer", http.StatusNotFound)
+		return
+	}
+	principal := NewClientIdentity(req).Principal()
+	if principal != ring.Owner {
+		log.Errorf("rejecting snapshot of ring buffer %s of %s by %s", ring.ID, ring.Owner, principal)
+		http.Error(w, "not the owner of the ring buffer", http.StatusForbidden)
+		return
+	}
+	if !ring.Captured() {
+		http.Error(w, "ring buffer has not captured anything yet", http.StatusConflict)
+		return
+	}
+	var post time.Duration
+	if p, ok := params["post"]; ok {
+		var err error
+		if post, err = parsePostSeconds(p[0]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	reason := fmt.Sprintf("requested by %s", principal)
+
+	if _, ok := params["save"]; ok {
+		if SnapshotDir == "" {
+			http.Error(w, "no snapshot directory configured", http.StatusBadRequest)
+			return
+		}
+		if !ring.reserveRequestedSave() {
+			http.Error(w, "too many saved snapshots", http.StatusTooManyRequests)
+			return
+		}
+		path, err := ring.Save(post, reason)
+		if err != nil {
+			ring.conn.Errorf("%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"file": path})
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(req) {
+		conn := NewWSConn()
+		cnx, err := wsupgrader.Upgrade(w, req, nil)
+		if err != nil {
+			conn.Errorf("websocket upgrade process failed: %s", err.Error())
+			return
+		}
+		conn.Conn = cnx
+		defer conn.Close()
+		conn.Debugf("streaming snapshot of ring buffer %s", ring.ID)
+		if err := ring.Snapshot(NewPiper(conn), post, reason); err != nil {
+			conn.Errorf("cannot stream snapshot: %s", err.Error())
+			conn.GracefullyClose(websocket.CloseAbnormalClosure, "cannot stream snapshot")
+			return
+		}
+		conn.GracefullyClose(websocket.CloseNormalClosure, "snapshot complete")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s.pcapng\"",
+		ring.ID, time.Now().UTC().Format("20060102T150405Z")))
+	if err := ring.Snapshot(w, post, reason); err != nil {
+		ring.conn.Errorf("cannot send snapshot: %s", err.Error())
+	}
+}
+
+// writeJSON writes the specified value as a JSON response with the specified
+// HTTP status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("cannot create JSON response: %s", err.Error())
+		http.Error(w, "cannot create JSON response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(j)
+}
@@ -0,0 +1,797 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Serves the network interfaces of the discovered capture targets as remote
+// interfaces via the RPCAP remote capture protocol (version 0), as spoken by
+// rpcapd and libpcap, so that stock Wireshark can capture from containers
+// without the csharg extcap plugin. RPCAP sessions use the same capture target
+// resolution, network namespace locking, and capture process machinery as
+// websocket capture sessions. Packet data is only sent over separate TCP data
+// connections that clients open toward the server ("passive mode"), which is
+// what stock Wireshark uses.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pcapng "github.com/siemens/csharg/pcapng"
+	log "github.com/sirupsen/logrus"
+	"github.com/thediveo/lxkns/ops"
+	"github.com/thediveo/lxkns/ops/relations"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/bpf"
+)
+
+// DefaultRPCAPPort is the well-known port of RPCAP servers.
+const DefaultRPCAPPort = 2002
+
+// RPCAP protocol message types; replies have the RPCAPMsgReply bit set.
+const (
+	RPCAPMsgError        = uint8(1)
+	RPCAPMsgFindAllIf    = uint8(2)
+	RPCAPMsgOpen         = uint8(3)
+	RPCAPMsgStartCap     = uint8(4)
+	RPCAPMsgUpdateFilter = uint8(5)
+	RPCAPMsgClose        = uint8(6)
+	RPCAPMsgPacket       = uint8(7)
+	RPCAPMsgAuth         = uint8(8)
+	RPCAPMsgStats        = uint8(9)
+	RPCAPMsgEndCap       = uint8(10)
+	RPCAPMsgSetSampling  = uint8(11)
+	RPCAPMsgReply        = uint8(0x80)
+)
+
+// RPCAP protocol error codes.
+const (
+	RPCAPErrFindAllIf    = uint16(4)
+	RPCAPErrOpen         = uint16(6)
+	RPCAPErrUpdateFilter = uint16(7)
+	RPCAPErrGetStats     = uint16(8)
+	RPCAPErrReadEx       = uint16(9)
+	RPCAPErrStartCapture = uint16(12)
+	RPCAPErrEndCapture   = uint16(13)
+	RPCAPErrSetSampling  = uint16(15)
+	RPCAPErrWrongMsg     = uint16(16)
+	RPCAPErrWrongVer     = uint16(17)
+	RPCAPErrAuthFailed   = uint16(18)
+	RPCAPErrAuthType     = uint16(20)
+)
+
+// RPCAP protocol authentication types, start capture flags, and filter
+// types. The server-open start capture flag asks the server to open the data
+// connection toward the client (active mode).
+const (
+	RPCAPAuthNull           = uint16(0)
+	RPCAPAuthPassword       = uint16(1)
+	RPCAPStartCapPromisc    = uint16(1)
+	RPCAPStartCapDgram      = uint16(2)
+	RPCAPStartCapServerOpen = uint16(4)
+	RPCAPFilterBPF          = uint16(1)
+)
+
+// RPCAP protocol limits and deadlines.
+const (
+	RPCAPMaxPayload   = 1 << 20          // maximum accepted message payload size.
+	RPCAPBufferSize   = 256 * 1024       // buffer size reported to clients.
+	RPCAPAuthDeadline = 30 * time.Second // for clients to authenticate.
+	RPCAPDataDeadline = 10 * time.Second // for clients to connect their data connections.
+)
+
+// rpcapByteOrderMagic tells RPCAP clients that the server uses the same byte
+// order for its host-order fields, which we don't have anyway.
+const rpcapByteOrderMagic = uint32(0xa1b2c3d4)
+
+// RPCAPUsers maps RPCAP user names to their bcrypt password hashes, as loaded
+// from the RPCAPUsersFile. RPCAP clients always need to authenticate as one
+// of these users.
+var RPCAPUsers map[string][]byte
+
+// rpcapDummyHash is checked against when authenticating unknown users, so that
+// unknown users cannot be told apart from known users by response times.
+var rpcapDummyHash, _ = bcrypt.GenerateFromPassword([]byte("packetflix"), bcrypt.DefaultCost)
+
+// LoadRPCAPUsers loads RPCAP users from the specified file, with a line
+// "user:bcrypt-hash-of-password" per user, as created by "htpasswd -nB user".
+// Empty lines and lines starting with "#" are ignored.
+func LoadRPCAPUsers(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read RPCAP users file: %s", err.Error())
+	}
+	defer f.Close()
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid RPCAP user in line %d of %s", lineno, path)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt password hash in line %d of %s", lineno, path)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// ServeRPCAP accepts RPCAP control connections on the specified port. It only
+// returns if it cannot listen on the port.
+func ServeRPCAP(port uint16) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("[::]:%d", port))
+	if err != nil {
+		return err
+	}
+	log.Infof("starting RPCAP server on port %d...", port)
+	for {
+		ctrl, err := listener.Accept()
+		if err != nil {
+			log.Errorf("cannot accept RPCAP connection: %s", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go NewRPCAPSession(ctrl).Serve()
+	}
+}
+
+// rpcapHeader is the common header of all RPCAP messages.
+type rpcapHeader struct {
+	Ver   uint8
+	Type  uint8
+	Value uint16
+	Plen  uint32
+}
+
+// RPCAPSession is an RPCAP control connection, together with the remote
+// interface opened by the client and its capture, if any.
+type RPCAPSession struct {
+	conn    *WSConn // for logging.
+	ctrl    net.Conn
+	writeMu sync.Mutex // serializes replies and asynchronous error messages.
+	client  *ClientIdentity
+	authed  bool
+
+	args     *Args // capture target of the opened remote interface; nil if none.
+	linktype uint16
+	netns    relations.Relation
+	unlocker func()
+	release  func()
+	capture  *rpcapCapture // running capture; nil if none.
+}
+
+// NewRPCAPSession returns a new RPCAP session on the specified control
+// connection.
+func NewRPCAPSession(ctrl net.Conn) *RPCAPSession {
+	client := &ClientIdentity{Address: ctrl.RemoteAddr().String()}
+	if host, _, err := net.SplitHostPort(client.Address); err == nil {
+		client.Address = host
+	}
+	return &RPCAPSession{
+		conn:   NewWSConn(),
+		ctrl:   ctrl,
+		client: client,
+	}
+}
+
+// Serve handles the RPCAP messages from the client until the client closes
+// the session or the control connection fails.
+func (s *RPCAPSession) Serve() {
+	s.conn.Debugf("RPCAP session from %s started", s.client.Address)
+	defer func() {
+		s.closeInterface()
+		s.ctrl.Close()
+		s.conn.Debugf("RPCAP session finished")
+	}()
+	_ = s.ctrl.SetReadDeadline(time.Now().Add(RPCAPAuthDeadline))
+	for {
+		var hdr rpcapHeader
+		if err := binary.Read(s.ctrl, binary.BigEndian, &hdr); err != nil {
+			if err != io.EOF {
+				s.conn.Debugf("RPCAP control connection failed: %s", err.Error())
+			}
+			return
+		}
+		if hdr.Plen > RPCAPMaxPayload {
+			s.sendError(RPCAPErrWrongMsg, "message too large")
+			return
+		}
+		payload := make([]byte, hdr.Plen)
+		if _, err := io.ReadFull(s.ctrl, payload); err != nil {
+			return
+		}
+		if hdr.Ver != 0 {
+			s.sendError(RPCAPErrWrongVer, "unsupported RPCAP protocol version")
+			continue
+		}
+		if hdr.Type == RPCAPMsgClose {
+			return
+		}
+		if !s.authed && hdr.Type != RPCAPMsgAuth {
+			s.sendError(RPCAPErrAuthFailed, "authentication required")
+			return
+		}
+		switch hdr.Type {
+		case RPCAPMsgAuth:
+			if !s.auth(payload) {
+				return
+			}
+			_ = s.ctrl.SetReadDeadline(time.Time{})
+		case RPCAPMsgFindAllIf:
+			s.findAllIf()
+		case RPCAPMsgOpen:
+			s.open(string(payload))
+		case RPCAPMsgStartCap:
+			s.startCap(payload)
+		case RPCAPMsgUpdateFilter:
+			s.updateFilter(payload)
+		case RPCAPMsgStats:
+			s.stats()
+		case RPCAPMsgEndCap:
+			s.stopCapture()
+			s.reply(RPCAPMsgEndCap, 0, nil)
+		case RPCAPMsgSetSampling:
+			if len(payload) < 8 || payload[0] != 0 {
+				s.sendError(RPCAPErrSetSampling, "sampling is not supported")
+				continue
+			}
+			s.reply(RPCAPMsgSetSampling, 0, nil)
+		default:
+			s.sendError(RPCAPErrWrongMsg, fmt.Sprintf("unsupported message type %d", hdr.Type))
+		}
+	}
+}
+
+// auth authenticates the client, returning true if successful.
+func (s *RPCAPSession) auth(payload []byte) bool {
+	if len(payload) < 8 {
+		s.sendError(RPCAPErrAuthFailed, "malformed authentication request")
+		return false
+	}
+	authtype := binary.BigEndian.Uint16(payload[0:2])
+	userlen := int(binary.BigEndian.Uint16(payload[4:6]))
+	passlen := int(binary.BigEndian.Uint16(payload[6:8]))
+	switch authtype {
+	case RPCAPAuthNull:
+		s.sendError(RPCAPErrAuthType, "password authentication required")
+		return false
+	case RPCAPAuthPassword:
+		if len(payload) < 8+userlen+passlen {
+			s.sendError(RPCAPErrAuthFailed, "malformed authentication request")
+			return false
+		}
+		user := string(payload[8 : 8+userlen])
+		password := payload[8+userlen : 8+userlen+passlen]
+		hash, ok := RPCAPUsers[user]
+		if !ok {
+			hash = rpcapDummyHash
+		}
+		if bcrypt.CompareHashAndPassword(hash, password) != nil || !ok {
+			s.conn.Errorf("RPCAP authentication of user %q from %s failed", user, s.client.Address)
+			s.sendError(RPCAPErrAuthFailed, "authentication failed")
+			return false
+		}
+		s.client.User = user
+	default:
+		s.sendError(RPCAPErrAuthType, "unsupported authentication type")
+		return false
+	}
+	s.authed = true
+	s.conn.Debugf("RPCAP client %s authenticated", s.client.Principal())
+	// Announce that we only support protocol version 0.
+	reply := make([]byte, 8)
+	binary.BigEndian.PutUint32(reply[4:8], rpcapByteOrderMagic)
+	s.reply(RPCAPMsgAuth, 0, reply)
+	return true
+}
+
+// rpcapInterface is a remote interface, referencing a network interface of a
+// discovered capture target.
+type rpcapInterface struct {
+	Name        string
+	Description string
+	Loopback    bool
+}
+
+// rpcapInterfaces returns the remote interfaces of the discovered capture
+// targets, named "NIF@TARGET", where the network interface "any" captures
+// from all network interfaces of a capture target.
+func rpcapInterfaces() ([]rpcapInterface, error) {
+	targets, err := discoveredTargets()
+	if err != nil {
+		return nil, err
+	}
+	nifs := []rpcapInterface{}
+	for _, t := range targets {
+		if t.NetNS == 0 {
+			continue
+		}
+		name := rpcapTargetName(t.Prefix, t.Name)
+		nifs = append(nifs, rpcapInterface{
+			Name:        "any@" + name,
+			Description: fmt.Sprintf("all network interfaces of %s %s", t.Type, name),
+		})
+		for _, nif := range t.NetworkInterfaces {
+			nifs = append(nifs, rpcapInterface{
+				Name:        nif + "@" + name,
+				Description: fmt.Sprintf("network interface %s of %s %s", nif, t.Type, name),
+				Loopback:    nif == "lo",
+			})
+		}
+	}
+	return nifs, nil
+}
+
+// rpcapTargetName returns the name of a capture target as used in remote
+// interface names.
+func rpcapTargetName(prefix, name string) string {
+	if prefix != "" {
+		return prefix + ":" + name
+	}
+	return name
+}
+
+// findAllIf replies with the list of remote interfaces.
+func (s *RPCAPSession) findAllIf() {
+	nifs, err := rpcapInterfaces()
+	if err != nil {
+		s.sendError(RPCAPErrFindAllIf, "cannot discover capture targets: "+err.Error())
+		return
+	}
+	var payload []byte
+	for _, nif := range nifs {
+		entry := make([]byte, 12)
+		binary.BigEndian.PutUint16(entry[0:2], uint16(len(nif.Name)))
+		binary.BigEndian.PutUint16(entry[2:4], uint16(len(nif.Description)))
+		if nif.Loopback {
+			binary.BigEndian.PutUint32(entry[4:8], 1) // PCAP_IF_LOOPBACK
+		}
+		payload = append(payload, entry...)
+		payload = append(payload, nif.Name...)
+		payload = append(payload, nif.Description...)
+	}
+	s.reply(RPCAPMsgFindAllIf, uint16(len(nifs)), payload)
+}
+
+// open opens the specified remote interface, locking the network namespace of
+// its capture target until the interface gets closed again.
+func (s *RPCAPSession) open(name string) {
+	s.closeInterface()
+	nif, targetname, ok := strings.Cut(name, "@")
+	if !ok || nif == "" {
+		s.sendError(RPCAPErrOpen, fmt.Sprintf("invalid remote interface %q", name))
+		return
+	}
+	targets, err := discoveredTargets()
+	if err != nil {
+		s.sendError(RPCAPErrOpen, "cannot discover capture targets: "+err.Error())
+		return
+	}
+	args := &Args{}
+	for _, t := range targets {
+		if rpcapTargetName(t.Prefix, t.Name) == targetname && t.NetNS != 0 {
+			target := *t
+			target.NetworkInterfaces = []string{nif}
+			args.Target = &target
+			break
+		}
+	}
+	if args.Target == nil {
+		s.sendError(RPCAPErrOpen, fmt.Sprintf("unknown capture target %q", targetname))
+		return
+	}
+	release, err := Sessions.Acquire(s.client.Principal(), uint64(args.Target.NetNS))
+	if err != nil {
+		s.conn.Errorf("rejecting RPCAP session of %s: %s", s.client.Principal(), err.Error())
+		s.sendError(RPCAPErrOpen, err.Error())
+		return
+	}
+	netnsref := targetNetnsPath(s.conn, args)
+	if len(netnsref) == 0 {
+		release()
+		s.sendError(RPCAPErrOpen, "could not locate network namespace for container")
+		return
+	}
+	lockednetns, unlocker, err := lockTargetNetns(args, netnsref)
+	if err != nil {
+		release()
+		s.conn.Errorf("cannot not lock netns:[%d], reason: %s", args.Target.NetNS, err.Error())
+		s.sendError(RPCAPErrOpen, "cannot lock target network stack")
+		return
+	}
+	s.args = args
+	s.netns = lockednetns
+	s.unlocker = unlocker
+	s.release = release
+	s.linktype = linkTypeOf(nif, lockednetns)
+	s.conn.Debugf("RPCAP client %s opened %s, link type %d", s.client.Principal(), name, s.linktype)
+	reply := make([]byte, 8)
+	binary.BigEndian.PutUint32(reply[0:4], uint32(s.linktype))
+	s.reply(RPCAPMsgOpen, 0, reply)
+}
+
+// closeInterface stops any running capture and closes the currently opened
+// remote interface, if any.
+func (s *RPCAPSession) closeInterface() {
+	s.stopCapture()
+	if s.args == nil {
+		return
+	}
+	s.unlocker()
+	s.release()
+	s.args = nil
+}
+
+// linkTypeOf returns the link-layer header type that the capture process will
+// use when capturing from the specified network interface inside the (locked)
+// network namespace. RPCAP clients need to know the link-layer header type
+// before the capture starts, in order to compile their capture filters.
+func linkTypeOf(nif string, netns relations.Relation) uint16 {
+	if nif == "any" {
+		return LinkTypeLinuxSLL
+	}
+	res, err := ops.Execute(func() interface{} {
+		netif, err := net.InterfaceByName(nif)
+		if err != nil {
+			return LinkTypeEthernet
+		}
+		if netif.Flags&net.FlagLoopback == 0 && len(netif.HardwareAddr) != 6 {
+			return LinkTypeRaw
+		}
+		return LinkTypeEthernet
+	}, netns)
+	if err != nil {
+		return LinkTypeEthernet
+	}
+	return res.(uint16)
+}
+
+// startCap starts capturing from the opened remote interface, sending the
+// captured packets over a new data connection.
+func (s *RPCAPSession) startCap(payload []byte) {
+	if s.args == nil {
+		s.sendError(RPCAPErrStartCapture, "no remote interface opened")
+		return
+	}
+	if s.capture != nil {
+		s.sendError(RPCAPErrStartCapture, "capture already running")
+		return
+	}
+	req, err := parseRPCAPStartCap(payload)
+	if err != nil {
+		s.sendError(RPCAPErrStartCapture, err.Error())
+		return
+	}
+	// Listen for the data connection on the same address the client reached
+	// us at.
+	host, _, _ := net.SplitHostPort(s.ctrl.LocalAddr().String())
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		s.sendError(RPCAPErrStartCapture, "cannot open data connection: "+err.Error())
+		return
+	}
+	defer listener.Close()
+	reply := make([]byte, 8)
+	binary.BigEndian.PutUint32(reply[0:4], RPCAPBufferSize)
+	binary.BigEndian.PutUint16(reply[4:6], uint16(listener.Addr().(*net.TCPAddr).Port))
+	s.reply(RPCAPMsgStartCap, 0, reply)
+	_ = listener.(*net.TCPListener).SetDeadline(time.Now().Add(RPCAPDataDeadline))
+	data, err := s.acceptData(listener)
+	if err != nil {
+		s.sendError(RPCAPErrStartCapture, "client did not connect data connection")
+		return
+	}
+
+	args := *s.args
+	args.KeepChaste = req.flags&RPCAPStartCapPromisc == 0
+	if req.snaplen > 0 && req.snaplen < MaxSnapLen {
+		args.SnapLen = req.snaplen
+	}
+	// Each capture gets its own connection wrapper, so that its capture
+	// process can be terminated independently of previous captures.
+	capconn := &WSConn{ID: s.conn.ID}
+	c := &rpcapCapture{
+		session: s,
+		conn:    capconn,
+		data:    data,
+		snaplen: args.SnapLen,
+		done:    make(chan struct{}),
+	}
+	c.filter.Store(req.filter)
+	if err := c.start(&args); err != nil {
+		data.Close()
+		s.conn.Errorf("%s", err.Error())
+		s.sendError(RPCAPErrStartCapture, err.Error())
+		return
+	}
+	s.capture = c
+}
+
+// rpcapStartCapRequest is a parsed start capture request.
+type rpcapStartCapRequest struct {
+	snaplen uint32
+	flags   uint16
+	filter  *bpf.VM // nil if none.
+}
+
+// parseRPCAPStartCap parses the payload of a start capture request, rejecting
+// requests for active mode or UDP data connections.
+func parseRPCAPStartCap(payload []byte) (*rpcapStartCapRequest, error) {
+	if len(payload) < 12 {
+		return nil, fmt.Errorf("malformed start capture request")
+	}
+	req := &rpcapStartCapRequest{
+		snaplen: binary.BigEndian.Uint32(payload[0:4]),
+		flags:   binary.BigEndian.Uint16(payload[8:10]),
+	}
+	if req.flags&(RPCAPStartCapDgram|RPCAPStartCapServerOpen) != 0 {
+		return nil, fmt.Errorf("only passive mode with TCP data connections is supported")
+	}
+	filter, err := rpcapFilter(payload[12:])
+	if err != nil {
+		return nil, err
+	}
+	req.filter = filter
+	return req, nil
+}
+
+// acceptData accepts the data connection from the same host as the control
+// connection, rejecting connections from any other hosts, until the
+// listener's deadline passes.
+func (s *RPCAPSession) acceptData(listener net.Listener) (net.Conn, error) {
+	ctrlhost, _, _ := net.SplitHostPort(s.ctrl.RemoteAddr().String())
+	for {
+		data, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		datahost, _, _ := net.SplitHostPort(data.RemoteAddr().String())
+		ctrlip, dataip := net.ParseIP(ctrlhost), net.ParseIP(datahost)
+		if ctrlip != nil && ctrlip.Equal(dataip) {
+			return data, nil
+		}
+		s.conn.Errorf("rejecting RPCAP data connection from %s, expected %s",
+			data.RemoteAddr().String(), ctrlhost)
+		data.Close()
+	}
+}
+
+// updateFilter replaces the capture filter of the running capture.
+func (s *RPCAPSession) updateFilter(payload []byte) {
+	if s.capture == nil {
+		s.sendError(RPCAPErrUpdateFilter, "no capture running")
+		return
+	}
+	filter, err := rpcapFilter(payload)
+	if err != nil {
+		s.sendError(RPCAPErrUpdateFilter, err.Error())
+		return
+	}
+	s.capture.filter.Store(filter)
+	s.reply(RPCAPMsgUpdateFilter, 0, nil)
+}
+
+// stats replies with the statistics of the running or last capture.
+func (s *RPCAPSession) stats() {
+	if s.args == nil {
+		s.sendError(RPCAPErrGetStats, "no remote interface opened")
+		return
+	}
+	reply := make([]byte, 16)
+	if c := s.capture; c != nil {
+		binary.BigEndian.PutUint32(reply[0:4], saturate32(c.received.Load()))
+		binary.BigEndian.PutUint32(reply[12:16], saturate32(c.sent.Load()))
+	}
+	s.reply(RPCAPMsgStats, 0, reply)
+}
+
+// saturate32 returns the specified counter as an unsigned 32 bit value,
+// saturating instead of wrapping around.
+func saturate32(n uint64) uint32 {
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+// stopCapture stops the running capture, if any, and waits for its capture
+// process to terminate.
+func (s *RPCAPSession) stopCapture() {
+	c := s.capture
+	if c == nil {
+		return
+	}
+	s.capture = nil
+	c.conn.Terminate()
+	Reaper.SessionEnded(c.conn)
+	<-c.done
+}
+
+// reply sends a reply message of the specified type.
+func (s *RPCAPSession) reply(msgtype uint8, value uint16, payload []byte) {
+	s.send(RPCAPMsgReply|msgtype, value, payload)
+}
+
+// sendError sends an error message with the specified error code and text.
+func (s *RPCAPSession) sendError(code uint16, text string) {
+	s.send(RPCAPMsgError, code, []byte(text))
+}
+
+// send sends a message over the control connection.
+func (s *RPCAPSession) send(msgtype uint8, value uint16, payload []byte) {
+	msg := make([]byte, 8, 8+len(payload))
+	msg[1] = msgtype
+	binary.BigEndian.PutUint16(msg[2:4], value)
+	binary.BigEndian.PutUint32(msg[4:8], uint32(len(payload)))
+	msg = append(msg, payload...)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.ctrl.Write(msg); err != nil {
+		s.conn.Debugf("RPCAP control connection failed: %s", err.Error())
+	}
+}
+
+// rpcapFilter returns a BPF virtual machine for the specified RPCAP filter,
+// or nil if the filter is empty.
+func rpcapFilter(payload []byte) (*bpf.VM, error) {
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("malformed filter")
+	}
+	if binary.BigEndian.Uint16(payload[0:2]) != RPCAPFilterBPF {
+		return nil, fmt.Errorf("unsupported filter type")
+	}
+	n := int(binary.BigEndian.Uint32(payload[4:8]))
+	if n == 0 {
+		return nil, nil
+	}
+	if len(payload) < 8+8*n {
+		return nil, fmt.Errorf("malformed filter")
+	}
+	insns := make([]bpf.Instruction, 0, n)
+	for i := 0; i < n; i++ {
+		raw := payload[8+8*i : 16+8*i]
+		insns = append(insns, bpf.RawInstruction{
+			Op: binary.BigEndian.Uint16(raw[0:2]),
+			Jt: raw[2],
+			Jf: raw[3],
+			K:  binary.BigEndian.Uint32(raw[4:8]),
+		}.Disassemble())
+	}
+	vm, err := bpf.NewVM(insns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %s", err.Error())
+	}
+	return vm, nil
+}
+
+// rpcapCapture is a running RPCAP capture, as well as the pcapng block editor
+// forwarding the captured packets to the client's data connection.
+type rpcapCapture struct {
+	session  *RPCAPSession
+	conn     *WSConn // for terminating the capture process.
+	data     net.Conn
+	filter   atomic.Pointer[bpf.VM]
+	snaplen  uint32
+	received atomic.Uint64
+	sent     atomic.Uint64
+	failed   atomic.Bool   // data connection failed, stop forwarding.
+	done     chan struct{} // closed after the capture process terminated.
+}
+
+// start starts the capture process inside the locked network namespace.
+func (c *rpcapCapture) start(args *Args) error {
+	s := c.session
+	cmd := exec.Command(CaptureProgram, captureArgs(c.conn, args)...)
+	stream := NewBlockStream(io.Discard, c)
+	cmd.Stdout = pcapng.NewStreamEditor(stream, args.Target, "", args.KeepChaste)
+	grrr := NewGrumbler(c.conn)
+	cmd.Stderr = grrr
+	cgroup, err := confineCapture(c.conn, cmd)
+	if err != nil {
+		return fmt.Errorf("cannot confine capture process: %s", err.Error())
+	}
+	err, starterr := startCapture(c.conn, cmd, s.netns)
+	if err == nil {
+		err = starterr
+	}
+	if err != nil {
+		if cgroup != nil {
+			cgroup.Remove()
+		}
+		return fmt.Errorf("cannot start capture process: %s", err.Error())
+	}
+	captureDone := make(chan struct{})
+	c.conn.Exited = captureDone
+	c.conn.Process = cmd.Process
+	Reaper.Track(c.conn, cmd.Process, cgroup)
+	go func() {
+		err := cmd.Wait()
+		close(captureDone)
+		Reaper.SessionEnded(c.conn)
+		Reaper.Reaped(c.conn)
+		c.data.Close()
+		// Tell the client in case the capture process failed on its own,
+		// instead of getting stopped.
+		if err != nil && grrr.Reason() != "" {
+			s.sendError(RPCAPErrReadEx, grrr.Reason())
+		}
+		c.conn.Debugf("RPCAP capture process terminated")
+		close(c.done)
+	}()
+	return nil
+}
+
+// EditBlock forwards the captured packets passing the filter to the client.
+func (c *rpcapCapture) EditBlock(s *BlockStream, blk *Block) []*Block {
+	switch blk.Type {
+	case BlockTypeIDB:
+		if len(blk.Body) >= 2 {
+			if linktype := s.Endian.Uint16(blk.Body[0:2]); linktype != c.session.linktype {
+				c.conn.Errorf("capture process uses link type %d instead of announced %d",
+					linktype, c.session.linktype)
+			}
+		}
+	case BlockTypeEPB:
+		if !c.failed.Load() {
+			c.forward(s, blk)
+		}
+	}
+	return []*Block{blk}
+}
+
+// forward sends a captured packet to the client, unless filtered out.
+func (c *rpcapCapture) forward(s *BlockStream, blk *Block) {
+	pkt := ParseEnhancedPacket(blk, s.Endian)
+	if pkt == nil {
+		return
+	}
+	nif := s.Interface(pkt.InterfaceID)
+	if nif == nil {
+		return
+	}
+	c.received.Add(1)
+	data := pkt.Data
+	if vm := c.filter.Load(); vm != nil {
+		keep, err := vm.Run(data)
+		if err != nil || keep == 0 {
+			return
+		}
+		if keep < len(data) {
+			data = data[:keep]
+		}
+	}
+	if c.snaplen != 0 && uint32(len(data)) > c.snaplen {
+		data = data[:c.snaplen]
+	}
+	ns := ticksToNanos(pkt.Timestamp, nif.TsResol)
+	npkt := c.sent.Add(1)
+	msg := make([]byte, 28, 28+len(data))
+	msg[1] = RPCAPMsgPacket
+	binary.BigEndian.PutUint32(msg[4:8], uint32(20+len(data)))
+	binary.BigEndian.PutUint32(msg[8:12], uint32(ns/1e9))
+	binary.BigEndian.PutUint32(msg[12:16], uint32(ns%1e9/1e3))
+	binary.BigEndian.PutUint32(msg[16:20], uint32(len(data)))
+	binary.BigEndian.PutUint32(msg[20:24], pkt.OrigLen)
+	binary.BigEndian.PutUint32(msg[24:28], uint32(npkt))
+	msg = append(msg, data...)
+	if _, err := c.data.Write(msg); err != nil {
+		c.conn.Debugf("RPCAP data connection failed: %s", err.Error())
+		c.failed.Store(true)
+		c.conn.Terminate()
+	}
+}
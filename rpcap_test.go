@@ -0,0 +1,214 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// rpcapStartCapTCP is a start capture request as sent by libpcap (and thus
+// stock Wireshark) in passive mode, in promiscuous mode with the default snap
+// length, and with the capture filter "tcp" compiled for Ethernet, as listed
+// by "tcpdump -dd tcp".
+var rpcapStartCapTCP = []byte{
+	0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x74, // header: version 0, startcap, plen 116
+	0x00, 0x04, 0x00, 0x00, // snaplen 262144
+	0x00, 0x00, 0x03, 0xe8, // read timeout 1000ms
+	0x00, 0x01, // flags: promiscuous
+	0x00, 0x00, // portdata
+	0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, // BPF filter with 12 instructions
+	0x00, 0x28, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, // ldh [12]
+	0x00, 0x15, 0x00, 0x05, 0x00, 0x00, 0x86, 0xdd, // jeq #0x86dd
+	0x00, 0x30, 0x00, 0x00, 0x00, 0x00, 0x00, 0x14, // ldb [20]
+	0x00, 0x15, 0x06, 0x00, 0x00, 0x00, 0x00, 0x06, // jeq #6
+	0x00, 0x15, 0x00, 0x06, 0x00, 0x00, 0x00, 0x2c, // jeq #44
+	0x00, 0x30, 0x00, 0x00, 0x00, 0x00, 0x00, 0x36, // ldb [54]
+	0x00, 0x15, 0x03, 0x04, 0x00, 0x00, 0x00, 0x06, // jeq #6
+	0x00, 0x15, 0x00, 0x03, 0x00, 0x00, 0x08, 0x00, // jeq #0x800
+	0x00, 0x30, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, // ldb [23]
+	0x00, 0x15, 0x00, 0x01, 0x00, 0x00, 0x00, 0x06, // jeq #6
+	0x00, 0x06, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, // ret #262144
+	0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ret #0
+}
+
+// testEthernetFrame returns an Ethernet frame carrying an IPv4 packet of the
+// specified transport protocol.
+func testEthernetFrame(proto uint8) []byte {
+	frame := make([]byte, 14, 54)
+	binary.BigEndian.PutUint16(frame[12:14], EtherTypeIPv4)
+	return append(frame, testIPv4Packet(proto, "10.0.0.1", "10.0.0.2", 1234, 80, 0).Data...)
+}
+
+func TestParseRPCAPStartCap(t *testing.T) {
+	var hdr rpcapHeader
+	r := bytes.NewReader(rpcapStartCapTCP)
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		t.Fatalf("cannot read header: %s", err.Error())
+	}
+	if hdr.Ver != 0 || hdr.Type != RPCAPMsgStartCap || int(hdr.Plen) != r.Len() {
+		t.Fatalf("unexpected header %+v", hdr)
+	}
+	payload, _ := io.ReadAll(r)
+	req, err := parseRPCAPStartCap(payload)
+	if err != nil {
+		t.Fatalf("passive mode request rejected: %s", err.Error())
+	}
+	if req.snaplen != 262144 || req.flags != RPCAPStartCapPromisc || req.filter == nil {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	for _, tt := range []struct {
+		proto uint8
+		keep  int
+	}{
+		{IPProtoTCP, 262144},
+		{IPProtoUDP, 0},
+	} {
+		if keep, err := req.filter.Run(testEthernetFrame(tt.proto)); err != nil || keep != tt.keep {
+			t.Errorf("filter on protocol %d: got %d, %v, want %d", tt.proto, keep, err, tt.keep)
+		}
+	}
+
+	for _, tt := range []struct {
+		name  string
+		flags uint16
+	}{
+		{"active mode", RPCAPStartCapServerOpen},
+		{"UDP data connection", RPCAPStartCapDgram},
+	} {
+		bad := append([]byte{}, payload...)
+		binary.BigEndian.PutUint16(bad[8:10], tt.flags)
+		if _, err := parseRPCAPStartCap(bad); err == nil {
+			t.Errorf("%s request accepted", tt.name)
+		}
+	}
+	for _, bad := range [][]byte{payload[:11], payload[:19], payload[:len(payload)-1]} {
+		if _, err := parseRPCAPStartCap(bad); err == nil {
+			t.Errorf("truncated request of %d octets accepted", len(bad))
+		}
+	}
+}
+
+func TestRPCAPFilter(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+		ok      bool
+		none    bool
+	}{
+		{"empty", []byte{0, 1, 0, 0, 0, 0, 0, 0}, true, true},
+		{"ret", []byte{0, 1, 0, 0, 0, 0, 0, 1, 0, 6, 0, 0, 0, 0, 0xff, 0xff}, true, false},
+		{"unknown type", []byte{0, 2, 0, 0, 0, 0, 0, 0}, false, false},
+		{"missing instruction", []byte{0, 1, 0, 0, 0, 0, 0, 2, 0, 6, 0, 0, 0, 0, 0xff, 0xff}, false, false},
+		{"no return", []byte{0, 1, 0, 0, 0, 0, 0, 1, 0, 0x28, 0, 0, 0, 0, 0, 12}, false, false},
+		{"malformed", []byte{0, 1, 0}, false, false},
+	} {
+		vm, err := rpcapFilter(tt.payload)
+		if (err == nil) != tt.ok || (err == nil && (vm == nil) != tt.none) {
+			t.Errorf("%s: got %v, %v", tt.name, vm, err)
+		}
+	}
+}
+
+// rpcapRoundTrip sends the specified message over the control connection and
+// returns the header and payload of the reply.
+func rpcapRoundTrip(t *testing.T, ctrl net.Conn, msg []byte) (rpcapHeader, []byte) {
+	t.Helper()
+	_ = ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ctrl.Write(msg); err != nil {
+		t.Fatalf("cannot send message: %s", err.Error())
+	}
+	var hdr rpcapHeader
+	if err := binary.Read(ctrl, binary.BigEndian, &hdr); err != nil {
+		t.Fatalf("cannot read reply header: %s", err.Error())
+	}
+	payload := make([]byte, hdr.Plen)
+	if _, err := io.ReadFull(ctrl, payload); err != nil {
+		t.Fatalf("cannot read reply payload: %s", err.Error())
+	}
+	return hdr, payload
+}
+
+// rpcapAuthRequest returns a password authentication request as sent by
+// libpcap.
+func rpcapAuthRequest(user, password string) []byte {
+	msg := []byte{0, RPCAPMsgAuth, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[4:8], uint32(8+len(user)+len(password)))
+	binary.BigEndian.PutUint16(msg[12:14], uint16(len(user)))
+	binary.BigEndian.PutUint16(msg[14:16], uint16(len(password)))
+	return append(append(msg, user...), password...)
+}
+
+func TestRPCAPSession(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(users map[string][]byte) { RPCAPUsers = users }(RPCAPUsers)
+	RPCAPUsers = map[string][]byte{"alice": hash}
+
+	for _, tt := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"null authentication", []byte{0, RPCAPMsgAuth, 0, 0, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"wrong password", rpcapAuthRequest("alice", "guess")},
+		{"unknown user", rpcapAuthRequest("mallory", "secret")},
+		{"unauthenticated", rpcapStartCapTCP},
+	} {
+		client, server := net.Pipe()
+		go NewRPCAPSession(server).Serve()
+		hdr, _ := rpcapRoundTrip(t, client, tt.msg)
+		if hdr.Type != RPCAPMsgError {
+			t.Errorf("%s: got reply type %d instead of an error", tt.name, hdr.Type)
+		}
+		client.Close()
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go NewRPCAPSession(server).Serve()
+	hdr, payload := rpcapRoundTrip(t, client, rpcapAuthRequest("alice", "secret"))
+	if hdr.Type != RPCAPMsgReply|RPCAPMsgAuth || len(payload) != 8 ||
+		binary.BigEndian.Uint32(payload[4:8]) != rpcapByteOrderMagic {
+		t.Fatalf("unexpected authentication reply %+v %x", hdr, payload)
+	}
+	// Without an opened remote interface, starting a capture must fail with
+	// a proper error message.
+	hdr, payload = rpcapRoundTrip(t, client, rpcapStartCapTCP)
+	if hdr.Type != RPCAPMsgError || hdr.Value != RPCAPErrStartCapture ||
+		!strings.Contains(string(payload), "no remote interface") {
+		t.Errorf("unexpected start capture reply %+v %q", hdr, payload)
+	}
+	// Sampling isn't supported, but disabling it is fine.
+	hdr, _ = rpcapRoundTrip(t, client, []byte{0, RPCAPMsgSetSampling, 0, 0, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0})
+	if hdr.Type != RPCAPMsgReply|RPCAPMsgSetSampling {
+		t.Errorf("unexpected set sampling reply %+v", hdr)
+	}
+}
+
+func TestSaturate32(t *testing.T) {
+	for _, tt := range []struct {
+		n    uint64
+		want uint32
+	}{
+		{0, 0},
+		{42, 42},
+		{1<<32 - 1, 1<<32 - 1},
+		{1 << 32, 1<<32 - 1},
+		{1 << 40, 1<<32 - 1},
+	} {
+		if got := saturate32(tt.n); got != tt.want {
+			t.Errorf("saturate32(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// A minimal client for uploading objects to S3-compatible object stores, such
+// as AWS S3 or MinIO, signing its requests using AWS Signature Version 4. The
+// bucket is always addressed path-style, as this works with all S3-compatible
+// object stores without further DNS setup.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3UploadTimeout is the maximum time for uploading a single object.
+const S3UploadTimeout = 10 * time.Minute
+
+// S3Client uploads objects into a single bucket of an S3-compatible object
+// store.
+type S3Client struct {
+	Endpoint     *url.URL
+	Bucket       string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // optional temporary session token.
+	httpc        *http.Client
+}
+
+// NewS3Client returns a new client for the specified bucket, taking the
+// credentials from the usual AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// optional AWS_SESSION_TOKEN environment variables. Without an endpoint, the
+// AWS S3 endpoint of the specified region is used.
+func NewS3Client(endpoint string, bucket string, region string) (*S3Client, error) {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint \"%s\"", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("missing S3 bucket")
+	}
+	c := &S3Client{
+		Endpoint:     u,
+		Bucket:       bucket,
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		httpc:        &http.Client{Timeout: S3UploadTimeout},
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return nil, fmt.Errorf("missing S3 credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return c, nil
+}
+
+// S3Error is an error response from the object store.
+type S3Error struct {
+	Key        string
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+// Error returns the textual representation of the error response.
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("cannot upload object %s: %s %s", e.Key, e.Status, e.Message)
+}
+
+// Permanent returns true if retrying the request won't help, such as for
+// malformed requests or too large objects. Missing or wrong credentials,
+// missing buckets, timeouts, and throttling aren't permanent, as these might
+// get fixed on the object store side.
+func (e *S3Error) Permanent() bool {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return false
+	}
+	return e.StatusCode/100 == 4
+}
+
+// PutFile uploads the contents of the specified file as an object with the
+// specified key and user-defined metadata. Error responses from the object
+// store are returned as *S3Error.
+func (c *S3Client) PutFile(key string, path string, metadata map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Signature version 4 needs the payload hash up front.
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	u := *c.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket + "/" + key
+	u.RawPath = s3URIEncode(u.Path) // send exactly what gets signed.
+	req, err := http.NewRequest(http.MethodPut, u.String(), io.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/x-pcapng")
+	for name, value := range metadata {
+		req.Header.Set("X-Amz-Meta-"+name, value)
+	}
+	c.sign(req, hex.EncodeToString(h.Sum(nil)), time.Now())
+	resp, err := c.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &S3Error{
+			Key:        key,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Message:    strings.TrimSpace(string(msg)),
+		}
+	}
+	return nil
+}
+
+// sign signs the specified request with the specified payload hash, using
+// AWS Signature Version 4.
+func (c *S3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzdate := now.UTC().Format("20060102T150405Z")
+	date := amzdate[:8]
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+	// Sign the host and all x-amz-* headers.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	crhash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(crhash[:])
+	key := []byte("AWS4" + c.SecretKey)
+	for _, part := range []string{date, c.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the specified data with the specified
+// key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery returns the canonical query string of the specified query
+// parameters as required by Signature Version 4: the encoded parameters
+// sorted by name and then value, always with "=", even for empty values.
+func s3CanonicalQuery(query url.Values) string {
+	type param struct{ name, value string }
+	params := []param{}
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, param{s3QueryEncode(name), s3QueryEncode(value)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].name != params[j].name {
+			return params[i].name < params[j].name
+		}
+		return params[i].value < params[j].value
+	})
+	encoded := make([]string, 0, len(params))
+	for _, p := range params {
+		encoded = append(encoded, p.name+"="+p.value)
+	}
+	return strings.Join(encoded, "&")
+}
+
+// s3URIEncode encodes the specified path as required by Signature Version 4,
+// leaving only unreserved characters and slashes unencoded.
+func s3URIEncode(path string) string {
+	return s3Encode(path, true)
+}
+
+// s3QueryEncode encodes the specified query parameter name or value as
+// required by Signature Version 4, leaving only unreserved characters
+// unencoded.
+func s3QueryEncode(s string) string {
+	return s3Encode(s, false)
+}
+
+// s3Encode encodes the specified string, leaving only unreserved characters
+// and optionally slashes unencoded.
+func s3Encode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, ch := range []byte(s) {
+		switch {
+		case ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9',
+			ch == '-', ch == '.', ch == '_', ch == '~', ch == '/' && keepSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,396 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Correlates captured packets with the sockets and thus processes owning them
+// inside the capture target's network namespace. This allows telling apart
+// the traffic of multiple containers sharing the same network namespace, such
+// as the containers of a pod with their service mesh sidecars.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unsafe"
+
+	pcapng "github.com/siemens/csharg/pcapng"
+)
+
+// SocketTableRefreshInterval limits how often the socket tables get refreshed
+// in the background after failing to find the owner of a packet.
+const SocketTableRefreshInterval = 1 * time.Second
+
+// hostEndian is the byte order of this host, as used in /proc/net/{tcp,udp}*
+// address fields.
+var hostEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(0x0102)
+	if *(*byte)(unsafe.Pointer(&x)) == 0x01 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}()
+
+// containerIDRegexp matches container IDs in cgroup paths.
+var containerIDRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// SocketOwner describes the process owning a socket.
+type SocketOwner struct {
+	PID       int    `json:"pid"`
+	Comm      string `json:"comm"`
+	Container string `json:"container,omitempty"` // (abbreviated) container ID, if any.
+}
+
+// String returns the textual representation of a socket owner, as used in
+// packet comments. Process names containing spaces or non-printable characters
+// get quoted.
+func (o *SocketOwner) String() string {
+	comm := o.Comm
+	if comm == "" || strings.IndexFunc(comm, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r) || r == '"'
+	}) >= 0 {
+		comm = strconv.Quote(comm)
+	}
+	s := fmt.Sprintf("pid=%d comm=%s", o.PID, comm)
+	if o.Container != "" {
+		s += " container=" + o.Container
+	}
+	return s
+}
+
+// socketKey identifies a connected socket by its transport protocol and its
+// local and remote addresses.
+type socketKey struct {
+	proto  uint8
+	local  netip.AddrPort
+	remote netip.AddrPort
+}
+
+// listenerKey identifies a listening or unconnected socket by its transport
+// protocol and local port.
+type listenerKey struct {
+	proto uint8
+	port  uint16
+}
+
+// listener is a listening or unconnected socket bound to a local address,
+// which might be unspecified.
+type listener struct {
+	local netip.Addr
+	inode uint64
+}
+
+// socketTables is a snapshot of the sockets of a network namespace together
+// with their owners, as well as the local addresses of the network namespace.
+type socketTables struct {
+	sockets   map[socketKey]uint64
+	listeners map[listenerKey][]listener
+	owners    map[uint64]*SocketOwner
+	locals    map[netip.Addr]bool
+}
+
+// SocketAnnotator is a pcapng block editor that adds comments to TCP and UDP
+// packets naming the process and container owning the packet's socket. The
+// socket tables get refreshed in the background, so that packets are always
+// annotated from the most recent snapshot without stalling the packet
+// capture stream.
+type SocketAnnotator struct {
+	conn        *WSConn
+	netns       uint64
+	tables      atomic.Pointer[socketTables]
+	mu          sync.Mutex // protects refreshing and lastRefresh.
+	refreshing  bool
+	lastRefresh time.Time
+}
+
+// NewSocketAnnotator returns a new block editor annotating packets with the
+// owners of their sockets in the network namespace with the specified inode
+// number. It immediately starts reading the socket tables in the background.
+func NewSocketAnnotator(conn *WSConn, netns uint64) *SocketAnnotator {
+	a := &SocketAnnotator{
+		conn:  conn,
+		netns: netns,
+	}
+	a.tables.Store(&socketTables{})
+	a.refreshInBackground()
+	return a
+}
+
+// EditBlock annotates Enhanced Packet Blocks with their socket owners.
+func (a *SocketAnnotator) EditBlock(s *BlockStream, blk *Block) []*Block {
+	if blk.Type != BlockTypeEPB {
+		return []*Block{blk}
+	}
+	pkt := ParseEnhancedPacket(blk, s.Endian)
+	if pkt == nil {
+		return []*Block{blk}
+	}
+	nif := s.Interface(pkt.InterfaceID)
+	if nif == nil {
+		return []*Block{blk}
+	}
+	owner := a.Owner(DecodePacket(nif.LinkType, pkt.Data))
+	if owner == nil {
+		return []*Block{blk}
+	}
+	pkt.Options = append(pkt.Options, &pcapng.Option{
+		Code:  pcapng.OptComment,
+		Value: []byte(owner.String()),
+	})
+	return []*Block{pkt.Block(s.Endian)}
+}
+
+// Owner returns the owner of the socket the specified packet belongs to, or
+// nil if unknown. In case of an unknown owner, a background refresh of the
+// socket tables gets triggered, subject to SocketTableRefreshInterval.
+func (a *SocketAnnotator) Owner(p *PacketLayers) *SocketOwner {
+	if p.L4Proto != IPProtoTCP && p.L4Proto != IPProtoUDP {
+		return nil
+	}
+	owner := a.tables.Load().lookup(p)
+	if owner == nil {
+		a.refreshInBackground()
+	}
+	return owner
+}
+
+// refreshInBackground rereads the socket tables in a separate go routine,
+// unless a refresh is already in progress or the last refresh is too recent.
+func (a *SocketAnnotator) refreshInBackground() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.refreshing || time.Since(a.lastRefresh) < SocketTableRefreshInterval {
+		return
+	}
+	a.refreshing = true
+	go func() {
+		tables := readSocketTables(a.netns)
+		a.tables.Store(tables)
+		a.mu.Lock()
+		a.refreshing = false
+		a.lastRefresh = time.Now()
+		a.mu.Unlock()
+	}()
+}
+
+// lookup returns the owner of the socket of the specified packet, based on
+// this socket tables snapshot. As we don't know the direction of the packet,
+// we try both directions.
+func (t *socketTables) lookup(p *PacketLayers) *SocketOwner {
+	srcip, dstip := p.Addresses()
+	srcport, dstport := p.Ports()
+	src, _ := netip.AddrFromSlice(srcip)
+	dst, _ := netip.AddrFromSlice(dstip)
+	srcap := netip.AddrPortFrom(src.Unmap(), srcport)
+	dstap := netip.AddrPortFrom(dst.Unmap(), dstport)
+	for _, key := range []socketKey{
+		{proto: p.L4Proto, local: srcap, remote: dstap},
+		{proto: p.L4Proto, local: dstap, remote: srcap},
+	} {
+		if inode, ok := t.sockets[key]; ok {
+			if owner := t.owners[inode]; owner != nil {
+				return owner
+			}
+		}
+	}
+	// Only the endpoint local to the network namespace can belong to a
+	// listening or unconnected socket; otherwise, a packet from a local
+	// client to a remote server would get attributed to an unrelated local
+	// server listening on the same port as the remote server.
+	for _, local := range []netip.AddrPort{srcap, dstap} {
+		if !local.Addr().IsLoopback() && !t.locals[local.Addr()] {
+			continue
+		}
+		for _, l := range t.listeners[listenerKey{proto: p.L4Proto, port: local.Port()}] {
+			if l.local.IsUnspecified() || l.local == local.Addr() {
+				if owner := t.owners[l.inode]; owner != nil {
+					return owner
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readSocketTables reads the socket tables of the network namespace with the
+// specified inode number as well as the socket owners.
+func readSocketTables(netns uint64) *socketTables {
+	t := &socketTables{
+		owners:    map[uint64]*SocketOwner{},
+		sockets:   map[socketKey]uint64{},
+		listeners: map[listenerKey][]listener{},
+		locals:    map[netip.Addr]bool{},
+	}
+	pids := Netnses.Processes(netns, time.Now().Add(-NetnsProcessesMaxAge))
+	if len(pids) == 0 {
+		return t
+	}
+	for _, pid := range pids {
+		t.scanFds(pid)
+	}
+	for _, table := range []struct {
+		name  string
+		proto uint8
+	}{
+		{"tcp", IPProtoTCP}, {"tcp6", IPProtoTCP},
+		{"udp", IPProtoUDP}, {"udp6", IPProtoUDP},
+	} {
+		t.readSocketTable(fmt.Sprintf("/proc/%d/net/%s", pids[0], table.name), table.proto)
+	}
+	t.readLocalAddrs(pids[0])
+	return t
+}
+
+// scanFds scans the open file descriptors of the specified process for
+// sockets, registering the process as their owner.
+func (t *socketTables) scanFds(pid int) {
+	fddir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := os.ReadDir(fddir)
+	if err != nil {
+		return
+	}
+	var owner *SocketOwner
+	for _, fd := range fds {
+		link, err := os.Readlink(fddir + "/" + fd.Name())
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode, err := strconv.ParseUint(link[8:len(link)-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if owner == nil {
+			owner = newSocketOwner(pid)
+		}
+		// In case of sockets shared between processes, stick with the first
+		// owner, which usually is the parent.
+		if _, ok := t.owners[inode]; !ok {
+			t.owners[inode] = owner
+		}
+	}
+}
+
+// readSocketTable reads the specified /proc/[PID]/net/{tcp,udp}* socket table.
+func (t *socketTables) readSocketTable(path string, proto uint8) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // skip header line.
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, err1 := parseProcNetAddr(fields[1])
+		remote, err2 := parseProcNetAddr(fields[2])
+		inode, err3 := strconv.ParseUint(fields[9], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || inode == 0 {
+			continue
+		}
+		if remote.Port() == 0 {
+			key := listenerKey{proto: proto, port: local.Port()}
+			t.listeners[key] = append(t.listeners[key], listener{local: local.Addr(), inode: inode})
+			continue
+		}
+		t.sockets[socketKey{proto: proto, local: local, remote: remote}] = inode
+	}
+}
+
+// readLocalAddrs reads the local IPv4 and IPv6 addresses of the network
+// namespace of the process with the specified PID from its
+// /proc/[PID]/net/fib_trie and /proc/[PID]/net/if_inet6.
+func (t *socketTables) readLocalAddrs(pid int) {
+	if f, err := os.Open(fmt.Sprintf("/proc/%d/net/fib_trie", pid)); err == nil {
+		// Leaf lines "|-- 10.0.0.1" are followed by their routes, such as
+		// "/32 host LOCAL" for local addresses.
+		var leaf netip.Addr
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if addr, ok := strings.CutPrefix(line, "|-- "); ok {
+				leaf, _ = netip.ParseAddr(addr)
+				continue
+			}
+			if leaf.IsValid() && strings.HasPrefix(line, "/32 host LOCAL") {
+				t.locals[leaf] = true
+			}
+		}
+		f.Close()
+	}
+	if f, err := os.Open(fmt.Sprintf("/proc/%d/net/if_inet6", pid)); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			raw, err := hex.DecodeString(fields[0])
+			if err != nil || len(raw) != 16 {
+				continue
+			}
+			addr, _ := netip.AddrFromSlice(raw)
+			t.locals[addr] = true
+		}
+		f.Close()
+	}
+}
+
+// parseProcNetAddr parses an "address:port" field from /proc/net/{tcp,udp}*,
+// where the address consists of 32 bit words in host byte order, and the port
+// is in big endian byte order, all hex encoded.
+func parseProcNetAddr(s string) (netip.AddrPort, error) {
+	addrhex, porthex, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	raw, err := hex.DecodeString(addrhex)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(raw[i:], hostEndian.Uint32(raw[i:]))
+	}
+	port, err := strconv.ParseUint(porthex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", s)
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// newSocketOwner returns the details about the process with the specified PID.
+func newSocketOwner(pid int) *SocketOwner {
+	owner := &SocketOwner{PID: pid}
+	if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		owner.Comm = strings.TrimSpace(string(comm))
+	}
+	if id := containerID(pid); id != "" {
+		owner.Container = id[:12]
+	}
+	return owner
+}
+
+// containerID returns the ID of the container the process with the specified
+// PID belongs to, based on the process' cgroup path. If the process doesn't
+// belong to a container, then an empty string is returned.
+func containerID(pid int) string {
+	cgroup, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	return string(containerIDRegexp.Find(cgroup))
+}
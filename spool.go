@@ -0,0 +1,257 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Spools completed capture segments in a local directory until they have been
+// uploaded to the object store. Each segment file comes with a small sidecar
+// file telling its object key and metadata; only segments with a sidecar are
+// complete and thus get uploaded. As the spool directory is scanned whenever
+// the spooler starts, pending uploads survive object store outages as well as
+// restarts. When the spooled segments exceed the spool quota, such as during
+// longer object store outages, the oldest segments get dropped.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Upload retry backoff limits.
+const (
+	SpoolRetryMin = 5 * time.Second
+	SpoolRetryMax = 5 * time.Minute
+)
+
+// Spool is the spooler uploading completed capture segments; nil if uploading
+// to an object store has not been configured.
+var Spool *Spooler
+
+// spoolSidecar describes a spooled segment file.
+type spoolSidecar struct {
+	Key      string            `json:"key"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Spooler uploads the completed segments in its spool directory to an object
+// store, retrying failed uploads with exponential backoff.
+type Spooler struct {
+	dir    string
+	quota  int64 // maximum total size of the spooled segments in octets.
+	client *S3Client
+	wake   chan struct{}
+
+	mu        sync.Mutex
+	uploading string // segment currently being uploaded, never dropped.
+	uploaded  uint64
+	failed    uint64
+	dropped   uint64
+}
+
+// NewSpooler returns a new spooler for the specified spool directory, which
+// must exist, limiting the spooled segments to the specified quota in octets,
+// and uploading using the specified object store client.
+func NewSpooler(dir string, quota int64, client *S3Client) (*Spooler, error) {
+	if finfo, err := os.Stat(dir); err != nil || !finfo.IsDir() {
+		return nil, fmt.Errorf("invalid spool directory %s", dir)
+	}
+	if quota <= 0 {
+		return nil, fmt.Errorf("invalid spool quota")
+	}
+	return &Spooler{
+		dir:    dir,
+		quota:  quota,
+		client: client,
+		wake:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Spool moves the specified completed segment file into the spool directory,
+// under the specified name, and then queues it for uploading with the
+// specified object key and metadata. If queueing fails, the segment file gets
+// moved back, so that no segment without sidecar is left behind.
+func (sp *Spooler) Spool(path string, name string, key string, metadata map[string]string) error {
+	j, err := json.Marshal(&spoolSidecar{Key: key, Metadata: metadata})
+	if err != nil {
+		return err
+	}
+	segment := filepath.Join(sp.dir, name+".pcapng")
+	if err := os.Rename(path, segment); err != nil {
+		return err
+	}
+	// Write the sidecar atomically, as it marks the segment as complete.
+	tmp := filepath.Join(sp.dir, name+".json.part")
+	err = os.WriteFile(tmp, j, 0644)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(sp.dir, name+".json"))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		if rerr := os.Rename(segment, path); rerr != nil {
+			log.Errorf("cannot roll back spooling segment %s: %s", segment, rerr.Error())
+		}
+		return err
+	}
+	sp.enforceQuota()
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Path returns the path for a new, incomplete segment file with the specified
+// name inside the spool directory.
+func (sp *Spooler) Path(name string) string {
+	return filepath.Join(sp.dir, name+".pcapng.part")
+}
+
+// Run uploads spooled segments as they get completed, never returning.
+func (sp *Spooler) Run() {
+	if parts, _ := filepath.Glob(filepath.Join(sp.dir, "*.pcapng.part")); len(parts) > 0 {
+		log.Warnf("ignoring %d incomplete segments in spool directory %s", len(parts), sp.dir)
+	}
+	sp.enforceQuota()
+	backoff := SpoolRetryMin
+	for {
+		if sp.uploadAll() {
+			backoff = SpoolRetryMin
+			<-sp.wake
+			continue
+		}
+		log.Warnf("retrying spooled segment uploads in %s", backoff)
+		select {
+		case <-sp.wake:
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > SpoolRetryMax {
+			backoff = SpoolRetryMax
+		}
+	}
+}
+
+// uploadAll uploads all completed segments in the spool directory, oldest
+// first, returning false if any upload failed and thus needs to be retried.
+// Segments the object store permanently rejects get discarded, while other
+// rejected segments are skipped until the next pass, so that a single
+// rejected segment cannot block the others. However, if the object store
+// cannot be reached at all, uploadAll gives up right away.
+func (sp *Spooler) uploadAll() bool {
+	defer sp.setUploading("")
+	ok := true
+	sidecars, _ := filepath.Glob(filepath.Join(sp.dir, "*.json"))
+	sort.Strings(sidecars)
+	for _, sidecar := range sidecars {
+		segment := strings.TrimSuffix(sidecar, ".json") + ".pcapng"
+		sp.setUploading(segment)
+		j, err := os.ReadFile(sidecar)
+		if os.IsNotExist(err) {
+			continue // dropped in the meantime.
+		}
+		var meta spoolSidecar
+		if err == nil {
+			err = json.Unmarshal(j, &meta)
+		}
+		if err != nil {
+			log.Errorf("discarding spooled segment %s with invalid sidecar: %s", segment, err.Error())
+			os.Remove(segment)
+			os.Remove(sidecar)
+			continue
+		}
+		if _, err := os.Stat(segment); err != nil {
+			log.Errorf("discarding sidecar %s without segment", sidecar)
+			os.Remove(sidecar)
+			continue
+		}
+		if err := sp.client.PutFile(meta.Key, segment, meta.Metadata); err != nil {
+			log.Errorf("cannot upload spooled segment %s: %s", segment, err.Error())
+			sp.mu.Lock()
+			sp.failed++
+			sp.mu.Unlock()
+			var s3err *S3Error
+			if !errors.As(err, &s3err) {
+				return false
+			}
+			if s3err.Permanent() {
+				log.Errorf("discarding spooled segment %s rejected by object store", segment)
+				os.Remove(segment)
+				os.Remove(sidecar)
+				continue
+			}
+			ok = false
+			continue
+		}
+		log.Debugf("uploaded spooled segment %s as %s", segment, meta.Key)
+		sp.mu.Lock()
+		sp.uploaded++
+		sp.mu.Unlock()
+		os.Remove(segment)
+		os.Remove(sidecar)
+	}
+	return ok
+}
+
+// setUploading sets the segment currently being uploaded, so that it doesn't
+// get dropped.
+func (sp *Spooler) setUploading(segment string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.uploading = segment
+}
+
+// enforceQuota drops the oldest completed segments, except for the segment
+// currently being uploaded, as long as the completed segments exceed the
+// spool quota.
+func (sp *Spooler) enforceQuota() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	type spooled struct {
+		sidecar, segment string
+		size             int64
+	}
+	sidecars, _ := filepath.Glob(filepath.Join(sp.dir, "*.json"))
+	sort.Strings(sidecars)
+	segments := make([]spooled, 0, len(sidecars))
+	var total int64
+	for _, sidecar := range sidecars {
+		segment := strings.TrimSuffix(sidecar, ".json") + ".pcapng"
+		finfo, err := os.Stat(segment)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, spooled{sidecar: sidecar, segment: segment, size: finfo.Size()})
+		total += finfo.Size()
+	}
+	for _, s := range segments {
+		if total <= sp.quota {
+			return
+		}
+		if s.segment == sp.uploading {
+			continue
+		}
+		log.Errorf("spool quota exceeded, dropping segment %s", s.segment)
+		os.Remove(s.sidecar)
+		os.Remove(s.segment)
+		total -= s.size
+		sp.dropped++
+	}
+}
+
+// Stats returns the number of segments uploaded so far, the number of failed
+// upload attempts, as well as the number of segments dropped due to the spool
+// quota.
+func (sp *Spooler) Stats() (uploaded, failed, dropped uint64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.uploaded, sp.failed, sp.dropped
+}
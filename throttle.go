@@ -0,0 +1,207 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Limits the bandwidth of a packet capture stream, so that captures from busy
+// network interfaces remain usable over slow links to remote capture clients.
+// Excess packets are either dropped, or the capture gets sampled.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	pcapng "github.com/siemens/csharg/pcapng"
+)
+
+// Throttling strategies.
+const (
+	ThrottleDrop   = "drop"   // drop excess packets, counting them.
+	ThrottleSample = "sample" // switch to 1-in-N packet sampling.
+)
+
+// ThrottleStrategies lists the supported throttling strategies.
+var ThrottleStrategies = map[string]bool{
+	ThrottleDrop:   true,
+	ThrottleSample: true,
+}
+
+// ThrottleWindow is the period over which the packet capture stream rate is
+// measured when sampling.
+const ThrottleWindow = time.Second
+
+// ThrottleMinBurst is the minimum burst size in octets, so that even a packet
+// of the maximum snap length in its Enhanced Packet Block, including some
+// options, can pass at rates below its size.
+const ThrottleMinBurst = MaxSnapLen + 1024
+
+// Throttler is a pcapng block editor limiting the rate of a packet capture
+// stream. Only packet blocks are subject to throttling, while all other blocks
+// always pass, albeit being accounted for.
+type Throttler struct {
+	rate     uint64 // octets per second.
+	burst    uint64 // octets passing in a burst; at least ThrottleMinBurst.
+	strategy string
+	// drop strategy: token bucket, holding at most a second's worth of
+	// octets, but never less than a burst.
+	tokens  float64
+	last    time.Time
+	dropped uint64 // packets dropped since last passed packet.
+	octets  uint64 // octets dropped since last passed packet.
+	// sample strategy: 1-in-N sampling, with N adapted per window.
+	windowStart time.Time
+	windowSize  uint64 // octets seen in the current window.
+	n           uint64 // current sampling rate: 1-in-n packets.
+	count       uint64 // packets seen since last sampled packet.
+	announced   uint64 // sampling rate last announced in the stream.
+}
+
+// NewThrottler returns a new block editor limiting the packet capture stream
+// to the specified rate in octets per second, using the specified strategy.
+func NewThrottler(rate uint64, strategy string) *Throttler {
+	burst := rate
+	if burst < ThrottleMinBurst {
+		burst = ThrottleMinBurst
+	}
+	return &Throttler{
+		rate:      rate,
+		burst:     burst,
+		strategy:  strategy,
+		tokens:    float64(burst),
+		n:         1,
+		announced: 1,
+	}
+}
+
+// EditBlock throttles packet blocks, marking the section header with the
+// bandwidth limit and the packets following throttling with comments.
+func (t *Throttler) EditBlock(s *BlockStream, blk *Block) []*Block {
+	size := uint64(len(blk.Body)) + 12
+	switch blk.Type {
+	case BlockTypeSHB:
+		how := "dropping excess packets"
+		if t.strategy == ThrottleSample {
+			how = "sampling packets"
+		}
+		return []*Block{AppendOptions(blk, 16, s.Endian, &pcapng.Option{
+			Code:  pcapng.OptComment,
+			Value: []byte(fmt.Sprintf("packet capture limited to %d octets/s by %s", t.rate, how)),
+		})}
+	case BlockTypeEPB, BlockTypeSPB:
+		if t.strategy == ThrottleSample {
+			return t.sample(s, blk, size)
+		}
+		return t.drop(s, blk, size)
+	}
+	t.account(size)
+	return []*Block{blk}
+}
+
+// account accounts for the specified number of octets of a block that always
+// passes.
+func (t *Throttler) account(size uint64) {
+	if t.strategy == ThrottleSample {
+		t.measure(size)
+		return
+	}
+	t.refill()
+	t.tokens -= float64(size)
+}
+
+// refill refills the token bucket according to the time passed.
+func (t *Throttler) refill() {
+	now := time.Now()
+	if !t.last.IsZero() {
+		t.tokens += now.Sub(t.last).Seconds() * float64(t.rate)
+		if t.tokens > float64(t.burst) {
+			t.tokens = float64(t.burst)
+		}
+	}
+	t.last = now
+}
+
+// drop passes a packet block if there are enough tokens left, otherwise it
+// drops the packet. The first packet passing after dropped packets gets a
+// comment with the number of dropped packets.
+func (t *Throttler) drop(s *BlockStream, blk *Block, size uint64) []*Block {
+	t.refill()
+	if t.tokens < float64(size) {
+		t.dropped++
+		t.octets += size
+		return nil
+	}
+	t.tokens -= float64(size)
+	if t.dropped == 0 {
+		return []*Block{blk}
+	}
+	comment := fmt.Sprintf("bandwidth limit: dropped %d packets (%d octets) before this packet",
+		t.dropped, t.octets)
+	t.dropped = 0
+	t.octets = 0
+	return []*Block{t.comment(s, blk, comment)}
+}
+
+// measure accounts for the specified number of octets in the current
+// measurement window, and adapts the sampling rate after each window.
+func (t *Throttler) measure(size uint64) {
+	now := time.Now()
+	if t.windowStart.IsZero() {
+		t.windowStart = now
+	}
+	if elapsed := now.Sub(t.windowStart); elapsed >= ThrottleWindow {
+		// The octets seen in the window are those after sampling, so scale
+		// them up to the unsampled rate first.
+		unsampled := float64(t.windowSize*t.n) / elapsed.Seconds()
+		n := uint64(unsampled/float64(t.rate)) + 1
+		if unsampled <= float64(t.rate) {
+			n = 1
+		}
+		t.n = n
+		t.windowStart = now
+		t.windowSize = 0
+	}
+	t.windowSize += size
+	// Don't wait for the window to end when the sampled packet capture stream
+	// already exceeds a full window's worth of octets (or a burst), but
+	// instead sample more sparsely right away.
+	if t.windowSize > t.burst {
+		t.n *= 2
+		t.windowStart = now
+		t.windowSize = 0
+	}
+}
+
+// sample passes only every n-th packet block. The first packet passing after
+// the sampling rate has changed gets a comment with the new sampling rate.
+func (t *Throttler) sample(s *BlockStream, blk *Block, size uint64) []*Block {
+	t.count++
+	if t.count < t.n {
+		return nil
+	}
+	t.count = 0
+	t.measure(size)
+	if t.n == t.announced {
+		return []*Block{blk}
+	}
+	t.announced = t.n
+	comment := "bandwidth limit: sampling ended, capturing all packets"
+	if t.n > 1 {
+		comment = fmt.Sprintf("bandwidth limit: sampling 1 in %d packets", t.n)
+	}
+	return []*Block{t.comment(s, blk, comment)}
+}
+
+// comment adds a comment to the specified packet block. As Simple Packet
+// Blocks cannot carry options, their comments get lost.
+func (t *Throttler) comment(s *BlockStream, blk *Block, comment string) *Block {
+	pkt := ParseEnhancedPacket(blk, s.Endian)
+	if pkt == nil {
+		return blk
+	}
+	pkt.Options = append(pkt.Options, &pcapng.Option{
+		Code:  pcapng.OptComment,
+		Value: []byte(comment),
+	})
+	return pkt.Block(s.Endian)
+}
@@ -0,0 +1,129 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Controls the resolution of timestamps in the packet capture stream, as well
+// as the source of timestamps used by the capture process.
+
+package main
+
+import (
+	pcapng "github.com/siemens/csharg/pcapng"
+)
+
+// Timestamp resolutions as encoded in the pcapng if_tsresol option.
+const (
+	TsResolMicro = uint8(6)
+	TsResolNano  = uint8(9)
+)
+
+// TimestampPrecisions maps the supported timestamp precision query parameter
+// values onto their if_tsresol encodings.
+var TimestampPrecisions = map[string]uint8{
+	"micro": TsResolMicro,
+	"nano":  TsResolNano,
+}
+
+// TimestampTypes lists the timestamp sources (types) known to libpcap, see
+// also: https://www.tcpdump.org/manpages/pcap-tstamp.7.html
+var TimestampTypes = map[string]bool{
+	"host":                 true,
+	"host_lowprec":         true,
+	"host_hiprec":          true,
+	"host_hiprec_unsynced": true,
+	"adapter":              true,
+	"adapter_unsynced":     true,
+}
+
+// TimestampEditor is a pcapng block editor that converts all timestamps in the
+// packet capture stream into a specific timestamp resolution, and correctly
+// reflects this resolution in the if_tsresol options of Interface
+// Description Blocks.
+type TimestampEditor struct {
+	tsresol  uint8
+	original []uint8 // original timestamp resolutions per interface ID.
+}
+
+// NewTimestampEditor returns a new block editor converting timestamps into the
+// specified resolution.
+func NewTimestampEditor(tsresol uint8) *TimestampEditor {
+	return &TimestampEditor{tsresol: tsresol}
+}
+
+// EditBlock converts the timestamps of EPBs and ISBs and updates IDBs.
+func (t *TimestampEditor) EditBlock(s *BlockStream, blk *Block) []*Block {
+	switch blk.Type {
+	case BlockTypeSHB:
+		t.original = nil
+	case BlockTypeIDB:
+		if len(blk.Body) < 8 {
+			break
+		}
+		tsresol := TsResolMicro
+		opts := []*pcapng.Option{}
+		for _, opt := range ParseOptions(blk.Body[8:], s.Endian) {
+			if opt.Code == OptIfTsResol {
+				if len(opt.Value) > 0 {
+					tsresol = opt.Value[0]
+				}
+				continue
+			}
+			opts = append(opts, opt)
+		}
+		t.original = append(t.original, tsresol)
+		// Please note that the default resolution of microseconds is signalled
+		// by the absence of the if_tsresol option.
+		if t.tsresol != TsResolMicro {
+			opts = append(opts, &pcapng.Option{Code: OptIfTsResol, Value: []byte{t.tsresol}})
+		}
+		body := append([]byte{}, blk.Body[:8]...)
+		blk = &Block{Type: blk.Type, Body: append(body, OptionsBytes(opts, s.Endian)...)}
+	case BlockTypeEPB:
+		if len(blk.Body) < 12 {
+			break
+		}
+		if from, ok := t.resolution(s.Endian.Uint32(blk.Body[0:4])); ok {
+			blk.Body = append([]byte{}, blk.Body...)
+			t.convertTimestamp(blk.Body[4:12], from, s)
+		}
+	case BlockTypeISB:
+		if len(blk.Body) < 12 {
+			break
+		}
+		from, ok := t.resolution(s.Endian.Uint32(blk.Body[0:4]))
+		if !ok {
+			break
+		}
+		body := append([]byte{}, blk.Body[:12]...)
+		t.convertTimestamp(body[4:12], from, s)
+		opts := ParseOptions(blk.Body[12:], s.Endian)
+		for idx, opt := range opts {
+			if (opt.Code == OptISBStartTime || opt.Code == OptISBEndTime) && len(opt.Value) == 8 {
+				value := append([]byte{}, opt.Value...)
+				t.convertTimestamp(value, from, s)
+				opts[idx] = &pcapng.Option{Code: opt.Code, Value: value}
+			}
+		}
+		blk = &Block{Type: blk.Type, Body: append(body, OptionsBytes(opts, s.Endian)...)}
+	}
+	return []*Block{blk}
+}
+
+// resolution returns the original timestamp resolution of the interface with
+// the specified ID, and whether timestamps of this interface need conversion.
+func (t *TimestampEditor) resolution(id uint32) (uint8, bool) {
+	if int(id) >= len(t.original) {
+		return 0, false
+	}
+	from := t.original[id]
+	return from, from != t.tsresol
+}
+
+// convertTimestamp converts the pcapng timestamp (upper 32 bits followed by
+// lower 32 bits) in place from the specified resolution into our resolution.
+func (t *TimestampEditor) convertTimestamp(ts []byte, from uint8, s *BlockStream) {
+	ticks := uint64(s.Endian.Uint32(ts[0:4]))<<32 | uint64(s.Endian.Uint32(ts[4:8]))
+	ticks = nanosToTicks(ticksToNanos(ticks, from), t.tsresol)
+	s.Endian.PutUint32(ts[0:4], uint32(ticks>>32))
+	s.Endian.PutUint32(ts[4:8], uint32(ticks))
+}
@@ -0,0 +1,400 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Aggregates the captured packet headers into conversation tables, a protocol
+// hierarchy, and top talkers, similar to Wireshark's statistics dialogs, and
+// periodically reports them as JSON text messages on the websocket. This gives
+// a quick overview of a capture target's traffic without having to stream the
+// packets themselves.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Traffic statistics defaults and limits.
+const (
+	DefaultTrafficTop       = 10    // default number of entries per table.
+	MaxTrafficTop           = 1000  // maximum number of entries per table.
+	MaxTrafficConversations = 65536 // maximum number of tracked conversations per table.
+	MaxTrafficTalkers       = 65536 // maximum number of tracked talkers.
+	MaxTrafficInterval      = 3600  // maximum reporting interval in seconds.
+	TrafficStatsSnapLen     = 256   // captured octets per packet, enough for the headers.
+)
+
+// ConversationStats are the statistics of a conversation between two IP
+// addresses, or between two transport layer endpoints, as reported in JSON
+// text messages. A is the lower, B the higher address (and port).
+type ConversationStats struct {
+	A         string    `json:"a"`
+	PortA     uint16    `json:"aport,omitempty"`
+	B         string    `json:"b"`
+	PortB     uint16    `json:"bport,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	PacketsAB uint64    `json:"packetsab"`
+	OctetsAB  uint64    `json:"octetsab"`
+	PacketsBA uint64    `json:"packetsba"`
+	OctetsBA  uint64    `json:"octetsba"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+}
+
+// ProtocolStats are the statistics of a protocol in the protocol hierarchy,
+// as reported in JSON text messages.
+type ProtocolStats struct {
+	Protocol string           `json:"protocol"`
+	Packets  uint64           `json:"packets"`
+	Octets   uint64           `json:"octets"`
+	Children []*ProtocolStats `json:"children,omitempty"`
+}
+
+// TalkerStats are the statistics of a single IP address, as reported in JSON
+// text messages.
+type TalkerStats struct {
+	Address     string `json:"address"`
+	PacketsSent uint64 `json:"packetssent"`
+	OctetsSent  uint64 `json:"octetssent"`
+	PacketsRecv uint64 `json:"packetsrecv"`
+	OctetsRecv  uint64 `json:"octetsrecv"`
+}
+
+// TrafficMessage is a traffic statistics report sent as a websocket text
+// message. The statistics are cumulative since the start of the capture, and
+// the tables contain only the top entries by octets.
+type TrafficMessage struct {
+	Type            string               `json:"type"` // always "traffic".
+	Start           time.Time            `json:"start"`
+	End             time.Time            `json:"end"`
+	Packets         uint64               `json:"packets"`
+	Octets          uint64               `json:"octets"`
+	IPConversations []*ConversationStats `json:"ipconversations"`
+	Conversations   []*ConversationStats `json:"conversations"`
+	Protocols       []*ProtocolStats     `json:"protocols"`
+	TopTalkers      []*TalkerStats       `json:"toptalkers"`
+	Untracked       uint64               `json:"untracked"`
+}
+
+// convKey identifies a bidirectional conversation, with a being the lower
+// endpoint. Ports and protocol are zero for IP conversations.
+type convKey struct {
+	a, b         netip.Addr
+	portA, portB uint16
+	proto        uint8
+}
+
+// protocolNode is a node in the protocol hierarchy.
+type protocolNode struct {
+	packets  uint64
+	octets   uint64
+	children map[string]*protocolNode
+}
+
+// TrafficStats is a pcapng block editor aggregating the captured packets into
+// conversations, protocol hierarchy, and talkers, periodically reporting the
+// top entries as JSON text messages. All blocks pass unchanged.
+type TrafficStats struct {
+	conn *WSConn
+	top  int
+
+	mu        sync.Mutex
+	start     time.Time
+	packets   uint64
+	octets    uint64
+	ipconvs   map[convKey]*ConversationStats
+	convs     map[convKey]*ConversationStats
+	protocols *protocolNode
+	talkers   map[netip.Addr]*TalkerStats
+	untracked uint64 // packets not accounted for in the tables as they were full.
+}
+
+// NewTrafficStats returns a new traffic statistics reporter, reporting the
+// specified number of top entries per table.
+func NewTrafficStats(conn *WSConn, top int) *TrafficStats {
+	return &TrafficStats{
+		conn:      conn,
+		top:       top,
+		start:     time.Now(),
+		ipconvs:   map[convKey]*ConversationStats{},
+		convs:     map[convKey]*ConversationStats{},
+		protocols: &protocolNode{},
+		talkers:   map[netip.Addr]*TalkerStats{},
+	}
+}
+
+// EditBlock accounts for packet blocks, passing all blocks on unchanged.
+func (ts *TrafficStats) EditBlock(s *BlockStream, blk *Block) []*Block {
+	if blk.Type != BlockTypeEPB {
+		return []*Block{blk}
+	}
+	pkt := ParseEnhancedPacket(blk, s.Endian)
+	if pkt == nil {
+		return []*Block{blk}
+	}
+	nif := s.Interface(pkt.InterfaceID)
+	if nif == nil {
+		return []*Block{blk}
+	}
+	p := DecodePacket(nif.LinkType, pkt.Data)
+	when := time.Unix(0, int64(ticksToNanos(pkt.Timestamp, nif.TsResol)))
+	octets := uint64(pkt.OrigLen)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.packets++
+	ts.octets += octets
+	ts.protocols.add(protocolPath(p), octets)
+	if p.L3Proto != EtherTypeIPv4 && p.L3Proto != EtherTypeIPv6 {
+		return []*Block{blk}
+	}
+	srcip, dstip := p.Addresses()
+	src, _ := netip.AddrFromSlice(srcip)
+	dst, _ := netip.AddrFromSlice(dstip)
+	src, dst = src.Unmap(), dst.Unmap()
+	ts.talk(src, dst, octets)
+	ts.converse(ts.ipconvs, src, 0, dst, 0, 0, octets, when)
+	if p.L4Offset >= 0 {
+		srcport, dstport := p.Ports()
+		ts.converse(ts.convs, src, srcport, dst, dstport, p.L4Proto, octets, when)
+	}
+	return []*Block{blk}
+}
+
+// talk accounts for a packet sent from the specified source to the specified
+// destination address.
+func (ts *TrafficStats) talk(src, dst netip.Addr, octets uint64) {
+	for idx, addr := range []netip.Addr{src, dst} {
+		t, ok := ts.talkers[addr]
+		if !ok {
+			if len(ts.talkers) >= MaxTrafficTalkers {
+				ts.untracked++
+				continue
+			}
+			t = &TalkerStats{Address: addr.String()}
+			ts.talkers[addr] = t
+		}
+		if idx == 0 {
+			t.PacketsSent++
+			t.OctetsSent += octets
+		} else {
+			t.PacketsRecv++
+			t.OctetsRecv += octets
+		}
+	}
+}
+
+// converse accounts for a packet in its conversation in the specified table.
+func (ts *TrafficStats) converse(table map[convKey]*ConversationStats,
+	src netip.Addr, srcport uint16, dst netip.Addr, dstport uint16, proto uint8,
+	octets uint64, when time.Time,
+) {
+	key := convKey{a: src, portA: srcport, b: dst, portB: dstport, proto: proto}
+	reverse := src.Compare(dst) > 0 || (src == dst && srcport > dstport)
+	if reverse {
+		key = convKey{a: dst, portA: dstport, b: src, portB: srcport, proto: proto}
+	}
+	c, ok := table[key]
+	if !ok {
+		if len(table) >= MaxTrafficConversations {
+			ts.untracked++
+			return
+		}
+		c = &ConversationStats{
+			A:     key.a.String(),
+			PortA: key.portA,
+			B:     key.b.String(),
+			PortB: key.portB,
+			Start: when,
+		}
+		if proto != 0 {
+			c.Protocol = transportName(proto)
+		}
+		table[key] = c
+	}
+	c.End = when
+	if reverse {
+		c.PacketsBA++
+		c.OctetsBA += octets
+	} else {
+		c.PacketsAB++
+		c.OctetsAB += octets
+	}
+}
+
+// Run periodically reports the traffic statistics with the specified interval
+// until the done channel gets closed, then reports a final time.
+func (ts *TrafficStats) Run(interval time.Duration, done <-chan struct{}) {
+	ts.conn.Debugf("reporting traffic statistics every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			ts.report()
+			return
+		case <-ticker.C:
+			ts.report()
+		}
+	}
+}
+
+// report sends the current traffic statistics as a JSON text message.
+func (ts *TrafficStats) report() {
+	ts.mu.Lock()
+	msg := &TrafficMessage{
+		Type:            "traffic",
+		Start:           ts.start,
+		End:             time.Now(),
+		Packets:         ts.packets,
+		Octets:          ts.octets,
+		IPConversations: topConversations(ts.ipconvs, ts.top),
+		Conversations:   topConversations(ts.convs, ts.top),
+		Protocols:       ts.protocols.stats(),
+		TopTalkers:      topTalkers(ts.talkers, ts.top),
+		Untracked:       ts.untracked,
+	}
+	j, err := json.Marshal(msg)
+	ts.mu.Unlock()
+	if err != nil {
+		ts.conn.Errorf("cannot create traffic statistics report: %s", err.Error())
+		return
+	}
+	_ = ts.conn.WriteMessage(websocket.TextMessage, j)
+}
+
+// topConversations returns copies of the top conversations by octets.
+func topConversations(table map[convKey]*ConversationStats, top int) []*ConversationStats {
+	convs := make([]*ConversationStats, 0, len(table))
+	for _, c := range table {
+		convs = append(convs, c)
+	}
+	sort.Slice(convs, func(i, j int) bool {
+		return convs[i].OctetsAB+convs[i].OctetsBA > convs[j].OctetsAB+convs[j].OctetsBA
+	})
+	if len(convs) > top {
+		convs = convs[:top]
+	}
+	for idx, c := range convs {
+		cc := *c
+		convs[idx] = &cc
+	}
+	return convs
+}
+
+// topTalkers returns copies of the top talkers by octets sent and received.
+func topTalkers(talkers map[netip.Addr]*TalkerStats, top int) []*TalkerStats {
+	ts := make([]*TalkerStats, 0, len(talkers))
+	for _, t := range talkers {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].OctetsSent+ts[i].OctetsRecv > ts[j].OctetsSent+ts[j].OctetsRecv
+	})
+	if len(ts) > top {
+		ts = ts[:top]
+	}
+	for idx, t := range ts {
+		tt := *t
+		ts[idx] = &tt
+	}
+	return ts
+}
+
+// add accounts for a packet along the specified protocol path.
+func (n *protocolNode) add(path []string, octets uint64) {
+	for _, name := range path {
+		if n.children == nil {
+			n.children = map[string]*protocolNode{}
+		}
+		child, ok := n.children[name]
+		if !ok {
+			child = &protocolNode{}
+			n.children[name] = child
+		}
+		child.packets++
+		child.octets += octets
+		n = child
+	}
+}
+
+// stats returns the statistics of the children of this protocol node, ordered
+// by octets.
+func (n *protocolNode) stats() []*ProtocolStats {
+	if len(n.children) == 0 {
+		return nil
+	}
+	stats := make([]*ProtocolStats, 0, len(n.children))
+	for name, child := range n.children {
+		stats = append(stats, &ProtocolStats{
+			Protocol: name,
+			Packets:  child.packets,
+			Octets:   child.octets,
+			Children: child.stats(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Octets != stats[j].Octets {
+			return stats[i].Octets > stats[j].Octets
+		}
+		return stats[i].Protocol < stats[j].Protocol
+	})
+	return stats
+}
+
+// protocolPath returns the names of the link, network, and transport layer
+// protocols of the specified packet, as far as known.
+func protocolPath(p *PacketLayers) []string {
+	var path []string
+	switch p.LinkType {
+	case LinkTypeEthernet:
+		path = append(path, "eth")
+	case LinkTypeLinuxSLL:
+		path = append(path, "sll")
+	case LinkTypeLinuxSLL2:
+		path = append(path, "sll2")
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		path = append(path, "raw")
+	default:
+		return append(path, fmt.Sprintf("linktype %d", p.LinkType))
+	}
+	if p.L3Offset < 0 {
+		return path
+	}
+	switch p.L3Proto {
+	case EtherTypeIPv4:
+		path = append(path, "ipv4")
+	case EtherTypeIPv6:
+		path = append(path, "ipv6")
+	case EtherTypeARP:
+		return append(path, "arp")
+	}
+	if p.L4Offset < 0 {
+		return path
+	}
+	return append(path, transportName(p.L4Proto))
+}
+
+// transportName returns the name of the specified IP transport protocol.
+func transportName(proto uint8) string {
+	switch proto {
+	case IPProtoTCP:
+		return "tcp"
+	case IPProtoUDP:
+		return "udp"
+	case IPProtoICMP:
+		return "icmp"
+	case IPProtoICMPv6:
+		return "icmpv6"
+	case IPProtoSCTP:
+		return "sctp"
+	}
+	return fmt.Sprintf("ip proto %d", proto)
+}
@@ -0,0 +1,79 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Limits the amount of captured packet data handed out to capture clients:
+// either to a maximum number of octets per packet (snap length), or to only
+// the protocol headers up to and including the transport layer header, without
+// any payload.
+
+package main
+
+import (
+	pcapng "github.com/siemens/csharg/pcapng"
+)
+
+// MaxSnapLen is the maximum snap length that can be requested; it matches the
+// maximum snap length of libpcap.
+const MaxSnapLen = 262144
+
+// Truncator is a pcapng block editor that truncates packets and reflects the
+// snap length in the Interface Description Blocks.
+type Truncator struct {
+	snaplen     uint32 // if non-zero, maximum packet data length.
+	headersOnly bool   // truncate packets after their transport layer header.
+}
+
+// NewTruncator returns a new block editor truncating packet data to the
+// specified snap length (if non-zero), and optionally after the transport
+// layer header.
+func NewTruncator(snaplen uint32, headersOnly bool) *Truncator {
+	return &Truncator{
+		snaplen:     snaplen,
+		headersOnly: headersOnly,
+	}
+}
+
+// EditBlock updates the snap length of Interface Description Blocks and
+// truncates the packet data of Enhanced Packet Blocks.
+func (t *Truncator) EditBlock(s *BlockStream, blk *Block) []*Block {
+	switch blk.Type {
+	case BlockTypeIDB:
+		if len(blk.Body) < 8 {
+			break
+		}
+		if t.snaplen != 0 {
+			if snaplen := s.Endian.Uint32(blk.Body[4:8]); snaplen == 0 || snaplen > t.snaplen {
+				blk.Body = append([]byte{}, blk.Body...)
+				s.Endian.PutUint32(blk.Body[4:8], t.snaplen)
+			}
+		}
+		if t.headersOnly {
+			blk = AppendOptions(blk, 8, s.Endian, &pcapng.Option{
+				Code:  pcapng.OptComment,
+				Value: []byte("packet data truncated after transport layer headers"),
+			})
+		}
+	case BlockTypeEPB:
+		pkt := ParseEnhancedPacket(blk, s.Endian)
+		if pkt == nil {
+			break
+		}
+		caplen := len(pkt.Data)
+		if t.headersOnly {
+			if nif := s.Interface(pkt.InterfaceID); nif != nil {
+				caplen = DecodePacket(nif.LinkType, pkt.Data).PayloadOffset
+			} else {
+				caplen = 0
+			}
+		}
+		if t.snaplen != 0 && caplen > int(t.snaplen) {
+			caplen = int(t.snaplen)
+		}
+		if caplen < len(pkt.Data) {
+			pkt.Data = pkt.Data[:caplen]
+			return []*Block{pkt.Block(s.Endian)}
+		}
+	}
+	return []*Block{blk}
+}
@@ -0,0 +1,302 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Runs long-running background captures that get written into rotated pcapng
+// segment files, which are then uploaded to an object store. The object keys
+// are derived from the node, capture target prefix and name, and the segment
+// start time, while the object metadata carries the capture target
+// description.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siemens/csharg/api"
+	"github.com/thediveo/lxkns/ops/relations"
+)
+
+// Upload segment limits.
+const (
+	DefaultSegmentSeconds   = 300   // default maximum duration of a segment.
+	DefaultSegmentMegabytes = 100   // default maximum size of a segment in MiB.
+	MaxSegmentSeconds       = 86400 // maximum duration of a segment.
+	MaxSegmentMegabytes     = 4096  // maximum size of a segment in MiB.
+)
+
+// Uploads are the currently running uploading captures.
+var Uploads = NewBackgroundCaptureSet[*Upload, *UploadInfo]("upload")
+
+// Upload is a pcapng block editor writing a packet capture stream into
+// rotated segment files, which get spooled for uploading. Each segment starts
+// with the section header and interface descriptions, so that each segment
+// forms a valid pcapng stream on its own.
+type Upload struct {
+	BackgroundCapture
+	MaxAge     time.Duration
+	MaxSize    int64 // in octets.
+	node       string
+	mu         sync.Mutex
+	endian     binary.ByteOrder
+	preamble   []*Block // section header and interface description blocks.
+	file       *os.File // current segment file; nil if none.
+	bw         *bufio.Writer
+	segStarted time.Time
+	segSize    int64
+	segments   uint64 // number of segments spooled so far.
+	octets     uint64 // number of octets spooled so far.
+	failed     bool   // segment writing failed, stop writing.
+}
+
+// UploadInfo describes a running uploading capture.
+type UploadInfo struct {
+	ID        string      `json:"id"`
+	Target    *api.Target `json:"target"`
+	Filter    string      `json:"filter,omitempty"`
+	Seconds   int         `json:"seconds"`
+	Megabytes int         `json:"megabytes"`
+	Started   time.Time   `json:"started"`
+	Owner     string      `json:"owner"`
+	Segments  uint64      `json:"segments"` // number of segments spooled so far.
+	Octets    uint64      `json:"octets"`   // number of octets spooled so far.
+}
+
+// NewUpload returns a new uploading capture for the specified capture target,
+// rotating segments after maxAge or maxSize octets, whatever comes first. The
+// upload takes on the ID of the specified (unconnected) connection, which is
+// also used for logging and terminating the capture process.
+func NewUpload(conn *WSConn, args *Args, maxAge time.Duration, maxSize int64) *Upload {
+	node := args.Target.NodeName
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	return &Upload{
+		BackgroundCapture: newBackgroundCapture("upload", conn, args),
+		MaxAge:            maxAge,
+		MaxSize:           maxSize,
+		node:              node,
+	}
+}
+
+// EditBlock writes a block into the current segment, starting a new segment
+// as necessary, and then passes the block on unchanged.
+func (u *Upload) EditBlock(s *BlockStream, blk *Block) []*Block {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failed {
+		return []*Block{blk}
+	}
+	switch blk.Type {
+	case BlockTypeSHB:
+		u.rotate()
+		u.endian = s.Endian
+		u.preamble = []*Block{blk}
+		return []*Block{blk}
+	case BlockTypeIDB:
+		u.preamble = append(u.preamble, blk)
+		if u.file != nil {
+			u.write(blk)
+		}
+		return []*Block{blk}
+	}
+	if u.file == nil {
+		if err := u.create(); err != nil {
+			u.conn.Errorf("cannot create segment: %s", err.Error())
+			u.failed = true
+			return []*Block{blk}
+		}
+	}
+	u.write(blk)
+	if u.segSize >= u.MaxSize {
+		u.rotate()
+	}
+	return []*Block{blk}
+}
+
+// create creates a new segment file, starting with the preamble.
+func (u *Upload) create() error {
+	u.segStarted = time.Now()
+	f, err := os.OpenFile(Spool.Path(u.segmentName()), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	u.file = f
+	u.bw = bufio.NewWriterSize(f, 64*1024)
+	u.segSize = 0
+	for _, blk := range u.preamble {
+		u.write(blk)
+	}
+	return nil
+}
+
+// write writes the specified block into the current segment file.
+func (u *Upload) write(blk *Block) {
+	b := blk.Bytes(u.endian)
+	if _, err := u.bw.Write(b); err != nil {
+		u.conn.Errorf("cannot write segment: %s", err.Error())
+		u.failed = true
+		return
+	}
+	u.segSize += int64(len(b))
+}
+
+// rotate completes the current segment, if any, and spools it for uploading.
+func (u *Upload) rotate() {
+	if u.file == nil {
+		return
+	}
+	name := u.segmentName()
+	path := u.file.Name()
+	err := u.bw.Flush()
+	if cerr := u.file.Close(); err == nil {
+		err = cerr
+	}
+	u.file, u.bw = nil, nil
+	if err == nil {
+		err = Spool.Spool(path, name, u.objectKey(), u.metadata())
+	}
+	if err != nil {
+		u.conn.Errorf("cannot spool segment: %s", err.Error())
+		os.Remove(path)
+		return
+	}
+	u.segments++
+	u.octets += uint64(u.segSize)
+	u.conn.Debugf("spooled segment %s of %d octets", name, u.segSize)
+}
+
+// segmentName returns the spool file name of the current segment, which sorts
+// segments by their start time.
+func (u *Upload) segmentName() string {
+	return fmt.Sprintf("%s-%s-%d",
+		u.segStarted.UTC().Format("20060102T150405.000Z"), u.ID, u.segments)
+}
+
+// objectKey returns the object key of the current segment, consisting of the
+// node name, capture target prefix (if any) and name, and the segment's start
+// time.
+func (u *Upload) objectKey() string {
+	parts := []string{objectKeyPart(u.node)}
+	if u.Args.Target.Prefix != "" {
+		parts = append(parts, objectKeyPart(u.Args.Target.Prefix))
+	}
+	parts = append(parts,
+		objectKeyPart(u.Args.Target.Name),
+		fmt.Sprintf("%s-%s-%d.pcapng",
+			u.segStarted.UTC().Format("20060102T150405.000Z"), u.ID, u.segments))
+	return strings.Join(parts, "/")
+}
+
+// metadata returns the object metadata of the current segment.
+func (u *Upload) metadata() map[string]string {
+	target, _ := json.Marshal(u.Args.Target)
+	return map[string]string{
+		"target":  asciiOnly(string(target)),
+		"upload":  u.ID,
+		"segment": strconv.FormatUint(u.segments, 10),
+		"started": u.segStarted.UTC().Format(time.RFC3339Nano),
+		"ended":   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// rotateIfDue rotates the current segment if it has become too old, even if
+// there is no further traffic.
+func (u *Upload) rotateIfDue() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file != nil && time.Since(u.segStarted) >= u.MaxAge {
+		u.rotate()
+	}
+}
+
+// Info returns information about the uploading capture.
+func (u *Upload) Info() *UploadInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return &UploadInfo{
+		ID:        u.ID,
+		Target:    u.Args.Target,
+		Filter:    u.Args.CaptureFilter,
+		Seconds:   int(u.MaxAge / time.Second),
+		Megabytes: int(u.MaxSize >> 20),
+		Started:   u.Started,
+		Owner:     u.Owner,
+		Segments:  u.segments,
+		Octets:    u.octets,
+	}
+}
+
+// Start starts the background capture feeding the upload. After the capture
+// process has terminated, the upload spools its last segment.
+func (u *Upload) Start(client *ClientIdentity, release func()) error {
+	return u.start(client, release, u,
+		func(_ relations.Relation, captureDone <-chan struct{}) {
+			Uploads.Add(u)
+			u.conn.Debugf("uploading netns:[%d] traffic in segments of %s or %d MiB",
+				u.Args.Target.NetNS, u.MaxAge, u.MaxSize>>20)
+			// Rotate segments on time even when there's no traffic to
+			// trigger it.
+			go func() {
+				ticker := time.NewTicker(time.Second)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-captureDone:
+						return
+					case <-ticker.C:
+						u.rotateIfDue()
+					}
+				}
+			}()
+		},
+		func() {
+			u.mu.Lock()
+			u.rotate()
+			u.mu.Unlock()
+			Uploads.Remove(u)
+		})
+}
+
+// objectKeyPart returns the specified name made safe for use as part of an
+// object key, replacing anything but letters, digits, and "-", "_", ".", ":"
+// with "_". Slashes are kept, so that pod names become further key parts.
+func objectKeyPart(name string) string {
+	if name == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9',
+			r == '-', r == '_', r == '.', r == ':', r == '/':
+			return r
+		}
+		return '_'
+	}, strings.Trim(name, "/"))
+}
+
+// asciiOnly escapes non-ASCII characters in the specified JSON text, so that
+// it can be used as an HTTP header value.
+func asciiOnly(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r > 0x7e && r <= 0xffff:
+			fmt.Fprintf(&b, "\\u%04x", r)
+		case r > 0xffff:
+			r -= 0x10000
+			fmt.Fprintf(&b, "\\u%04x\\u%04x", 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
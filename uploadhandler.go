@@ -0,0 +1,52 @@
+// (c) Siemens AG 2023
+//
+// SPDX-License-Identifier: MIT
+
+// Handles the /uploads API endpoint for starting, listing, and stopping
+// background captures uploading their segments to an object store.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Handle the /uploads API endpoint: GET lists the running uploads, POST starts
+// a new upload, and DELETE stops an upload, but only if requested by the
+// upload's owner.
+func uploadsHandler(w http.ResponseWriter, req *http.Request) {
+	Uploads.Serve(w, req, newUploadFromParams)
+}
+
+// newUploadFromParams returns a new upload with the upload specific
+// parameters from the request. Per-packet annotations and anything else that
+// needs a live capture client are not supported by uploads.
+func newUploadFromParams(conn *WSConn, args *Args, req *http.Request) (*Upload, error) {
+	if Spool == nil {
+		return nil, fmt.Errorf("no object store configured")
+	}
+	if err := checkBackgroundParams("upload", args); err != nil {
+		return nil, err
+	}
+	params := req.URL.Query()
+	seconds := DefaultSegmentSeconds
+	if s, ok := params["seconds"]; ok {
+		secs, err := strconv.ParseUint(s[0], 10, 32)
+		if err != nil || secs == 0 || secs > MaxSegmentSeconds {
+			return nil, fmt.Errorf("invalid seconds \"%s\"", s[0])
+		}
+		seconds = int(secs)
+	}
+	megabytes := DefaultSegmentMegabytes
+	if m, ok := params["megabytes"]; ok {
+		mibs, err := strconv.ParseUint(m[0], 10, 16)
+		if err != nil || mibs == 0 || mibs > MaxSegmentMegabytes || mibs > SpoolMegabytes {
+			return nil, fmt.Errorf("invalid megabytes \"%s\"", m[0])
+		}
+		megabytes = int(mibs)
+	}
+	return NewUpload(conn, args, time.Duration(seconds)*time.Second, int64(megabytes)<<20), nil
+}
@@ -80,11 +80,13 @@ const (
 // allows differentiating multiple (concurrent) websocket connections in the
 // logs.
 type WSConn struct {
-	state           WSConnState // what's up???
-	*websocket.Conn             // usual (gorilla) websocket connection.
-	ID              string      // unique ID string for this connection.
-	*os.Process                 // associated process with its lifetime bounded by this connection.
+	state           WSConnState     // what's up???
+	*websocket.Conn                 // usual (gorilla) websocket connection.
+	ID              string          // unique ID string for this connection.
+	*os.Process                     // associated process with its lifetime bounded by this connection.
+	Exited          <-chan struct{} // closed after the associated process has been reaped.
 	terminateOnce   sync.Once
+	writeMu         sync.Mutex // websockets allow only a single concurrent writer.
 }
 
 // NewWSConn returns a new websocket connection wrapper that features an
@@ -105,18 +107,43 @@ func (c *WSConn) Errorf(format string, args ...interface{}) {
 	log.Errorf("("+c.ID+") "+format, args...)
 }
 
+// WriteMessage writes a message of the specified type to the websocket,
+// serializing concurrent writers, such as the piper, statistics reporters, and
+// graceful closes.
+func (c *WSConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
 // Terminate sends the associated capture process the signal to terminate
 // itself. It ensures that this signal is sent only once, even when triggering
-// this method multiple times.
+// this method multiple times. If the capture process doesn't terminate within
+// the kill grace period, it gets killed.
 func (c *WSConn) Terminate() {
 	if c.Process != nil {
 		c.terminateOnce.Do(func() {
 			c.Debugf("signalling capture process to terminate...")
 			c.Process.Signal(syscall.SIGTERM)
+			go c.escalate()
 		})
 	}
 }
 
+// escalate kills the associated capture process if it hasn't been reaped
+// after the kill grace period.
+func (c *WSConn) escalate() {
+	timer := time.NewTimer(KillGracePeriod)
+	defer timer.Stop()
+	select {
+	case <-c.Exited:
+		return
+	case <-timer.C:
+	}
+	c.Errorf("capture process did not terminate within %s, killing it", KillGracePeriod)
+	_ = c.Process.Kill()
+}
+
 // Watch watches the websocket connection for any signs of closing or failure.
 // Additionally, it also handles acknowledging a graceful shutdown or receiving
 // a client's graceful acknowledge.